@@ -16,14 +16,37 @@ package main
 
 import (
 	"context"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/kelseyhightower/envconfig"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/praetorian-inc/trident/pkg/dispatch"
+	"github.com/praetorian-inc/trident/pkg/nozzle/exec"
 
+	_ "github.com/praetorian-inc/trident/pkg/dispatch/clients/local"
+	_ "github.com/praetorian-inc/trident/pkg/dispatch/clients/pool"
 	_ "github.com/praetorian-inc/trident/pkg/dispatch/clients/webhook"
+
+	// nozzles used by the local worker client
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/adfs"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/anyconnect"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/autologon"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/exchange"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/fortinet"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/generichttp"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/globalprotect"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/kerberos"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/ldap"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/netscaler"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/o365"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/oidcropc"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/okta"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/owa"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/ssh"
 )
 
 type specification struct {
@@ -35,6 +58,14 @@ type specification struct {
 
 	WorkerName   string                 `envconfig:"WORKER_NAME" required:"true"`
 	WorkerConfig dispatch.WorkerOptions `envconfig:"WORKER_CONFIG" required:"true"`
+
+	// BatchSize is the maximum number of tasks submitted to a worker at once,
+	// tasks are submitted one at a time unless it is greater than one
+	BatchSize int           `envconfig:"BATCH_SIZE" default:"1"`
+	BatchWait time.Duration `envconfig:"BATCH_WAIT" default:"1s"`
+
+	// PluginDir is where the local worker client finds exec nozzle plugins
+	PluginDir string `envconfig:"PLUGIN_DIR"`
 }
 
 var spec specification
@@ -50,6 +81,8 @@ func init() {
 		log.Fatal(err)
 	}
 
+	exec.PluginDir = spec.PluginDir
+
 	log.SetLevel(level)
 	log.SetFormatter(&log.TextFormatter{
 		FullTimestamp:   true,
@@ -58,7 +91,14 @@ func init() {
 }
 
 func main() {
-	ctx := context.Background()
+	// stop receiving tasks, and then the plugins, when the worker is stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		cancel()
+	}()
 
 	worker, err := dispatch.Open(spec.WorkerName, spec.WorkerConfig)
 	if err != nil {
@@ -68,11 +108,17 @@ func main() {
 		ProjectID:      spec.ProjectID,
 		SubscriptionID: spec.SubscriptionID,
 		ResultTopicID:  spec.ResultTopicID,
+		BatchSize:      spec.BatchSize,
+		BatchWait:      spec.BatchWait,
 	}, worker)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	log.Printf("starting dispatcher for subscription %s", spec.SubscriptionID)
-	log.Fatal(dis.Listen(ctx))
+	err = dis.Listen(ctx)
+	exec.Shutdown()
+	if err != nil {
+		log.Fatal(err)
+	}
 }
@@ -24,9 +24,11 @@ import (
 	"github.com/kelseyhightower/envconfig"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/praetorian-inc/trident/pkg/auth"
 	"github.com/praetorian-inc/trident/pkg/auth/cloudflare"
 	"github.com/praetorian-inc/trident/pkg/db"
 	"github.com/praetorian-inc/trident/pkg/scheduler"
+	"github.com/praetorian-inc/trident/pkg/seal"
 	"github.com/praetorian-inc/trident/pkg/server"
 )
 
@@ -40,6 +42,11 @@ type specification struct {
 	AuthDomain string `envconfig:"CF_AUTH_DOMAIN"`
 	PolicyAUD  string `envconfig:"CF_AUDIENCE"`
 
+	// OperatorTokens are the common names (client IDs) of the service tokens
+	// which may act as operators. Every other service token is a worker and
+	// may only send heartbeats.
+	OperatorTokens []string `envconfig:"CF_OPERATOR_TOKENS"`
+
 	// pubsub configuration options
 	ProjectID      string `envconfig:"PROJECT_ID" required:"true"`
 	TopicID        string `envconfig:"TOPIC_ID" required:"true"`
@@ -48,6 +55,10 @@ type specification struct {
 	// redis configuration options
 	RedisURI      string `envconfig:"REDIS_URI" required:"true"`
 	RedisPassword string `envconfig:"REDIS_PASSWORD"`
+
+	// ArtifactKey is the base64 encoded AES-256 key used to encrypt captured
+	// session artifacts. Artifacts are discarded if it is unset.
+	ArtifactKey string `envconfig:"ARTIFACT_KEY"`
 }
 
 var spec specification
@@ -82,6 +93,18 @@ func main() {
 	}
 	defer db.Close() // nolint:errcheck
 
+	var sealer *seal.Sealer
+	if spec.ArtifactKey != "" {
+		sealer, err = seal.ParseKey(spec.ArtifactKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// keep the key out of the debug log of the spec below
+		spec.ArtifactKey = ""
+	} else {
+		log.Warn("ARTIFACT_KEY is not set, session artifacts will be discarded")
+	}
+
 	sch, err := scheduler.NewPubSubScheduler(scheduler.Options{
 		Database:       db,
 		ProjectID:      spec.ProjectID,
@@ -89,14 +112,16 @@ func main() {
 		SubscriptionID: spec.SubscriptionID,
 		RedisURI:       spec.RedisURI,
 		RedisPassword:  spec.RedisPassword,
+		Sealer:         sealer,
 	})
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	s := &server.Server{
-		DB:  db,
-		Sch: sch,
+		DB:     db,
+		Sch:    sch,
+		Sealer: sealer,
 	}
 
 	log.WithFields(log.Fields{
@@ -117,15 +142,23 @@ func main() {
 	r.Use(middleware.Timeout(60 * time.Second))
 
 	// Insert authenication middleware to verify JWTs on all requests
-	r.Use(cloudflare.Verifier(spec.AuthDomain, spec.PolicyAUD))
-
-	// routes
-	r.Get("/healthz", s.HealthzHandler)
-	r.Post("/campaign/status", s.StatusUpdateHandler)
-	r.Post("/campaign", s.CampaignHandler)
-	r.Post("/results", s.ResultsHandler)
-	r.Get("/list", s.CampaignListHandler)
-	r.Post("/describe", s.CampaignDescribeHandler)
+	r.Use(cloudflare.Verifier(spec.AuthDomain, spec.PolicyAUD, spec.OperatorTokens))
+
+	// routes. workers may only send heartbeats
+	r.With(auth.RequireRole(auth.RoleOperator, auth.RoleWorker)).Post("/workers/heartbeat", s.WorkerHeartbeatHandler)
+	r.Group(func(r chi.Router) {
+		r.Use(auth.RequireRole(auth.RoleOperator))
+		r.Get("/healthz", s.HealthzHandler)
+		r.Post("/campaign/status", s.StatusUpdateHandler)
+		r.Post("/campaign", s.CampaignHandler)
+		r.Post("/results", s.ResultsHandler)
+		r.Get("/list", s.CampaignListHandler)
+		r.Post("/describe", s.CampaignDescribeHandler)
+		r.Post("/artifacts", s.ArtifactsHandler)
+		r.Get("/workers", s.WorkerListHandler)
+		r.Post("/workers/state", s.WorkerStateHandler)
+		r.Get("/workers/stats", s.WorkerStatsHandler)
+	})
 
 	go func() {
 		log.Printf("starting server on port %d", spec.AdminListenerPort)
@@ -0,0 +1,188 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// trident-idp-sim serves simulated Okta, o365, and ADFS login endpoints for
+// rehearsing campaigns. Point a provider at it with the "simulator" option.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"flag"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/praetorian-inc/trident/pkg/idpsim"
+)
+
+var (
+	flagAddr           string
+	flagCert           string
+	flagKey            string
+	flagHostname       string
+	flagUsers          string
+	flagLog            string
+	flagReport         string
+	flagThreshold      int
+	flagWindow         time.Duration
+	flagDuration       time.Duration
+	flagSmartLockout   bool
+	flagRateLimit      float64
+	flagRateBurst      int
+	flagTrustForwarded bool
+)
+
+func main() {
+	p := idpsim.DefaultPolicy
+	flag.StringVar(&flagAddr, "addr", ":8443", "address to listen on")
+	flag.StringVar(&flagCert, "cert", "", "TLS certificate (a self-signed certificate is generated if unset)")
+	flag.StringVar(&flagKey, "key", "", "TLS private key")
+	flag.StringVar(&flagHostname, "hostname", "localhost", "host name of the generated certificate")
+	flag.StringVar(&flagUsers, "users", "", "path to the user directory (username:password[:mfa,expired] per line)")
+	flag.StringVar(&flagLog, "log", "-", "path to append the attempt log to (or '-' for stdout)")
+	flag.StringVar(&flagReport, "report", "", "print the report for an attempt log and exit")
+	flag.IntVar(&flagThreshold, "lockout-threshold", p.LockoutThreshold, "failed logins which lock an account (0 disables lockout)")
+	flag.DurationVar(&flagWindow, "lockout-window", p.LockoutWindow, "observation window for failed logins")
+	flag.DurationVar(&flagDuration, "lockout-duration", p.LockoutDuration, "how long an account stays locked")
+	flag.BoolVar(&flagSmartLockout, "smart-lockout", p.SmartLockout, "simulate Azure AD and ADFS extranet smart lockout")
+	flag.Float64Var(&flagRateLimit, "rate-limit", p.RateLimit, "logins per second allowed from each source (0 disables rate limiting)")
+	flag.IntVar(&flagRateBurst, "rate-burst", p.RateBurst, "burst of logins allowed from each source")
+	flag.BoolVar(&flagTrustForwarded, "trust-forwarded", false, "take the source IP from X-Forwarded-For")
+	flag.Parse()
+
+	if flagReport != "" {
+		f, err := os.Open(flagReport) // nolint:gosec
+		if err != nil {
+			log.Fatalf("error reading attempt log: %s", err)
+		}
+		defer f.Close() // nolint:errcheck,gosec
+
+		report, err := idpsim.ReadReport(f)
+		if err != nil {
+			log.Fatal(err)
+		}
+		report.Print(os.Stdout)
+		return
+	}
+
+	if flagUsers == "" {
+		log.Fatal("-users is required")
+	}
+	f, err := os.Open(flagUsers) // nolint:gosec
+	if err != nil {
+		log.Fatalf("error reading users: %s", err)
+	}
+	users, err := idpsim.ParseUsers(f)
+	f.Close() // nolint:errcheck,gosec
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var attempts io.Writer = os.Stdout
+	if flagLog != "-" {
+		f, err := os.OpenFile(flagLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Fatalf("error opening attempt log: %s", err)
+		}
+		defer f.Close() // nolint:errcheck,gosec
+		attempts = f
+	}
+
+	sim := idpsim.New(users, idpsim.Policy{
+		LockoutThreshold: flagThreshold,
+		LockoutWindow:    flagWindow,
+		LockoutDuration:  flagDuration,
+		SmartLockout:     flagSmartLockout,
+		RateLimit:        flagRateLimit,
+		RateBurst:        flagRateBurst,
+	})
+	sim.Log = attempts
+	sim.TrustForwarded = flagTrustForwarded
+
+	var cert tls.Certificate
+	if flagCert != "" {
+		cert, err = tls.LoadX509KeyPair(flagCert, flagKey)
+	} else {
+		cert, err = selfSigned(flagHostname)
+	}
+	if err != nil {
+		log.Fatalf("error loading certificate: %s", err)
+	}
+
+	srv := &http.Server{
+		Addr:      flagAddr,
+		Handler:   sim.Handler(),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+
+	// print the report when the rehearsal is over
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		report := sim.Report()
+		report.Print(os.Stderr)
+		srv.Close() // nolint:errcheck,gosec
+	}()
+
+	log.Infof("simulating %d users on %s", len(users), flagAddr)
+	err = srv.ListenAndServeTLS("", "")
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// selfSigned generates a certificate for hostname.
+func selfSigned(hostname string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hostname},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(hostname); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{hostname}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
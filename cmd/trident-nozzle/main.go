@@ -19,6 +19,7 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"strings"
@@ -26,11 +27,25 @@ import (
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/praetorian-inc/trident/pkg/event"
 	"github.com/praetorian-inc/trident/pkg/nozzle"
+	"github.com/praetorian-inc/trident/pkg/nozzle/exec"
 
 	_ "github.com/praetorian-inc/trident/pkg/nozzle/adfs"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/anyconnect"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/autologon"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/exchange"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/fortinet"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/generichttp"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/globalprotect"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/kerberos"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/ldap"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/netscaler"
 	_ "github.com/praetorian-inc/trident/pkg/nozzle/o365"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/oidcropc"
 	_ "github.com/praetorian-inc/trident/pkg/nozzle/okta"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/owa"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/ssh"
 )
 
 var (
@@ -38,6 +53,8 @@ var (
 	flagProviderMeta string
 	flagUsernames    string
 	flagPasswords    string
+	flagEnumerate    bool
+	flagPluginDir    string
 )
 
 func main() {
@@ -45,8 +62,13 @@ func main() {
 	flag.StringVar(&flagProviderMeta, "metadata", "{}", "configuration data for auth provider")
 	flag.StringVar(&flagUsernames, "usernames", "-", "path to username list (or '-' for stdin)")
 	flag.StringVar(&flagPasswords, "passwords", "passwords.txt", "path to password list")
+	flag.BoolVar(&flagEnumerate, "enumerate", false, "check which usernames exist instead of guessing passwords")
+	flag.StringVar(&flagPluginDir, "plugin-dir", "", "directory of plugins for the exec provider")
 	flag.Parse()
 
+	exec.PluginDir = flagPluginDir
+	defer exec.Shutdown()
+
 	var metadata map[string]string
 	err := json.Unmarshal([]byte(flagProviderMeta), &metadata)
 	if err != nil {
@@ -63,16 +85,21 @@ func main() {
 	}
 	defer usernames.Close() // nolint:errcheck,gosec
 
-	content, err := ioutil.ReadFile(flagPasswords) // nolint:gosec
+	noz, err := nozzle.Open(flagProvider, metadata)
 	if err != nil {
-		log.Fatalf("error reading passwords: %s", err)
+		log.Fatalf("error opening nozzle: %s", err)
 	}
-	passwords := strings.Split(string(content), "\n")
 
-	noz, err := nozzle.Open(flagProvider, metadata)
+	if flagEnumerate {
+		enumerate(noz, usernames)
+		return
+	}
+
+	content, err := ioutil.ReadFile(flagPasswords) // nolint:gosec
 	if err != nil {
-		log.Fatalf("error opening nozzle: %s", err)
+		log.Fatalf("error reading passwords: %s", err)
 	}
+	passwords := strings.Split(string(content), "\n")
 
 	var wg sync.WaitGroup
 
@@ -112,3 +139,29 @@ func main() {
 
 	wg.Wait()
 }
+
+// enumerate prints each username which the nozzle reports as existing.
+func enumerate(noz nozzle.Nozzle, usernames io.Reader) {
+	scanner := bufio.NewScanner(usernames)
+	for scanner.Scan() {
+		username := scanner.Text()
+		if username == "" {
+			continue
+		}
+
+		res, err := nozzle.CheckUser(noz, username)
+		if err != nil {
+			log.Fatalf("error checking user: %s", err)
+		}
+
+		if res.UserStatus == event.UserStatusExists {
+			fmt.Println(username)
+		} else {
+			log.Infof("user %s status %s (%v)", username, res.UserStatus, res.Metadata)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("scanner error: %s", err)
+	}
+}
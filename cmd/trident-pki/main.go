@@ -0,0 +1,133 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// trident-pki mints an engagement CA and the certificates dispatchers and
+// workers use for mutual TLS.
+//
+//	trident-pki init -dir pki -name "example engagement"
+//	trident-pki issue -dir pki -name worker-a -server -host worker-a.example.org
+//	trident-pki issue -dir pki -name dispatcher -client
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/praetorian-inc/trident/pkg/pki"
+)
+
+// hosts collects repeated -host flags.
+type hosts []string
+
+func (h *hosts) String() string { return strings.Join(*h, ",") }
+
+func (h *hosts) Set(s string) error {
+	*h = append(*h, s)
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s init|issue [flags]\n", os.Args[0])
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "init":
+		initCA(os.Args[2:])
+	case "issue":
+		issue(os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+// initCA creates the engagement CA in ca.pem and ca-key.pem.
+func initCA(args []string) {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	dir := fs.String("dir", "pki", "directory to write the CA to")
+	name := fs.String("name", "trident engagement CA", "common name of the CA")
+	validity := fs.Duration("validity", 90*24*time.Hour, "how long the CA is valid")
+	fs.Parse(args) // nolint:errcheck,gosec
+
+	certFile, keyFile := filepath.Join(*dir, "ca.pem"), filepath.Join(*dir, "ca-key.pem")
+	if _, err := os.Stat(keyFile); err == nil {
+		log.Fatalf("%s already exists", keyFile)
+	}
+	if err := os.MkdirAll(*dir, 0700); err != nil {
+		log.Fatal(err)
+	}
+
+	ca, err := pki.NewCA(*name, *validity)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ca.Write(certFile, keyFile); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("wrote CA to %s, keep %s private", certFile, keyFile)
+}
+
+// issue creates a certificate signed by the engagement CA in <name>.pem and
+// <name>-key.pem.
+func issue(args []string) {
+	var h hosts
+	fs := flag.NewFlagSet("issue", flag.ExitOnError)
+	dir := fs.String("dir", "pki", "directory containing the CA")
+	name := fs.String("name", "", "common name of the certificate, used for its file names")
+	server := fs.Bool("server", false, "issue a server certificate for a worker")
+	client := fs.Bool("client", false, "issue a client certificate for a dispatcher")
+	validity := fs.Duration("validity", 30*24*time.Hour, "how long the certificate is valid")
+	fs.Var(&h, "host", "DNS name or IP address of a worker (repeatable)")
+	fs.Parse(args) // nolint:errcheck,gosec
+
+	if *name == "" {
+		log.Fatal("-name is required")
+	}
+	var u pki.Usage
+	switch {
+	case *server && !*client:
+		u = pki.UsageServer
+		if len(h) == 0 {
+			log.Fatal("-server requires at least one -host")
+		}
+	case *client && !*server:
+		u = pki.UsageClient
+	default:
+		log.Fatal("one of -server or -client is required")
+	}
+
+	ca, err := pki.Load(filepath.Join(*dir, "ca.pem"), filepath.Join(*dir, "ca-key.pem"))
+	if err != nil {
+		log.Fatalf("error loading CA: %s", err)
+	}
+	kp, err := ca.Issue(*name, h, u, *validity)
+	if err != nil {
+		log.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(*dir, *name+".pem"), filepath.Join(*dir, *name+"-key.pem")
+	if err := kp.Write(certFile, keyFile); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("wrote %s certificate to %s and %s", u, certFile, keyFile)
+}
@@ -15,9 +15,12 @@
 package main
 
 import (
-	"crypto/subtle"
+	"context"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi"
@@ -25,21 +28,69 @@ import (
 	"github.com/kelseyhightower/envconfig"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/praetorian-inc/trident/pkg/auth/cloudflare"
+	"github.com/praetorian-inc/trident/pkg/auth/signing"
+	"github.com/praetorian-inc/trident/pkg/nozzle/exec"
+	"github.com/praetorian-inc/trident/pkg/pki"
 	"github.com/praetorian-inc/trident/pkg/worker/webhook"
 
 	_ "github.com/praetorian-inc/trident/pkg/nozzle/adfs"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/anyconnect"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/autologon"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/exchange"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/fortinet"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/generichttp"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/globalprotect"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/kerberos"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/ldap"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/netscaler"
 	_ "github.com/praetorian-inc/trident/pkg/nozzle/o365"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/oidcropc"
 	_ "github.com/praetorian-inc/trident/pkg/nozzle/okta"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/owa"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/ssh"
 )
 
 type specification struct {
 	LogLevel    string `envconfig:"LOG_LEVEL" default:"INFO"`
 	Port        int    `envconfig:"PORT"`
 	AccessToken []byte `envconfig:"ACCESS_TOKEN"`
+	PluginDir   string `envconfig:"PLUGIN_DIR"`
+
+	// BatchConcurrency is the number of tasks of a batch performed at once
+	BatchConcurrency int `envconfig:"BATCH_CONCURRENCY" default:"10"`
+
+	// SigningKeys maps key IDs to the base64 encoded HMAC keys dispatchers
+	// sign requests with (e.g. k1:<key>,k2:<key>). When they are set, unsigned
+	// requests are only accepted with the ACCESS_TOKEN, if it is set.
+	SigningKeys     map[string]string `envconfig:"SIGNING_KEYS"`
+	SignatureMaxAge time.Duration     `envconfig:"SIGNATURE_MAX_AGE" default:"5m"`
+
+	// TLS options, the worker serves HTTPS if TLSCert is set and requires
+	// client certificates issued by TLSClientCA if it is set
+	TLSCert     string `envconfig:"TLS_CERT"`
+	TLSKey      string `envconfig:"TLS_KEY"`
+	TLSClientCA string `envconfig:"TLS_CLIENT_CA"`
+
+	// WorkerID names the worker in the orchestrator (defaults to the hostname)
+	WorkerID string `envconfig:"WORKER_ID"`
+
+	// registration options, the worker only registers with the orchestrator
+	// if OrchestratorURL is set
+	OrchestratorURL   string        `envconfig:"ORCHESTRATOR_URL"`
+	PublicURL         string        `envconfig:"PUBLIC_URL"`
+	HeartbeatInterval time.Duration `envconfig:"HEARTBEAT_INTERVAL" default:"30s"`
+
+	// Cloudflare Access service token used to authenticate heartbeats
+	ClientID     string `envconfig:"CF_ACCESS_CLIENT_ID"`
+	ClientSecret string `envconfig:"CF_ACCESS_CLIENT_SECRET"`
 }
 
 var spec specification
 
+// version is set at build time
+var version = "dev"
+
 func init() {
 	err := envconfig.Process("worker", &spec)
 	if err != nil {
@@ -51,6 +102,8 @@ func init() {
 		log.Fatal(err)
 	}
 
+	exec.PluginDir = spec.PluginDir
+
 	log.SetLevel(level)
 	log.SetFormatter(&log.TextFormatter{
 		FullTimestamp:   true,
@@ -58,23 +111,34 @@ func init() {
 	})
 }
 
-func tokenVerifier(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token := r.Header.Get("X-Access-Token")
-		if subtle.ConstantTimeCompare([]byte(token), spec.AccessToken) == 0 {
-			http.Error(w, http.StatusText(403), 403)
-			return
-		}
-		next.ServeHTTP(w, r)
-	})
-}
-
 func main() {
 	s, err := webhook.NewWebhookServer()
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	s.Name = spec.WorkerID
+	s.BatchConcurrency = spec.BatchConcurrency
+	if s.Name == "" {
+		s.Name, err = os.Hostname()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if spec.OrchestratorURL != "" {
+		go s.Heartbeat(context.Background(), webhook.HeartbeatOptions{
+			OrchestratorURL: spec.OrchestratorURL,
+			Authenticator: &cloudflare.ServiceTokenAuthenticator{
+				ClientID:     spec.ClientID,
+				ClientSecret: spec.ClientSecret,
+			},
+			URL:      spec.PublicURL,
+			Version:  version,
+			Interval: spec.HeartbeatInterval,
+		})
+	}
+
 	r := chi.NewRouter()
 
 	// A good base middleware stack
@@ -88,12 +152,58 @@ func main() {
 	// processing should be stopped.
 	r.Use(middleware.Timeout(60 * time.Second))
 
-	// Insert authenication middleware to verify access token on all requests
-	r.Use(tokenVerifier)
+	// Insert authenication middleware to verify signatures or the access
+	// token on all requests
+	var verifier *signing.Verifier
+	if len(spec.SigningKeys) > 0 {
+		keys, err := signing.ParseKeys(spec.SigningKeys)
+		if err != nil {
+			log.Fatal(err)
+		}
+		verifier = signing.NewVerifier(keys, spec.SignatureMaxAge)
+	}
+	r.Use(webhook.Verifier(verifier, spec.AccessToken))
 
 	r.Get("/healthz", s.HealthzHandler)
 	r.Post("/", s.EventHandler)
+	r.Post("/batch", s.BatchHandler)
+
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", spec.Port),
+		Handler: r,
+	}
 
-	log.Printf("starting server on port %d", spec.Port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", spec.Port), r))
+	// finish the tasks in flight, and then stop the plugins, when the worker
+	// is stopped
+	stopped := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx) // nolint:errcheck,gosec
+		exec.Shutdown()
+		close(stopped)
+	}()
+
+	if spec.TLSCert == "" {
+		if spec.TLSClientCA != "" {
+			log.Fatal("WORKER_TLS_CLIENT_CA requires WORKER_TLS_CERT and WORKER_TLS_KEY")
+		}
+		log.Printf("starting server on port %d", spec.Port)
+		err = srv.ListenAndServe()
+	} else {
+		srv.TLSConfig, err = pki.ServerConfig(spec.TLSCert, spec.TLSKey, spec.TLSClientCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("starting TLS server on port %d (client certificates required: %v)",
+			spec.Port, spec.TLSClientCA != "")
+		err = srv.ListenAndServeTLS("", "")
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
 }
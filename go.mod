@@ -7,10 +7,13 @@ require (
 	github.com/Azure/go-ntlmssp v0.0.0-20200615164410-66371956d46c
 	github.com/cloudflare/cloudflared v0.0.0-20200820175612-810d268c99ac
 	github.com/coreos/go-oidc/v3 v3.0.0-alpha.1
+	github.com/go-asn1-ber/asn1-ber v1.5.1
 	github.com/go-chi/chi v4.1.2+incompatible
+	github.com/go-ldap/ldap/v3 v3.3.0
 	github.com/go-openapi/strfmt v0.19.5 // indirect
 	github.com/go-redis/redis/v7 v7.4.0
 	github.com/golang/gddo v0.0.0-20200715224205-051695c33a3f
+	github.com/google/uuid v1.1.1
 	github.com/jedib0t/go-pretty v4.3.0+incompatible
 	github.com/jinzhu/gorm v1.9.16
 	github.com/kelseyhightower/envconfig v1.4.0
@@ -19,5 +22,7 @@ require (
 	github.com/sirupsen/logrus v1.6.0
 	github.com/spf13/cobra v1.0.0
 	github.com/spf13/viper v1.7.1
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 	golang.org/x/time v0.0.0-20200630173020-3af7569d3a1e
+	gopkg.in/yaml.v2 v2.2.4
 )
@@ -47,3 +47,21 @@ func (a *ArgoAuthenticator) Auth(req *http.Request) error {
 
 	return nil
 }
+
+// ServiceTokenAuthenticator implements the Authenticator interface with a
+// Cloudflare Access service token, which lets non-interactive clients such as
+// workers authenticate to the orchestrator. The orchestrator only lets service
+// tokens send worker heartbeats unless they are configured as operators.
+type ServiceTokenAuthenticator struct {
+	ClientID     string
+	ClientSecret string
+}
+
+// Auth sets the service token headers on the provided request. Cloudflare
+// Access exchanges them for an access token before the request reaches the
+// orchestrator.
+func (a *ServiceTokenAuthenticator) Auth(req *http.Request) error {
+	req.Header.Set("CF-Access-Client-Id", a.ClientID)
+	req.Header.Set("CF-Access-Client-Secret", a.ClientSecret)
+	return nil
+}
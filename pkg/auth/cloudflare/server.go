@@ -23,11 +23,15 @@ import (
 
 	"github.com/coreos/go-oidc/v3/oidc"
 
+	"github.com/praetorian-inc/trident/pkg/auth"
 	"github.com/praetorian-inc/trident/pkg/util"
 )
 
-// Verifier returns a function that is used to verify the Cloudflare access token
-func Verifier(authDomain string, policyAUD string) func(http.Handler) http.Handler {
+// Verifier returns a function that is used to verify the Cloudflare access
+// token. Service tokens are given the worker role unless their common name
+// (the token's client ID) is listed in operatorTokens; users are always
+// operators.
+func Verifier(authDomain string, policyAUD string, operatorTokens []string) func(http.Handler) http.Handler {
 	u, err := url.Parse(authDomain)
 	if err != nil {
 		log.Fatalf("authDomain not a valid url: %s", err)
@@ -47,12 +51,14 @@ func Verifier(authDomain string, policyAUD string) func(http.Handler) http.Handl
 	verifier := oidc.NewVerifier(authDomain, keySet, config)
 
 	return func(next http.Handler) http.Handler {
-		return VerifyToken(verifier)(next)
+		return VerifyToken(verifier, operatorTokens)(next)
 	}
 }
 
-// VerifyToken is a middleware to verify a CF Access token
-func VerifyToken(verifier *oidc.IDTokenVerifier) func(http.Handler) http.Handler {
+// VerifyToken is a middleware to verify a CF Access token and record the
+// requester's identity and role. Service tokens listed in operatorTokens are
+// operators and every other service token is a worker.
+func VerifyToken(verifier *oidc.IDTokenVerifier, operatorTokens []string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		hfn := func(w http.ResponseWriter, r *http.Request) {
 			headers := r.Header
@@ -69,7 +75,7 @@ func VerifyToken(verifier *oidc.IDTokenVerifier) func(http.Handler) http.Handler
 
 			// Verify the access token
 			ctx := r.Context()
-			_, err := verifier.Verify(ctx, accessJWT)
+			token, err := verifier.Verify(ctx, accessJWT)
 			if err != nil {
 				w.WriteHeader(http.StatusUnauthorized)
 				_, err = w.Write([]byte(fmt.Sprintf("Invalid token: %s", err.Error())))
@@ -78,7 +84,29 @@ func VerifyToken(verifier *oidc.IDTokenVerifier) func(http.Handler) http.Handler
 				}
 				return
 			}
-			next.ServeHTTP(w, r)
+
+			// record who made the request for audited handlers. service
+			// tokens are identified by their common name instead of an email
+			var claims struct {
+				Email      string `json:"email"`
+				CommonName string `json:"common_name"`
+			}
+			if token.Claims(&claims) == nil {
+				if claims.Email != "" {
+					ctx = auth.WithIdentity(ctx, claims.Email)
+					ctx = auth.WithRole(ctx, auth.RoleOperator)
+				} else if claims.CommonName != "" {
+					role := auth.RoleWorker
+					for _, name := range operatorTokens {
+						if name == claims.CommonName {
+							role = auth.RoleOperator
+						}
+					}
+					ctx = auth.WithIdentity(ctx, claims.CommonName)
+					ctx = auth.WithRole(ctx, role)
+				}
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
 		}
 		return http.HandlerFunc(hfn)
 	}
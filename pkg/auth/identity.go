@@ -0,0 +1,81 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"net/http"
+)
+
+type (
+	identityKey struct{}
+	roleKey     struct{}
+)
+
+// Roles of authenticated requesters.
+const (
+	// RoleOperator is a person, or their automation, operating trident.
+	// Operators may use every endpoint.
+	RoleOperator = "operator"
+
+	// RoleWorker is a worker authenticating with a service token. Workers
+	// may only send heartbeats.
+	RoleWorker = "worker"
+)
+
+// WithIdentity returns a copy of ctx carrying the identity (e.g. the email
+// address) of the authenticated requester. Authentication middleware sets it
+// for handlers which audit who made a request.
+func WithIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// Identity returns the identity of the authenticated requester, or an empty
+// string if the request was not authenticated with one.
+func Identity(ctx context.Context) string {
+	identity, _ := ctx.Value(identityKey{}).(string)
+	return identity
+}
+
+// WithRole returns a copy of ctx carrying the role (e.g. RoleOperator) of the
+// authenticated requester. Authentication middleware sets it alongside the
+// identity.
+func WithRole(ctx context.Context, role string) context.Context {
+	return context.WithValue(ctx, roleKey{}, role)
+}
+
+// Role returns the role of the authenticated requester, or an empty string if
+// the request was not authenticated with one.
+func Role(ctx context.Context) string {
+	role, _ := ctx.Value(roleKey{}).(string)
+	return role
+}
+
+// RequireRole is a middleware which rejects requests whose requester does not
+// have one of roles with 403 Forbidden.
+func RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			role := Role(r.Context())
+			for _, allowed := range roles {
+				if role == allowed {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		})
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package signing authenticates requests from dispatchers to workers with
+// HMAC-SHA256 signatures. Each request is signed over its method, path, body,
+// a timestamp, and a random nonce, so a captured request cannot be altered or
+// replayed. Keys are identified by a key ID so they can be rotated: a worker
+// accepts every key it is configured with while dispatchers move to the new
+// key.
+package signing
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Headers carrying the signature of a request.
+const (
+	HeaderKeyID     = "X-Trident-Key-Id"
+	HeaderTimestamp = "X-Trident-Timestamp"
+	HeaderNonce     = "X-Trident-Nonce"
+	HeaderSignature = "X-Trident-Signature"
+)
+
+// MinKeySize is the minimum size of a key in bytes.
+const MinKeySize = 32
+
+// DefaultMaxAge is how far a request's timestamp may be from the verifier's
+// clock unless configured otherwise.
+const DefaultMaxAge = 5 * time.Minute
+
+// maxBodySize limits the body read by Verify.
+const maxBodySize = 10 << 20
+
+var (
+	// ErrInvalid is returned when a signature does not match the request.
+	ErrInvalid = errors.New("signing: invalid signature")
+
+	// ErrUnknownKey is returned when a request is signed with a key ID the
+	// verifier does not have.
+	ErrUnknownKey = errors.New("signing: unknown key id")
+
+	// ErrExpired is returned when a request's timestamp is too far from the
+	// verifier's clock.
+	ErrExpired = errors.New("signing: timestamp outside the allowed window")
+
+	// ErrReplayed is returned when a request's nonce was already used.
+	ErrReplayed = errors.New("signing: request was replayed")
+)
+
+// ParseKeys decodes a map of key IDs to base64 encoded keys, as generated by
+//
+//	openssl rand -base64 32
+func ParseKeys(encoded map[string]string) (map[string][]byte, error) {
+	keys := make(map[string][]byte, len(encoded))
+	for id, s := range encoded {
+		key, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("signing: key %q is not valid base64: %w", id, err)
+		}
+		if len(key) < MinKeySize {
+			return nil, fmt.Errorf("signing: key %q must be at least %d bytes", id, MinKeySize)
+		}
+		keys[id] = key
+	}
+	return keys, nil
+}
+
+// Signer signs requests with a single key.
+type Signer struct {
+	// KeyID identifies the key to the verifier
+	KeyID string
+
+	// Key is the shared secret
+	Key []byte
+}
+
+// Sign sets the signature headers of req, whose body must be body.
+func (s *Signer) Sign(req *http.Request, body []byte) error {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return err
+	}
+	nonce := hex.EncodeToString(b)
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req.Header.Set(HeaderKeyID, s.KeyID)
+	req.Header.Set(HeaderTimestamp, ts)
+	req.Header.Set(HeaderNonce, nonce)
+	req.Header.Set(HeaderSignature, sign(s.Key, req.Method, path(req), ts, nonce, body))
+	return nil
+}
+
+// path returns the path of a request as the server receives it.
+func path(r *http.Request) string {
+	if p := r.URL.EscapedPath(); p != "" {
+		return p
+	}
+	return "/"
+}
+
+// sign returns the base64 encoded signature of a request.
+func sign(key []byte, method, path, ts, nonce string, body []byte) string {
+	digest := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%x", method, path, ts, nonce, digest)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Signed returns whether a request carries a signature.
+func Signed(r *http.Request) bool {
+	return r.Header.Get(HeaderSignature) != ""
+}
+
+// Verifier verifies signed requests and rejects replayed ones. It is safe for
+// concurrent use.
+type Verifier struct {
+	keys   map[string][]byte
+	maxAge time.Duration
+
+	mu     sync.Mutex
+	nonces map[string]time.Time
+	pruned time.Time
+}
+
+// NewVerifier returns a Verifier which accepts requests signed with any of
+// keys and timestamped within maxAge of its clock.
+func NewVerifier(keys map[string][]byte, maxAge time.Duration) *Verifier {
+	if maxAge <= 0 {
+		maxAge = DefaultMaxAge
+	}
+	return &Verifier{
+		keys:   keys,
+		maxAge: maxAge,
+		nonces: make(map[string]time.Time),
+		pruned: time.Now(),
+	}
+}
+
+// Verify checks the signature of r, then records its nonce so the request
+// cannot be replayed. The body is read and replaced so handlers can still
+// read it.
+func (v *Verifier) Verify(r *http.Request) error {
+	key, ok := v.keys[r.Header.Get(HeaderKeyID)]
+	if !ok {
+		return ErrUnknownKey
+	}
+
+	ts := r.Header.Get(HeaderTimestamp)
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrInvalid
+	}
+	now := time.Now()
+	if d := now.Sub(time.Unix(sec, 0)); d > v.maxAge || d < -v.maxAge {
+		return ErrExpired
+	}
+
+	var body []byte
+	if r.Body != nil {
+		body, err = ioutil.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+		if err != nil {
+			return fmt.Errorf("signing: error reading body: %w", err)
+		}
+		if len(body) > maxBodySize {
+			return fmt.Errorf("signing: body is larger than %d bytes", maxBodySize)
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	nonce := r.Header.Get(HeaderNonce)
+	expected := sign(key, r.Method, path(r), ts, nonce, body)
+	if nonce == "" || !hmac.Equal([]byte(expected), []byte(r.Header.Get(HeaderSignature))) {
+		return ErrInvalid
+	}
+
+	return v.useNonce(r.Header.Get(HeaderKeyID)+":"+nonce, now)
+}
+
+// useNonce records a nonce, returning ErrReplayed if it was already used.
+// Nonces are forgotten once their requests would have expired anyway.
+func (v *Verifier) useNonce(nonce string, now time.Time) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if now.Sub(v.pruned) > v.maxAge {
+		for n, expires := range v.nonces {
+			if now.After(expires) {
+				delete(v.nonces, n)
+			}
+		}
+		v.pruned = now
+	}
+
+	if _, ok := v.nonces[nonce]; ok {
+		return ErrReplayed
+	}
+	v.nonces[nonce] = now.Add(2 * v.maxAge)
+	return nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signing
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var (
+	key1 = bytes.Repeat([]byte{1}, MinKeySize)
+	key2 = bytes.Repeat([]byte{2}, MinKeySize)
+)
+
+func signedRequest(t *testing.T, s *Signer, body string) *http.Request {
+	req, err := http.NewRequest("POST", "https://worker.example.org/", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Sign(req, []byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+// clone returns a copy of req with its own body, as an attacker replaying a
+// captured request would send it.
+func clone(req *http.Request, body string) *http.Request {
+	c := req.Clone(req.Context())
+	c.Body = ioutil.NopCloser(bytes.NewBufferString(body))
+	return c
+}
+
+func TestVerify(t *testing.T) {
+	// the worker accepts both keys while dispatchers rotate to k2
+	v := NewVerifier(map[string][]byte{"k1": key1, "k2": key2}, time.Minute)
+	body := `{"username":"alice@example.org","password":"Password1!"}`
+
+	for _, s := range []*Signer{{KeyID: "k1", Key: key1}, {KeyID: "k2", Key: key2}} {
+		req := signedRequest(t, s, body)
+		replay := clone(req, body)
+		if err := v.Verify(req); err != nil {
+			t.Fatalf("[%s] error verifying request: %s", s.KeyID, err)
+		}
+		b, _ := ioutil.ReadAll(req.Body)
+		if string(b) != body {
+			t.Errorf("[%s] body was not restored: %q", s.KeyID, b)
+		}
+		if err := v.Verify(replay); err != ErrReplayed {
+			t.Errorf("[%s] replayed request returned %v, expected ErrReplayed", s.KeyID, err)
+		}
+	}
+
+	s := &Signer{KeyID: "k1", Key: key1}
+	stale := signedRequest(t, s, body)
+	stale.Header.Set(HeaderTimestamp, strconv.FormatInt(time.Now().Add(-2*time.Minute).Unix(), 10))
+	future := signedRequest(t, s, body)
+	future.Header.Set(HeaderTimestamp, strconv.FormatInt(time.Now().Add(2*time.Minute).Unix(), 10))
+	otherPath := signedRequest(t, s, body)
+	otherPath.URL.Path = "/admin"
+
+	var testcases = []struct {
+		desc string
+		req  *http.Request
+		err  error
+	}{
+		{"tampered body", clone(signedRequest(t, s, body), `{"username":"bob@example.org"}`), ErrInvalid},
+		{"other path", otherPath, ErrInvalid},
+		{"wrong key", signedRequest(t, &Signer{KeyID: "k1", Key: key2}, body), ErrInvalid},
+		{"unknown key", signedRequest(t, &Signer{KeyID: "k3", Key: key1}, body), ErrUnknownKey},
+		{"stale", stale, ErrExpired},
+		{"future", future, ErrExpired},
+	}
+	for _, test := range testcases {
+		if err := v.Verify(test.req); err != test.err {
+			t.Errorf("[%s] returned %v, expected %v", test.desc, err, test.err)
+		}
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	keys, err := ParseKeys(map[string]string{"k1": "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="})
+	if err != nil || len(keys["k1"]) != 32 {
+		t.Errorf("unexpected keys %v (%v)", keys, err)
+	}
+	for _, key := range []string{"not base64!", "c2hvcnQ="} {
+		if _, err := ParseKeys(map[string]string{"k1": key}); err == nil {
+			t.Errorf("expected an error parsing %q", key)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	// limits the artifacts returned to these results
+	flagResultIDs []uint
+
+	// the justification recorded in the artifact access log
+	flagReason string
+)
+
+var artifactsCmd = &cobra.Command{
+	Use:   "artifacts",
+	Short: "session artifacts retrieval subcommand",
+	Long: `returns the session artifacts (tokens, cookies, and MFA posture) captured
+for a campaign's valid results. every request is recorded in the orchestrator's
+artifact access log along with your identity and the given reason.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		artifactsGet(cmd, args)
+	},
+}
+
+func init() {
+	artifactsCmd.Flags().UintVarP(&campaignID, "campaign", "c", 0,
+		"the identifier of the campaign.")
+	artifactsCmd.Flags().UintSliceVar(&flagResultIDs, "result", nil,
+		"only return the artifacts of these result ids")
+	artifactsCmd.Flags().StringVar(&flagReason, "reason", "",
+		"why the artifacts are needed (recorded in the access log)")
+	for _, flag := range []string{"campaign", "reason"} {
+		err := artifactsCmd.MarkFlagRequired(flag)
+		if err != nil {
+			log.Fatalf("issue during argument parsing: %s", err)
+		}
+	}
+
+	rootCmd.AddCommand(artifactsCmd)
+}
+
+// artifactsGet requests the session artifacts of a campaign from the
+// orchestrator and prints them as JSON.
+func artifactsGet(cmd *cobra.Command, args []string) {
+	orchestrator := viper.GetString("orchestrator-url")
+
+	requestBody, err := json.Marshal(map[string]interface{}{
+		"campaign_id": campaignID,
+		"result_ids":  flagResultIDs,
+		"reason":      flagReason,
+	})
+	if err != nil {
+		log.Fatalf("error during JSON marshalling for request body: %s", err)
+	}
+
+	req, err := http.NewRequest("POST", orchestrator+"/artifacts", bytes.NewBuffer(requestBody))
+	if err != nil {
+		log.Fatalf("error during request creation: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// add Cloudflare Access token to our request
+	err = authenticator.Auth(req)
+	if err != nil {
+		log.Fatalf("error during authentication: %s", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatalf("error sending request: %s", err)
+	}
+	defer resp.Body.Close() // nolint:errcheck
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatalf("error reading response body: %s", err)
+	}
+	if resp.StatusCode != 200 {
+		log.Fatalf("error returning artifacts from server: %d %s", resp.StatusCode, bytes.TrimSpace(respBody))
+	}
+
+	var out bytes.Buffer
+	err = json.Indent(&out, respBody, "", "  ")
+	if err != nil {
+		log.Fatalf("error parsing response json: %s", err)
+	}
+	out.WriteTo(os.Stdout) // nolint:errcheck,gosec
+}
@@ -20,6 +20,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/praetorian-inc/trident/pkg/db"
+	"github.com/praetorian-inc/trident/pkg/event"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"strings"
@@ -50,6 +52,15 @@ var (
 	// authentication provider to select for target, provider metadata is
 	// read from the config file
 	flagProvider string
+
+	// the type of campaign to create (spray or enumeration)
+	flagCampaignType string
+
+	// an enumeration campaign whose existing users are used as the user list
+	flagUsersFromCampaign uint
+
+	// the names of the workers to pin the campaign to
+	flagWorkers []string
 )
 
 const (
@@ -62,6 +73,8 @@ Username count: %d
 Password count: %d
 Provider: %s
 Metadata: %v
+Type: %s
+Workers: %s
 
 `
 )
@@ -80,24 +93,24 @@ func init() {
 
 	// required arguments
 
+	// userfile is required unless --users-from is set, and passfile is
+	// required for spray campaigns. both are validated in campaignCreate.
+
 	campaignCreateCmd.Flags().StringVarP(&flagUsernameFile, "userfile", "u", "",
 		"file of usernames (newline separated)")
-	err := campaignCreateCmd.MarkFlagRequired("userfile")
-	if err != nil {
-		log.Fatalf("issue during argument parsing: %s", err)
-
-	}
 
 	campaignCreateCmd.Flags().StringVarP(&flagPasswordFile, "passfile", "p", "",
 		"file of passwords (newline separated)")
-	err = campaignCreateCmd.MarkFlagRequired("passfile")
-	if err != nil {
-		log.Fatalf("issue during argument parsing: %s", err)
-
-	}
 
 	// optional arguments
 
+	// default: spray
+	campaignCreateCmd.Flags().StringVarP(&flagCampaignType, "type", "t", string(db.CampaignTypeSpray),
+		"the type of campaign (spray, enumeration)")
+
+	campaignCreateCmd.Flags().UintVar(&flagUsersFromCampaign, "users-from", 0,
+		"use the users found to exist by this enumeration campaign instead of --userfile")
+
 	// default: time.Now()
 	campaignCreateCmd.Flags().StringVarP(&flagNotBefore, "notbefore", "b", defaultNotBefore,
 		"requests will not start before this time")
@@ -114,6 +127,10 @@ func init() {
 	campaignCreateCmd.Flags().StringVarP(&flagProvider, "auth-provider", "a", "okta",
 		"this is the authentication platform you are attacking")
 
+	// default: any worker
+	campaignCreateCmd.Flags().StringSliceVar(&flagWorkers, "worker", nil,
+		"only send tasks to these registered workers (repeatable)")
+
 	campaignCmd.AddCommand(campaignCreateCmd)
 }
 
@@ -154,14 +171,37 @@ func campaignCreate(cmd *cobra.Command, args []string) {
 	orchestrator := viper.GetString("orchestrator-url")
 	providers := viper.GetStringMap("providers")
 
-	users, err := readLines(flagUsernameFile)
-	if err != nil {
-		log.Fatalf("error reading lines from user file: %s", err)
+	campaignType := db.CampaignType(flagCampaignType)
+	if campaignType != db.CampaignTypeSpray && campaignType != db.CampaignTypeEnumeration {
+		log.Fatalf("unknown campaign type: %s", flagCampaignType)
 	}
 
-	passwords, err := readLines(flagPasswordFile)
-	if err != nil {
-		log.Fatalf("error reading lines from password file: %s", err)
+	var users []string
+	var err error
+	switch {
+	case flagUsersFromCampaign != 0:
+		users, err = enumeratedUsers(orchestrator, flagUsersFromCampaign)
+		if err != nil {
+			log.Fatalf("error fetching users from campaign %d: %s", flagUsersFromCampaign, err)
+		}
+	case flagUsernameFile != "":
+		users, err = readLines(flagUsernameFile)
+		if err != nil {
+			log.Fatalf("error reading lines from user file: %s", err)
+		}
+	default:
+		log.Fatal("one of --userfile or --users-from is required")
+	}
+
+	var passwords []string
+	if campaignType == db.CampaignTypeSpray {
+		if flagPasswordFile == "" {
+			log.Fatal("--passfile is required for spray campaigns")
+		}
+		passwords, err = readLines(flagPasswordFile)
+		if err != nil {
+			log.Fatalf("error reading lines from password file: %s", err)
+		}
 	}
 
 	parsedNotBefore, err := time.Parse(time.RFC3339Nano, flagNotBefore)
@@ -176,19 +216,26 @@ func campaignCreate(cmd *cobra.Command, args []string) {
 		"not_before":        parsedNotBefore,
 		"not_after":         parsedNotAfter,
 		"status":            db.CampaignStatusActive,
+		"type":              campaignType,
 		"schedule_interval": flagScheduleInterval,
 		"users":             users,
 		"passwords":         passwords,
 		"provider":          flagProvider,
 		"provider_metadata": providers[flagProvider],
+		"workers":           flagWorkers,
 	})
 	if err != nil {
 		log.Fatalf("error during JSON marshalling for request body: %s", err)
 	}
 
+	pinnedWorkers := "any"
+	if len(flagWorkers) > 0 {
+		pinnedWorkers = strings.Join(flagWorkers, ", ")
+	}
+
 	// print summary of campaign and prompt user to accept
 	fmt.Printf(campaignSummary, parsedNotBefore, parsedNotAfter, flagScheduleInterval,
-		len(users), len(passwords), flagProvider, providers[flagProvider])
+		len(users), len(passwords), flagProvider, providers[flagProvider], campaignType, pinnedWorkers)
 	if !confirm("Send campaign?") {
 		log.Printf("not sending campaign")
 		return
@@ -212,5 +259,56 @@ func campaignCreate(cmd *cobra.Command, args []string) {
 	defer resp.Body.Close() // nolint:errcheck
 
 	log.Debug(resp)
+	if resp.StatusCode != 200 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		log.Fatalf("error creating campaign: %d %s", resp.StatusCode, bytes.TrimSpace(respBody))
+	}
 	log.Info("successfully created campaign")
 }
+
+// enumeratedUsers queries the orchestrator for the users which the provided
+// enumeration campaign found to exist.
+func enumeratedUsers(orchestrator string, cID uint) ([]string, error) {
+	requestBody, err := json.Marshal(map[string]interface{}{
+		"ReturnedFields": []string{"username"},
+		"Filter": map[string]interface{}{
+			"campaign_id": cID,
+			"user_status": event.UserStatusExists,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", orchestrator+"/results", bytes.NewBuffer(requestBody))
+	if err != nil {
+		return nil, err
+	}
+
+	err = authenticator.Auth(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint:errcheck
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected status code from server: %d", resp.StatusCode)
+	}
+
+	var results []db.Result
+	err = json.NewDecoder(resp.Body).Decode(&results)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []string
+	for _, r := range results {
+		users = append(users, r.Username)
+	}
+	return users, nil
+}
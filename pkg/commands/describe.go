@@ -112,6 +112,11 @@ func describeGet(cmd *cobra.Command, args []string) {
 	} else {
 		fmt.Printf("Status:         %s\n", db.CampaignStatusActive)
 	}
+	if campaign.Type != "" {
+		fmt.Printf("Type:           %s\n", campaign.Type)
+	} else {
+		fmt.Printf("Type:           %s\n", db.CampaignTypeSpray)
+	}
 	fmt.Printf("User Count:     %d\n", len(campaign.Users))
 	fmt.Printf("Password Count: %d\n", len(campaign.Passwords))
 	fmt.Printf("Provider:       %s\n", campaign.Provider)
@@ -39,6 +39,7 @@ var listCmd = &cobra.Command{
 
 var listTableHeaderNames = []string{
 	"campaign id",
+	"type",
 	"provider",
 	"metadata",
 	"status",
@@ -47,6 +48,7 @@ var listTableHeaderNames = []string{
 
 var listTableHeaderFields = []string{
 	"id",
+	"type",
 	"provider",
 	"provider_metadata",
 	"status",
@@ -107,9 +109,11 @@ func listGet(cmd *cobra.Command, args []string) {
 			if !ok {
 				log.Fatal("there was an error retrieving results from the map")
 			}
-			// Legacy handling for campaigns created pre-Status implementation
+			// Legacy handling for campaigns created pre-Status and pre-Type implementation
 			if field == "status" && v == "" {
 				row = append(row, db.CampaignStatusActive)
+			} else if field == "type" && v == "" {
+				row = append(row, db.CampaignTypeSpray)
 			} else {
 				row = append(row, v)
 			}
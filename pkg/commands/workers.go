@@ -0,0 +1,176 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/jedib0t/go-pretty/table"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/praetorian-inc/trident/pkg/db"
+	"github.com/praetorian-inc/trident/pkg/event"
+)
+
+var workersCmd = &cobra.Command{
+	Use:   "workers",
+	Short: "top-level command for viewing and controlling workers",
+	Long: `used by an operator to list the workers registered with the orchestrator
+	and to drain, disable, or enable them`,
+}
+
+var workersListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list the registered workers",
+	Long:  `lists the workers registered with the orchestrator and their last heartbeat`,
+	Run: func(cmd *cobra.Command, args []string) {
+		workersList(cmd, args)
+	},
+}
+
+var workersDrainCmd = &cobra.Command{
+	Use:   "drain <worker>...",
+	Short: "stop sending new tasks to workers",
+	Long: `drained workers fail their health checks, so pool dispatchers stop
+choosing them for new tasks, but they still perform tasks they are sent`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		workersSetState(args, event.WorkerStateDraining)
+	},
+}
+
+var workersDisableCmd = &cobra.Command{
+	Use:   "disable <worker>...",
+	Short: "stop workers from performing tasks",
+	Long:  `disabled workers fail their health checks and refuse every task`,
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		workersSetState(args, event.WorkerStateDisabled)
+	},
+}
+
+var workersEnableCmd = &cobra.Command{
+	Use:   "enable <worker>...",
+	Short: "return drained or disabled workers to service",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		workersSetState(args, event.WorkerStateActive)
+	},
+}
+
+func init() {
+	workersCmd.AddCommand(workersListCmd)
+	workersCmd.AddCommand(workersDrainCmd)
+	workersCmd.AddCommand(workersDisableCmd)
+	workersCmd.AddCommand(workersEnableCmd)
+	rootCmd.AddCommand(workersCmd)
+}
+
+// workersList retrieves the registered workers and prints them to the CLI
+func workersList(cmd *cobra.Command, args []string) {
+	orchestrator := viper.GetString("orchestrator-url")
+
+	req, err := http.NewRequest("GET", orchestrator+"/workers", nil)
+	if err != nil {
+		log.Fatalf("error during request creation: %s", err)
+	}
+
+	// add Cloudflare Access token to our request
+	err = authenticator.Auth(req)
+	if err != nil {
+		log.Fatalf("error during authentication: %s", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatalf("error sending request: %s", err)
+	}
+	defer resp.Body.Close() // nolint:errcheck
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatalf("error reading response body: %s", err)
+	}
+	if resp.StatusCode != 200 {
+		log.Fatalf("error listing workers from server: %d %s", resp.StatusCode, bytes.TrimSpace(respBody))
+	}
+
+	var workers []db.Worker
+	err = json.Unmarshal(respBody, &workers)
+	if err != nil {
+		log.Fatalf("error parsing response json: %s", err)
+	}
+
+	t := table.NewWriter()
+	t.SetOutputMirror(os.Stdout)
+	t.AppendHeader(table.Row{"name", "kind", "state", "online", "ip", "load", "version", "nozzles", "last seen"})
+	for _, w := range workers {
+		t.AppendRow(table.Row{w.Name, w.Kind, w.State, w.Online, w.IP, w.Load, w.Version,
+			strings.Join(w.Nozzles, ","), w.LastSeen})
+	}
+
+	if flagOutputFormat == "csv" {
+		t.RenderCSV()
+		return
+	}
+
+	t.Render()
+}
+
+// workersSetState sets the state of each of the named workers
+func workersSetState(names []string, state event.WorkerState) {
+	orchestrator := viper.GetString("orchestrator-url")
+
+	for _, name := range names {
+		requestBody, err := json.Marshal(map[string]interface{}{
+			"name":  name,
+			"state": state,
+		})
+		if err != nil {
+			log.Fatalf("error during JSON marshalling for request body: %s", err)
+		}
+
+		req, err := http.NewRequest("POST", orchestrator+"/workers/state", bytes.NewBuffer(requestBody))
+		if err != nil {
+			log.Fatalf("error during request creation: %s", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		// add Cloudflare Access token to our request
+		err = authenticator.Auth(req)
+		if err != nil {
+			log.Fatalf("error during authentication: %s", err)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.Fatalf("error sending request: %s", err)
+		}
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close() // nolint:errcheck,gosec
+
+		if resp.StatusCode != 200 {
+			log.Fatalf("error setting worker %s to %s: %d %s", name, state, resp.StatusCode, bytes.TrimSpace(respBody))
+		}
+		log.Infof("worker %s is now %s", name, state)
+	}
+}
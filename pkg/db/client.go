@@ -23,6 +23,8 @@ import (
 
 	"github.com/jinzhu/gorm"
 	"github.com/lib/pq"
+
+	"github.com/praetorian-inc/trident/pkg/event"
 )
 
 // Datastore is an interface that allows for the swap of backend database
@@ -36,6 +38,14 @@ type Datastore interface {
 	DescribeCampaign(Query) (Campaign, error)
 	IsCampaignCancelled(uint) (bool, error)
 	UpdateCampaignStatus(uint, CampaignStatus) error
+	InsertArtifact(*Artifact) error
+	SelectArtifacts(campaignID uint, resultIDs []uint) ([]Artifact, error)
+	InsertArtifactAccess(*ArtifactAccess) error
+	SaveWorkerStat(*WorkerStat) error
+	ListWorkerStats() ([]WorkerStat, error)
+	SaveWorker(*Worker) error
+	ListWorkers() ([]Worker, error)
+	UpdateWorkerState(name string, state event.WorkerState) error
 	Close() error
 }
 
@@ -98,6 +108,10 @@ func New(connectionString string) (*TridentDB, error) {
 
 	s.db.AutoMigrate(&Campaign{})
 	s.db.AutoMigrate(&Result{})
+	s.db.AutoMigrate(&Artifact{})
+	s.db.AutoMigrate(&ArtifactAccess{})
+	s.db.AutoMigrate(&WorkerStat{})
+	s.db.AutoMigrate(&Worker{})
 
 	return &s, nil
 }
@@ -194,7 +208,7 @@ func (t *TridentDB) StreamingInsertResults() chan *Result {
 
 			stmt, err := txn.Prepare(pq.CopyIn("results",
 				"campaign_id", "ip", "timestamp", "username", "password",
-				"valid", "locked", "mfa", "rate_limited", "metadata",
+				"valid", "locked", "mfa", "rate_limited", "user_status", "metadata",
 			))
 			if err != nil {
 				log.Fatal(err)
@@ -203,7 +217,7 @@ func (t *TridentDB) StreamingInsertResults() chan *Result {
 			execres := func(r *Result) {
 				_, err = stmt.Exec(
 					r.CampaignID, r.IP, r.Timestamp, r.Username, r.Password,
-					r.Valid, r.Locked, r.MFA, r.RateLimited, r.Metadata,
+					r.Valid, r.Locked, r.MFA, r.RateLimited, r.UserStatus, r.Metadata,
 				)
 				if err != nil {
 					log.Printf("error in streaming exec: %s", err)
@@ -262,7 +276,7 @@ func (t *TridentDB) StreamingInsertResults() chan *Result {
 func (t *TridentDB) ListCampaign() ([]Campaign, error) {
 	var campaigns []Campaign
 
-	err := t.db.Select([]string{"id", "provider", "provider_metadata", "status", "created_at"}).
+	err := t.db.Select([]string{"id", "type", "provider", "provider_metadata", "status", "created_at"}).
 		Find(&campaigns).Error
 	if err != nil {
 		return nil, err
@@ -302,3 +316,97 @@ func (t *TridentDB) DescribeCampaign(query Query) (Campaign, error) {
 
 	return campaign, nil
 }
+
+// InsertArtifact stores the sealed session artifacts of a result.
+func (t *TridentDB) InsertArtifact(a *Artifact) error {
+	return t.db.Create(a).Error
+}
+
+// SelectArtifacts returns the sealed session artifacts of a campaign's
+// results, limited to resultIDs if any are given.
+func (t *TridentDB) SelectArtifacts(campaignID uint, resultIDs []uint) ([]Artifact, error) {
+	var artifacts []Artifact
+
+	q := t.db.Where("campaign_id = ?", campaignID)
+	if len(resultIDs) > 0 {
+		q = q.Where("result_id IN (?)", resultIDs)
+	}
+	err := q.Order("result_id").Find(&artifacts).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return artifacts, nil
+}
+
+// InsertArtifactAccess records a request for session artifacts in the audit
+// log.
+func (t *TridentDB) InsertArtifactAccess(a *ArtifactAccess) error {
+	return t.db.Create(a).Error
+}
+
+// SaveWorkerStat creates or replaces the statistics of a dispatcher's worker.
+func (t *TridentDB) SaveWorkerStat(stat *WorkerStat) error {
+	return t.db.
+		Where(WorkerStat{Dispatcher: stat.Dispatcher, Worker: stat.Worker}).
+		Assign(*stat).
+		FirstOrCreate(stat).
+		Error
+}
+
+// ListWorkerStats returns the latest statistics of every worker.
+func (t *TridentDB) ListWorkerStats() ([]WorkerStat, error) {
+	var stats []WorkerStat
+
+	err := t.db.Order("dispatcher, worker").Find(&stats).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// SaveWorker registers a worker or updates its registration from a heartbeat.
+// The state of a registered worker is left unchanged and new workers are
+// active, so operators' drain and disable decisions survive heartbeats.
+func (t *TridentDB) SaveWorker(w *Worker) error {
+	return t.db.
+		Where(Worker{Name: w.Name}).
+		Attrs(Worker{State: event.WorkerStateActive}).
+		Assign(Worker{
+			Kind:     w.Kind,
+			URL:      w.URL,
+			Version:  w.Version,
+			Nozzles:  w.Nozzles,
+			IP:       w.IP,
+			Load:     w.Load,
+			LastSeen: w.LastSeen,
+		}).
+		FirstOrCreate(w).
+		Error
+}
+
+// ListWorkers returns every registered worker.
+func (t *TridentDB) ListWorkers() ([]Worker, error) {
+	var workers []Worker
+
+	err := t.db.Order("name").Find(&workers).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return workers, nil
+}
+
+// UpdateWorkerState sets the state of the named worker, returning
+// gorm.ErrRecordNotFound if it is not registered.
+func (t *TridentDB) UpdateWorkerState(name string, state event.WorkerState) error {
+	res := t.db.Model(&Worker{}).Where("name = ?", name).Update("state", state)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
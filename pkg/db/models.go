@@ -16,9 +16,13 @@ package db
 
 import (
 	"encoding/json"
+	"fmt"
 	"time"
 
 	"github.com/lib/pq"
+
+	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/seal"
 )
 
 // Model is the base type that contains information about the DB record being stored.
@@ -44,6 +48,19 @@ const (
 	CampaignStatusPaused = "Paused"
 )
 
+// The CampaignType enum indicates what kind of tasks a Campaign produces
+type CampaignType string
+
+const (
+	// CampaignTypeSpray is a password spraying campaign. Campaigns created
+	// before campaign types existed have an empty Type and are also spray
+	// campaigns.
+	CampaignTypeSpray CampaignType = "spray"
+	// CampaignTypeEnumeration checks whether each user exists without guessing
+	// any passwords
+	CampaignTypeEnumeration CampaignType = "enumeration"
+)
+
 // Campaign stores the metadata associated with an entire password spraying campaign
 type Campaign struct {
 	// inherit the base model's fields
@@ -61,6 +78,9 @@ type Campaign struct {
 	// current status of the campaign, used to pause/cancel/resume without deletion
 	Status CampaignStatus `json:"status"`
 
+	// the kind of campaign (spray or enumeration)
+	Type CampaignType `json:"type"`
+
 	// the slice of usernames to guess in this campaign
 	Users pq.StringArray `json:"users" gorm:"type:varchar(255)[]"`
 
@@ -74,6 +94,10 @@ type Campaign struct {
 	// successful requests to the portal
 	ProviderMetadata json.RawMessage `json:"provider_metadata"`
 
+	// the names of the workers the campaign is pinned to, or empty to use
+	// any worker
+	Workers pq.StringArray `json:"workers" gorm:"type:varchar(255)[]"`
+
 	// the results of the campaign
 	Results []Result `json:"results"`
 }
@@ -111,15 +135,174 @@ type Result struct {
 	// RateLimited indicates the provider has detected a large number of requests
 	RateLimited bool `json:"rate_limited"`
 
+	// UserStatus is the result of an enumeration task (exists, not_exists, or
+	// unknown) and is empty for credential guesses
+	UserStatus string `json:"user_status"`
+
 	// Additional metadata from the auth provider (e.g. information about MFA)
 	Metadata json.RawMessage `json:"metadata"`
 }
 
+// Artifact stores the session artifacts (tokens, cookies, and MFA posture)
+// captured for a valid result. The artifacts are sealed with the
+// orchestrator's artifact key and are only returned, decrypted, by the audited
+// artifacts endpoint.
+type Artifact struct {
+	// inherit the base model's fields
+	Model
+
+	// ResultID is the valid result the artifacts were captured for
+	ResultID uint `json:"result_id" gorm:"unique_index"`
+
+	// CampaignID is the campaign of the result
+	CampaignID uint `json:"campaign_id" gorm:"index"`
+
+	// Username is the username of the result
+	Username string `json:"username"`
+
+	// Sealed is the encrypted JSON of the artifacts. It is never serialized.
+	Sealed []byte `json:"-"`
+}
+
+// aad returns the additional data the artifact is sealed with, which binds
+// the ciphertext to its result.
+func (a *Artifact) aad() []byte {
+	return []byte(fmt.Sprintf("trident-artifact:%d:%d:%s", a.CampaignID, a.ResultID, a.Username))
+}
+
+// Seal encrypts the JSON encoding of v into Sealed. The ResultID, CampaignID,
+// and Username must be set first.
+func (a *Artifact) Seal(s *seal.Sealer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	a.Sealed, err = s.Seal(data, a.aad())
+	return err
+}
+
+// Open decrypts Sealed into v.
+func (a *Artifact) Open(s *seal.Sealer, v interface{}) error {
+	data, err := s.Open(a.Sealed, a.aad())
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// ArtifactAccess is the audit record of a request for session artifacts.
+type ArtifactAccess struct {
+	// inherit the base model's fields
+	Model
+
+	// Identity is the authenticated requester (the Cloudflare Access email)
+	Identity string `json:"identity"`
+
+	// RemoteAddr is the address the request came from
+	RemoteAddr string `json:"remote_addr"`
+
+	// Reason is the justification given by the requester
+	Reason string `json:"reason"`
+
+	// CampaignID is the campaign whose artifacts were requested
+	CampaignID uint `json:"campaign_id" gorm:"index"`
+
+	// ResultIDs limits the request to these results, if set
+	ResultIDs pq.Int64Array `json:"result_ids" gorm:"type:bigint[]"`
+
+	// Count is the number of artifacts returned
+	Count int `json:"count"`
+}
+
+// WorkerStat stores the latest statistics a dispatcher reported for one of
+// its workers. There is a single row for each dispatcher and worker.
+type WorkerStat struct {
+	// inherit the base model's fields
+	Model
+
+	// Dispatcher is the hostname of the reporting dispatcher
+	Dispatcher string `json:"dispatcher" gorm:"unique_index:idx_worker_stat"`
+
+	// Worker is the name of the worker
+	Worker string `json:"worker" gorm:"unique_index:idx_worker_stat"`
+
+	// ReportedAt is when the dispatcher collected the statistics
+	ReportedAt time.Time `json:"reported_at"`
+
+	// Healthy is whether the worker passed its last health check
+	Healthy bool `json:"healthy"`
+
+	// Ejected is whether the dispatcher has ejected the worker
+	Ejected bool `json:"ejected"`
+
+	// Submitted is the number of tasks sent to the worker
+	Submitted int64 `json:"submitted"`
+
+	// Succeeded is the number of tasks the worker completed
+	Succeeded int64 `json:"succeeded"`
+
+	// Errors is the number of tasks which failed with an error
+	Errors int64 `json:"errors"`
+
+	// RateLimited is the number of tasks which were rate limited
+	RateLimited int64 `json:"rate_limited"`
+
+	// Ejections is the number of times the worker was ejected
+	Ejections int64 `json:"ejections"`
+
+	// LastError is the most recent error
+	LastError string `json:"last_error"`
+}
+
+// WorkerTimeout is how long a worker is considered online after its last
+// heartbeat.
+const WorkerTimeout = 2 * time.Minute
+
+// Worker is a worker registered with the orchestrator by its heartbeats.
+type Worker struct {
+	// inherit the base model's fields
+	Model
+
+	// Name uniquely identifies the worker
+	Name string `json:"name" gorm:"unique_index"`
+
+	// Kind is the kind of worker (e.g. webhook)
+	Kind string `json:"kind"`
+
+	// URL is where dispatchers reach the worker, if it is known
+	URL string `json:"url"`
+
+	// Version is the version of the worker
+	Version string `json:"version"`
+
+	// Nozzles are the nozzles the worker supports
+	Nozzles pq.StringArray `json:"nozzles" gorm:"type:varchar(255)[]"`
+
+	// IP is the egress IP of the worker's credential guesses
+	IP string `json:"ip"`
+
+	// Load is the number of tasks the worker was performing
+	Load int `json:"load"`
+
+	// LastSeen is the time of the worker's last heartbeat
+	LastSeen time.Time `json:"last_seen"`
+
+	// State is set by operators to drain or disable the worker
+	State event.WorkerState `json:"state"`
+
+	// Online is whether the worker sent a heartbeat within WorkerTimeout. It
+	// is computed when workers are listed.
+	Online bool `json:"online" gorm:"-"`
+}
+
 // Task carries metadata about a single task in the password spraying campaign
 type Task struct {
 	// CampaignID is used to track the results of the task
 	CampaignID uint `json:"campaign_id"`
 
+	// Type is the kind of campaign which produced this task
+	Type CampaignType `json:"type,omitempty"`
+
 	// NotBefore will prevent execution until this time
 	NotBefore time.Time `json:"not_before"`
 
@@ -137,6 +320,9 @@ type Task struct {
 
 	// ProviderMetadata is any required configuration data for the provider
 	ProviderMetadata json.RawMessage `json:"metadata"`
+
+	// Workers pins the task to the named workers
+	Workers []string `json:"workers,omitempty"`
 }
 
 // MarshalBinary task marshalling
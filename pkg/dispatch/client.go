@@ -16,6 +16,7 @@ package dispatch
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"sync"
 
@@ -27,12 +28,37 @@ var (
 	drivers   = make(map[string]Driver)
 )
 
+// ErrUnavailable is returned, possibly wrapped, by a WorkerClient which has no
+// worker available for a task right now. The dispatcher redelivers the task
+// rather than dropping it.
+var ErrUnavailable = errors.New("dispatch: no worker is available for the task")
+
 // WorkerClient is an interface that wraps the Submit function, which simply
 // accepts and AuthRequest, performs work, and returns an AuthResponse.
 type WorkerClient interface {
 	Submit(event.AuthRequest) (*event.AuthResponse, error)
 }
 
+// StatsReporter is implemented by WorkerClients which keep statistics for
+// their workers. The dispatcher periodically reports them to the orchestrator.
+type StatsReporter interface {
+	Stats() []event.WorkerStats
+}
+
+// Result is the outcome of one task of a batch.
+type Result struct {
+	Response *event.AuthResponse
+	Err      error
+}
+
+// BatchSubmitter is implemented by WorkerClients which can submit several
+// tasks at once, saving a round trip to the worker for each task. SubmitBatch
+// returns a Result for each task in the order they were submitted. Tasks
+// which were not attempted have an error wrapping ErrUnavailable.
+type BatchSubmitter interface {
+	SubmitBatch([]event.AuthRequest) []Result
+}
+
 // Driver is an interface which wraps the creation of a WorkerClient.
 type Driver interface {
 	New(opts map[string]string) (WorkerClient, error)
@@ -0,0 +1,114 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package local implements a dispatch.WorkerClient which performs tasks in
+// the dispatcher process, so small engagements and CI can run without
+// deploying workers. Nozzles must be registered in the dispatcher with blank
+// imports, as in the webhook-worker. Tasks pinned to other workers are
+// refused, so that a dispatcher sharing the task subscription with them
+// leaves those tasks for them.
+package local
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/praetorian-inc/trident/pkg/dispatch"
+	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/util"
+	"github.com/praetorian-inc/trident/pkg/worker"
+)
+
+func init() {
+	dispatch.Register("local", Driver{})
+}
+
+// DefaultConcurrency is the number of tasks a local client executes at once
+// unless configured otherwise.
+const DefaultConcurrency = 10
+
+// DefaultName is the worker name of a local client unless configured
+// otherwise.
+const DefaultName = "local"
+
+// Driver implements the dispatch.Driver interface.
+type Driver struct{}
+
+// New is used to create a local worker client and accepts the following
+// configuration options:
+//
+//	concurrency: the maximum number of tasks executed at once (defaults to 10).
+//	ip:          the originating IP reported in results (defaults to the
+//	             external IP of the dispatcher).
+//	name:        the worker name pinned tasks must include (defaults to
+//	             "local").
+func (Driver) New(opts map[string]string) (dispatch.WorkerClient, error) {
+	concurrency := DefaultConcurrency
+	if s, ok := opts["concurrency"]; ok {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("local client: invalid concurrency %q", s)
+		}
+		concurrency = n
+	}
+
+	ip, ok := opts["ip"]
+	if !ok {
+		var err error
+		ip, err = util.ExternalIP()
+		if err != nil {
+			return nil, fmt.Errorf("local client: unable to determine external IP: %w", err)
+		}
+	}
+
+	name, ok := opts["name"]
+	if !ok {
+		name = DefaultName
+	}
+
+	return &Client{
+		Name: name,
+		IP:   ip,
+		sem:  make(chan struct{}, concurrency),
+	}, nil
+}
+
+// Client implements the dispatch.WorkerClient interface by opening nozzles in
+// the current process.
+type Client struct {
+	// Name is the worker name pinned tasks must include to be performed
+	Name string
+
+	// IP is the originating IP reported in results
+	IP string
+
+	// sem limits the number of tasks executed at once
+	sem chan struct{}
+}
+
+// Submit fulfils the dispatch.WorkerClient interface and performs a task,
+// waiting while the maximum number of tasks are already executing. A task
+// pinned to other workers is refused with an error wrapping
+// dispatch.ErrUnavailable, so that it is redelivered.
+func (c *Client) Submit(r event.AuthRequest) (*event.AuthResponse, error) {
+	if !r.Allows(c.Name) {
+		return nil, fmt.Errorf("local client: task is not pinned to %s: %w", c.Name, dispatch.ErrUnavailable)
+	}
+
+	c.sem <- struct{}{}
+	defer func() { <-c.sem }()
+
+	return worker.Execute(context.Background(), r, c.IP)
+}
@@ -0,0 +1,147 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/praetorian-inc/trident/pkg/dispatch"
+	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+)
+
+// running and peak count the concurrent logins of the test nozzle
+var running, peak int32
+
+type testDriver struct{}
+
+func (testDriver) New(opts map[string]string) (nozzle.Nozzle, error) {
+	return testNozzle{}, nil
+}
+
+type testNozzle struct{}
+
+func (testNozzle) Login(username, password string) (*event.AuthResponse, error) {
+	n := atomic.AddInt32(&running, 1)
+	defer atomic.AddInt32(&running, -1)
+	for {
+		p := atomic.LoadInt32(&peak)
+		if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	if username == "error" {
+		return nil, fmt.Errorf("connection refused")
+	}
+	return &event.AuthResponse{Valid: password == "Password1!"}, nil
+}
+
+func init() {
+	nozzle.Register("local-test", testDriver{})
+}
+
+func TestSubmit(t *testing.T) {
+	wc, err := dispatch.Open("local", map[string]string{"concurrency": "2", "ip": "203.0.113.10"})
+	if err != nil {
+		t.Fatalf("unable to open worker client: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := event.AuthRequest{
+				CampaignID: 7,
+				Username:   fmt.Sprintf("user%d@example.org", i),
+				Password:   "Password1!",
+				Provider:   "local-test",
+			}
+			res, err := wc.Submit(req)
+			if err != nil {
+				t.Errorf("[%s] error in submit: %s", req.Username, err)
+				return
+			}
+			if !res.Valid || res.CampaignID != 7 || res.Username != req.Username ||
+				res.Password != req.Password || res.IP != "203.0.113.10" || res.Timestamp.IsZero() {
+				t.Errorf("[%s] unexpected response %+v", req.Username, res)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if p := atomic.LoadInt32(&peak); p != 2 {
+		t.Errorf("peak concurrency was %d, expected 2", p)
+	}
+
+	_, err = wc.Submit(event.AuthRequest{Username: "error", Provider: "local-test"})
+	if err == nil {
+		t.Errorf("expected nozzle error to be returned")
+	}
+	_, err = wc.Submit(event.AuthRequest{Username: "alice", Provider: "missing"})
+	if err == nil {
+		t.Errorf("expected error for unknown provider")
+	}
+}
+
+func TestPinned(t *testing.T) {
+	var testcases = []struct {
+		desc      string
+		opts      map[string]string
+		workers   []string
+		performed bool
+	}{
+		{"unpinned", map[string]string{}, nil, true},
+		{"pinned to local", map[string]string{}, []string{"worker-a", "local"}, true},
+		{"pinned elsewhere", map[string]string{}, []string{"worker-a"}, false},
+		{"pinned to name", map[string]string{"name": "worker-a"}, []string{"worker-a"}, true},
+		{"pinned to default name", map[string]string{"name": "worker-a"}, []string{"local"}, false},
+	}
+	for _, test := range testcases {
+		test.opts["ip"] = "203.0.113.10"
+		wc, err := dispatch.Open("local", test.opts)
+		if err != nil {
+			t.Fatalf("[%s] unable to open worker client: %s", test.desc, err)
+		}
+		res, err := wc.Submit(event.AuthRequest{
+			Username: "alice",
+			Password: "Password1!",
+			Provider: "local-test",
+			Workers:  test.workers,
+		})
+		if test.performed && (err != nil || !res.Valid) {
+			t.Errorf("[%s] task was not performed: %v", test.desc, err)
+		}
+		if !test.performed && !errors.Is(err, dispatch.ErrUnavailable) {
+			t.Errorf("[%s] expected ErrUnavailable, got %v", test.desc, err)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, c := range []string{"0", "-1", "many"} {
+		_, err := dispatch.Open("local", map[string]string{"concurrency": c, "ip": "203.0.113.10"})
+		if err == nil {
+			t.Errorf("expected error for concurrency %q", c)
+		}
+	}
+}
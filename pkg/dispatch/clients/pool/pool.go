@@ -0,0 +1,377 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pool implements a dispatch.WorkerClient which balances tasks across
+// many webhook workers, so a single dispatcher can spray from several egress
+// IPs. Workers are health checked and ejected with a circuit breaker after
+// repeated errors or rate limited responses (e.g. when their IP is blocked).
+package pool
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/praetorian-inc/trident/pkg/dispatch"
+	"github.com/praetorian-inc/trident/pkg/dispatch/clients/webhook"
+	"github.com/praetorian-inc/trident/pkg/event"
+)
+
+func init() {
+	dispatch.Register("pool", Driver{})
+}
+
+// Strategies used to choose the worker for a task.
+const (
+	// RoundRobin sends tasks to each worker in turn
+	RoundRobin = "round-robin"
+
+	// Random sends each task to a random worker
+	Random = "random"
+
+	// Sticky sends every task for a username to the same worker
+	Sticky = "sticky"
+)
+
+// Defaults used unless configured otherwise.
+const (
+	DefaultHealthInterval   = 30 * time.Second
+	DefaultFailureThreshold = 3
+	DefaultCooldown         = 5 * time.Minute
+)
+
+// ErrNoWorkers is returned by Submit when every worker the task may be sent to
+// is unhealthy or ejected. It wraps dispatch.ErrUnavailable.
+var ErrNoWorkers = fmt.Errorf("pool: no healthy workers: %w", dispatch.ErrUnavailable)
+
+// Driver implements the dispatch.Driver interface.
+type Driver struct{}
+
+// New is used to create a pool worker client and accepts the following
+// configuration options:
+//
+//	workers:           a JSON array of webhook client options, one object per
+//	                   worker, e.g. [{"url":"https://...","token":"..."}]. An
+//	                   optional "name" identifies the worker in statistics and
+//	                   campaign pinning, and defaults to its url.
+//	strategy:          round-robin (default), random, or sticky.
+//	health-interval:   how often each worker's /healthz is checked (defaults
+//	                   to 30s).
+//	failure-threshold: the number of consecutive errors or rate limited
+//	                   responses which eject a worker (defaults to 3).
+//	cooldown:          how long an ejected worker is left out before it is
+//	                   tried again (defaults to 5m).
+func (Driver) New(opts map[string]string) (dispatch.WorkerClient, error) {
+	s, ok := opts["workers"]
+	if !ok {
+		return nil, fmt.Errorf("pool client requires 'workers' config parameter")
+	}
+	var configs []map[string]string
+	err := json.Unmarshal([]byte(s), &configs)
+	if err != nil {
+		return nil, fmt.Errorf("pool client: invalid workers: %w", err)
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("pool client requires at least one worker")
+	}
+
+	p := &Pool{
+		Strategy:  RoundRobin,
+		Threshold: DefaultFailureThreshold,
+		Cooldown:  DefaultCooldown,
+		stop:      make(chan struct{}),
+	}
+	if s, ok := opts["strategy"]; ok {
+		switch s {
+		case RoundRobin, Random, Sticky:
+			p.Strategy = s
+		default:
+			return nil, fmt.Errorf("pool client: invalid strategy %q", s)
+		}
+	}
+	if s, ok := opts["failure-threshold"]; ok {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("pool client: invalid failure-threshold %q", s)
+		}
+		p.Threshold = n
+	}
+	if s, ok := opts["cooldown"]; ok {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("pool client: invalid cooldown %q", s)
+		}
+		p.Cooldown = d
+	}
+	interval := DefaultHealthInterval
+	if s, ok := opts["health-interval"]; ok {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("pool client: invalid health-interval %q", s)
+		}
+		interval = d
+	}
+
+	for i, config := range configs {
+		wc, err := webhook.Driver{}.New(config)
+		if err != nil {
+			return nil, fmt.Errorf("pool client: worker %d: %w", i, err)
+		}
+		name, ok := config["name"]
+		if !ok {
+			name = config["url"]
+		}
+		p.workers = append(p.workers, &worker{
+			name:    name,
+			client:  wc.(*webhook.Client),
+			healthy: true,
+		})
+	}
+
+	go p.checkHealth(interval)
+	return p, nil
+}
+
+// Pool implements the dispatch.WorkerClient, dispatch.BatchSubmitter, and
+// dispatch.StatsReporter interfaces for a set of webhook workers.
+type Pool struct {
+	// Strategy is how a worker is chosen for each task
+	Strategy string
+
+	// Threshold is the number of consecutive failures which eject a worker
+	Threshold int
+
+	// Cooldown is how long an ejected worker is left out
+	Cooldown time.Duration
+
+	workers []*worker
+
+	// next is the round robin counter
+	next uint64
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// worker is a webhook worker and the state of its circuit breaker.
+type worker struct {
+	name   string
+	client *webhook.Client
+
+	mu       sync.Mutex
+	healthy  bool
+	failures int
+	ejected  time.Time
+	stats    event.WorkerStats
+}
+
+// Submit fulfils the dispatch.WorkerClient interface and submits a task to a
+// healthy worker. A failed task is not retried on another worker, since the
+// guess may already have reached the identity provider.
+func (p *Pool) Submit(r event.AuthRequest) (*event.AuthResponse, error) {
+	w, err := p.pick(&r)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := w.client.Submit(r)
+	if errors.Is(err, dispatch.ErrUnavailable) {
+		// the worker refused the task (e.g. it is disabled), which is not
+		// a failure of the worker
+		return nil, fmt.Errorf("pool: worker %s: %w", w.name, err)
+	}
+	w.record(res, err, p.Threshold, p.Cooldown)
+	if err != nil {
+		return nil, fmt.Errorf("pool: worker %s: %w", w.name, err)
+	}
+	return res, nil
+}
+
+// SubmitBatch fulfils the dispatch.BatchSubmitter interface. A worker is chosen
+// for each task as in Submit, and the tasks for each worker are submitted to
+// it in one batch.
+func (p *Pool) SubmitBatch(rs []event.AuthRequest) []dispatch.Result {
+	results := make([]dispatch.Result, len(rs))
+	batches := make(map[*worker][]int)
+	for i := range rs {
+		w, err := p.pick(&rs[i])
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		batches[w] = append(batches[w], i)
+	}
+
+	var wg sync.WaitGroup
+	for w, indices := range batches {
+		wg.Add(1)
+		go func(w *worker, indices []int) {
+			defer wg.Done()
+			batch := make([]event.AuthRequest, len(indices))
+			for j, i := range indices {
+				batch[j] = rs[i]
+			}
+			for j, res := range w.client.SubmitBatch(batch) {
+				i := indices[j]
+				results[i] = res
+				if res.Err != nil {
+					results[i].Err = fmt.Errorf("pool: worker %s: %w", w.name, res.Err)
+				}
+				if errors.Is(res.Err, dispatch.ErrUnavailable) {
+					// the worker refused or skipped the task, which is
+					// not a failure of the worker
+					continue
+				}
+				w.record(res.Response, res.Err, p.Threshold, p.Cooldown)
+			}
+		}(w, indices)
+	}
+	wg.Wait()
+	return results
+}
+
+// Stats fulfils the dispatch.StatsReporter interface.
+func (p *Pool) Stats() []event.WorkerStats {
+	now := time.Now()
+	stats := make([]event.WorkerStats, len(p.workers))
+	for i, w := range p.workers {
+		w.mu.Lock()
+		stats[i] = w.stats
+		stats[i].Worker = w.name
+		stats[i].Healthy = w.healthy
+		stats[i].Ejected = now.Before(w.ejected)
+		w.mu.Unlock()
+	}
+	return stats
+}
+
+// Close stops health checking the workers.
+func (p *Pool) Close() error {
+	p.closeOnce.Do(func() { close(p.stop) })
+	return nil
+}
+
+// pick chooses an available worker according to the strategy. When the chosen
+// worker is unavailable, or the task is pinned to other workers, the next
+// available worker is used instead.
+func (p *Pool) pick(r *event.AuthRequest) (*worker, error) {
+	n := len(p.workers)
+
+	var start int
+	switch p.Strategy {
+	case Random:
+		start = rand.Intn(n) // nolint:gosec
+	case Sticky:
+		h := fnv.New32a()
+		h.Write([]byte(strings.ToLower(r.Username))) // nolint:errcheck,gosec
+		start = int(h.Sum32() % uint32(n))
+	default:
+		start = int((atomic.AddUint64(&p.next, 1) - 1) % uint64(n))
+	}
+
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		w := p.workers[(start+i)%n]
+		if r.Allows(w.name) && w.available(now) {
+			return w, nil
+		}
+	}
+	return nil, ErrNoWorkers
+}
+
+// checkHealth checks the health of every worker each interval until the pool
+// is closed.
+func (p *Pool) checkHealth(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, w := range p.workers {
+			wg.Add(1)
+			go func(w *worker) {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(context.Background(), interval)
+				defer cancel()
+				w.setHealth(w.client.Healthz(ctx))
+			}(w)
+		}
+		wg.Wait()
+
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// available returns whether the worker is healthy and not ejected.
+func (w *worker) available(now time.Time) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.healthy && !now.Before(w.ejected)
+}
+
+// setHealth records the result of a health check.
+func (w *worker) setHealth(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err != nil && w.healthy {
+		log.Warnf("pool: worker %s failed health check: %s", w.name, err)
+	} else if err == nil && !w.healthy {
+		log.Infof("pool: worker %s passed health check", w.name)
+	}
+	w.healthy = err == nil
+}
+
+// record updates the worker's statistics and circuit breaker with the outcome
+// of a task. After threshold consecutive failures the worker is ejected for
+// cooldown. Once the cooldown passes a single failure ejects it again, and a
+// success closes the breaker.
+func (w *worker) record(res *event.AuthResponse, err error, threshold int, cooldown time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.stats.Submitted++
+	switch {
+	case err != nil:
+		w.stats.Errors++
+		w.stats.LastError = err.Error()
+		w.failures++
+	case res.RateLimited:
+		w.stats.RateLimited++
+		w.failures++
+	default:
+		w.stats.Succeeded++
+		w.failures = 0
+		return
+	}
+
+	if w.failures >= threshold {
+		w.ejected = time.Now().Add(cooldown)
+		w.stats.Ejections++
+		log.Warnf("pool: ejecting worker %s for %s after %d consecutive failures",
+			w.name, cooldown, w.failures)
+	}
+}
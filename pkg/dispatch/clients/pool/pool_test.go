@@ -0,0 +1,309 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/praetorian-inc/trident/pkg/dispatch"
+	"github.com/praetorian-inc/trident/pkg/event"
+)
+
+// testWorker is a webhook worker which counts the tasks it receives.
+type testWorker struct {
+	*httptest.Server
+	tasks       int32
+	batches     int32
+	healthy     int32
+	rateLimited int32
+	disabled    int32
+}
+
+func newTestWorker(t *testing.T, token string) *testWorker {
+	w := &testWorker{healthy: 1}
+	w.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Access-Token") != token {
+			http.Error(rw, `{"error":"unauthorized"}`, 401)
+			return
+		}
+		if r.URL.Path == "/healthz" {
+			if atomic.LoadInt32(&w.healthy) == 0 {
+				http.Error(rw, "unhealthy", 503)
+			}
+			return
+		}
+		if atomic.LoadInt32(&w.disabled) == 1 {
+			rw.WriteHeader(503)
+			json.NewEncoder(rw).Encode(&event.ErrorResponse{ErrorMsg: "worker is disabled"}) // nolint:errcheck,gosec
+			return
+		}
+		if r.URL.Path == "/batch" {
+			var reqs []event.AuthRequest
+			if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+				t.Errorf("error decoding batch: %s", err)
+			}
+			atomic.AddInt32(&w.batches, 1)
+			atomic.AddInt32(&w.tasks, int32(len(reqs)))
+			results := make([]event.BatchResult, len(reqs))
+			for i, req := range reqs {
+				results[i].Response = &event.AuthResponse{Username: req.Username}
+			}
+			json.NewEncoder(rw).Encode(&results) // nolint:errcheck,gosec
+			return
+		}
+
+		var req event.AuthRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("error decoding task: %s", err)
+		}
+		atomic.AddInt32(&w.tasks, 1)
+		json.NewEncoder(rw).Encode(&event.AuthResponse{ // nolint:errcheck,gosec
+			Username:    req.Username,
+			RateLimited: atomic.LoadInt32(&w.rateLimited) == 1,
+		})
+	}))
+	return w
+}
+
+func openPool(t *testing.T, opts map[string]string, workers ...*testWorker) *Pool {
+	var configs []map[string]string
+	for i, w := range workers {
+		configs = append(configs, map[string]string{
+			"name":  fmt.Sprintf("worker-%d", i),
+			"url":   w.URL + "/",
+			"token": fmt.Sprintf("token-%d", i),
+		})
+	}
+	b, _ := json.Marshal(configs)
+	opts["workers"] = string(b)
+
+	wc, err := dispatch.Open("pool", opts)
+	if err != nil {
+		t.Fatalf("unable to open worker client: %s", err)
+	}
+	p := wc.(*Pool)
+	t.Cleanup(func() { p.Close() }) // nolint:errcheck
+	return p
+}
+
+func submit(t *testing.T, p *Pool, username string) *event.AuthResponse {
+	res, err := p.Submit(event.AuthRequest{Username: username})
+	if err != nil {
+		t.Fatalf("[%s] error in submit: %s", username, err)
+	}
+	return res
+}
+
+func TestRoundRobin(t *testing.T) {
+	a, b := newTestWorker(t, "token-0"), newTestWorker(t, "token-1")
+	defer a.Close()
+	defer b.Close()
+	p := openPool(t, map[string]string{}, a, b)
+
+	for i := 0; i < 6; i++ {
+		submit(t, p, fmt.Sprintf("user%d@example.org", i))
+	}
+	if atomic.LoadInt32(&a.tasks) != 3 || atomic.LoadInt32(&b.tasks) != 3 {
+		t.Errorf("tasks were not balanced: %d and %d", a.tasks, b.tasks)
+	}
+
+	stats := p.Stats()
+	if len(stats) != 2 || stats[0].Worker != "worker-0" || stats[0].Submitted != 3 || stats[0].Succeeded != 3 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestSticky(t *testing.T) {
+	a, b := newTestWorker(t, "token-0"), newTestWorker(t, "token-1")
+	defer a.Close()
+	defer b.Close()
+	p := openPool(t, map[string]string{"strategy": Sticky}, a, b)
+
+	for i := 0; i < 4; i++ {
+		submit(t, p, "alice@example.org")
+	}
+	if n := atomic.LoadInt32(&a.tasks) + atomic.LoadInt32(&b.tasks); n != 4 || (a.tasks != 0 && b.tasks != 0) {
+		t.Errorf("tasks for one user were split: %d and %d", a.tasks, b.tasks)
+	}
+}
+
+func TestPinned(t *testing.T) {
+	a, b := newTestWorker(t, "token-0"), newTestWorker(t, "token-1")
+	defer a.Close()
+	defer b.Close()
+	p := openPool(t, map[string]string{}, a, b)
+
+	for i := 0; i < 4; i++ {
+		_, err := p.Submit(event.AuthRequest{Username: "alice@example.org", Workers: []string{"worker-1"}})
+		if err != nil {
+			t.Fatalf("error in submit: %s", err)
+		}
+	}
+	if atomic.LoadInt32(&a.tasks) != 0 || atomic.LoadInt32(&b.tasks) != 4 {
+		t.Errorf("pinned tasks were sent to other workers: %d and %d", a.tasks, b.tasks)
+	}
+
+	_, err := p.Submit(event.AuthRequest{Username: "alice@example.org", Workers: []string{"worker-9"}})
+	if !errors.Is(err, dispatch.ErrUnavailable) {
+		t.Errorf("expected ErrUnavailable for a task pinned to unknown workers, got %v", err)
+	}
+}
+
+func TestSubmitBatch(t *testing.T) {
+	a, b := newTestWorker(t, "token-0"), newTestWorker(t, "token-1")
+	defer a.Close()
+	defer b.Close()
+	p := openPool(t, map[string]string{}, a, b)
+
+	var reqs []event.AuthRequest
+	for i := 0; i < 6; i++ {
+		reqs = append(reqs, event.AuthRequest{Username: fmt.Sprintf("user%d@example.org", i)})
+	}
+	reqs = append(reqs, event.AuthRequest{Username: "pinned@example.org", Workers: []string{"worker-9"}})
+
+	results := p.SubmitBatch(reqs)
+	for i, res := range results[:6] {
+		if res.Err != nil || res.Response.Username != reqs[i].Username {
+			t.Errorf("[%s] unexpected result %+v", reqs[i].Username, res)
+		}
+	}
+	if !errors.Is(results[6].Err, dispatch.ErrUnavailable) {
+		t.Errorf("expected ErrUnavailable for a task pinned to unknown workers, got %v", results[6].Err)
+	}
+	if atomic.LoadInt32(&a.batches) != 1 || atomic.LoadInt32(&a.tasks) != 3 || atomic.LoadInt32(&b.tasks) != 3 {
+		t.Errorf("tasks were not batched by worker: %d and %d tasks in %d and %d batches",
+			a.tasks, b.tasks, a.batches, b.batches)
+	}
+	if stats := p.Stats(); stats[0].Submitted != 3 || stats[1].Succeeded != 3 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	a, b := newTestWorker(t, "token-0"), newTestWorker(t, "token-1")
+	defer a.Close()
+	defer b.Close()
+	p := openPool(t, map[string]string{"failure-threshold": "2", "cooldown": "1h"}, a, b)
+
+	// worker-0 is blocked and is ejected after two rate limited responses
+	atomic.StoreInt32(&a.rateLimited, 1)
+	for i := 0; i < 4; i++ {
+		submit(t, p, fmt.Sprintf("user%d@example.org", i))
+	}
+	for i := 0; i < 4; i++ {
+		if res := submit(t, p, fmt.Sprintf("user%d@example.org", i)); res.RateLimited {
+			t.Errorf("task was sent to an ejected worker")
+		}
+	}
+	if atomic.LoadInt32(&a.tasks) != 2 || atomic.LoadInt32(&b.tasks) != 6 {
+		t.Errorf("unexpected tasks: %d and %d", a.tasks, b.tasks)
+	}
+	stats := p.Stats()
+	if !stats[0].Ejected || stats[0].Ejections != 1 || stats[0].RateLimited != 2 {
+		t.Errorf("unexpected stats %+v", stats[0])
+	}
+
+	// once the cooldown passes a single failure ejects the worker again
+	p.workers[0].mu.Lock()
+	p.workers[0].ejected = time.Now()
+	p.workers[0].mu.Unlock()
+	submit(t, p, "alice@example.org")
+	submit(t, p, "bob@example.org")
+	if stats := p.Stats(); !stats[0].Ejected || stats[0].Ejections != 2 {
+		t.Errorf("half open worker was not ejected: %+v", stats[0])
+	}
+
+	// no tasks are submitted when every worker is ejected
+	b.Close()
+	for i := 0; i < 2; i++ {
+		_, err := p.Submit(event.AuthRequest{Username: "alice@example.org"})
+		if err == nil {
+			t.Errorf("expected error from closed worker")
+		}
+	}
+	if _, err := p.Submit(event.AuthRequest{Username: "alice@example.org"}); err != ErrNoWorkers {
+		t.Errorf("expected ErrNoWorkers, got %v", err)
+	}
+}
+
+func TestRefused(t *testing.T) {
+	a := newTestWorker(t, "token-0")
+	defer a.Close()
+	p := openPool(t, map[string]string{"failure-threshold": "1"}, a)
+
+	// a disabled worker refuses tasks without being ejected, and the tasks
+	// are redelivered
+	atomic.StoreInt32(&a.disabled, 1)
+	if _, err := p.Submit(event.AuthRequest{Username: "alice@example.org"}); !errors.Is(err, dispatch.ErrUnavailable) {
+		t.Errorf("expected ErrUnavailable from a disabled worker, got %v", err)
+	}
+	for _, res := range p.SubmitBatch([]event.AuthRequest{{Username: "bob@example.org"}}) {
+		if !errors.Is(res.Err, dispatch.ErrUnavailable) {
+			t.Errorf("expected ErrUnavailable from a disabled worker, got %v", res.Err)
+		}
+	}
+	if stats := p.Stats(); stats[0].Ejected || stats[0].Errors != 0 {
+		t.Errorf("refusals were counted as failures: %+v", stats[0])
+	}
+
+	atomic.StoreInt32(&a.disabled, 0)
+	submit(t, p, "alice@example.org")
+}
+
+func TestHealthCheck(t *testing.T) {
+	a, b := newTestWorker(t, "token-0"), newTestWorker(t, "token-1")
+	defer a.Close()
+	defer b.Close()
+	atomic.StoreInt32(&a.healthy, 0)
+	p := openPool(t, map[string]string{"health-interval": "10ms"}, a, b)
+
+	deadline := time.Now().Add(time.Second)
+	for p.Stats()[0].Healthy && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if stats := p.Stats(); stats[0].Healthy || !stats[1].Healthy {
+		t.Fatalf("unexpected health %+v", stats)
+	}
+	for i := 0; i < 4; i++ {
+		submit(t, p, fmt.Sprintf("user%d@example.org", i))
+	}
+	if atomic.LoadInt32(&a.tasks) != 0 {
+		t.Errorf("tasks were sent to an unhealthy worker")
+	}
+}
+
+func TestNew(t *testing.T) {
+	var testcases = []map[string]string{
+		{},
+		{"workers": "[]"},
+		{"workers": "not json"},
+		{"workers": `[{"url":"https://worker.example.org/"}]`},
+		{"workers": `[{"url":"https://worker.example.org/","token":"x"}]`, "strategy": "fastest"},
+		{"workers": `[{"url":"https://worker.example.org/","token":"x"}]`, "failure-threshold": "0"},
+		{"workers": `[{"url":"https://worker.example.org/","token":"x"}]`, "cooldown": "soon"},
+	}
+	for _, opts := range testcases {
+		if _, err := dispatch.Open("pool", opts); err == nil {
+			t.Errorf("expected error for options %v", opts)
+		}
+	}
+}
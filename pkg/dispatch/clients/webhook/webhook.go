@@ -16,13 +16,17 @@ package webhook
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 
+	"github.com/praetorian-inc/trident/pkg/auth/signing"
 	"github.com/praetorian-inc/trident/pkg/dispatch"
 	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/pki"
 )
 
 func init() {
@@ -35,29 +39,67 @@ type Driver struct{}
 // New is used to create a webhook worker client and accepts the following
 // configuration options:
 //  url:    an HTTPS link to the webhook server.
-//  token:  a shared secret used to authenticate the client to the webhook server.
+//  key:    a base64 encoded HMAC key used to sign each request to the webhook
+//          server. Signed requests cannot be altered or replayed.
+//  key-id: identifies the key to the webhook server (defaults to "default").
+//  token:  a shared secret used to authenticate the client to the webhook
+//          server when no key is configured.
 //  header: the HTTP header used for authentication (defaults to X-Access-Token).
+//  tls-cert, tls-key: PEM files of a client certificate presented to the
+//          webhook server for mutual TLS.
+//  tls-ca: a PEM file of the CA which issued the webhook server's
+//          certificate. Only certificates issued by this CA are trusted.
 func (Driver) New(opts map[string]string) (dispatch.WorkerClient, error) {
 	url, ok := opts["url"]
 	if !ok {
 		return nil, fmt.Errorf("webhook client requires 'url' config parameter")
 	}
+
+	var signer *signing.Signer
+	if key, ok := opts["key"]; ok {
+		keyID, ok := opts["key-id"]
+		if !ok {
+			keyID = "default"
+		}
+		keys, err := signing.ParseKeys(map[string]string{keyID: key})
+		if err != nil {
+			return nil, fmt.Errorf("webhook client: %w", err)
+		}
+		signer = &signing.Signer{KeyID: keyID, Key: keys[keyID]}
+	}
+
 	token, ok := opts["token"]
-	if !ok {
-		return nil, fmt.Errorf("webhook client requires 'token' config parameter")
+	if !ok && signer == nil {
+		return nil, fmt.Errorf("webhook client requires 'key' or 'token' config parameter")
 	}
 	header, ok := opts["header"]
 	if !ok {
 		header = "X-Access-Token"
 	}
+
+	client := http.DefaultClient
+	if opts["tls-cert"] != "" || opts["tls-key"] != "" || opts["tls-ca"] != "" {
+		config, err := pki.ClientConfig(opts["tls-cert"], opts["tls-key"], opts["tls-ca"])
+		if err != nil {
+			return nil, fmt.Errorf("webhook client: %w", err)
+		}
+		client = &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: config,
+		}}
+	}
+
 	return &Client{
-		URL:    url,
-		Header: header,
-		Token:  token,
+		URL:        url,
+		Header:     header,
+		Token:      token,
+		Signer:     signer,
+		HTTPClient: client,
 	}, nil
 }
 
-// Client implements the dispatch.WorkerClient interface for webhooks.
+// Client implements the dispatch.WorkerClient and dispatch.BatchSubmitter
+// interfaces for webhooks.
 type Client struct {
 	// URL is the HTTPS URL to a worker
 	URL string
@@ -68,6 +110,14 @@ type Client struct {
 
 	// Token is an authorization token used to communicate with the worker
 	Token string
+
+	// Signer signs requests to the worker. The token is not sent when it is
+	// set.
+	Signer *signing.Signer
+
+	// HTTPClient sends requests to the worker, with the client certificate
+	// and trusted CA when mutual TLS is configured
+	HTTPClient *http.Client
 }
 
 // Submit fulfils the dispatch.WorkerClient interface and submits a task to the
@@ -78,24 +128,170 @@ func (w *Client) Submit(r event.AuthRequest) (*event.AuthResponse, error) {
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set(w.Header, w.Token)
+	err = w.authenticate(req, data)
+	if err != nil {
+		return nil, err
+	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := w.httpClient().Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close() // nolint:errcheck
 
 	if resp.StatusCode != 200 {
-		var res event.ErrorResponse
-		err = json.NewDecoder(resp.Body).Decode(&res)
-		if err != nil {
-			return nil, err
-		}
-		return nil, errors.New(res.ErrorMsg)
+		return nil, statusError(resp)
 	}
 
 	var res event.AuthResponse
 	err = json.NewDecoder(resp.Body).Decode(&res)
 	return &res, err
 }
+
+// MaxBatchSize is the maximum number of tasks sent to the webhook server in
+// one request, larger batches are split.
+const MaxBatchSize = 100
+
+// SubmitBatch fulfils the dispatch.BatchSubmitter interface and submits tasks
+// to the /batch endpoint of the webhook server, which is resolved relative to
+// the URL. If a whole batch fails every task in it has the same error.
+func (w *Client) SubmitBatch(rs []event.AuthRequest) []dispatch.Result {
+	results := make([]dispatch.Result, 0, len(rs))
+	for len(rs) > 0 {
+		n := len(rs)
+		if n > MaxBatchSize {
+			n = MaxBatchSize
+		}
+		results = append(results, w.submitBatch(rs[:n])...)
+		rs = rs[n:]
+	}
+	return results
+}
+
+// submitBatch submits a batch of at most MaxBatchSize tasks.
+func (w *Client) submitBatch(rs []event.AuthRequest) []dispatch.Result {
+	results := make([]dispatch.Result, len(rs))
+	res, err := w.postBatch(rs)
+	if err == nil && len(res) != len(rs) {
+		err = fmt.Errorf("webhook client: batch of %d tasks returned %d results", len(rs), len(res))
+	}
+	for i := range results {
+		switch {
+		case err != nil:
+			results[i].Err = err
+		case res[i].Skipped:
+			results[i].Err = fmt.Errorf("webhook client: task skipped: %s: %w", res[i].Error, dispatch.ErrUnavailable)
+		case res[i].Error != "":
+			results[i].Err = errors.New(res[i].Error)
+		case res[i].Response == nil:
+			results[i].Err = errors.New("webhook client: batch result is missing its response")
+		default:
+			results[i].Response = res[i].Response
+		}
+	}
+	return results
+}
+
+// postBatch sends a batch of tasks to the webhook server.
+func (w *Client) postBatch(rs []event.AuthRequest) ([]event.BatchResult, error) {
+	u, err := w.endpoint("batch")
+	if err != nil {
+		return nil, err
+	}
+	data, _ := json.Marshal(rs)
+	req, err := http.NewRequest("POST", u, bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+	err = w.authenticate(req, data)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := w.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint:errcheck
+
+	if resp.StatusCode != 200 {
+		return nil, statusError(resp)
+	}
+
+	var res []event.BatchResult
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	return res, err
+}
+
+// Healthz checks that the configured webhook server is up by requesting its
+// /healthz endpoint, which is resolved relative to the URL.
+func (w *Client) Healthz(ctx context.Context) error {
+	u, err := w.endpoint("healthz")
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	err = w.authenticate(req, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := w.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint:errcheck
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("webhook client: health check returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// statusError returns the error of a non-200 response. Refusals by workers
+// which are disabled (503) or not pinned for the task (409) wrap
+// dispatch.ErrUnavailable, since the task was not attempted and should be
+// redelivered.
+func statusError(resp *http.Response) error {
+	var res event.ErrorResponse
+	err := json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil || res.ErrorMsg == "" {
+		res.ErrorMsg = fmt.Sprintf("webhook client: worker returned %d", resp.StatusCode)
+	}
+	switch resp.StatusCode {
+	case http.StatusServiceUnavailable, http.StatusConflict:
+		return fmt.Errorf("%s: %w", res.ErrorMsg, dispatch.ErrUnavailable)
+	}
+	return errors.New(res.ErrorMsg)
+}
+
+// endpoint resolves the path of an endpoint relative to the URL.
+func (w *Client) endpoint(path string) (string, error) {
+	base, err := url.Parse(w.URL)
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(&url.URL{Path: path}).String(), nil
+}
+
+// authenticate signs req, whose body is body, or sets the access token if the
+// client has no signing key.
+func (w *Client) authenticate(req *http.Request, body []byte) error {
+	if w.Signer != nil {
+		return w.Signer.Sign(req, body)
+	}
+	req.Header.Set(w.Header, w.Token)
+	return nil
+}
+
+// httpClient returns the HTTP client used to reach the worker.
+func (w *Client) httpClient() *http.Client {
+	if w.HTTPClient != nil {
+		return w.HTTPClient
+	}
+	return http.DefaultClient
+}
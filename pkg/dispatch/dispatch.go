@@ -39,7 +39,9 @@ package dispatch
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
+	"os"
 	"time"
 
 	"cloud.google.com/go/pubsub"
@@ -55,6 +57,11 @@ type Dispatcher struct {
 
 	sub     *pubsub.Subscription
 	resultc *pubsub.Topic
+
+	statsInterval time.Duration
+
+	batchSize int
+	batchWait time.Duration
 }
 
 // Options is used to configure a Dispatcher
@@ -70,6 +77,19 @@ type Options struct {
 	// ResultTopicID is the Pub/Sub topic ID used by the dispatcher to publish
 	// results..
 	ResultTopicID string
+
+	// StatsInterval is how often worker statistics are published when the
+	// WorkerClient is a StatsReporter. It defaults to one minute.
+	StatsInterval time.Duration
+
+	// BatchSize is the maximum number of tasks submitted to the worker at
+	// once when the WorkerClient is a BatchSubmitter. Tasks are submitted
+	// one at a time if it is less than two.
+	BatchSize int
+
+	// BatchWait is how long a task waits for a batch to fill before the
+	// batch is submitted anyway. It defaults to one second.
+	BatchWait time.Duration
 }
 
 // NewDispatcher creates a dispatcher based on the provided options and worker.
@@ -82,42 +102,181 @@ func NewDispatcher(ctx context.Context, opts Options, wc WorkerClient) (*Dispatc
 	sub := client.Subscription(opts.SubscriptionID)
 	sub.ReceiveSettings.Synchronous = true
 	sub.ReceiveSettings.MaxOutstandingMessages = 10
+	if 2*opts.BatchSize > sub.ReceiveSettings.MaxOutstandingMessages {
+		// allow a batch to fill while the previous one is submitted
+		sub.ReceiveSettings.MaxOutstandingMessages = 2 * opts.BatchSize
+	}
+
+	interval := opts.StatsInterval
+	if interval == 0 {
+		interval = time.Minute
+	}
+	wait := opts.BatchWait
+	if wait == 0 {
+		wait = time.Second
+	}
 
 	return &Dispatcher{
-		wc:      wc,
-		sub:     sub,
-		resultc: client.Topic(opts.ResultTopicID),
+		wc:            wc,
+		sub:           sub,
+		resultc:       client.Topic(opts.ResultTopicID),
+		statsInterval: interval,
+		batchSize:     opts.BatchSize,
+		batchWait:     wait,
 	}, nil
 }
 
 // Listen listens for task messages on the Pub/Sub subscription. Tasks are sent
-// to the worker and results are then published to the Pub/Sub topic.
+// to the worker and results are then published to the Pub/Sub topic. Tasks are
+// redelivered if the worker client returns ErrUnavailable. Worker statistics
+// are published while listening if the worker client is a StatsReporter.
 func (d *Dispatcher) Listen(ctx context.Context) error {
-	return d.sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
-		// always ACK messages to avoid infinite loop handling a bad message
-		defer msg.Ack()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if sr, ok := d.wc.(StatsReporter); ok {
+		go d.reportStats(ctx, sr)
+	}
 
-		var req event.AuthRequest
-		err := json.Unmarshal(msg.Data, &req)
-		if err != nil {
-			log.Printf("error unmarshaling: %s", err)
+	if bs, ok := d.wc.(BatchSubmitter); ok && d.batchSize > 1 {
+		tasks := make(chan task)
+		go d.batch(ctx, bs, tasks)
+		return d.sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+			req, ok := decode(msg)
+			if !ok {
+				return
+			}
+			select {
+			case tasks <- task{msg: msg, req: req}:
+			case <-ctx.Done():
+				msg.Nack()
+			}
+		})
+	}
+
+	return d.sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		req, ok := decode(msg)
+		if !ok {
 			return
 		}
+		resp, err := d.wc.Submit(req)
+		d.finish(ctx, msg, resp, err)
+	})
+}
+
+// task is a task waiting to be submitted in a batch.
+type task struct {
+	msg *pubsub.Message
+	req event.AuthRequest
+}
 
-		ts := time.Now()
-		if ts.After(req.NotAfter) {
+// batch collects tasks into batches, which are submitted once they are full
+// or the oldest task has waited for the batch wait time. Tasks which have not
+// been submitted when the context is done are redelivered.
+func (d *Dispatcher) batch(ctx context.Context, bs BatchSubmitter, tasks <-chan task) {
+	var pending []task
+	var flush <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			for _, t := range pending {
+				t.msg.Nack()
+			}
 			return
+		case t := <-tasks:
+			pending = append(pending, t)
+			if len(pending) == 1 {
+				flush = time.After(d.batchWait)
+			}
+			if len(pending) < d.batchSize {
+				continue
+			}
+		case <-flush:
 		}
 
-		resp, err := d.wc.Submit(req)
-		if err != nil {
-			log.Printf("error from worker: %s", err)
+		go d.submitBatch(ctx, bs, pending)
+		pending, flush = nil, nil
+	}
+}
+
+// submitBatch submits a batch of tasks and handles the result of each.
+func (d *Dispatcher) submitBatch(ctx context.Context, bs BatchSubmitter, tasks []task) {
+	reqs := make([]event.AuthRequest, len(tasks))
+	for i, t := range tasks {
+		reqs[i] = t.req
+	}
+	results := bs.SubmitBatch(reqs)
+	for i, t := range tasks {
+		d.finish(ctx, t.msg, results[i].Response, results[i].Err)
+	}
+}
+
+// decode unmarshals the task in a message. Malformed and expired tasks are
+// acknowledged and not returned.
+func decode(msg *pubsub.Message) (event.AuthRequest, bool) {
+	var req event.AuthRequest
+	err := json.Unmarshal(msg.Data, &req)
+	if err != nil {
+		// ACK bad messages to avoid an infinite loop handling them
+		msg.Ack()
+		log.Printf("error unmarshaling: %s", err)
+		return req, false
+	}
+
+	ts := time.Now()
+	if ts.After(req.NotAfter) {
+		msg.Ack()
+		return req, false
+	}
+	return req, true
+}
+
+// finish acknowledges a task's message and publishes its result, or
+// redelivers the task if it was not attempted.
+func (d *Dispatcher) finish(ctx context.Context, msg *pubsub.Message, resp *event.AuthResponse, err error) {
+	if errors.Is(err, ErrUnavailable) {
+		// no worker could take the task, so it was not attempted. NACK
+		// it to be redelivered until a worker is available or the task
+		// expires.
+		msg.Nack()
+		log.Printf("task redelivered: %s", err)
+		return
+	}
+	msg.Ack()
+	if err != nil {
+		log.Printf("error from worker: %s", err)
+		return
+	}
+
+	b, _ := json.Marshal(resp)
+	d.resultc.Publish(ctx, &pubsub.Message{
+		Data: b,
+	})
+}
+
+// reportStats publishes the worker statistics to the Pub/Sub topic each
+// interval until the context is done. The messages are marked with the
+// event.MessageTypeAttribute so they are not mistaken for results.
+func (d *Dispatcher) reportStats(ctx context.Context, sr StatsReporter) {
+	hostname, _ := os.Hostname()
+
+	ticker := time.NewTicker(d.statsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
 			return
+		case <-ticker.C:
 		}
 
-		b, _ := json.Marshal(resp)
+		b, _ := json.Marshal(event.WorkerStatsReport{
+			Dispatcher: hostname,
+			Timestamp:  time.Now(),
+			Workers:    sr.Stats(),
+		})
 		d.resultc.Publish(ctx, &pubsub.Message{
-			Data: b,
+			Data:       b,
+			Attributes: map[string]string{event.MessageTypeAttribute: event.MessageTypeWorkerStats},
 		})
-	})
+	}
 }
@@ -0,0 +1,164 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dispatch_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+
+	"github.com/praetorian-inc/trident/pkg/dispatch"
+	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+	"github.com/praetorian-inc/trident/pkg/worker/webhook"
+
+	_ "github.com/praetorian-inc/trident/pkg/dispatch/clients/webhook"
+)
+
+type testDriver struct{}
+
+func (testDriver) New(opts map[string]string) (nozzle.Nozzle, error) {
+	return testDriver{}, nil
+}
+
+func (testDriver) Login(username, password string) (*event.AuthResponse, error) {
+	return &event.AuthResponse{Valid: password == "Password1!"}, nil
+}
+
+func init() {
+	nozzle.Register("dispatch-test", testDriver{})
+}
+
+// TestDisabledWorker checks that tasks refused by a disabled worker are
+// redelivered rather than lost, and are performed once it is enabled.
+func TestDisabledWorker(t *testing.T) {
+	srv := pstest.NewServer()
+	defer srv.Close()                           // nolint:errcheck
+	os.Setenv("PUBSUB_EMULATOR_HOST", srv.Addr) // nolint:errcheck,gosec
+	defer os.Unsetenv("PUBSUB_EMULATOR_HOST")   // nolint:errcheck
+
+	for _, batchSize := range []int{1, 4} {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		client, err := pubsub.NewClient(ctx, "trident-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		suffix := fmt.Sprintf("-%d", batchSize)
+		tasks, err := client.CreateTopic(ctx, "tasks"+suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.CreateSubscription(ctx, "tasks-sub"+suffix, pubsub.SubscriptionConfig{Topic: tasks})
+		if err != nil {
+			t.Fatal(err)
+		}
+		results, err := client.CreateTopic(ctx, "results"+suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resultSub, err := client.CreateSubscription(ctx, "results-sub"+suffix, pubsub.SubscriptionConfig{Topic: results})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// a disabled worker which counts the requests it refuses
+		s := &webhook.Server{Name: "worker-a"}
+		s.SetState(event.WorkerStateDisabled)
+		var refused int32
+		mux := http.NewServeMux()
+		mux.HandleFunc("/", s.EventHandler)
+		mux.HandleFunc("/batch", s.BatchHandler)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if s.State() == event.WorkerStateDisabled {
+				atomic.AddInt32(&refused, 1)
+			}
+			mux.ServeHTTP(w, r)
+		}))
+
+		wc, err := dispatch.Open("webhook", map[string]string{"url": ts.URL + "/", "token": "s3cret"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := dispatch.NewDispatcher(ctx, dispatch.Options{
+			ProjectID:      "trident-test",
+			SubscriptionID: "tasks-sub" + suffix,
+			ResultTopicID:  "results" + suffix,
+			BatchSize:      batchSize,
+			BatchWait:      10 * time.Millisecond,
+		}, wc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go d.Listen(ctx) // nolint:errcheck
+
+		const n = 3
+		for i := 0; i < n; i++ {
+			b, _ := json.Marshal(event.AuthRequest{
+				Username: fmt.Sprintf("user%d", i),
+				Password: "Password1!",
+				Provider: "dispatch-test",
+				NotAfter: time.Now().Add(time.Hour),
+			})
+			if _, err := tasks.Publish(ctx, &pubsub.Message{Data: b}).Get(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// the tasks are redelivered while the worker is disabled
+		for atomic.LoadInt32(&refused) <= n && ctx.Err() == nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+		s.SetState(event.WorkerStateActive)
+
+		var mu sync.Mutex
+		received := make(map[string]bool)
+		rctx, rcancel := context.WithCancel(ctx)
+		err = resultSub.Receive(rctx, func(_ context.Context, msg *pubsub.Message) {
+			msg.Ack()
+			var res event.AuthResponse
+			if err := json.Unmarshal(msg.Data, &res); err != nil {
+				t.Errorf("[batch size %d] error decoding result: %s", batchSize, err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			received[res.Username] = res.Valid
+			if len(received) == n {
+				rcancel()
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(received) != n {
+			t.Errorf("[batch size %d] received %d of %d results after %d refusals",
+				batchSize, len(received), n, atomic.LoadInt32(&refused))
+		}
+
+		rcancel()
+		cancel()
+		ts.Close()
+		client.Close() // nolint:errcheck,gosec
+	}
+}
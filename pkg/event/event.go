@@ -18,11 +18,38 @@ import (
 	"time"
 )
 
+const (
+	// TaskTypeSpray is a credential guess and is the default task type
+	TaskTypeSpray = "spray"
+
+	// TaskTypeEnumeration checks whether a username exists without guessing a
+	// password
+	TaskTypeEnumeration = "enumeration"
+)
+
+// UserStatus indicates whether a username exists at the identity provider.
+type UserStatus string
+
+const (
+	// UserStatusUnknown means the provider did not reveal whether the user exists
+	UserStatusUnknown UserStatus = "unknown"
+
+	// UserStatusExists means the user is known to exist
+	UserStatusExists UserStatus = "exists"
+
+	// UserStatusNotExists means the user is known to not exist
+	UserStatusNotExists UserStatus = "not_exists"
+)
+
 // AuthRequest defines a single authentication attempt task.
 type AuthRequest struct {
 	// CampaignID is used to track the results of the task
 	CampaignID uint `json:"campaign_id"`
 
+	// Type is the kind of task (TaskTypeSpray or TaskTypeEnumeration). An empty
+	// value is treated as TaskTypeSpray.
+	Type string `json:"type,omitempty"`
+
 	// NotBefore will prevent execution until this time
 	NotBefore time.Time `json:"not_before"`
 
@@ -40,6 +67,23 @@ type AuthRequest struct {
 
 	// ProviderMetadata is any required configuration data for the provider
 	ProviderMetadata map[string]string `json:"metadata"`
+
+	// Workers pins the task to the named workers. Any worker may perform the
+	// task if it is empty.
+	Workers []string `json:"workers,omitempty"`
+}
+
+// Allows returns whether the task may be performed by the named worker.
+func (r *AuthRequest) Allows(worker string) bool {
+	if len(r.Workers) == 0 {
+		return true
+	}
+	for _, w := range r.Workers {
+		if w == worker {
+			return true
+		}
+	}
+	return false
 }
 
 // AuthResponse represents the response to an authentication attempt.
@@ -71,8 +115,167 @@ type AuthResponse struct {
 	// RateLimited indicates the provider has detected a large number of requests
 	RateLimited bool `json:"rate_limited"`
 
+	// UserStatus indicates whether the user exists. It is always set for
+	// enumeration tasks and is set for credential guesses when the provider's
+	// response reveals it.
+	UserStatus UserStatus `json:"user_status,omitempty"`
+
 	// Additional metadata from the auth provider (e.g. information about MFA)
 	Metadata map[string]interface{} `json:"metadata"`
+
+	// Artifacts are the session artifacts issued for a valid credential. They
+	// are encrypted at rest and never returned with ordinary results.
+	Artifacts *Artifacts `json:"artifacts,omitempty"`
+}
+
+// MFAPosture indicates whether the identity provider enforces MFA for a user.
+type MFAPosture string
+
+const (
+	// MFAPostureUnknown means the login did not reveal whether MFA is enforced
+	MFAPostureUnknown MFAPosture = ""
+
+	// MFAPostureEnforced means the provider required an additional factor (or
+	// factor enrollment) to complete the login
+	MFAPostureEnforced MFAPosture = "enforced"
+
+	// MFAPostureNotEnforced means the provider issued a session for the
+	// password alone
+	MFAPostureNotEnforced MFAPosture = "not_enforced"
+)
+
+// Artifacts are the session artifacts captured after a successful primary
+// authentication.
+type Artifacts struct {
+	// Tokens are the tokens issued by the provider keyed by their name in the
+	// provider's response (e.g. access_token, refresh_token, sessionToken)
+	Tokens map[string]string `json:"tokens,omitempty"`
+
+	// Cookies are the session cookies set by the provider
+	Cookies []Cookie `json:"cookies,omitempty"`
+
+	// Factors are the MFA factors the user has enrolled
+	Factors []Factor `json:"factors,omitempty"`
+
+	// MFA is whether the provider enforces MFA for the user
+	MFA MFAPosture `json:"mfa,omitempty"`
+}
+
+// Cookie is a session cookie set by an identity provider.
+type Cookie struct {
+	Name    string    `json:"name"`
+	Value   string    `json:"value"`
+	Domain  string    `json:"domain,omitempty"`
+	Path    string    `json:"path,omitempty"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// Factor is an MFA factor enrolled by a user.
+type Factor struct {
+	// Type is the provider's name for the factor type, e.g. push or
+	// token:software:totp
+	Type string `json:"type"`
+
+	// Provider is the factor provider, e.g. OKTA or GOOGLE
+	Provider string `json:"provider,omitempty"`
+}
+
+// MessageTypeAttribute is the Pub/Sub message attribute which identifies
+// messages on the result topic which are not an AuthResponse.
+const MessageTypeAttribute = "type"
+
+// MessageTypeWorkerStats identifies a WorkerStatsReport on the result topic.
+const MessageTypeWorkerStats = "worker_stats"
+
+// WorkerStatsReport is published by a dispatcher to report the statistics of
+// its workers to the orchestrator.
+type WorkerStatsReport struct {
+	// Dispatcher identifies the dispatcher (its hostname)
+	Dispatcher string `json:"dispatcher"`
+
+	// Timestamp is when the statistics were collected
+	Timestamp time.Time `json:"timestamp"`
+
+	// Workers are the statistics of each worker
+	Workers []WorkerStats `json:"workers"`
+}
+
+// WorkerStats are the statistics a dispatcher keeps for one of its workers.
+// The counts are totals since the dispatcher started.
+type WorkerStats struct {
+	// Worker is the name of the worker
+	Worker string `json:"worker"`
+
+	// Healthy is whether the worker passed its last health check
+	Healthy bool `json:"healthy"`
+
+	// Ejected is whether the worker is left out after repeated failures
+	Ejected bool `json:"ejected"`
+
+	// Submitted is the number of tasks sent to the worker
+	Submitted int64 `json:"submitted"`
+
+	// Succeeded is the number of tasks the worker completed
+	Succeeded int64 `json:"succeeded"`
+
+	// Errors is the number of tasks which failed with an error
+	Errors int64 `json:"errors"`
+
+	// RateLimited is the number of tasks which were rate limited, which
+	// usually means the worker's egress IP is blocked
+	RateLimited int64 `json:"rate_limited"`
+
+	// Ejections is the number of times the worker was ejected
+	Ejections int64 `json:"ejections"`
+
+	// LastError is the most recent error
+	LastError string `json:"last_error,omitempty"`
+}
+
+// WorkerState is the operator controlled state of a registered worker.
+type WorkerState string
+
+const (
+	// WorkerStateActive workers perform tasks
+	WorkerStateActive WorkerState = "active"
+
+	// WorkerStateDraining workers fail their health checks so they are no
+	// longer chosen for new tasks, but still perform tasks they are sent
+	WorkerStateDraining WorkerState = "draining"
+
+	// WorkerStateDisabled workers fail their health checks and refuse tasks
+	WorkerStateDisabled WorkerState = "disabled"
+)
+
+// WorkerHeartbeat is periodically sent by a worker to register itself with
+// the orchestrator.
+type WorkerHeartbeat struct {
+	// Name uniquely identifies the worker
+	Name string `json:"name"`
+
+	// Kind is the kind of worker (e.g. webhook)
+	Kind string `json:"kind"`
+
+	// URL is where dispatchers reach the worker, if it is known
+	URL string `json:"url,omitempty"`
+
+	// Version is the version of the worker
+	Version string `json:"version"`
+
+	// Nozzles are the nozzles the worker supports
+	Nozzles []string `json:"nozzles"`
+
+	// IP is the egress IP of the worker's credential guesses
+	IP string `json:"ip"`
+
+	// Load is the number of tasks the worker is performing
+	Load int `json:"load"`
+}
+
+// WorkerHeartbeatResponse is the orchestrator's response to a heartbeat.
+type WorkerHeartbeatResponse struct {
+	// State is the state the operator has set for the worker
+	State WorkerState `json:"state"`
 }
 
 // ErrorResponse represents a failure in task processing. This response should
@@ -81,3 +284,18 @@ type ErrorResponse struct {
 	// ErrorMsg is the result of error.Error()
 	ErrorMsg string `json:"error"`
 }
+
+// BatchResult is the outcome of one task of a batch submitted to a worker,
+// which responds with a BatchResult for each task in the order they were
+// submitted. Either Response or Error is set.
+type BatchResult struct {
+	// Response is the result of the task
+	Response *AuthResponse `json:"response,omitempty"`
+
+	// Error is set if the task failed or was not performed
+	Error string `json:"error,omitempty"`
+
+	// Skipped is set if the task was not performed (e.g. the batch timed
+	// out before it was due), so it may be redelivered
+	Skipped bool `json:"skipped,omitempty"`
+}
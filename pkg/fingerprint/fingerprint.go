@@ -0,0 +1,272 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fingerprint provides a library of realistic browser header profiles
+// used by nozzles to avoid sending a single, easily signatured User-Agent.
+// Profiles are selected per campaign through the nozzle's ProviderMetadata:
+//
+//	profiles:     comma separated list of profile names (defaults to all)
+//	profile-mode: "sticky" (default) picks one profile per username,
+//	              "random" picks a new profile for every request.
+//
+// Clients whose transport is configured with OrderHeaders also write headers in
+// the order the profile's browser does, rather than net/http's sorted order.
+package fingerprint
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Profile is a set of headers that a specific browser sends with each request.
+type Profile struct {
+	// Name is used to select the profile from campaign configuration
+	Name string
+
+	// UserAgent is the value of the User-Agent header
+	UserAgent string
+
+	// Accept is sent with page loads and form posts when the nozzle has not
+	// set its own Accept header
+	Accept string
+
+	// AcceptLanguage is the value of the Accept-Language header
+	AcceptLanguage string
+
+	// SecCHUA, SecCHUAMobile, and SecCHUAPlatform are the UA client hints sent
+	// by Chromium based browsers. They are empty for other browsers.
+	SecCHUA         string
+	SecCHUAMobile   string
+	SecCHUAPlatform string
+
+	// Order is the order in which the browser writes its request headers.
+	// It is honored by transports configured with OrderHeaders.
+	Order []string
+}
+
+// Apply sets the profile's headers on req. Headers which the nozzle has
+// already set (e.g. Accept for a JSON API) are left untouched. The profile's
+// Accept header is only sent with requests a browser would make by navigating,
+// those without a body or with a form body. Other requests, such as SOAP or
+// JSON APIs, are sent the */* a browser script sends by default.
+func (p *Profile) Apply(req *http.Request) {
+	accept := acceptAny
+	if navigation(req) {
+		accept = p.Accept
+	}
+
+	headers := [][2]string{
+		{"User-Agent", p.UserAgent},
+		{"Accept", accept},
+		{"Accept-Language", p.AcceptLanguage},
+		{"sec-ch-ua", p.SecCHUA},
+		{"sec-ch-ua-mobile", p.SecCHUAMobile},
+		{"sec-ch-ua-platform", p.SecCHUAPlatform},
+	}
+	for _, h := range headers {
+		if h[1] == "" || req.Header.Get(h[0]) != "" {
+			continue
+		}
+		// client hint headers are lowercase on the wire, so avoid
+		// canonicalizing them via Header.Set
+		if strings.HasPrefix(h[0], "sec-") {
+			req.Header[h[0]] = []string{h[1]}
+			continue
+		}
+		req.Header.Set(h[0], h[1])
+	}
+}
+
+// navigation reports whether req is a page load or form post.
+func navigation(req *http.Request) bool {
+	contentType := req.Header.Get("Content-Type")
+	if contentType == "" {
+		return req.Body == nil || req.Body == http.NoBody
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "application/x-www-form-urlencoded" || mediaType == "multipart/form-data"
+}
+
+const (
+	acceptHTML = "text/html,application/xhtml+xml,application/xml;q=0.9," +
+		"image/avif,image/webp,image/apng,*/*;q=0.8"
+	acceptAny = "*/*"
+)
+
+// Header orders of HTTP/1.1 requests, including headers set by nozzles and
+// net/http
+var (
+	chromiumOrder = []string{
+		"Host", "Connection", "Content-Length", "Cache-Control",
+		"sec-ch-ua", "sec-ch-ua-mobile", "sec-ch-ua-platform",
+		"Upgrade-Insecure-Requests", "Origin", "Content-Type", "User-Agent",
+		"Accept", "Sec-Fetch-Site", "Sec-Fetch-Mode", "Sec-Fetch-User",
+		"Sec-Fetch-Dest", "Referer", "Accept-Encoding", "Accept-Language",
+		"Cookie",
+	}
+	firefoxOrder = []string{
+		"Host", "User-Agent", "Accept", "Accept-Language", "Accept-Encoding",
+		"Content-Type", "Content-Length", "Origin", "Connection", "Referer",
+		"Cookie", "Upgrade-Insecure-Requests", "Sec-Fetch-Dest",
+		"Sec-Fetch-Mode", "Sec-Fetch-Site", "Sec-Fetch-User",
+	}
+	safariOrder = []string{
+		"Host", "Content-Type", "Origin", "Accept", "User-Agent", "Referer",
+		"Content-Length", "Accept-Language", "Accept-Encoding", "Connection",
+		"Cookie",
+	}
+)
+
+// Profiles is the library of known browser profiles, keyed by name.
+var Profiles = map[string]*Profile{
+	"chrome-windows": {
+		Name: "chrome-windows",
+		UserAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 " +
+			"(KHTML, like Gecko) Chrome/118.0.0.0 Safari/537.36",
+		Accept:          acceptHTML,
+		AcceptLanguage:  "en-US,en;q=0.9",
+		SecCHUA:         `"Chromium";v="118", "Google Chrome";v="118", "Not=A?Brand";v="99"`,
+		SecCHUAMobile:   "?0",
+		SecCHUAPlatform: `"Windows"`,
+		Order:           chromiumOrder,
+	},
+	"chrome-macos": {
+		Name: "chrome-macos",
+		UserAgent: "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 " +
+			"(KHTML, like Gecko) Chrome/118.0.0.0 Safari/537.36",
+		Accept:          acceptHTML,
+		AcceptLanguage:  "en-US,en;q=0.9",
+		SecCHUA:         `"Chromium";v="118", "Google Chrome";v="118", "Not=A?Brand";v="99"`,
+		SecCHUAMobile:   "?0",
+		SecCHUAPlatform: `"macOS"`,
+		Order:           chromiumOrder,
+	},
+	"edge-windows": {
+		Name: "edge-windows",
+		UserAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 " +
+			"(KHTML, like Gecko) Chrome/118.0.0.0 Safari/537.36 Edg/118.0.2088.46",
+		Accept:          acceptHTML,
+		AcceptLanguage:  "en-US,en;q=0.9",
+		SecCHUA:         `"Chromium";v="118", "Microsoft Edge";v="118", "Not=A?Brand";v="99"`,
+		SecCHUAMobile:   "?0",
+		SecCHUAPlatform: `"Windows"`,
+		Order:           chromiumOrder,
+	},
+	"firefox-windows": {
+		Name:           "firefox-windows",
+		UserAgent:      "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:109.0) Gecko/20100101 Firefox/118.0",
+		Accept:         "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8",
+		AcceptLanguage: "en-US,en;q=0.5",
+		Order:          firefoxOrder,
+	},
+	"safari-macos": {
+		Name: "safari-macos",
+		UserAgent: "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 " +
+			"(KHTML, like Gecko) Version/17.0 Safari/605.1.15",
+		Accept:         "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+		AcceptLanguage: "en-US,en;q=0.9",
+		Order:          safariOrder,
+	},
+}
+
+// Mode controls how a Selector chooses a profile for each request.
+type Mode string
+
+const (
+	// ModeSticky always uses the same profile for a given username
+	ModeSticky Mode = "sticky"
+
+	// ModeRandom chooses a new profile for every request
+	ModeRandom Mode = "random"
+)
+
+// Selector chooses a Profile for each request according to its Mode.
+type Selector struct {
+	profiles []*Profile
+	mode     Mode
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+// NewSelector creates a Selector from nozzle configuration options. The
+// "profiles" option is a comma separated list of profile names and defaults to
+// every known profile. The "profile-mode" option is either sticky (default) or
+// random.
+func NewSelector(opts map[string]string) (*Selector, error) {
+	var names []string
+	if v, ok := opts["profiles"]; ok && v != "" {
+		for _, name := range strings.Split(v, ",") {
+			names = append(names, strings.TrimSpace(name))
+		}
+	} else {
+		for name := range Profiles {
+			names = append(names, name)
+		}
+		// map iteration is random, but sticky selection must be stable
+		sort.Strings(names)
+	}
+
+	var profiles []*Profile
+	for _, name := range names {
+		p, ok := Profiles[name]
+		if !ok {
+			return nil, fmt.Errorf("fingerprint: unknown profile %q", name)
+		}
+		profiles = append(profiles, p)
+	}
+
+	mode := ModeSticky
+	if v, ok := opts["profile-mode"]; ok && v != "" {
+		mode = Mode(v)
+	}
+	if mode != ModeSticky && mode != ModeRandom {
+		return nil, fmt.Errorf("fingerprint: unknown profile mode %q", mode)
+	}
+
+	return &Selector{
+		profiles: profiles,
+		mode:     mode,
+		rnd:      rand.New(rand.NewSource(time.Now().UnixNano())), // nolint:gosec
+	}, nil
+}
+
+// Pick returns the profile to use for a request on behalf of username.
+func (s *Selector) Pick(username string) *Profile {
+	if len(s.profiles) == 1 {
+		return s.profiles[0]
+	}
+
+	if s.mode == ModeRandom {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.profiles[s.rnd.Intn(len(s.profiles))]
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(username))) // nolint:errcheck,gosec
+	return s.profiles[h.Sum32()%uint32(len(s.profiles))]
+}
+
+// Apply picks a profile for username and sets its headers on req.
+func (s *Selector) Apply(req *http.Request, username string) {
+	s.Pick(username).Apply(req)
+}
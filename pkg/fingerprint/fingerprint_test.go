@@ -0,0 +1,137 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fingerprint
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNewSelector(t *testing.T) {
+	var testcases = []struct {
+		opts      map[string]string
+		expecterr bool
+	}{
+		{map[string]string{}, false},
+		{map[string]string{"profiles": "chrome-windows, firefox-windows"}, false},
+		{map[string]string{"profile-mode": "random"}, false},
+		{map[string]string{"profiles": "netscape"}, true},
+		{map[string]string{"profile-mode": "roundrobin"}, true},
+	}
+	for _, test := range testcases {
+		_, err := NewSelector(test.opts)
+		if test.expecterr && err == nil {
+			t.Errorf("expected error for %v", test.opts)
+		}
+		if !test.expecterr && err != nil {
+			t.Errorf("unexpected error for %v: %s", test.opts, err)
+		}
+	}
+}
+
+func TestStickySelection(t *testing.T) {
+	s, err := NewSelector(map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := []string{"alice@example.org", "bob@example.org", "eve@example.org"}
+	for _, u := range users {
+		p := s.Pick(u)
+		for i := 0; i < 10; i++ {
+			if s.Pick(u) != p {
+				t.Errorf("sticky selection for %s changed profiles", u)
+			}
+		}
+	}
+}
+
+func TestRandomSelection(t *testing.T) {
+	s, err := NewSelector(map[string]string{"profile-mode": "random"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every profile is eventually picked for the same username
+	picked := make(map[string]bool)
+	for i := 0; i < 1000 && len(picked) < len(Profiles); i++ {
+		picked[s.Pick("alice@example.org").Name] = true
+	}
+	if len(picked) != len(Profiles) {
+		t.Errorf("random selection picked %d of %d profiles", len(picked), len(Profiles))
+	}
+
+	// a single profile is always picked
+	s, err = NewSelector(map[string]string{"profiles": "safari-macos", "profile-mode": "random"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if p := s.Pick("alice@example.org"); p.Name != "safari-macos" {
+			t.Errorf("random selection picked %s from a single profile", p.Name)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	req, _ := http.NewRequest("POST", "https://example.org", nil)
+	req.Header.Set("Accept", "application/json")
+
+	p := Profiles["chrome-windows"]
+	p.Apply(req)
+
+	if req.Header.Get("User-Agent") != p.UserAgent {
+		t.Errorf("User-Agent was %q, expected %q", req.Header.Get("User-Agent"), p.UserAgent)
+	}
+	if req.Header.Get("Accept") != "application/json" {
+		t.Errorf("Apply overwrote the nozzle's Accept header")
+	}
+	if v := req.Header["sec-ch-ua"]; len(v) != 1 || v[0] != p.SecCHUA {
+		t.Errorf("sec-ch-ua was %v, expected %q", v, p.SecCHUA)
+	}
+}
+
+func TestApplyAccept(t *testing.T) {
+	p := Profiles["firefox-windows"]
+
+	var testcases = []struct {
+		desc        string
+		method      string
+		contentType string
+		body        string
+		expected    string
+	}{
+		{"page load", "GET", "", "", p.Accept},
+		{"form post", "POST", "application/x-www-form-urlencoded", "UserName=alice", p.Accept},
+		{"multipart form post", "POST", "multipart/form-data; boundary=x", "--x--", p.Accept},
+		{"json api", "POST", "application/json", "{}", "*/*"},
+		{"soap api", "POST", "application/soap+xml; charset=utf-8", "<s:Envelope/>", "*/*"},
+		{"amazon json api", "POST", "application/x-amz-json-1.1", "{}", "*/*"},
+	}
+	for _, test := range testcases {
+		req, _ := http.NewRequest(test.method, "https://example.org", strings.NewReader(test.body))
+		if test.body == "" {
+			req, _ = http.NewRequest(test.method, "https://example.org", nil)
+		}
+		if test.contentType != "" {
+			req.Header.Set("Content-Type", test.contentType)
+		}
+		p.Apply(req)
+		if v := req.Header.Get("Accept"); v != test.expected {
+			t.Errorf("[%s] Accept was %q, expected %q", test.desc, v, test.expected)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fingerprint
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OrderHeaders configures t to write the headers of every request carrying a
+// profile's User-Agent in that profile's Order, rather than the sorted order
+// net/http uses. Requests are rewritten as they are written to the connection,
+// so HTTPS requests sent through a proxy, which t encrypts itself, are written
+// in sorted order.
+func OrderHeaders(t *http.Transport) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &orderedConn{Conn: conn}, nil
+	}
+
+	t.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		config := &tls.Config{}
+		if t.TLSClientConfig != nil {
+			config = t.TLSClientConfig.Clone()
+		}
+		if config.ServerName == "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				host = addr
+			}
+			config.ServerName = host
+		}
+
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline) // nolint:errcheck,gosec
+		}
+		tconn := tls.Client(conn, config)
+		if err = tconn.Handshake(); err != nil {
+			conn.Close() // nolint:errcheck,gosec
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{}) // nolint:errcheck,gosec
+		return &orderedConn{Conn: tconn}, nil
+	}
+	return t
+}
+
+// orderedConn rewrites the head of each HTTP/1.1 request written to it so its
+// header fields are in the order of the profile whose User-Agent it carries.
+// It follows the request bodies to find where each head starts.
+type orderedConn struct {
+	net.Conn
+
+	// head is the part of a request head which has been written so far
+	head []byte
+
+	// body is the number of bytes left in a fixed length request body
+	body int64
+
+	// chunks tracks a chunked request body, and is nil otherwise
+	chunks *chunks
+
+	// tunnel is set once the connection stops carrying HTTP requests, e.g.
+	// after a CONNECT request
+	tunnel bool
+}
+
+func (c *orderedConn) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		var k int
+		switch {
+		case c.tunnel:
+			k = len(p)
+		case c.body > 0:
+			k = len(p)
+			if int64(k) > c.body {
+				k = int(c.body)
+			}
+			c.body -= int64(k)
+		case c.chunks != nil:
+			var done bool
+			var err error
+			k, done, err = c.chunks.scan(p)
+			if err != nil {
+				return 0, err
+			}
+			if done {
+				c.chunks = nil
+			}
+		default:
+			// anything but a request line, such as a TLS handshake through
+			// a proxy, is passed through untouched
+			if len(c.head) == 0 && (p[0] < 'A' || p[0] > 'Z') {
+				c.tunnel = true
+				continue
+			}
+
+			c.head = append(c.head, p...)
+			i := bytes.Index(c.head, []byte("\r\n\r\n"))
+			if i < 0 {
+				return n, nil
+			}
+			head, rest := c.head[:i+4], c.head[i+4:]
+			c.head = nil
+
+			method, fields := parseHead(head)
+			if err := c.follow(method, fields); err != nil {
+				return 0, err
+			}
+			if _, err := c.Conn.Write(writeHead(head, reorder(fields))); err != nil {
+				return 0, err
+			}
+			p = rest
+			continue
+		}
+
+		if _, err := c.Conn.Write(p[:k]); err != nil {
+			return 0, err
+		}
+		p = p[k:]
+	}
+	return n, nil
+}
+
+// follow sets up the connection to pass through the body of the request with
+// the given method and header fields.
+func (c *orderedConn) follow(method string, fields []string) error {
+	if method == http.MethodConnect {
+		c.tunnel = true
+		return nil
+	}
+	if strings.EqualFold(fieldValue(fields, "Transfer-Encoding"), "chunked") {
+		c.chunks = &chunks{}
+		return nil
+	}
+	if v := fieldValue(fields, "Content-Length"); v != "" {
+		length, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || length < 0 {
+			return fmt.Errorf("fingerprint: invalid Content-Length %q", v)
+		}
+		c.body = length
+	}
+	return nil
+}
+
+// chunks follows a chunked request body (RFC 7230 section 4.1) to find its
+// end.
+type chunks struct {
+	// line is the part of a chunk size or trailer line written so far
+	line []byte
+
+	// data is the number of bytes left in the chunk, including its CRLF
+	data int64
+
+	// trailer is set once the last chunk has been written
+	trailer bool
+}
+
+// scan returns how many bytes of p belong to the body and whether the body
+// ends with them.
+func (c *chunks) scan(p []byte) (int, bool, error) {
+	for i := 0; i < len(p); {
+		if c.data > 0 {
+			k := int64(len(p) - i)
+			if k > c.data {
+				k = c.data
+			}
+			c.data -= k
+			i += int(k)
+			continue
+		}
+
+		b := p[i]
+		i++
+		if b != '\n' {
+			c.line = append(c.line, b)
+			continue
+		}
+		line := strings.TrimSuffix(string(c.line), "\r")
+		c.line = c.line[:0]
+
+		if c.trailer {
+			if line == "" {
+				return i, true, nil
+			}
+			continue
+		}
+		if j := strings.IndexByte(line, ';'); j >= 0 {
+			line = line[:j]
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+		if err != nil || size < 0 {
+			return 0, false, fmt.Errorf("fingerprint: invalid chunk size %q", line)
+		}
+		if size == 0 {
+			c.trailer = true
+		} else {
+			c.data = size + 2
+		}
+	}
+	return len(p), false, nil
+}
+
+// parseHead returns the method and header fields of a request head.
+func parseHead(head []byte) (string, []string) {
+	lines := strings.Split(string(head[:len(head)-4]), "\r\n")
+	method := lines[0]
+	if i := strings.IndexByte(method, ' '); i >= 0 {
+		method = method[:i]
+	}
+	return method, lines[1:]
+}
+
+// writeHead returns head with its header fields replaced by fields.
+func writeHead(head []byte, fields []string) []byte {
+	requestLine := head[:bytes.Index(head, []byte("\r\n"))+2]
+
+	var b bytes.Buffer
+	b.Write(requestLine)
+	for _, f := range fields {
+		b.WriteString(f)
+		b.WriteString("\r\n")
+	}
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+// fieldValue returns the value of the named header field.
+func fieldValue(fields []string, name string) string {
+	for _, f := range fields {
+		if i := strings.IndexByte(f, ':'); i >= 0 && strings.EqualFold(f[:i], name) {
+			return strings.TrimSpace(f[i+1:])
+		}
+	}
+	return ""
+}
+
+// reorder sorts the header fields into the Order of the profile whose
+// User-Agent they carry. Fields the profile does not list follow those it
+// does, in their original order. Fields without a known User-Agent are
+// returned unchanged.
+func reorder(fields []string) []string {
+	p := profileFor(fieldValue(fields, "User-Agent"))
+	if p == nil || len(p.Order) == 0 {
+		return fields
+	}
+
+	rank := func(f string) int {
+		if i := strings.IndexByte(f, ':'); i >= 0 {
+			for j, name := range p.Order {
+				if strings.EqualFold(f[:i], name) {
+					return j
+				}
+			}
+		}
+		return len(p.Order)
+	}
+	sorted := append([]string{}, fields...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return rank(sorted[i]) < rank(sorted[j])
+	})
+	return sorted
+}
+
+// profileFor returns the profile with the given User-Agent, or nil.
+func profileFor(userAgent string) *Profile {
+	if userAgent == "" {
+		return nil
+	}
+	for _, p := range Profiles {
+		if p.UserAgent == userAgent {
+			return p
+		}
+	}
+	return nil
+}
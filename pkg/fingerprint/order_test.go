@@ -0,0 +1,202 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fingerprint
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// wireServer records the header names of each request in the order they were
+// written on the wire.
+type wireServer struct {
+	listener net.Listener
+	heads    chan []string
+	conns    int32
+}
+
+func newWireServer(t *testing.T) *wireServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &wireServer{listener: l, heads: make(chan []string, 10)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&s.conns, 1)
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *wireServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	// the client waits for each response, so raw holds a single request
+	var raw bytes.Buffer
+	r := bufio.NewReader(io.TeeReader(conn, &raw))
+	for {
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, req.Body) // nolint:errcheck
+		req.Body.Close()
+
+		var names []string
+		head := raw.String()[:strings.Index(raw.String(), "\r\n\r\n")]
+		for _, line := range strings.Split(head, "\r\n")[1:] {
+			names = append(names, line[:strings.IndexByte(line, ':')])
+		}
+		s.heads <- names
+		raw.Reset()
+
+		if _, err = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")); err != nil {
+			return
+		}
+	}
+}
+
+func TestOrderHeaders(t *testing.T) {
+	s := newWireServer(t)
+	defer s.listener.Close()
+	url := "http://" + s.listener.Addr().String()
+
+	chrome, firefox := Profiles["chrome-windows"], Profiles["firefox-windows"]
+	var testcases = []struct {
+		desc        string
+		profile     *Profile
+		method      string
+		contentType string
+		body        io.Reader
+		expected    []string
+	}{
+		{
+			"chrome form post", chrome, "POST", "application/x-www-form-urlencoded", strings.NewReader("UserName=alice"),
+			[]string{"Host", "Content-Length", "sec-ch-ua", "sec-ch-ua-mobile", "sec-ch-ua-platform", "Content-Type",
+				"User-Agent", "Accept", "Accept-Encoding", "Accept-Language", "X-Test"},
+		},
+		{
+			"firefox page load", firefox, "GET", "", nil,
+			[]string{"Host", "User-Agent", "Accept", "Accept-Language", "Accept-Encoding", "X-Test"},
+		},
+		{
+			// a body of unknown length is sent chunked
+			"chrome chunked post", chrome, "POST", "application/json", ioutil.NopCloser(strings.NewReader(`{"user":"alice"}`)),
+			[]string{"Host", "sec-ch-ua", "sec-ch-ua-mobile", "sec-ch-ua-platform", "Content-Type", "User-Agent",
+				"Accept", "Accept-Encoding", "Accept-Language", "Transfer-Encoding", "X-Test"},
+		},
+		{
+			"unknown user agent", nil, "GET", "", nil,
+			[]string{"Host", "User-Agent", "X-Test", "Accept-Encoding"},
+		},
+	}
+
+	client := &http.Client{Transport: OrderHeaders(&http.Transport{})}
+	for _, test := range testcases {
+		req, _ := http.NewRequest(test.method, url, test.body)
+		req.Header.Set("X-Test", "1")
+		if test.contentType != "" {
+			req.Header.Set("Content-Type", test.contentType)
+		}
+		if test.profile != nil {
+			test.profile.Apply(req)
+		} else {
+			req.Header.Set("User-Agent", "curl/8.4.0")
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("[%s] error sending request: %s", test.desc, err)
+		}
+		resp.Body.Close()
+
+		names := <-s.heads
+		if strings.Join(names, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("[%s] headers were written in order %v, expected %v", test.desc, names, test.expected)
+		}
+	}
+
+	// every request was found on a single kept alive connection
+	if conns := atomic.LoadInt32(&s.conns); conns != 1 {
+		t.Errorf("requests used %d connections, expected 1", conns)
+	}
+}
+
+func TestOrderHeadersTLS(t *testing.T) {
+	p := Profiles["safari-macos"]
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.UserAgent())) // nolint:errcheck
+	}))
+	defer ts.Close()
+
+	// the server's certificate is verified unless verification is disabled
+	var testcases = []struct {
+		insecure  bool
+		expecterr bool
+	}{
+		{false, true},
+		{true, false},
+	}
+	for _, test := range testcases {
+		client := &http.Client{Transport: OrderHeaders(&http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: test.insecure}, // nolint:gosec
+		})}
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		p.Apply(req)
+
+		resp, err := client.Do(req)
+		if test.expecterr {
+			if err == nil {
+				resp.Body.Close()
+				t.Errorf("[insecure %t] expected certificate error", test.insecure)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("[insecure %t] error sending request: %s", test.insecure, err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != p.UserAgent {
+			t.Errorf("[insecure %t] server received User-Agent %q, expected %q", test.insecure, body, p.UserAgent)
+		}
+	}
+}
+
+func TestUniqueUserAgents(t *testing.T) {
+	// OrderHeaders finds the profile of a request by its User-Agent
+	seen := make(map[string]string)
+	for name, p := range Profiles {
+		if other, ok := seen[p.UserAgent]; ok {
+			t.Errorf("profiles %s and %s have the same User-Agent", name, other)
+		}
+		seen[p.UserAgent] = name
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idpsim
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Handler returns the simulator's HTTP handler. It serves:
+//
+//	POST /api/v1/authn                                Okta primary authentication
+//	POST /common/oauth2/token                         Azure AD v1 token endpoint
+//	POST /common/oauth2/v2.0/token                    Azure AD v2 token endpoint
+//	POST /adfs/ls/idpinitiatedsignon                  ADFS forms sign-in
+//	POST /adfs/services/trust/2005/usernamemixed      ADFS WS-Trust
+//	GET  /_sim/report                                 the report, as JSON
+func (s *Simulator) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/authn", s.okta)
+	mux.HandleFunc("/common/oauth2/token", s.o365)
+	mux.HandleFunc("/common/oauth2/v2.0/token", s.o365)
+	mux.HandleFunc("/adfs/ls/idpinitiatedsignon", s.adfsSignon)
+	mux.HandleFunc("/adfs/services/trust/2005/usernamemixed", s.adfsTrust)
+	mux.HandleFunc("/_sim/report", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, 200, s.Report())
+	})
+	return mux
+}
+
+// sourceIP returns the address the request came from.
+func (s *Simulator) sourceIP(r *http.Request) string {
+	if s.TrustForwarded {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			return strings.TrimSpace(strings.Split(fwd, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (s *Simulator) okta(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if r.Method != "POST" || json.NewDecoder(r.Body).Decode(&req) != nil {
+		writeJSON(w, 400, map[string]string{"errorCode": "E0000003", "errorSummary": "The request body was not well-formed."})
+		return
+	}
+
+	status := map[Result]string{
+		ResultValid:           "SUCCESS",
+		ResultMFA:             "MFA_REQUIRED",
+		ResultPasswordExpired: "PASSWORD_EXPIRED",
+		ResultLocked:          "LOCKED_OUT",
+	}
+	switch res := s.Authenticate("okta", s.sourceIP(r), req.Username, req.Password); res {
+	case ResultRateLimited:
+		writeJSON(w, 429, map[string]string{"errorCode": "E0000047", "errorSummary": "API call exceeded rate limit due to too many requests."})
+	case ResultInvalid, ResultUnknownUser:
+		writeJSON(w, 401, map[string]string{"errorCode": "E0000004", "errorSummary": "Authentication failed"})
+	default:
+		writeJSON(w, 200, map[string]string{"status": status[res]})
+	}
+}
+
+func (s *Simulator) o365(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.PostFormValue("grant_type") != "password" {
+		writeJSON(w, 400, map[string]string{
+			"error":             "invalid_request",
+			"error_description": "AADSTS900144: The request body must contain the following parameter: 'grant_type'.",
+		})
+		return
+	}
+
+	codes := map[Result]string{
+		ResultInvalid:         "AADSTS50126: Error validating credentials due to invalid username or password.",
+		ResultMFA:             "AADSTS50076: Due to a configuration change made by your administrator, or because you moved to a new location, you must use multi-factor authentication to access this resource.",
+		ResultPasswordExpired: "AADSTS50055: The password is expired.",
+		ResultLocked:          "AADSTS50053: Your account is locked because you've tried to sign in too many times with an incorrect user ID or password.",
+		ResultUnknownUser:     "AADSTS50034: The user account does not exist in this directory.",
+	}
+	switch res := s.Authenticate("o365", s.sourceIP(r), r.PostFormValue("username"), r.PostFormValue("password")); res {
+	case ResultValid:
+		writeJSON(w, 200, map[string]interface{}{
+			"token_type":   "Bearer",
+			"expires_in":   3599,
+			"access_token": randomToken(),
+		})
+	case ResultRateLimited:
+		w.WriteHeader(429)
+	default:
+		writeJSON(w, 400, map[string]string{
+			"error":             "invalid_grant",
+			"error_description": codes[res],
+		})
+	}
+}
+
+const (
+	signInPage = `<html><body><form method="post" id="loginForm" autocomplete="off" action="/adfs/ls/idpinitiatedsignon">
+<span id="errorText" for="">%s</span>
+<input id="userNameInput" name="UserName" type="email" value="" autocomplete="off">
+<input id="passwordInput" name="Password" type="password" autocomplete="off">
+<input id="kmsiInput" type="checkbox" name="Kmsi" value="true">
+<input id="optionForms" type="hidden" name="AuthMethod" value="FormsAuthentication"/>
+</form></body></html>`
+	mfaPage = `<html><body><form method="post" id="options" action="/adfs/ls/idpinitiatedsignon">
+<input id="authMethod" type="hidden" name="AuthMethod" value="AzureMfaAuthentication"/>
+</form></body></html>`
+	trustToken = `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope"><s:Body>` +
+		`<trust:RequestSecurityTokenResponse xmlns:trust="http://schemas.xmlsoap.org/ws/2005/02/trust"/>` +
+		`</s:Body></s:Envelope>`
+	trustFault = `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope"><s:Body><s:Fault>` +
+		`<s:Code><s:Value>s:Sender</s:Value><s:Subcode><s:Value xmlns:a="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd">a:%s</s:Value></s:Subcode></s:Code>` +
+		`<s:Reason><s:Text xml:lang="en-US">%s</s:Text></s:Reason>` +
+		`</s:Fault></s:Body></s:Envelope>`
+)
+
+// adfsLockout returns the ADFS description of a lockout, which is an extranet
+// lockout under smart lockout.
+func (s *Simulator) adfsLockout() string {
+	if s.Policy.SmartLockout {
+		return "Extranet lockout is in effect for this account."
+	}
+	return "Your account has been locked out. Contact your administrator."
+}
+
+// adfsSignon serves the forms sign-in page. The first request of a sign-in
+// sets the MSISSamlRequest cookie which the credentials are posted with.
+func (s *Simulator) adfsSignon(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.PostFormValue("SignInIdpSite") != "" {
+		http.SetCookie(w, &http.Cookie{Name: "MSISSamlRequest", Value: randomToken(), Path: "/adfs", Secure: true, HttpOnly: true})
+		fmt.Fprintf(w, signInPage, "") // nolint:errcheck
+		return
+	}
+	if _, err := r.Cookie("MSISSamlRequest"); err != nil {
+		fmt.Fprintf(w, signInPage, "") // nolint:errcheck
+		return
+	}
+
+	switch s.Authenticate("adfs", s.sourceIP(r), r.PostFormValue("UserName"), r.PostFormValue("Password")) {
+	case ResultValid:
+		http.SetCookie(w, &http.Cookie{Name: "MSISAuth", Value: randomToken(), Path: "/adfs", Secure: true, HttpOnly: true})
+		http.Redirect(w, r, "/adfs/ls/idpinitiatedsignon", http.StatusFound)
+	case ResultPasswordExpired:
+		http.Redirect(w, r, "/adfs/portal/updatepassword/", http.StatusFound)
+	case ResultMFA:
+		fmt.Fprint(w, mfaPage) // nolint:errcheck
+	case ResultLocked:
+		fmt.Fprintf(w, signInPage, html.EscapeString(s.adfsLockout())) // nolint:errcheck
+	case ResultRateLimited:
+		w.WriteHeader(429)
+	default:
+		fmt.Fprintf(w, signInPage, "Incorrect user ID or password. Type the correct user ID and password, and try again.") // nolint:errcheck
+	}
+}
+
+// adfsTrust serves the WS-Trust usernamemixed endpoint, which reports every
+// failure as a SOAP fault.
+func (s *Simulator) adfsTrust(w http.ResponseWriter, r *http.Request) {
+	var env struct {
+		Username string `xml:"Header>Security>UsernameToken>Username"`
+		Password string `xml:"Header>Security>UsernameToken>Password"`
+	}
+	if r.Method != "POST" || xml.NewDecoder(r.Body).Decode(&env) != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	const failed = "ID3242: The security token could not be authenticated or authorized."
+	w.Header().Set("Content-Type", "application/soap+xml; charset=utf-8")
+
+	subcode, reason := "FailedAuthentication", failed
+	switch s.Authenticate("adfs", s.sourceIP(r), env.Username, env.Password) {
+	case ResultValid:
+		fmt.Fprint(w, trustToken) // nolint:errcheck
+		return
+	case ResultMFA:
+		subcode, reason = "RequestFailed", "MSIS7068: Access denied."
+	case ResultPasswordExpired:
+		reason = failed + " The password for this account has expired."
+	case ResultLocked:
+		reason = failed + " " + s.adfsLockout()
+	case ResultRateLimited:
+		subcode, reason = "RequestFailed", "MSIS7042: The same client browser session has made '6' requests in the last '11' seconds."
+	}
+	w.WriteHeader(500)
+	fmt.Fprintf(w, trustFault, subcode, html.EscapeString(reason)) // nolint:errcheck
+}
+
+func randomToken() string {
+	b := make([]byte, 16)
+	rand.Read(b) // nolint:errcheck,gosec
+	return hex.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v) // nolint:errcheck,gosec
+}
@@ -0,0 +1,308 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package idpsim implements a simulated identity provider for rehearsing
+// campaigns. It serves Okta, o365, and ADFS compatible login endpoints backed
+// by a single user directory, enforces an account lockout policy and a per
+// source rate limit, and logs every attempt so a report can show whether a
+// campaign would have locked out any accounts.
+//
+// Nozzles are pointed at a simulator with the "simulator" option (see
+// nozzle.SimulatorOption).
+package idpsim
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Result is the outcome of a simulated login.
+type Result string
+
+// Login results
+const (
+	ResultValid           Result = "valid"
+	ResultMFA             Result = "mfa"
+	ResultPasswordExpired Result = "password_expired"
+	ResultInvalid         Result = "invalid"
+	ResultLocked          Result = "locked"
+	ResultUnknownUser     Result = "unknown_user"
+	ResultRateLimited     Result = "rate_limited"
+)
+
+// User is an account in the simulated directory.
+type User struct {
+	Username        string
+	Password        string
+	MFA             bool
+	PasswordExpired bool
+}
+
+// ParseUsers reads users, one per line, in the form
+// username:password[:flag,...] where the flags are mfa and expired, so
+// passwords may not contain a colon. Blank lines and lines starting with #
+// are ignored.
+func ParseUsers(r io.Reader) ([]User, error) {
+	var users []User
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) < 2 || fields[0] == "" {
+			return nil, fmt.Errorf("idpsim: line %d: expected username:password[:flags]", n)
+		}
+		u := User{Username: fields[0], Password: fields[1]}
+		if len(fields) == 3 {
+			for _, flag := range strings.Split(fields[2], ",") {
+				switch strings.TrimSpace(flag) {
+				case "mfa":
+					u.MFA = true
+				case "expired":
+					u.PasswordExpired = true
+				case "":
+				default:
+					return nil, fmt.Errorf("idpsim: line %d: unknown flag %q", n, flag)
+				}
+			}
+		}
+		users = append(users, u)
+	}
+	return users, scanner.Err()
+}
+
+// Policy is the account lockout and rate limiting policy of a simulator.
+type Policy struct {
+	// LockoutThreshold is the number of failed logins within the
+	// LockoutWindow which locks an account. Zero disables lockout.
+	LockoutThreshold int
+
+	// LockoutWindow is the observation window after which the failed login
+	// count is reset (Active Directory's "reset account lockout counter
+	// after")
+	LockoutWindow time.Duration
+
+	// LockoutDuration is how long an account stays locked
+	LockoutDuration time.Duration
+
+	// SmartLockout enables the behavior of Azure AD smart lockout and ADFS
+	// extranet smart lockout: logins from familiar locations (sources which
+	// have logged in successfully) are counted and locked separately from
+	// unfamiliar ones, repeating one of the last three bad passwords is not
+	// counted, and the lockout duration doubles with each lockout.
+	SmartLockout bool
+
+	// RateLimit is the number of logins allowed per second from each source,
+	// with bursts of up to RateBurst. Zero disables rate limiting.
+	RateLimit float64
+	RateBurst int
+}
+
+// DefaultPolicy resembles a common Active Directory lockout policy.
+var DefaultPolicy = Policy{
+	LockoutThreshold: 5,
+	LockoutWindow:    30 * time.Minute,
+	LockoutDuration:  30 * time.Minute,
+	RateLimit:        10,
+	RateBurst:        20,
+}
+
+// Attempt is a logged login.
+type Attempt struct {
+	Time     time.Time `json:"time"`
+	SourceIP string    `json:"source_ip"`
+	Provider string    `json:"provider"`
+	Username string    `json:"username"`
+	Result   Result    `json:"result"`
+
+	// Familiar is set for logins from a familiar location under smart lockout
+	Familiar bool `json:"familiar,omitempty"`
+
+	// LockedOut is set for the attempt which locked the account, and
+	// LockedUntil is when the lockout ends
+	LockedOut   bool       `json:"locked_out,omitempty"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+}
+
+// counter tracks failed logins from one class of location.
+type counter struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+	lockouts    int
+	recent      []string
+}
+
+type account struct {
+	User
+
+	// counters are indexed by whether the source is familiar. Without smart
+	// lockout only the first is used.
+	counters [2]counter
+	familiar map[string]bool
+}
+
+// Simulator is a simulated identity provider. It is safe for concurrent use.
+type Simulator struct {
+	// Policy is the lockout and rate limiting policy
+	Policy Policy
+
+	// Log receives every attempt as a line of JSON, if set
+	Log io.Writer
+
+	// TrustForwarded uses the X-Forwarded-For header for the source IP, for
+	// simulators behind a load balancer
+	TrustForwarded bool
+
+	// Now returns the current time, and is replaced in tests
+	Now func() time.Time
+
+	mu       sync.Mutex
+	accounts map[string]*account
+	limiters map[string]*rate.Limiter
+	report   Report
+}
+
+// New returns a simulator for users with the policy.
+func New(users []User, policy Policy) *Simulator {
+	s := &Simulator{
+		Policy:   policy,
+		Now:      time.Now,
+		accounts: map[string]*account{},
+		limiters: map[string]*rate.Limiter{},
+	}
+	for _, u := range users {
+		s.accounts[strings.ToLower(u.Username)] = &account{
+			User:     u,
+			familiar: map[string]bool{},
+		}
+	}
+	return s
+}
+
+// Authenticate decides the result of a login from source ip to provider, and
+// logs the attempt. Usernames are case insensitive.
+func (s *Simulator) Authenticate(provider, ip, username, password string) Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := Attempt{
+		Time:     s.Now(),
+		SourceIP: ip,
+		Provider: provider,
+		Username: username,
+	}
+	a.Result = s.authenticate(&a, password)
+
+	s.report.Add(a)
+	if s.Log != nil {
+		data, _ := json.Marshal(a)
+		s.Log.Write(append(data, '\n')) // nolint:errcheck,gosec
+	}
+	return a.Result
+}
+
+func (s *Simulator) authenticate(a *Attempt, password string) Result {
+	p := s.Policy
+	now := a.Time
+
+	if p.RateLimit > 0 {
+		l, ok := s.limiters[a.SourceIP]
+		if !ok {
+			l = rate.NewLimiter(rate.Limit(p.RateLimit), p.RateBurst)
+			s.limiters[a.SourceIP] = l
+		}
+		if !l.AllowN(now, 1) {
+			return ResultRateLimited
+		}
+	}
+
+	acct, ok := s.accounts[strings.ToLower(a.Username)]
+	if !ok {
+		return ResultUnknownUser
+	}
+
+	c := &acct.counters[0]
+	if p.SmartLockout && acct.familiar[a.SourceIP] {
+		a.Familiar = true
+		c = &acct.counters[1]
+	}
+
+	if now.Before(c.lockedUntil) {
+		return ResultLocked
+	}
+
+	if password != acct.Password {
+		if p.LockoutThreshold == 0 {
+			return ResultInvalid
+		}
+		if p.SmartLockout {
+			for _, r := range c.recent {
+				if r == password {
+					return ResultInvalid
+				}
+			}
+			c.recent = append(c.recent, password)
+			if len(c.recent) > 3 {
+				c.recent = c.recent[1:]
+			}
+		}
+		if now.Sub(c.lastFailure) > p.LockoutWindow {
+			c.failures = 0
+		}
+		c.failures++
+		c.lastFailure = now
+
+		if c.failures >= p.LockoutThreshold {
+			duration := p.LockoutDuration
+			if p.SmartLockout {
+				duration <<= uint(c.lockouts)
+			}
+			c.failures = 0
+			c.lockouts++
+			c.lockedUntil = now.Add(duration)
+			until := c.lockedUntil
+			a.LockedOut = true
+			a.LockedUntil = &until
+		}
+		return ResultInvalid
+	}
+
+	c.failures = 0
+	acct.familiar[a.SourceIP] = true
+	switch {
+	case acct.PasswordExpired:
+		return ResultPasswordExpired
+	case acct.MFA:
+		return ResultMFA
+	}
+	return ResultValid
+}
+
+// Report returns a report of every attempt so far.
+func (s *Simulator) Report() Report {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.report.copy()
+}
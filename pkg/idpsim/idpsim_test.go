@@ -0,0 +1,239 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idpsim
+
+import (
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/adfs"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/o365"
+	_ "github.com/praetorian-inc/trident/pkg/nozzle/okta"
+)
+
+var users = []User{
+	{Username: "alice@example.org", Password: "Password1!"},
+	{Username: "eve@example.org", Password: "Password1!", MFA: true},
+	{Username: "old@example.org", Password: "Password1!", PasswordExpired: true},
+}
+
+// clock is a fake time source advanced by the test.
+type clock struct{ now time.Time }
+
+func (c *clock) Now() time.Time          { return c.now }
+func (c *clock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func simulator(p Policy) (*Simulator, *clock) {
+	s := New(users, p)
+	c := &clock{now: time.Date(2020, 9, 1, 9, 0, 0, 0, time.UTC)}
+	s.Now = c.Now
+	return s, c
+}
+
+type step struct {
+	desc     string
+	advance  time.Duration
+	ip       string
+	username string
+	password string
+	result   Result
+}
+
+func run(t *testing.T, s *Simulator, c *clock, steps []step) {
+	for _, st := range steps {
+		c.Advance(st.advance)
+		ip := st.ip
+		if ip == "" {
+			ip = "203.0.113.10"
+		}
+		res := s.Authenticate("test", ip, st.username, st.password)
+		if res != st.result {
+			t.Errorf("[%s] result was %s, expected %s", st.desc, res, st.result)
+		}
+	}
+}
+
+func TestParseUsers(t *testing.T) {
+	parsed, err := ParseUsers(strings.NewReader("# users\nalice@example.org:Password1!\n\neve@example.org:Pass:mfa\nold@example.org:Password1!:expired,mfa\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != 3 {
+		t.Fatalf("parsed %d users, expected 3", len(parsed))
+	}
+	if parsed[1].Password != "Pass" || !parsed[1].MFA {
+		t.Errorf("unexpected user %+v", parsed[1])
+	}
+	if !parsed[2].MFA || !parsed[2].PasswordExpired {
+		t.Errorf("unexpected user %+v", parsed[2])
+	}
+
+	for _, bad := range []string{"alice", ":password", "alice:pw:admin"} {
+		if _, err := ParseUsers(strings.NewReader(bad)); err == nil {
+			t.Errorf("expected an error parsing %q", bad)
+		}
+	}
+}
+
+func TestLockout(t *testing.T) {
+	s, c := simulator(Policy{
+		LockoutThreshold: 3,
+		LockoutWindow:    10 * time.Minute,
+		LockoutDuration:  30 * time.Minute,
+	})
+	run(t, s, c, []step{
+		{"valid", 0, "", "alice@example.org", "Password1!", ResultValid},
+		{"case insensitive", 0, "", "Alice@Example.org", "Password1!", ResultValid},
+		{"mfa", 0, "", "eve@example.org", "Password1!", ResultMFA},
+		{"expired", 0, "", "old@example.org", "Password1!", ResultPasswordExpired},
+		{"unknown", 0, "", "nobody@example.org", "Password1!", ResultUnknownUser},
+		{"failure 1", 0, "", "alice@example.org", "a", ResultInvalid},
+		{"failure 2", time.Minute, "", "alice@example.org", "b", ResultInvalid},
+		{"window expired", 11 * time.Minute, "", "alice@example.org", "c", ResultInvalid},
+		{"failure 2 again", time.Minute, "", "alice@example.org", "d", ResultInvalid},
+		{"failure 3 locks", time.Minute, "", "alice@example.org", "e", ResultInvalid},
+		{"locked", time.Minute, "", "alice@example.org", "Password1!", ResultLocked},
+		{"locked from anywhere", 0, "198.51.100.7", "alice@example.org", "Password1!", ResultLocked},
+		{"unlocked", 30 * time.Minute, "", "alice@example.org", "Password1!", ResultValid},
+	})
+
+	report := s.Report()
+	if !report.Tripped() || len(report.Lockouts) != 1 {
+		t.Fatalf("expected one lockout in the report, got %d", len(report.Lockouts))
+	}
+	if l := report.Lockouts[0]; l.Username != "alice@example.org" || !l.LockedUntil.Equal(l.Time.Add(30*time.Minute)) {
+		t.Errorf("unexpected lockout %+v", l)
+	}
+	if report.Attempts != 13 || report.Results[ResultLocked] != 2 {
+		t.Errorf("unexpected report %+v", report)
+	}
+}
+
+func TestSmartLockout(t *testing.T) {
+	s, c := simulator(Policy{
+		LockoutThreshold: 2,
+		LockoutWindow:    time.Hour,
+		LockoutDuration:  time.Minute,
+		SmartLockout:     true,
+	})
+	const familiar, unfamiliar = "203.0.113.10", "198.51.100.7"
+	run(t, s, c, []step{
+		{"familiar", 0, familiar, "alice@example.org", "Password1!", ResultValid},
+		{"failure 1", 0, unfamiliar, "alice@example.org", "a", ResultInvalid},
+		{"repeated password", 0, unfamiliar, "alice@example.org", "a", ResultInvalid},
+		{"failure 2 locks", 0, unfamiliar, "alice@example.org", "b", ResultInvalid},
+		{"locked", 0, unfamiliar, "alice@example.org", "Password1!", ResultLocked},
+		{"familiar unaffected", 0, familiar, "alice@example.org", "Password1!", ResultValid},
+		{"unlocked", time.Minute, unfamiliar, "alice@example.org", "c", ResultInvalid},
+		{"second lockout", 0, unfamiliar, "alice@example.org", "d", ResultInvalid},
+		{"longer lockout", time.Minute, unfamiliar, "alice@example.org", "Password1!", ResultLocked},
+		{"second lockout ends", time.Minute, unfamiliar, "alice@example.org", "Password1!", ResultValid},
+	})
+}
+
+func TestRateLimit(t *testing.T) {
+	s, c := simulator(Policy{RateLimit: 1, RateBurst: 2})
+	run(t, s, c, []step{
+		{"burst 1", 0, "", "alice@example.org", "Password1!", ResultValid},
+		{"burst 2", 0, "", "alice@example.org", "Password1!", ResultValid},
+		{"limited", 0, "", "alice@example.org", "Password1!", ResultRateLimited},
+		{"other source", 0, "198.51.100.7", "alice@example.org", "Password1!", ResultValid},
+		{"refilled", time.Second, "", "alice@example.org", "Password1!", ResultValid},
+	})
+}
+
+func TestReport(t *testing.T) {
+	s, c := simulator(Policy{LockoutThreshold: 1, LockoutWindow: time.Hour, LockoutDuration: time.Hour})
+	var log bytes.Buffer
+	s.Log = &log
+	run(t, s, c, []step{
+		{"valid", 0, "", "alice@example.org", "Password1!", ResultValid},
+		{"lockout", time.Second, "", "eve@example.org", "wrong", ResultInvalid},
+	})
+
+	report, err := ReadReport(&log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Attempts != 2 || !report.Tripped() || report.Lockouts[0].SourceIP != "203.0.113.10" {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	var out bytes.Buffer
+	report.Print(&out)
+	if !strings.Contains(out.String(), "lockout tripped: yes (1 lockouts)") {
+		t.Errorf("unexpected report output:\n%s", out.String())
+	}
+}
+
+// TestNozzles runs the Okta, o365, and ADFS nozzles against the simulator.
+func TestNozzles(t *testing.T) {
+	providers := []struct {
+		name string
+		opts map[string]string
+	}{
+		{"okta", map[string]string{}},
+		{"o365", map[string]string{}},
+		{"adfs", map[string]string{}},
+		{"adfs", map[string]string{"strategy": "usernamemixed"}},
+	}
+
+	// each provider locks out its own user
+	directory := append([]User(nil), users...)
+	for i := range providers {
+		directory = append(directory, User{Username: fmt.Sprintf("bob%d@example.org", i), Password: "Password1!"})
+	}
+	s := New(directory, Policy{LockoutThreshold: 2, LockoutWindow: time.Hour, LockoutDuration: time.Hour})
+	srv := httptest.NewTLSServer(s.Handler())
+	defer srv.Close()
+
+	for i, p := range providers {
+		p.opts[nozzle.SimulatorOption] = srv.Listener.Addr().String()
+		noz, err := nozzle.Open(p.name, p.opts)
+		if err != nil {
+			t.Fatalf("[%s] unable to open nozzle: %s", p.name, err)
+		}
+
+		res, err := noz.Login("alice@example.org", "Password1!")
+		if err != nil || !res.Valid {
+			t.Errorf("[%s] valid login was %+v (%v)", p.name, res, err)
+		}
+		res, err = noz.Login("old@example.org", "Password1!")
+		if err != nil || !res.Valid || res.Metadata["passwordExpired"] != true {
+			t.Errorf("[%s] expired login was %+v (%v)", p.name, res, err)
+		}
+
+		bob := fmt.Sprintf("bob%d@example.org", i)
+		for j := 0; j < 2; j++ {
+			if _, err := noz.Login(bob, "wrong"); err != nil {
+				t.Fatalf("[%s] error in login: %s", p.name, err)
+			}
+		}
+		res, err = noz.Login(bob, "Password1!")
+		if err != nil || !res.Locked {
+			t.Errorf("[%s] locked login was %+v (%v)", p.name, res, err)
+		}
+	}
+
+	if n := len(s.Report().Lockouts); n != len(providers) {
+		t.Errorf("expected %d lockouts, got %d", len(providers), n)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idpsim
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// Report summarizes the attempts made against a simulator.
+type Report struct {
+	// Attempts is the number of logins
+	Attempts int `json:"attempts"`
+
+	// First and Last are the times of the first and last login
+	First time.Time `json:"first"`
+	Last  time.Time `json:"last"`
+
+	// Results counts the logins with each result
+	Results map[Result]int `json:"results"`
+
+	// Sources counts the logins from each source IP
+	Sources map[string]int `json:"sources"`
+
+	// Lockouts lists the attempts which locked an account
+	Lockouts []Attempt `json:"lockouts"`
+}
+
+// Add adds an attempt to the report.
+func (r *Report) Add(a Attempt) {
+	if r.Results == nil {
+		r.Results = map[Result]int{}
+		r.Sources = map[string]int{}
+	}
+	if r.Attempts == 0 || a.Time.Before(r.First) {
+		r.First = a.Time
+	}
+	if a.Time.After(r.Last) {
+		r.Last = a.Time
+	}
+	r.Attempts++
+	r.Results[a.Result]++
+	r.Sources[a.SourceIP]++
+	if a.LockedOut {
+		r.Lockouts = append(r.Lockouts, a)
+	}
+}
+
+// Tripped reports whether any account was locked out.
+func (r *Report) Tripped() bool {
+	return len(r.Lockouts) > 0
+}
+
+func (r *Report) copy() Report {
+	c := *r
+	c.Results = map[Result]int{}
+	c.Sources = map[string]int{}
+	for k, v := range r.Results {
+		c.Results[k] = v
+	}
+	for k, v := range r.Sources {
+		c.Sources[k] = v
+	}
+	c.Lockouts = append([]Attempt(nil), r.Lockouts...)
+	return c
+}
+
+// ReadReport builds a report from an attempt log.
+func ReadReport(log io.Reader) (*Report, error) {
+	var r Report
+	scanner := bufio.NewScanner(log)
+	for n := 1; scanner.Scan(); n++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var a Attempt
+		err := json.Unmarshal(scanner.Bytes(), &a)
+		if err != nil {
+			return nil, fmt.Errorf("idpsim: attempt log line %d: %w", n, err)
+		}
+		r.Add(a)
+	}
+	return &r, scanner.Err()
+}
+
+// Print writes the report in a human readable form.
+func (r *Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "attempts: %d from %d sources", r.Attempts, len(r.Sources)) // nolint:errcheck
+	if r.Attempts > 0 {
+		fmt.Fprintf(w, " between %s and %s", r.First.Format(time.RFC3339), r.Last.Format(time.RFC3339)) // nolint:errcheck
+	}
+	fmt.Fprintln(w) // nolint:errcheck
+
+	results := make([]string, 0, len(r.Results))
+	for res := range r.Results {
+		results = append(results, string(res))
+	}
+	sort.Strings(results)
+	for _, res := range results {
+		fmt.Fprintf(w, "  %-16s %d\n", res, r.Results[Result(res)]) // nolint:errcheck
+	}
+
+	if !r.Tripped() {
+		fmt.Fprintln(w, "lockout tripped: no") // nolint:errcheck
+		return
+	}
+	fmt.Fprintf(w, "lockout tripped: yes (%d lockouts)\n", len(r.Lockouts)) // nolint:errcheck
+	for _, a := range r.Lockouts {
+		fmt.Fprintf(w, "  %s %s locked by %s via %s", a.Time.Format(time.RFC3339), a.Username, a.SourceIP, a.Provider) // nolint:errcheck
+		if a.LockedUntil != nil {
+			fmt.Fprintf(w, " until %s", a.LockedUntil.Format(time.RFC3339)) // nolint:errcheck
+		}
+		fmt.Fprintln(w) // nolint:errcheck
+	}
+}
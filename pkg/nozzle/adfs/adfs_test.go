@@ -15,12 +15,24 @@
 package adfs
 
 import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/praetorian-inc/trident/pkg/event"
 	"github.com/praetorian-inc/trident/pkg/nozzle"
+	"github.com/praetorian-inc/trident/pkg/nozzle/nozzletest"
+	"github.com/praetorian-inc/trident/pkg/ntlm"
 )
 
 func TestMain(m *testing.M) {
@@ -52,4 +64,349 @@ func TestNozzle(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unable to open nozzle: %s", err)
 	}
+
+	_, err = nozzle.Open("adfs", map[string]string{
+		"domain":   "adfs.example.com",
+		"strategy": "kerberos",
+	})
+	if err == nil {
+		t.Errorf("expected error for unknown strategy")
+	}
+}
+
+const signInPage = `<form method="post" id="loginForm" autocomplete="off" novalidate="novalidate" action="/adfs/ls/idpinitiatedsignon">
+<div id="error" class="fieldMargin error smallText">
+<span id="errorText" for="">%s</span>
+</div>
+<input id="userNameInput" name="UserName" type="email" value="" spellcheck="false" autocomplete="off"/>
+<input id="passwordInput" name="Password" type="password" autocomplete="off"/>
+<input id="optionForms" type="hidden" name="AuthMethod" value="FormsAuthentication"/>
+</form>`
+
+const mfaPage = `<form method="post" id="options" class="hidden" action="/adfs/ls/idpinitiatedsignon">
+<input id="optionSelection" type="hidden" name="AuthMethod" value="AzureMfaAuthentication"/>
+<input id="context" type="hidden" name="Context" value="cb5fb4a9-f3b4-4b02-a4a2-2e1b2e6b4b43"/>
+</form>`
+
+const tokenEnvelope = `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:a="http://www.w3.org/2005/08/addressing">
+<s:Header><a:Action s:mustUnderstand="1">http://schemas.xmlsoap.org/ws/2005/02/trust/RSTR/Issue</a:Action></s:Header>
+<s:Body><t:RequestSecurityTokenResponse xmlns:t="http://schemas.xmlsoap.org/ws/2005/02/trust">
+<t:Lifetime><wsu:Created xmlns:wsu="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd">2020-10-20T18:00:00.000Z</wsu:Created></t:Lifetime>
+<t:RequestedSecurityToken><saml:Assertion xmlns:saml="urn:oasis:names:tc:SAML:1.0:assertion" MajorVersion="1" MinorVersion="1"/></t:RequestedSecurityToken>
+</t:RequestSecurityTokenResponse></s:Body></s:Envelope>`
+
+const faultEnvelope = `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:a="http://www.w3.org/2005/08/addressing">
+<s:Header><a:Action s:mustUnderstand="1">http://www.w3.org/2005/08/addressing/soap/fault</a:Action></s:Header>
+<s:Body><s:Fault><s:Code><s:Value>s:Sender</s:Value><s:Subcode>
+<s:Value xmlns:a="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd">a:%s</s:Value>
+</s:Subcode></s:Code><s:Reason><s:Text xml:lang="en-US">%s</s:Text></s:Reason></s:Fault></s:Body></s:Envelope>`
+
+// adfsServer is a stand-in for the ADFS endpoints. Each server issues its own
+// MSISSamlRequest cookies, which it stops recognizing after maxUses logins.
+type adfsServer struct {
+	sync.Mutex
+	t       *testing.T
+	name    string
+	issued  int
+	uses    int
+	maxUses int
+}
+
+func (s *adfsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/adfs/ls/idpinitiatedsignon":
+		s.signon(w, r)
+	case "/adfs/services/trust/2005/usernamemixed":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		user := usernameRegexp.FindSubmatch(body)
+		if user == nil {
+			s.t.Fatalf("usernamemixed request did not include a username")
+		}
+		s.trust(w, string(user[1]), bytes.Contains(body, []byte("<wsse:Password>Password1!</wsse:Password>")))
+	case "/adfs/services/trust/2005/windowstransport":
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "NTLM ") {
+			w.Header().Set("WWW-Authenticate", "NTLM")
+			w.WriteHeader(401)
+			return
+		}
+		data, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "NTLM "))
+		msg, err := ntlm.ParseAuthenticate(data)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "NTLM "+base64.StdEncoding.EncodeToString(challenge))
+			w.WriteHeader(401)
+			return
+		}
+		if !msg.Verify(serverChallenge, "CORP", "Password1!") {
+			w.WriteHeader(401)
+			return
+		}
+		s.trust(w, msg.User, true)
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+var usernameRegexp = regexp.MustCompile(`<wsse:Username>([^<]*)</wsse:Username>`)
+
+var serverChallenge = []byte("01234567")
+
+var challenge = ntlm.NewChallenge(&ntlm.ChallengeInfo{
+	NetBIOSDomain: "CORP",
+	DNSDomain:     "corp.example.org",
+}, serverChallenge)
+
+func (s *adfsServer) trust(w http.ResponseWriter, user string, correct bool) {
+	w.Header().Set("Content-Type", "application/soap+xml; charset=utf-8")
+	switch {
+	case user == "slow":
+		w.WriteHeader(500)
+		fmt.Fprintf(w, faultEnvelope, "RequestFailed", "MSIS7042: The same client browser session has made '6' requests in the last '11' seconds.") // nolint:errcheck
+	case user == "bob":
+		w.WriteHeader(500)
+		fmt.Fprintf(w, faultEnvelope, "FailedAuthentication", "ID3242: The security token could not be authenticated or authorized. The referenced account is currently locked out and may not be logged on to.") // nolint:errcheck
+	case user == "mal" && correct:
+		w.WriteHeader(500)
+		fmt.Fprintf(w, faultEnvelope, "FailedAuthentication", "ID3242: The security token could not be authenticated or authorized. Extranet lockout is in effect for this account.") // nolint:errcheck
+	case user == "eve" && correct:
+		w.WriteHeader(500)
+		fmt.Fprintf(w, faultEnvelope, "RequestFailed", "MSIS7068: Access denied.") // nolint:errcheck
+	case user == "old" && correct:
+		w.WriteHeader(500)
+		fmt.Fprintf(w, faultEnvelope, "FailedAuthentication", "ID3242: The security token could not be authenticated or authorized. The password for this account has expired.") // nolint:errcheck
+	case user == "alice" && correct:
+		fmt.Fprint(w, tokenEnvelope) // nolint:errcheck
+	default:
+		w.WriteHeader(500)
+		fmt.Fprintf(w, faultEnvelope, "FailedAuthentication", "ID3242: The security token could not be authenticated or authorized.") // nolint:errcheck
+	}
+}
+
+func (s *adfsServer) signon(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := r.ParseForm(); err != nil {
+		s.t.Fatal(err)
+	}
+	if r.PostForm.Get("SignInIdpSite") != "" {
+		s.issued++
+		s.uses = 0
+		http.SetCookie(w, &http.Cookie{Name: "MSISSamlRequest", Value: fmt.Sprintf("%s-%d", s.name, s.issued), Path: "/adfs"})
+		fmt.Fprintf(w, signInPage, "") // nolint:errcheck
+		return
+	}
+
+	c, err := r.Cookie("MSISSamlRequest")
+	s.uses++
+	if err != nil || c.Value != fmt.Sprintf("%s-%d", s.name, s.issued) || s.uses > s.maxUses {
+		fmt.Fprintf(w, signInPage, "") // nolint:errcheck
+		return
+	}
+
+	switch r.PostForm.Get("UserName") + ":" + r.PostForm.Get("Password") {
+	case "alice:Password1!":
+		http.SetCookie(w, &http.Cookie{Name: "MSISAuth", Value: "AAEAAFIB8TE0", Path: "/adfs"})
+		http.Redirect(w, r, "/adfs/ls/idpinitiatedsignon", http.StatusFound)
+	case "old:Password1!":
+		http.Redirect(w, r, "/adfs/portal/updatepassword/", http.StatusFound)
+	case "eve:Password1!":
+		fmt.Fprint(w, mfaPage) // nolint:errcheck
+	case "mal:Password1!":
+		fmt.Fprintf(w, signInPage, "Your account is disabled. Contact your administrator.") // nolint:errcheck
+	default:
+		if r.PostForm.Get("UserName") == "bob" {
+			fmt.Fprintf(w, signInPage, "Your account has been locked out. Contact your administrator.") // nolint:errcheck
+			return
+		}
+		fmt.Fprintf(w, signInPage, "Incorrect user ID or password. Type the correct user ID and password, and try again.") // nolint:errcheck
+	}
+}
+
+type testcase struct {
+	desc        string
+	username    string
+	password    string
+	valid       bool
+	mfa         bool
+	locked      bool
+	ratelimited bool
+	flag        string
+}
+
+func runTestcases(t *testing.T, name string, noz nozzle.Nozzle, testcases []testcase) {
+	for _, test := range testcases {
+		res, err := noz.Login(test.username, test.password)
+		if err != nil {
+			t.Errorf("[%s %s] error in login: %s", name, test.desc, err)
+			continue
+		}
+		if res.Valid != test.valid {
+			t.Errorf("[%s %s] noz.valid was %t, expected %t", name, test.desc, res.Valid, test.valid)
+		}
+		if res.MFA != test.mfa {
+			t.Errorf("[%s %s] noz.mfa %t, expected %t", name, test.desc, res.MFA, test.mfa)
+		}
+		if res.Locked != test.locked {
+			t.Errorf("[%s %s] noz.locked %t, expected %t", name, test.desc, res.Locked, test.locked)
+		}
+		if res.RateLimited != test.ratelimited {
+			t.Errorf("[%s %s] noz.ratelimited %t, expected %t", name, test.desc, res.RateLimited, test.ratelimited)
+		}
+		if test.flag != "" && res.Metadata[test.flag] != true {
+			t.Errorf("[%s %s] expected %s metadata", name, test.desc, test.flag)
+		}
+	}
+}
+
+func open(t *testing.T, srv *httptest.Server, strategy string) nozzle.Nozzle {
+	noz, err := nozzle.Open("adfs", map[string]string{
+		"domain":   srv.Listener.Addr().String(),
+		"strategy": strategy,
+	})
+	if err != nil {
+		t.Fatalf("unable to open nozzle: %s", err)
+	}
+	noz.(*Nozzle).Client = srv.Client()
+	return noz
+}
+
+func TestIdpInitiatedSignon(t *testing.T) {
+	srv := httptest.NewTLSServer(&adfsServer{t: t, name: "a", maxUses: 3})
+	defer srv.Close()
+
+	runTestcases(t, "idpinitiatedsignon", open(t, srv, "idpinitiatedsignon"), []testcase{
+		{"invalid login", "alice", "Invalid1!", false, false, false, false, ""},
+		{"valid login", "alice", "Password1!", true, false, false, false, ""},
+		{"valid login with mfa", "eve", "Password1!", true, true, false, false, ""},
+		{"password expired", "old", "Password1!", true, false, false, false, "passwordExpired"},
+		{"locked account", "bob", "Invalid1!", false, false, true, false, ""},
+		{"disabled account", "mal", "Password1!", false, false, true, false, "accountDisabled"},
+	})
+}
+
+func TestSessions(t *testing.T) {
+	first := &adfsServer{t: t, name: "first", maxUses: 100}
+	srv1 := httptest.NewTLSServer(first)
+	defer srv1.Close()
+	second := &adfsServer{t: t, name: "second", maxUses: 2}
+	srv2 := httptest.NewTLSServer(second)
+	defer srv2.Close()
+
+	// interleave logins against both domains, the second of which expires its
+	// sign-in context every other login. Each login opens a new nozzle, as
+	// workers do for every task.
+	for i := 0; i < 5; i++ {
+		for _, srv := range []*httptest.Server{srv1, srv2} {
+			noz := open(t, srv, "idpinitiatedsignon")
+			res, err := noz.Login("alice", "Password1!")
+			if err != nil {
+				t.Fatalf("error in login: %s", err)
+			}
+			if !res.Valid {
+				t.Errorf("noz.valid was false for %s", noz.(*Nozzle).Domain)
+			}
+		}
+	}
+
+	if first.issued != 1 {
+		t.Errorf("first domain issued %d cookies, expected 1", first.issued)
+	}
+	if second.issued != 3 {
+		t.Errorf("second domain issued %d cookies, expected 3", second.issued)
+	}
+
+	// cookies are refreshed once they reach the session lifetime
+	domain := srv1.Listener.Addr().String()
+	sessions.Lock()
+	s := sessions.domains[domain]
+	s.expires = time.Now()
+	sessions.domains[domain] = s
+	sessions.Unlock()
+	if _, err := open(t, srv1, "idpinitiatedsignon").Login("alice", "Password1!"); err != nil {
+		t.Fatalf("error in login: %s", err)
+	}
+	if first.issued != 2 {
+		t.Errorf("expired cookie was not refreshed")
+	}
+}
+
+func TestSharedSession(t *testing.T) {
+	server := &adfsServer{t: t, name: "shared", maxUses: 100}
+	srv := httptest.NewTLSServer(server)
+	defer srv.Close()
+
+	// nozzles for the same domain share a sign-in context
+	for _, noz := range []nozzle.Nozzle{open(t, srv, "idpinitiatedsignon"), open(t, srv, "idpinitiatedsignon")} {
+		if _, err := noz.Login("alice", "Password1!"); err != nil {
+			t.Fatalf("error in login: %s", err)
+		}
+	}
+	if server.issued != 1 {
+		t.Errorf("%d sign-in context requests, expected 1", server.issued)
+	}
+}
+
+func TestTrustStrategies(t *testing.T) {
+	srv := httptest.NewTLSServer(&adfsServer{t: t, name: "a"})
+	defer srv.Close()
+
+	runTestcases(t, "usernamemixed", open(t, srv, "usernamemixed"), []testcase{
+		{"invalid login", "alice", "Invalid1!", false, false, false, false, ""},
+		{"valid login", "alice", "Password1!", true, false, false, false, ""},
+		{"access denied", "eve", "Password1!", true, false, false, false, "accessDenied"},
+		{"password expired", "old", "Password1!", true, false, false, false, "passwordExpired"},
+		{"locked account", "bob", "Invalid1!", false, false, true, false, ""},
+		{"extranet lockout", "mal", "Password1!", false, false, true, false, "extranetLockout"},
+		{"loop detection", "slow", "Password1!", false, false, false, true, ""},
+	})
+
+	runTestcases(t, "ntlm", open(t, srv, "windowstransport"), []testcase{
+		{"invalid login", "alice", "Invalid1!", false, false, false, false, ""},
+		{"valid login", "alice", "Password1!", true, false, false, false, ""},
+		{"access denied", "eve", "Password1!", true, false, false, false, "accessDenied"},
+	})
+}
+
+func TestArtifacts(t *testing.T) {
+	srv := httptest.NewTLSServer(&adfsServer{t: t, name: "a", maxUses: 100})
+	defer srv.Close()
+	noz := open(t, srv, "idpinitiatedsignon")
+
+	res, err := noz.Login("alice", "Password1!")
+	if err != nil {
+		t.Fatalf("error in login: %s", err)
+	}
+	a := res.Artifacts
+	if a == nil || a.MFA != event.MFAPostureNotEnforced || len(a.Cookies) != 1 || a.Cookies[0].Name != "MSISAuth" || a.Cookies[0].Value != "AAEAAFIB8TE0" {
+		t.Errorf("artifacts were %+v", a)
+	}
+	if _, ok := res.Metadata["MSISAuthCookie"]; ok {
+		t.Errorf("session cookie was reported in metadata")
+	}
+
+	res, err = noz.Login("eve", "Password1!")
+	if err != nil {
+		t.Fatalf("error in login: %s", err)
+	}
+	if a := res.Artifacts; a == nil || a.MFA != event.MFAPostureEnforced || len(a.Factors) != 1 || a.Factors[0].Type != "AzureMfaAuthentication" {
+		t.Errorf("artifacts were %+v", a)
+	}
+
+	res, err = open(t, srv, "usernamemixed").Login("alice", "Password1!")
+	if err != nil {
+		t.Fatalf("error in login: %s", err)
+	}
+	if a := res.Artifacts; a == nil || !strings.Contains(a.Tokens["RequestSecurityTokenResponse"], "saml:Assertion") {
+		t.Errorf("artifacts were %+v", a)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	nozzletest.Run(t, Driver{}, nozzletest.ADFS, func(noz nozzle.Nozzle, client *http.Client) {
+		noz.(*Nozzle).Client = client
+	})
 }
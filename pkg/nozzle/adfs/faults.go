@@ -0,0 +1,132 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package adfs
+
+import (
+	"encoding/xml"
+	"html"
+	"regexp"
+	"strings"
+
+	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+)
+
+// faultCodes maps the ID or MSIS code at the start of a WS-Trust fault reason
+// to a normalized result. Faults without a known code are reported as invalid
+// credentials with the fault in the metadata.
+var faultCodes = map[string]nozzle.Outcome{
+	// the security token could not be authenticated or authorized
+	"ID3242": {Desc: "authentication failed", Generic: true},
+	// the request failed, usually with the cause in the inner reason
+	"MSIS3127": {Desc: "request failed", Generic: true},
+	// authentication succeeded but an issuance authorization rule denied the
+	// token, commonly because the relying party requires MFA
+	"MSIS7068": {Desc: "access denied", Valid: true, UserStatus: event.UserStatusExists, Flag: "accessDenied"},
+	// loop detection has blocked the client
+	"MSIS7042": {Desc: "loop detected", RateLimited: true},
+}
+
+// messages refine generic failures using the fault reason or the error text
+// of the sign-in page. The first match wins. Extranet lockout and extranet
+// smart lockout (ESL) are flagged separately from an Active Directory lockout
+// since they only block extranet sign-ins.
+var messages = []struct {
+	re *regexp.Regexp
+	o  nozzle.Outcome
+}{
+	{regexp.MustCompile(`(?i)extranet (smart )?lockout`), nozzle.Outcome{Desc: "extranet lockout", Locked: true, UserStatus: event.UserStatusExists, Flag: "extranetLockout"}},
+	{regexp.MustCompile(`(?i)locked out|account (is |has been )?locked`), nozzle.Outcome{Desc: "account locked", Locked: true, UserStatus: event.UserStatusExists}},
+	{regexp.MustCompile(`(?i)password (for this account )?(has )?expired|must change (your|the) password`), nozzle.Outcome{Desc: "password expired", Valid: true, UserStatus: event.UserStatusExists, Flag: "passwordExpired"}},
+	{regexp.MustCompile(`(?i)account (is )?(currently )?disabled`), nozzle.Outcome{Desc: "account disabled", Locked: true, UserStatus: event.UserStatusExists, Flag: "accountDisabled"}},
+	{regexp.MustCompile(`(?i)incorrect user id or password|user (id|name) or password is incorrect|could not be authenticated`), nozzle.Outcome{Desc: "invalid credentials"}},
+}
+
+var faultCodeRegexp = regexp.MustCompile(`^(ID|MSIS)\d+`)
+
+// soapEnvelope is the subset of a WS-Trust response used to classify a login.
+type soapEnvelope struct {
+	Subcode string `xml:"Body>Fault>Code>Subcode>Value"`
+	Reason  string `xml:"Body>Fault>Reason>Text"`
+
+	// the 2005 endpoints return a single response and the 13 endpoints a
+	// collection
+	Response   *struct{} `xml:"Body>RequestSecurityTokenResponse"`
+	Collection *struct{} `xml:"Body>RequestSecurityTokenResponseCollection"`
+}
+
+// token reports whether the envelope contains an issued token.
+func (env soapEnvelope) token() bool {
+	return env.Response != nil || env.Collection != nil
+}
+
+// parseEnvelope returns the SOAP envelope of a WS-Trust response. It returns
+// false when the body is not a SOAP envelope.
+func parseEnvelope(body []byte) (soapEnvelope, bool) {
+	var env soapEnvelope
+	if xml.Unmarshal(body, &env) != nil {
+		return env, false
+	}
+	return env, true
+}
+
+// classify returns the outcome for an error code and message. Unknown codes
+// return a zero outcome and false.
+func classify(code, message string) (nozzle.Outcome, bool) {
+	o, ok := faultCodes[code]
+	if code == "" || o.Generic {
+		for _, m := range messages {
+			if m.re.MatchString(message) {
+				return m.o, true
+			}
+		}
+	}
+	return o, ok
+}
+
+// faultResponse converts a SOAP fault into an AuthResponse.
+func faultResponse(env soapEnvelope, metadata map[string]interface{}) *event.AuthResponse {
+	reason := strings.TrimSpace(env.Reason)
+	code := faultCodeRegexp.FindString(reason)
+
+	// subcodes are qualified names such as a:FailedAuthentication
+	subcode := env.Subcode[strings.LastIndex(env.Subcode, ":")+1:]
+	metadata["faultCode"] = subcode
+	metadata["faultReason"] = reason
+	if code != "" {
+		metadata["code"] = code
+	}
+
+	o, ok := classify(code, reason)
+	if !ok {
+		metadata["unrecognizedCode"] = true
+		return &event.AuthResponse{
+			Valid:    false,
+			Metadata: metadata,
+		}
+	}
+	return o.Response(metadata)
+}
+
+var errorTextRegexp = regexp.MustCompile(`(?s)id="errorText"[^>]*>(.*?)</`)
+
+// errorText returns the error message shown by the sign-in page.
+func errorText(body []byte) string {
+	m := errorTextRegexp.FindSubmatch(body)
+	if m == nil {
+		return ""
+	}
+	return strings.TrimSpace(html.UnescapeString(string(m[1])))
+}
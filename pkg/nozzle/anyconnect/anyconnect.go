@@ -0,0 +1,225 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package anyconnect
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	netUrl "net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/fingerprint"
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+)
+
+var (
+	// RateLimiter limits requests from the same worker to a maximum of 3/s
+	RateLimiter = rate.NewLimiter(rate.Every(300*time.Millisecond), 1)
+)
+
+// maxBodySize limits the response body read for classification
+const maxBodySize = 1 << 20
+
+// Driver implements the nozzle.Driver interface.
+type Driver struct{}
+
+func init() {
+	nozzle.Register("anyconnect", Driver{})
+}
+
+// New is used to create a Cisco ASA AnyConnect (WebVPN) nozzle and accepts the
+// following configuration options:
+//
+// domain
+//
+// The host of the ASA's WebVPN portal, optionally with a port.
+//
+// group
+//
+// The connection profile (tunnel group) selected in the portal's GROUP
+// drop-down. Defaults to the ASA's default group.
+//
+// insecure
+//
+// Set to true to skip verification of the ASA's TLS certificate.
+// Certificates are verified by default.
+//
+// profiles, profile-mode
+//
+// The browser fingerprint profiles to send and how to choose between them. See
+// the fingerprint package for details.
+func (Driver) New(opts map[string]string) (nozzle.Nozzle, error) {
+	domain, ok := opts["domain"]
+	if !ok {
+		return nil, fmt.Errorf("anyconnect nozzle requires 'domain' config parameter")
+	}
+
+	profiles, err := fingerprint.NewSelector(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	insecure, err := nozzle.Insecure(opts)
+	if err != nil {
+		return nil, fmt.Errorf("anyconnect nozzle: %v", err)
+	}
+
+	return &Nozzle{
+		Domain:   domain,
+		Group:    opts["group"],
+		Profiles: profiles,
+		Client:   nozzle.NewClient(insecure),
+	}, nil
+}
+
+// Nozzle implements the nozzle.Nozzle interface for Cisco ASA WebVPN.
+type Nozzle struct {
+	// Domain is the ASA host
+	Domain string
+
+	// Group is the connection profile
+	Group string
+
+	// Profiles selects the browser headers sent with each request
+	Profiles *fingerprint.Selector
+
+	// Client is the HTTP client used to send requests. Each login uses a copy
+	// with a fresh cookie jar and redirects are never followed.
+	Client *http.Client
+}
+
+var (
+	reasonRegexp  = regexp.MustCompile(`reason=(\d+)`)
+	lockedRegexp  = regexp.MustCompile(`(?i)account (is |has been )?(locked|disabled)`)
+	expiredRegexp = regexp.MustCompile(`(?i)password (has )?expired|name="new_password"`)
+)
+
+// Login fulfils the nozzle.Nozzle interface. It loads the logon page, which
+// sets the cookies the ASA requires, and posts the logon form. A non-empty
+// webvpn session cookie is a valid login. A page asking for a challenge
+// response (an auth_handle form) is reported as MFA.
+func (n *Nozzle) Login(username, password string) (*event.AuthResponse, error) {
+	return n.LoginContext(context.Background(), username, password)
+}
+
+// LoginContext fulfils the nozzle.ContextNozzle interface. The requests are
+// cancelled with ctx.
+func (n *Nozzle) LoginContext(ctx context.Context, username, password string) (*event.AuthResponse, error) {
+	err := RateLimiter.Wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	client := *n.Client
+	client.Jar, _ = cookiejar.New(nil)
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	url := fmt.Sprintf("https://%s/+CSCOE+/logon.html", n.Domain)
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	n.Profiles.Apply(req, username)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(ioutil.Discard, resp.Body) // nolint:errcheck,gosec
+	resp.Body.Close()                  // nolint:errcheck,gosec
+
+	form := netUrl.Values{
+		"tgroup":      {""},
+		"next":        {""},
+		"tgcookieset": {""},
+		"group_list":  {n.Group},
+		"username":    {username},
+		"password":    {password},
+		"Login":       {"Login"},
+	}
+	url = fmt.Sprintf("https://%s/+webvpn+/index.html", n.Domain)
+	req, _ = http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	n.Profiles.Apply(req, username)
+	resp, err = client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint:errcheck
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := map[string]interface{}{
+		"status": resp.StatusCode,
+	}
+
+	session := false
+	for _, c := range resp.Cookies() {
+		if c.Name == "webvpn" && c.Value != "" {
+			session = true
+		}
+	}
+	location := resp.Header.Get("Location")
+	if m := reasonRegexp.FindStringSubmatch(location); m != nil {
+		metadata["reason"] = m[1]
+	}
+
+	switch {
+	case session:
+		return &event.AuthResponse{
+			Valid:      true,
+			UserStatus: event.UserStatusExists,
+			Metadata:   metadata,
+		}, nil
+	case bytes.Contains(body, []byte(`name="auth_handle"`)):
+		return &event.AuthResponse{
+			Valid:      true,
+			MFA:        true,
+			UserStatus: event.UserStatusExists,
+			Metadata:   metadata,
+		}, nil
+	case expiredRegexp.Match(body):
+		metadata["passwordExpired"] = true
+		return &event.AuthResponse{
+			Valid:      true,
+			UserStatus: event.UserStatusExists,
+			Metadata:   metadata,
+		}, nil
+	case lockedRegexp.Match(body):
+		return &event.AuthResponse{
+			Locked:     true,
+			UserStatus: event.UserStatusExists,
+			Metadata:   metadata,
+		}, nil
+	case bytes.Contains(body, []byte("Login failed")), metadata["reason"] != nil:
+		return &event.AuthResponse{
+			Valid:    false,
+			Metadata: metadata,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unrecognized anyconnect response: %d", resp.StatusCode)
+}
@@ -0,0 +1,155 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package anyconnect
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+	"github.com/praetorian-inc/trident/pkg/nozzle/nozzletest"
+)
+
+const successPage = `<html><head><script>
+document.location.replace("/+CSCOE+/portal.html");
+</script></head></html>`
+
+const challengePage = `<form name="frmLogin" method="post" action="/+webvpn+/login/challenge.html">
+<table><tr><td class="content">Enter the passcode sent to your phone</td></tr>
+<tr><td><input type="password" name="password" size="20"></td></tr></table>
+<input type="hidden" name="auth_handle" value="2617">
+<input type="hidden" name="status" value="2">
+<input type="hidden" name="username" value="eve">
+<input type="submit" name="Continue" value="Continue">
+</form>`
+
+const expiredPage = `<form name="frmLogin" method="post" action="/+webvpn+/login/password_change.html">
+<td class="content">Your password has expired. Enter a new password.</td>
+<input type="password" name="new_password" size="20">
+<input type="password" name="confirm_password" size="20">
+</form>`
+
+const lockedPage = `<form name="frmLogin" method="post" action="/+webvpn+/index.html">
+<td class="content">Login failed. Your account has been locked.</td>
+</form>`
+
+func asaHandler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/+CSCOE+/logon.html":
+			http.SetCookie(w, &http.Cookie{Name: "webvpnlogin", Value: "1", Path: "/"})
+			http.SetCookie(w, &http.Cookie{Name: "webvpnLang", Value: "en", Path: "/"})
+			fmt.Fprint(w, `<form name="frmLogin" method="post" action="/+webvpn+/index.html">`) // nolint:errcheck
+			return
+		case "/+webvpn+/index.html":
+		default:
+			w.WriteHeader(404)
+			return
+		}
+
+		if c, err := r.Cookie("webvpnlogin"); err != nil || c.Value != "1" {
+			t.Errorf("logon page cookie was not sent with login request")
+		}
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		if r.PostForm.Get("group_list") != "Employees" {
+			t.Errorf("group_list was %q", r.PostForm.Get("group_list"))
+		}
+
+		switch r.PostForm.Get("username") + ":" + r.PostForm.Get("password") {
+		case "alice:Password1!":
+			http.SetCookie(w, &http.Cookie{Name: "webvpn", Value: "C8A5E4@28672@AB12@5C1E0A", Path: "/"})
+			fmt.Fprint(w, successPage) // nolint:errcheck
+		case "eve:Password1!":
+			fmt.Fprint(w, challengePage) // nolint:errcheck
+		case "old:Password1!":
+			fmt.Fprint(w, expiredPage) // nolint:errcheck
+		case "bob:Password1!":
+			fmt.Fprint(w, lockedPage) // nolint:errcheck
+		case "unknown:Password1!":
+			w.WriteHeader(500)
+		default:
+			http.SetCookie(w, &http.Cookie{Name: "webvpn", Value: "", Path: "/"})
+			w.Header().Set("Location", "/+CSCOE+/logon.html?a0=15&a1=&a2=&a3=1&reason=1")
+			w.WriteHeader(302)
+		}
+	}
+}
+
+type testcase struct {
+	desc     string
+	username string
+	password string
+	valid    bool
+	mfa      bool
+	locked   bool
+	flag     string
+}
+
+func TestNozzle(t *testing.T) {
+	srv := httptest.NewTLSServer(asaHandler(t))
+	defer srv.Close()
+
+	noz, err := nozzle.Open("anyconnect", map[string]string{
+		"domain": srv.Listener.Addr().String(),
+		"group":  "Employees",
+	})
+	if err != nil {
+		t.Fatalf("unable to open nozzle: %s", err)
+	}
+	noz.(*Nozzle).Client = srv.Client()
+
+	var testcases = []testcase{
+		{"invalid login", "alice", "Invalid1!", false, false, false, ""},
+		{"valid login", "alice", "Password1!", true, false, false, ""},
+		{"valid login with challenge", "eve", "Password1!", true, true, false, ""},
+		{"password expired", "old", "Password1!", true, false, false, "passwordExpired"},
+		{"locked account", "bob", "Password1!", false, false, true, ""},
+	}
+
+	for _, test := range testcases {
+		res, err := noz.Login(test.username, test.password)
+		if err != nil {
+			t.Errorf("[%s] error in login: %s", test.desc, err)
+			continue
+		}
+		if res.Valid != test.valid {
+			t.Errorf("[%s] noz.valid was %t, expected %t", test.desc, res.Valid, test.valid)
+		}
+		if res.MFA != test.mfa {
+			t.Errorf("[%s] noz.mfa %t, expected %t", test.desc, res.MFA, test.mfa)
+		}
+		if res.Locked != test.locked {
+			t.Errorf("[%s] noz.locked %t, expected %t", test.desc, res.Locked, test.locked)
+		}
+		if test.flag != "" && res.Metadata[test.flag] != true {
+			t.Errorf("[%s] expected %s metadata", test.desc, test.flag)
+		}
+	}
+
+	_, err = noz.Login("unknown", "Password1!")
+	if err == nil {
+		t.Errorf("expected error for unrecognized response")
+	}
+}
+
+func TestConformance(t *testing.T) {
+	nozzletest.Run(t, Driver{}, nozzletest.AnyConnect, func(noz nozzle.Nozzle, client *http.Client) {
+		noz.(*Nozzle).Client = client
+	})
+}
@@ -0,0 +1,266 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package autologon
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/time/rate"
+
+	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/fingerprint"
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+	"github.com/praetorian-inc/trident/pkg/nozzle/o365"
+)
+
+var (
+	// RateLimiter limits requests from the same worker to a maximum of 3/s
+	RateLimiter = rate.NewLimiter(rate.Every(300*time.Millisecond), 1)
+)
+
+// Driver implements the nozzle.Driver interface.
+type Driver struct{}
+
+func init() {
+	nozzle.Register("autologon", Driver{})
+}
+
+// New is used to create an Azure AD Seamless SSO nozzle and accepts the
+// following configuration options:
+//
+// domain
+//
+// The tenant domain used in the autologon URL. This defaults to the domain of
+// each username (e.g. example.org for alice@example.org).
+//
+// host
+//
+// The autologon host to send requests to. This defaults to
+// autologon.microsoftazuread-sso.com and is unlikely to require configuration.
+//
+// insecure
+//
+// Set to true to skip verification of the autologon host's TLS certificate, e.g. when
+// sending logins through an intercepting proxy. Certificates are verified by
+// default.
+//
+// profiles, profile-mode
+//
+// The browser fingerprint profiles to send and how to choose between them. See
+// the fingerprint package for details.
+func (Driver) New(opts map[string]string) (nozzle.Nozzle, error) {
+	host, ok := opts["host"]
+	if !ok {
+		host = "autologon.microsoftazuread-sso.com"
+	}
+
+	profiles, err := fingerprint.NewSelector(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	insecure, err := nozzle.Insecure(opts)
+	if err != nil {
+		return nil, fmt.Errorf("autologon nozzle: %v", err)
+	}
+
+	return &Nozzle{
+		Host:     host,
+		Domain:   opts["domain"],
+		Profiles: profiles,
+		Client:   nozzle.NewClient(insecure),
+	}, nil
+}
+
+// Nozzle implements the nozzle.Nozzle interface for the Azure AD Seamless SSO
+// autologon endpoint. Unlike the o365 nozzle, this endpoint does not produce
+// Azure AD sign-in logs and is not subject to conditional access.
+type Nozzle struct {
+	// Host is the autologon host
+	// "autologon.microsoftazuread-sso.com" for example
+	Host string
+
+	// Domain is the tenant domain, if empty the username's domain is used
+	Domain string
+
+	// Profiles selects the browser headers sent with each request
+	Profiles *fingerprint.Selector
+
+	// Client is the HTTP client used to send requests
+	Client *http.Client
+}
+
+var (
+	autologonURL     = "https://%s/%s/winauth/trust/2005/usernamemixed?client-request-id=%s"
+	autologonRequest = `<?xml version="1.0" encoding="UTF-8"?>
+<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope"
+            xmlns:wsse="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd"
+            xmlns:wsu="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd"
+            xmlns:wsp="http://schemas.xmlsoap.org/ws/2004/09/policy"
+            xmlns:wsa="http://www.w3.org/2005/08/addressing"
+            xmlns:wst="http://schemas.xmlsoap.org/ws/2005/02/trust">
+  <s:Header>
+    <wsa:Action s:mustUnderstand="1">http://schemas.xmlsoap.org/ws/2005/02/trust/RST/Issue</wsa:Action>
+    <wsa:To s:mustUnderstand="1">%s</wsa:To>
+    <wsa:MessageID>urn:uuid:%s</wsa:MessageID>
+    <wsse:Security s:mustUnderstand="1">
+      <wsu:Timestamp wsu:Id="_0">
+        <wsu:Created>%s</wsu:Created>
+        <wsu:Expires>%s</wsu:Expires>
+      </wsu:Timestamp>
+      <wsse:UsernameToken wsu:Id="uuid-%s">
+        <wsse:Username>%s</wsse:Username>
+        <wsse:Password>%s</wsse:Password>
+      </wsse:UsernameToken>
+    </wsse:Security>
+  </s:Header>
+  <s:Body>
+    <wst:RequestSecurityToken Id="RST0">
+      <wst:RequestType>http://schemas.xmlsoap.org/ws/2005/02/trust/Issue</wst:RequestType>
+      <wsp:AppliesTo>
+        <wsa:EndpointReference>
+          <wsa:Address>urn:federation:MicrosoftOnline</wsa:Address>
+        </wsa:EndpointReference>
+      </wsp:AppliesTo>
+      <wst:KeyType>http://schemas.xmlsoap.org/ws/2005/05/identity/NoProofKey</wst:KeyType>
+    </wst:RequestSecurityToken>
+  </s:Body>
+</s:Envelope>`
+)
+
+func escape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s)) // nolint:gosec,errcheck
+	return b.String()
+}
+
+// soapFault is the subset of the SOAP fault returned for failed logins.
+type soapFault struct {
+	Body struct {
+		Fault struct {
+			Reason string `xml:"Reason>Text"`
+			Detail struct {
+				Code string `xml:"error>internalerror>code"`
+				Text string `xml:"error>internalerror>text"`
+			} `xml:"Detail"`
+		} `xml:"Fault"`
+	} `xml:"Body"`
+}
+
+func (n *Nozzle) domain(username string) (string, error) {
+	if n.Domain != "" {
+		return n.Domain, nil
+	}
+	i := strings.LastIndex(username, "@")
+	if i < 0 || i == len(username)-1 {
+		return "", fmt.Errorf("autologon nozzle requires a 'domain' config parameter or UPN usernames")
+	}
+	return username[i+1:], nil
+}
+
+// Login fulfils the nozzle.Nozzle interface and performs an authentication
+// requests against the autologon endpoint. This function supports rate
+// limiting and parses the AADSTS codes in SOAP faults.
+func (n *Nozzle) Login(username, password string) (*event.AuthResponse, error) {
+	return n.LoginContext(context.Background(), username, password)
+}
+
+// LoginContext fulfils the nozzle.ContextNozzle interface. The request is
+// cancelled with ctx.
+func (n *Nozzle) LoginContext(ctx context.Context, username, password string) (*event.AuthResponse, error) {
+	err := RateLimiter.Wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	domain, err := n.domain(username)
+	if err != nil {
+		return nil, err
+	}
+
+	requestID := uuid.New().String()
+	url := fmt.Sprintf(autologonURL, n.Host, domain, requestID)
+	created := time.Now().UTC()
+	data := fmt.Sprintf(autologonRequest, escape(url), uuid.New().String(),
+		created.Format(time.RFC3339), created.Add(10*time.Minute).Format(time.RFC3339),
+		uuid.New().String(), escape(username), escape(password))
+
+	req, _ := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(data))
+	req.Header.Set("Content-Type", "application/soap+xml; charset=utf-8")
+	n.Profiles.Apply(req, username)
+
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint:errcheck
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case 200:
+		// a proxy or maintenance page must not be credited as a login
+		if !bytes.Contains(body, []byte("DesktopSsoToken")) {
+			return nil, fmt.Errorf("autologon response did not contain a token")
+		}
+		return &event.AuthResponse{
+			Valid:      true,
+			UserStatus: event.UserStatusExists,
+			Metadata: map[string]interface{}{
+				"status": resp.StatusCode,
+			},
+		}, nil
+	case 429:
+		return &event.AuthResponse{
+			RateLimited: true,
+		}, nil
+	case 400, 401:
+		return parseFault(body)
+	}
+
+	return nil, fmt.Errorf("unhandled status code from autologon: %d", resp.StatusCode)
+}
+
+func parseFault(body []byte) (*event.AuthResponse, error) {
+	var fault soapFault
+	err := xml.Unmarshal(body, &fault)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing autologon fault: %w", err)
+	}
+
+	// the autologon endpoint returns the same AADSTS codes as the token
+	// endpoint, so both nozzles share the o365 code table
+	text := fault.Body.Fault.Detail.Text
+	code := o365.ParseCode(text)
+	if code == "" {
+		return nil, fmt.Errorf("unhandled autologon fault: %s", fault.Body.Fault.Reason)
+	}
+
+	if o, _ := o365.LookupCode(code); o.Fatal {
+		return nil, fmt.Errorf("autologon request failed with %s (%s)", code, o.Desc)
+	}
+	return o365.Response(code), nil
+}
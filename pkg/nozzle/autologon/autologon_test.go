@@ -0,0 +1,167 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package autologon
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+	"github.com/praetorian-inc/trident/pkg/nozzle/nozzletest"
+)
+
+const faultResponse = `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope">
+  <s:Body>
+    <s:Fault>
+      <s:Code><s:Value>s:Sender</s:Value></s:Code>
+      <s:Reason><s:Text xml:lang="en-US">Authentication Failure</s:Text></s:Reason>
+      <s:Detail>
+        <psf:error xmlns:psf="http://schemas.microsoft.com/Passport/SoapServices/SOAPFault">
+          <psf:value>0x80048821</psf:value>
+          <psf:internalerror>
+            <psf:code>0x80048821</psf:code>
+            <psf:text>%s: %s&#xD;
+Trace ID: 00000000-0000-0000-0000-000000000000</psf:text>
+          </psf:internalerror>
+        </psf:error>
+      </s:Detail>
+    </s:Fault>
+  </s:Body>
+</s:Envelope>`
+
+const successResponse = `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope">
+  <s:Body>
+    <wst:RequestSecurityTokenResponse xmlns:wst="http://schemas.xmlsoap.org/ws/2005/02/trust">
+      <wst:RequestedSecurityToken><DesktopSsoToken>token</DesktopSsoToken></wst:RequestedSecurityToken>
+    </wst:RequestSecurityTokenResponse>
+  </s:Body>
+</s:Envelope>`
+
+// users maps each test user to the AADSTS code returned for a bad password.
+var users = map[string]string{
+	"alice@example.org": "AADSTS50126",
+	"bob@example.org":   "AADSTS50053",
+	"eve@example.org":   "AADSTS50076",
+	"mal@example.org":   "AADSTS53003",
+}
+
+func autologonHandler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/winauth/trust/2005/usernamemixed") {
+			http.NotFound(w, r)
+			return
+		}
+		if strings.Split(r.URL.Path, "/")[1] == "unknown.example" {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, faultResponse, "AADSTS50128", "Invalid domain name") // nolint:errcheck
+			return
+		}
+
+		var env struct {
+			Username string `xml:"Header>Security>UsernameToken>Username"`
+			Password string `xml:"Header>Security>UsernameToken>Password"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&env); err != nil {
+			t.Errorf("error decoding request: %s", err)
+		}
+
+		code, ok := users[env.Username]
+		switch {
+		case !ok:
+			code = "AADSTS50034"
+		case env.Password == "Password1!" && code == "AADSTS50126":
+			w.Write([]byte(successResponse)) // nolint:errcheck,gosec
+			return
+		case env.Password != "Password1!" && code != "AADSTS50053":
+			code = "AADSTS50126"
+		}
+
+		w.WriteHeader(400)
+		fmt.Fprintf(w, faultResponse, code, "Error") // nolint:errcheck
+	}
+}
+
+type testcase struct {
+	desc     string
+	username string
+	password string
+	valid    bool
+	mfa      bool
+	locked   bool
+	status   event.UserStatus
+}
+
+func TestNozzle(t *testing.T) {
+	srv := httptest.NewTLSServer(autologonHandler(t))
+	defer srv.Close()
+
+	noz, err := nozzle.Open("autologon", map[string]string{
+		"host": srv.Listener.Addr().String(),
+	})
+	if err != nil {
+		t.Fatalf("unable to open nozzle: %s", err)
+	}
+	noz.(*Nozzle).Client = srv.Client()
+
+	var testcases = []testcase{
+		{"invalid login", "alice@example.org", "Invalid1!", false, false, false, event.UserStatusExists},
+		{"valid login", "alice@example.org", "Password1!", true, false, false, event.UserStatusExists},
+		{"locked account", "bob@example.org", "Password1!", false, false, true, event.UserStatusExists},
+		{"valid login with mfa", "eve@example.org", "Password1!", true, true, false, event.UserStatusExists},
+		{"valid login blocked by ca", "mal@example.org", "Password1!", true, false, false, event.UserStatusExists},
+		{"unknown user", "nobody@example.org", "Password1!", false, false, false, event.UserStatusNotExists},
+	}
+
+	for _, test := range testcases {
+		res, err := noz.Login(test.username, test.password)
+		if err != nil {
+			t.Errorf("[%s] error in login: %s", test.desc, err)
+			continue
+		}
+		if res.Valid != test.valid {
+			t.Errorf("[%s] noz.valid was %t, expected %t", test.desc, res.Valid, test.valid)
+		}
+		if res.MFA != test.mfa {
+			t.Errorf("[%s] noz.mfa %t, expected %t", test.desc, res.MFA, test.mfa)
+		}
+		if res.Locked != test.locked {
+			t.Errorf("[%s] noz.locked %t, expected %t", test.desc, res.Locked, test.locked)
+		}
+		if res.UserStatus != test.status {
+			t.Errorf("[%s] noz.status %s, expected %s", test.desc, res.UserStatus, test.status)
+		}
+	}
+
+	_, err = noz.Login("alice@unknown.example", "Password1!")
+	if err == nil {
+		t.Errorf("expected error for unknown tenant")
+	}
+
+	_, err = noz.Login("alice", "Password1!")
+	if err == nil {
+		t.Errorf("expected error for username without a domain")
+	}
+}
+
+func TestConformance(t *testing.T) {
+	nozzletest.Run(t, Driver{}, nozzletest.Autologon, func(noz nozzle.Nozzle, client *http.Client) {
+		noz.(*Nozzle).Client = client
+	})
+}
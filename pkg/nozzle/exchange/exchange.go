@@ -0,0 +1,282 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exchange
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/fingerprint"
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+	"github.com/praetorian-inc/trident/pkg/ntlm"
+)
+
+var (
+	// RateLimiter limits requests from the same worker to a maximum of 3/s
+	RateLimiter = rate.NewLimiter(rate.Every(300*time.Millisecond), 1)
+)
+
+// Driver implements the nozzle.Driver interface.
+type Driver struct{}
+
+func init() {
+	nozzle.Register("exchange", Driver{})
+}
+
+// Endpoint is an Exchange endpoint which accepts legacy authentication.
+type Endpoint struct {
+	// Path is the URL path of the endpoint
+	Path string
+
+	// Method is the HTTP method which elicits an authentication challenge
+	Method string
+}
+
+// Endpoints are the Exchange endpoints the nozzle can target. Each of these
+// authenticate with a password alone, so they are frequently exempt from the
+// MFA enforced on interactive logins.
+var Endpoints = map[string]Endpoint{
+	"ews":          {Path: "/EWS/Exchange.asmx", Method: "GET"},
+	"activesync":   {Path: "/Microsoft-Server-ActiveSync", Method: "OPTIONS"},
+	"autodiscover": {Path: "/autodiscover/autodiscover.xml", Method: "GET"},
+}
+
+// New is used to create an Exchange nozzle and accepts the following
+// configuration options:
+//
+// domain
+//
+// The host serving Exchange (e.g. mail.example.org).
+//
+// endpoint
+//
+// The endpoint to authenticate against. This can be one of the following:
+// ews (default), activesync, or autodiscover.
+//
+// auth
+//
+// The authentication scheme, either ntlm (default) or basic. Usernames may be
+// given in DOMAIN\user or UPN format.
+//
+// insecure
+//
+// Set to true to skip verification of the Exchange server's TLS certificate.
+// Certificates are verified by default.
+//
+// profiles, profile-mode
+//
+// The browser fingerprint profiles to send and how to choose between them. See
+// the fingerprint package for details.
+func (Driver) New(opts map[string]string) (nozzle.Nozzle, error) {
+	domain, ok := opts["domain"]
+	if !ok {
+		return nil, fmt.Errorf("exchange nozzle requires 'domain' config parameter")
+	}
+
+	endpoint, ok := opts["endpoint"]
+	if !ok {
+		endpoint = "ews"
+	}
+	if _, ok := Endpoints[endpoint]; !ok {
+		return nil, fmt.Errorf("exchange nozzle: unknown endpoint %q", endpoint)
+	}
+
+	auth, ok := opts["auth"]
+	if !ok {
+		auth = "ntlm"
+	}
+	if auth != "ntlm" && auth != "basic" {
+		return nil, fmt.Errorf("exchange nozzle: unknown auth scheme %q", auth)
+	}
+
+	profiles, err := fingerprint.NewSelector(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	insecure, err := nozzle.Insecure(opts)
+	if err != nil {
+		return nil, fmt.Errorf("exchange nozzle: %v", err)
+	}
+
+	return &Nozzle{
+		Domain:   domain,
+		Endpoint: endpoint,
+		Auth:     auth,
+		Profiles: profiles,
+		Client:   nozzle.NewClient(insecure),
+	}, nil
+}
+
+// Nozzle implements the nozzle.Nozzle interface for Exchange.
+type Nozzle struct {
+	// Domain is the Exchange host
+	Domain string
+
+	// Endpoint is the name of the targeted endpoint in Endpoints
+	Endpoint string
+
+	// Auth is the authentication scheme (ntlm or basic)
+	Auth string
+
+	// Profiles selects the browser headers sent with each request
+	Profiles *fingerprint.Selector
+
+	// Client is the HTTP client used to send requests. NTLM negotiation is
+	// added to its transport when Auth is ntlm and redirects are never
+	// followed.
+	Client *http.Client
+}
+
+// Login fulfils the nozzle.Nozzle interface and performs an authentication
+// request against the configured Exchange endpoint. A credential is only
+// credited once the endpoint has challenged for the configured scheme, since
+// endpoints which allow anonymous access, redirect to SSO, or deny every
+// client (e.g. IIS requiring client certificates) would otherwise report every
+// guess as valid. Any authenticated response is a valid login, and because
+// these endpoints do not prompt for MFA valid logins are flagged with the
+// "mfaBypass" metadata.
+func (n *Nozzle) Login(username, password string) (*event.AuthResponse, error) {
+	return n.LoginContext(context.Background(), username, password)
+}
+
+// LoginContext fulfils the nozzle.ContextNozzle interface. The requests are
+// cancelled with ctx.
+func (n *Nozzle) LoginContext(ctx context.Context, username, password string) (*event.AuthResponse, error) {
+	err := RateLimiter.Wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	e := Endpoints[n.Endpoint]
+	url := fmt.Sprintf("https://%s%s", n.Domain, e.Path)
+
+	rec := &recorder{RoundTripper: n.Client.Transport, schemes: []string{"Basic"}}
+	if n.Auth == "ntlm" {
+		// the negotiator falls back to basic authentication when NTLM is
+		// not offered
+		rec.schemes = []string{"NTLM", "Negotiate", "Basic"}
+	}
+	client := *n.Client
+	client.Transport = rec
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	if n.Auth == "ntlm" {
+		// the negotiator sends the request anonymously before negotiating
+		client = *ntlm.Client(&client)
+	} else {
+		req, _ := http.NewRequestWithContext(ctx, e.Method, url, nil)
+		n.Profiles.Apply(req, username)
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close() // nolint:errcheck,gosec
+		if !rec.challenged {
+			return nil, fmt.Errorf("exchange %s did not challenge for basic authentication (status %d)",
+				n.Endpoint, resp.StatusCode)
+		}
+	}
+
+	req, _ := http.NewRequestWithContext(ctx, e.Method, url, nil)
+	req.SetBasicAuth(username, password)
+	n.Profiles.Apply(req, username)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()            // nolint:errcheck
+	io.Copy(ioutil.Discard, resp.Body) // nolint:errcheck,gosec
+
+	metadata := map[string]interface{}{
+		"status":   resp.StatusCode,
+		"endpoint": n.Endpoint,
+		"auth":     n.Auth,
+	}
+
+	switch {
+	case resp.StatusCode == 401:
+		return &event.AuthResponse{
+			Valid:    false,
+			Metadata: metadata,
+		}, nil
+	case resp.StatusCode == 429:
+		return &event.AuthResponse{
+			RateLimited: true,
+			Metadata:    metadata,
+		}, nil
+	case resp.StatusCode >= 300 && resp.StatusCode < 400:
+		return nil, fmt.Errorf("unexpected redirect from exchange %s to %q", n.Endpoint, resp.Header.Get("Location"))
+	case !rec.challenged:
+		return nil, fmt.Errorf("exchange %s did not challenge for %s authentication (status %d)",
+			n.Endpoint, n.Auth, resp.StatusCode)
+	case resp.StatusCode == 403:
+		// the credential was accepted but the user is not permitted to use
+		// this endpoint (e.g. ActiveSync is disabled for the mailbox)
+		metadata["forbidden"] = true
+		return &event.AuthResponse{
+			Valid:      true,
+			UserStatus: event.UserStatusExists,
+			Metadata:   metadata,
+		}, nil
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		metadata["mfaBypass"] = true
+		return &event.AuthResponse{
+			Valid:      true,
+			UserStatus: event.UserStatusExists,
+			Metadata:   metadata,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unhandled status code from exchange %s: %d", n.Endpoint, resp.StatusCode)
+}
+
+// recorder is an http.RoundTripper which records whether the server challenged
+// the client to authenticate with one of schemes.
+type recorder struct {
+	http.RoundTripper
+	schemes    []string
+	challenged bool
+}
+
+// RoundTrip fulfils the http.RoundTripper interface.
+func (r *recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt := r.RoundTripper
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil || resp.StatusCode != 401 {
+		return resp, err
+	}
+	for _, h := range resp.Header.Values("WWW-Authenticate") {
+		for _, scheme := range r.schemes {
+			if strings.EqualFold(h, scheme) || strings.HasPrefix(strings.ToLower(h), strings.ToLower(scheme)+" ") {
+				r.challenged = true
+			}
+		}
+	}
+	return resp, err
+}
@@ -0,0 +1,181 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exchange
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+	"github.com/praetorian-inc/trident/pkg/nozzle/nozzletest"
+	"github.com/praetorian-inc/trident/pkg/ntlm"
+)
+
+var serverChallenge = []byte("01234567")
+
+var challenge = ntlm.NewChallenge(&ntlm.ChallengeInfo{
+	NetBIOSDomain: "CORP",
+	DNSDomain:     "corp.example.org",
+}, serverChallenge)
+
+var passwords = map[string]string{
+	"alice": "Password1!",
+	"bob":   "Password1!",
+}
+
+// authenticated returns the user authenticated by the request or writes the
+// next authentication challenge.
+func authenticated(t *testing.T, w http.ResponseWriter, r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	switch {
+	case strings.HasPrefix(auth, "Basic "):
+		user, pass, _ := r.BasicAuth()
+		if p, ok := passwords[user]; ok && p == pass {
+			return user, true
+		}
+	case strings.HasPrefix(auth, "NTLM "):
+		data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "NTLM "))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := ntlm.ParseAuthenticate(data)
+		if err != nil {
+			// this is the negotiate message, respond with a challenge
+			w.Header().Set("WWW-Authenticate", "NTLM "+base64.StdEncoding.EncodeToString(challenge))
+			w.WriteHeader(401)
+			return "", false
+		}
+		if p, ok := passwords[msg.User]; ok && msg.Verify(serverChallenge, "CORP", p) {
+			return msg.User, true
+		}
+	}
+
+	w.Header().Add("WWW-Authenticate", "NTLM")
+	w.Header().Add("WWW-Authenticate", `Basic realm="mail.example.org"`)
+	w.WriteHeader(401)
+	return "", false
+}
+
+func exchangeHandler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := authenticated(t, w, r)
+		if !ok {
+			return
+		}
+		switch {
+		case r.URL.Path == "/Microsoft-Server-ActiveSync" && user == "bob":
+			w.WriteHeader(403)
+		default:
+			w.WriteHeader(200)
+		}
+	}
+}
+
+type testcase struct {
+	desc      string
+	username  string
+	password  string
+	valid     bool
+	forbidden bool
+}
+
+func TestNozzle(t *testing.T) {
+	srv := httptest.NewTLSServer(exchangeHandler(t))
+	defer srv.Close()
+
+	var testcases = []testcase{
+		{"invalid login", "alice", "Invalid1!", false, false},
+		{"valid login", "alice", "Password1!", true, false},
+		{"valid login with domain", `CORP\alice`, "Password1!", true, false},
+		{"unknown user", "nobody", "Password1!", false, false},
+	}
+
+	for endpoint := range Endpoints {
+		for _, auth := range []string{"ntlm", "basic"} {
+			noz, err := nozzle.Open("exchange", map[string]string{
+				"domain":   srv.Listener.Addr().String(),
+				"endpoint": endpoint,
+				"auth":     auth,
+			})
+			if err != nil {
+				t.Fatalf("unable to open nozzle: %s", err)
+			}
+			noz.(*Nozzle).Client = srv.Client()
+
+			tests := testcases
+			if endpoint == "activesync" {
+				tests = append(tests, testcase{"activesync disabled", "bob", "Password1!", true, true})
+			}
+			for _, test := range tests {
+				if auth == "basic" && strings.Contains(test.username, `\`) {
+					continue
+				}
+				res, err := noz.Login(test.username, test.password)
+				if err != nil {
+					t.Errorf("[%s/%s %s] error in login: %s", endpoint, auth, test.desc, err)
+					continue
+				}
+				if res.Valid != test.valid {
+					t.Errorf("[%s/%s %s] noz.valid was %t, expected %t", endpoint, auth, test.desc, res.Valid, test.valid)
+				}
+				if test.valid && (res.Metadata["mfaBypass"] == true) == test.forbidden {
+					t.Errorf("[%s/%s %s] unexpected mfaBypass metadata %v", endpoint, auth, test.desc, res.Metadata["mfaBypass"])
+				}
+				if (res.Metadata["forbidden"] == true) != test.forbidden {
+					t.Errorf("[%s/%s %s] unexpected forbidden metadata %v", endpoint, auth, test.desc, res.Metadata["forbidden"])
+				}
+			}
+		}
+	}
+
+	// responses without an authentication challenge never credit a guess
+	unchallenged := map[string]http.HandlerFunc{
+		"anonymous access": func(w http.ResponseWriter, r *http.Request) {},
+		"sso redirect": func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "https://sso.example.org/login", http.StatusFound)
+		},
+		"ssl required": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(403)
+		},
+	}
+	for desc, h := range unchallenged {
+		srv := httptest.NewTLSServer(h)
+		for _, auth := range []string{"ntlm", "basic"} {
+			noz, err := nozzle.Open("exchange", map[string]string{"domain": srv.Listener.Addr().String(), "auth": auth})
+			if err != nil {
+				t.Fatalf("unable to open nozzle: %s", err)
+			}
+			noz.(*Nozzle).Client = srv.Client()
+			if res, err := noz.Login("alice", "Password1!"); err == nil {
+				t.Errorf("[%s/%s] expected error, got %+v", desc, auth, res)
+			}
+		}
+		srv.Close()
+	}
+
+	_, err := nozzle.Open("exchange", map[string]string{"domain": "mail.example.org", "endpoint": "owa"})
+	if err == nil {
+		t.Errorf("expected error for unknown endpoint")
+	}
+}
+
+func TestConformance(t *testing.T) {
+	nozzletest.Run(t, Driver{}, nozzletest.Exchange, func(noz nozzle.Nozzle, client *http.Client) {
+		noz.(*Nozzle).Client = client
+	})
+}
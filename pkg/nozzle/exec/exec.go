@@ -0,0 +1,505 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package exec implements a nozzle which delegates to an external plugin
+// program, so that one-off providers can be added without rebuilding the
+// workers.
+//
+// A plugin is started once for each configuration and kept running until it
+// has been idle for PluginIdleTimeout, another configuration needs its place
+// under MaxPlugins, or the worker calls Shutdown. It reads
+// requests from stdin and writes responses to stdout, one JSON object per
+// line. Anything written to stderr is passed through to the worker's stderr.
+// The exchange begins with a handshake, which checks the protocol version and
+// passes the nozzle configuration to the plugin:
+//
+//	> {"type":"describe","version":1}
+//	< {"type":"describe","version":1,"name":"acme","options":[{"name":"domain","required":true}],"capabilities":["check_user"]}
+//	> {"type":"options","options":{"domain":"portal.example.org"}}
+//	< {"type":"options"}
+//
+// Each guess is then sent as a login request and answered with a result in
+// the same shape as an event.AuthResponse:
+//
+//	> {"type":"login","id":1,"username":"alice","password":"Password1!"}
+//	< {"type":"result","id":1,"result":{"valid":true,"mfa":true,"metadata":{"factor":"push"}}}
+//
+// Session artifacts captured for a valid credential are returned in the
+// result's "artifacts" field.
+//
+// Plugins which advertise the check_user capability also accept check_user
+// requests, which carry only a username. Any request may be answered with
+// {"type":"error","id":1,"error":"reason"}, which is reported as a nozzle
+// error rather than an invalid credential.
+package exec
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+)
+
+var (
+	// RateLimiter limits requests from the same worker to a maximum of 3/s
+	RateLimiter = rate.NewLimiter(rate.Every(300*time.Millisecond), 1)
+
+	// PluginDir is the directory plugins are run from. Nozzle configurations
+	// come from campaign requests, so plugins are only ever resolved inside
+	// this directory. The exec nozzle is disabled when it is empty.
+	PluginDir string
+
+	// MaxPlugins limits the number of plugin processes kept running. The
+	// least recently used idle plugin is stopped to make room for another.
+	MaxPlugins = 8
+
+	// PluginIdleTimeout is how long a plugin process is kept running without
+	// requests before it is stopped.
+	PluginIdleTimeout = 10 * time.Minute
+)
+
+// maxMessageSize limits the length of a single plugin response
+const maxMessageSize = 1 << 20
+
+// Driver implements the nozzle.Driver interface.
+type Driver struct{}
+
+func init() {
+	nozzle.Register("exec", Driver{})
+}
+
+// New is used to create a nozzle backed by an external plugin and accepts the
+// following configuration options:
+//
+// plugin
+//
+// The file name of the plugin in PluginDir.
+//
+// timeout
+//
+// How long to wait for the plugin to answer a request, as a Go duration.
+// Defaults to 30s. A plugin which times out is killed and restarted on the
+// next request.
+//
+// Every other option is passed to the plugin during the handshake.
+func (Driver) New(opts map[string]string) (nozzle.Nozzle, error) {
+	if PluginDir == "" {
+		return nil, fmt.Errorf("exec nozzle is disabled because no plugin directory is configured")
+	}
+
+	name, ok := opts["plugin"]
+	if !ok {
+		return nil, fmt.Errorf("exec nozzle requires 'plugin' config parameter")
+	}
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return nil, fmt.Errorf("exec nozzle: invalid plugin %q", name)
+	}
+
+	timeout := 30 * time.Second
+	if v, ok := opts["timeout"]; ok {
+		var err error
+		timeout, err = time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("exec nozzle: invalid timeout %q", v)
+		}
+	}
+
+	options := map[string]string{}
+	for k, v := range opts {
+		if k != "plugin" && k != "timeout" {
+			options[k] = v
+		}
+	}
+
+	return &Nozzle{
+		Path:    filepath.Join(PluginDir, name),
+		Options: options,
+		Timeout: timeout,
+	}, nil
+}
+
+// Nozzle implements the nozzle.Nozzle interface for plugins.
+type Nozzle struct {
+	// Path is the plugin executable
+	Path string
+
+	// Options are passed to the plugin during the handshake
+	Options map[string]string
+
+	// Timeout limits how long a request may take
+	Timeout time.Duration
+}
+
+// plugins holds the running plugin processes, keyed by the plugin and its
+// options.
+var plugins = struct {
+	sync.Mutex
+	running map[string]*process
+}{running: map[string]*process{}}
+
+// acquire returns the running plugin for the nozzle's configuration,
+// starting it if needed. The plugin is not stopped for being idle until it is
+// released.
+func (n *Nozzle) acquire() (*process, error) {
+	options, _ := json.Marshal(n.Options)
+	key := n.Path + "\x00" + string(options)
+
+	plugins.Lock()
+	defer plugins.Unlock()
+
+	p, ok := plugins.running[key]
+	if !ok || p.exited() {
+		delete(plugins.running, key)
+		evict(MaxPlugins - 1)
+
+		var err error
+		p, err = start(n.Path, n.Options, n.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		p.key = key
+		plugins.running[key] = p
+	}
+
+	if p.idle != nil {
+		p.idle.Stop()
+	}
+	p.active++
+	p.lastUsed = time.Now()
+	return p, nil
+}
+
+// release marks the end of a request to p, and stops p once it has been idle
+// for PluginIdleTimeout.
+func release(p *process) {
+	plugins.Lock()
+	defer plugins.Unlock()
+
+	p.active--
+	p.lastUsed = time.Now()
+	if p.active == 0 {
+		p.idle = time.AfterFunc(PluginIdleTimeout, func() {
+			plugins.Lock()
+			defer plugins.Unlock()
+			if p.active == 0 && time.Since(p.lastUsed) >= PluginIdleTimeout {
+				stop(p)
+			}
+		})
+	}
+}
+
+// evict stops exited plugins and then the least recently used idle plugins
+// until at most max are running. Plugins serving a request are never
+// stopped. The caller must hold the plugins lock.
+func evict(max int) {
+	for _, p := range plugins.running {
+		if p.exited() {
+			stop(p)
+		}
+	}
+	for len(plugins.running) > max {
+		var lru *process
+		for _, p := range plugins.running {
+			if p.active == 0 && (lru == nil || p.lastUsed.Before(lru.lastUsed)) {
+				lru = p
+			}
+		}
+		if lru == nil {
+			return
+		}
+		stop(lru)
+	}
+}
+
+// stop kills p and forgets it. The caller must hold the plugins lock.
+func stop(p *process) {
+	if plugins.running[p.key] == p {
+		delete(plugins.running, p.key)
+	}
+	if p.idle != nil {
+		p.idle.Stop()
+	}
+	p.kill()
+}
+
+// Shutdown stops every running plugin. Workers call it before exiting so that
+// no plugin processes are left behind.
+func Shutdown() {
+	plugins.Lock()
+	defer plugins.Unlock()
+
+	for _, p := range plugins.running {
+		stop(p)
+	}
+}
+
+// Login fulfils the nozzle.Nozzle interface and sends a login request to the
+// plugin.
+func (n *Nozzle) Login(username, password string) (*event.AuthResponse, error) {
+	ctx := context.Background()
+	err := RateLimiter.Wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := n.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release(p)
+	return p.result(&Request{
+		Type:     TypeLogin,
+		Username: username,
+		Password: password,
+	}, n.Timeout)
+}
+
+// CheckUser fulfils the nozzle.Enumerator interface for plugins which
+// advertise the check_user capability.
+func (n *Nozzle) CheckUser(username string) (*event.AuthResponse, error) {
+	ctx := context.Background()
+	err := RateLimiter.Wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := n.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release(p)
+	if !p.supports(CapabilityCheckUser) {
+		return nil, fmt.Errorf("exec plugin %s does not support user enumeration", p.name)
+	}
+	return p.result(&Request{
+		Type:     TypeCheckUser,
+		Username: username,
+	}, n.Timeout)
+}
+
+// process is a running plugin. Requests are sent one at a time.
+type process struct {
+	sync.Mutex
+
+	name         string
+	capabilities []string
+	cmd          *osexec.Cmd
+	stdin        io.WriteCloser
+	responses    chan *Response
+	lastID       uint64
+
+	// done is closed once the plugin's stdout is closed and killed once it
+	// has been killed
+	done     chan struct{}
+	killed   chan struct{}
+	killOnce sync.Once
+
+	// key, active (the number of requests in flight), lastUsed, and the
+	// idle timer are guarded by the plugins lock
+	key      string
+	active   int
+	lastUsed time.Time
+	idle     *time.Timer
+}
+
+// start runs a plugin and performs the handshake.
+func start(path string, options map[string]string, timeout time.Duration) (*process, error) {
+	cmd := osexec.Command(path) // nolint:gosec
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("exec nozzle: unable to start plugin: %w", err)
+	}
+
+	p := &process{
+		name:      filepath.Base(path),
+		cmd:       cmd,
+		stdin:     stdin,
+		responses: make(chan *Response),
+		done:      make(chan struct{}),
+		killed:    make(chan struct{}),
+	}
+	go p.read(stdout)
+
+	err = p.handshake(options, timeout)
+	if err != nil {
+		p.kill()
+		return nil, err
+	}
+	return p, nil
+}
+
+// read decodes responses until the plugin closes stdout or writes something
+// which is not a response.
+func (p *process) read(stdout io.Reader) {
+	defer func() {
+		close(p.done)
+		p.cmd.Wait() // nolint:errcheck,gosec
+	}()
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 4096), maxMessageSize)
+	for scanner.Scan() {
+		var res Response
+		err := json.Unmarshal(scanner.Bytes(), &res)
+		if err != nil {
+			res = Response{
+				Type:  TypeError,
+				Error: fmt.Sprintf("invalid message from plugin: %s", err),
+			}
+		}
+		select {
+		case p.responses <- &res:
+		case <-p.killed:
+			return
+		}
+	}
+}
+
+// exited reports whether the plugin has exited or been killed.
+func (p *process) exited() bool {
+	select {
+	case <-p.done:
+		return true
+	case <-p.killed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *process) kill() {
+	p.killOnce.Do(func() {
+		close(p.killed)
+		p.stdin.Close()      // nolint:errcheck,gosec
+		p.cmd.Process.Kill() // nolint:errcheck,gosec
+	})
+}
+
+func (p *process) handshake(options map[string]string, timeout time.Duration) error {
+	res, err := p.roundTrip(&Request{Type: TypeDescribe, Version: ProtocolVersion}, timeout)
+	if err != nil {
+		return err
+	}
+	if res.Type != TypeDescribe {
+		return fmt.Errorf("exec plugin %s: unexpected %q response to describe", p.name, res.Type)
+	}
+	if res.Version != ProtocolVersion {
+		return fmt.Errorf("exec plugin %s: unsupported protocol version %d", p.name, res.Version)
+	}
+	if res.Name != "" {
+		p.name = res.Name
+	}
+	p.capabilities = res.Capabilities
+
+	for _, o := range res.Options {
+		if _, ok := options[o.Name]; o.Required && !ok {
+			return fmt.Errorf("exec plugin %s requires '%s' config parameter", p.name, o.Name)
+		}
+	}
+
+	res, err = p.roundTrip(&Request{Type: TypeOptions, Options: options}, timeout)
+	if err != nil {
+		return err
+	}
+	if res.Type != TypeOptions {
+		return fmt.Errorf("exec plugin %s: unexpected %q response to options", p.name, res.Type)
+	}
+	return nil
+}
+
+func (p *process) supports(capability string) bool {
+	for _, c := range p.capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// result sends a login or check_user request and returns its result.
+func (p *process) result(req *Request, timeout time.Duration) (*event.AuthResponse, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.lastID++
+	req.ID = p.lastID
+	res, err := p.roundTrip(req, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if res.Type != TypeResult || res.ID != req.ID || res.Result == nil {
+		// the plugin is out of step with its requests
+		p.kill()
+		return nil, fmt.Errorf("exec plugin %s: unexpected response to request %d", p.name, req.ID)
+	}
+
+	r := res.Result
+	return &event.AuthResponse{
+		Valid:       r.Valid,
+		Locked:      r.Locked,
+		MFA:         r.MFA,
+		RateLimited: r.RateLimited,
+		UserStatus:  r.UserStatus,
+		Metadata:    r.Metadata,
+		Artifacts:   r.Artifacts,
+	}, nil
+}
+
+// roundTrip sends a request and waits for the response. A plugin which exits
+// or does not answer in time is killed.
+func (p *process) roundTrip(req *Request, timeout time.Duration) (*Response, error) {
+	data, _ := json.Marshal(req)
+	_, err := p.stdin.Write(append(data, '\n'))
+	if err != nil {
+		p.kill()
+		return nil, fmt.Errorf("exec plugin %s: %w", p.name, err)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case res := <-p.responses:
+		if res.Type == TypeError {
+			return nil, fmt.Errorf("exec plugin %s: %s", p.name, res.Error)
+		}
+		return res, nil
+	case <-p.done:
+		return nil, fmt.Errorf("exec plugin %s exited", p.name)
+	case <-timer.C:
+		p.kill()
+		return nil, fmt.Errorf("exec plugin %s did not respond within %s", p.name, timeout)
+	}
+}
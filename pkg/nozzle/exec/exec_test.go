@@ -0,0 +1,281 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exec
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+)
+
+// The test binary doubles as the plugin: when started by the nozzle with
+// TRIDENT_TEST_PLUGIN set it serves the plugin protocol instead of running
+// the tests.
+func TestMain(m *testing.M) {
+	if os.Getenv("TRIDENT_TEST_PLUGIN") != "" {
+		servePlugin()
+		os.Exit(0)
+	}
+
+	PluginDir = filepath.Dir(os.Args[0])
+	os.Setenv("TRIDENT_TEST_PLUGIN", "1") // nolint:errcheck,gosec
+	os.Exit(m.Run())
+}
+
+func servePlugin() {
+	dec := json.NewDecoder(os.Stdin)
+	enc := json.NewEncoder(os.Stdout)
+
+	var options map[string]string
+	for {
+		var req Request
+		if dec.Decode(&req) != nil {
+			return
+		}
+
+		var res Response
+		switch req.Type {
+		case TypeDescribe:
+			res = Response{
+				Type:         TypeDescribe,
+				Version:      ProtocolVersion,
+				Name:         "acme-portal",
+				Options:      []Option{{Name: "domain", Required: true, Description: "portal host"}},
+				Capabilities: []string{CapabilityCheckUser},
+			}
+		case TypeOptions:
+			options = req.Options
+			res = Response{Type: TypeOptions}
+			if options["domain"] != "portal.example.org" {
+				res = Response{Type: TypeError, Error: "unknown domain " + options["domain"]}
+			}
+		case TypeLogin:
+			r := &event.AuthResponse{Metadata: map[string]interface{}{"pid": os.Getpid()}}
+			switch req.Username + ":" + req.Password {
+			case "alice:Password1!":
+				r.Valid = true
+			case "eve:Password1!":
+				r.Valid, r.MFA = true, true
+				r.Metadata["factor"] = "push"
+			case "bob:Password1!":
+				r.Locked = true
+			case "slow:Password1!":
+				time.Sleep(time.Minute)
+			case "crash:Password1!":
+				os.Exit(1)
+			case "unknown:Password1!":
+				enc.Encode(Response{Type: TypeError, ID: req.ID, Error: "portal returned 500"}) // nolint:errcheck,gosec
+				continue
+			}
+			res = Response{Type: TypeResult, ID: req.ID, Result: r}
+		case TypeCheckUser:
+			status := event.UserStatusNotExists
+			if req.Username == "alice" {
+				status = event.UserStatusExists
+			}
+			res = Response{Type: TypeResult, ID: req.ID, Result: &event.AuthResponse{UserStatus: status}}
+		}
+		enc.Encode(&res) // nolint:errcheck,gosec
+	}
+}
+
+func open(t *testing.T, opts map[string]string) nozzle.Nozzle {
+	opts["plugin"] = filepath.Base(os.Args[0])
+	noz, err := nozzle.Open("exec", opts)
+	if err != nil {
+		t.Fatalf("unable to open nozzle: %s", err)
+	}
+	return noz
+}
+
+type testcase struct {
+	desc     string
+	username string
+	password string
+	valid    bool
+	mfa      bool
+	locked   bool
+}
+
+func TestNozzle(t *testing.T) {
+	noz := open(t, map[string]string{"domain": "portal.example.org"})
+
+	var testcases = []testcase{
+		{"invalid login", "alice", "Invalid1!", false, false, false},
+		{"valid login", "alice", "Password1!", true, false, false},
+		{"valid login with mfa", "eve", "Password1!", true, true, false},
+		{"locked account", "bob", "Password1!", false, false, true},
+	}
+
+	for _, test := range testcases {
+		res, err := noz.Login(test.username, test.password)
+		if err != nil {
+			t.Errorf("[%s] error in login: %s", test.desc, err)
+			continue
+		}
+		if res.Valid != test.valid {
+			t.Errorf("[%s] noz.valid was %t, expected %t", test.desc, res.Valid, test.valid)
+		}
+		if res.MFA != test.mfa {
+			t.Errorf("[%s] noz.mfa %t, expected %t", test.desc, res.MFA, test.mfa)
+		}
+		if res.Locked != test.locked {
+			t.Errorf("[%s] noz.locked %t, expected %t", test.desc, res.Locked, test.locked)
+		}
+	}
+
+	_, err := noz.Login("unknown", "Password1!")
+	if err == nil {
+		t.Errorf("expected error from plugin")
+	}
+
+	res, err := nozzle.CheckUser(noz, "alice")
+	if err != nil {
+		t.Fatalf("error in check user: %s", err)
+	}
+	if res.UserStatus != event.UserStatusExists {
+		t.Errorf("user status was %s, expected %s", res.UserStatus, event.UserStatusExists)
+	}
+}
+
+func TestProcessReuse(t *testing.T) {
+	opts := map[string]string{"domain": "portal.example.org", "timeout": "500ms"}
+	first := open(t, opts)
+	second := open(t, map[string]string{"domain": "portal.example.org", "timeout": "500ms"})
+
+	pid := func(noz nozzle.Nozzle) interface{} {
+		res, err := noz.Login("alice", "Password1!")
+		if err != nil {
+			t.Fatalf("error in login: %s", err)
+		}
+		return res.Metadata["pid"]
+	}
+
+	before := pid(first)
+	if pid(second) != before {
+		t.Errorf("nozzles with the same configuration started separate plugins")
+	}
+
+	// a plugin which does not answer in time is killed and restarted
+	_, err := first.Login("slow", "Password1!")
+	if err == nil {
+		t.Errorf("expected timeout error")
+	}
+	after := pid(second)
+	if after == before {
+		t.Errorf("plugin was not restarted after a timeout")
+	}
+
+	// as is one which exits
+	_, err = first.Login("crash", "Password1!")
+	if err == nil {
+		t.Errorf("expected error when the plugin exits")
+	}
+	if pid(first) == after {
+		t.Errorf("plugin was not restarted after exiting")
+	}
+}
+
+func TestEviction(t *testing.T) {
+	max, idle := MaxPlugins, PluginIdleTimeout
+	MaxPlugins, PluginIdleTimeout = 1, 200*time.Millisecond
+	defer func() {
+		MaxPlugins, PluginIdleTimeout = max, idle
+		Shutdown()
+	}()
+	Shutdown()
+
+	running := func() []*process {
+		plugins.Lock()
+		defer plugins.Unlock()
+		var list []*process
+		for _, p := range plugins.running {
+			list = append(list, p)
+		}
+		return list
+	}
+	login := func(noz nozzle.Nozzle) {
+		if _, err := noz.Login("alice", "Password1!"); err != nil {
+			t.Fatalf("error in login: %s", err)
+		}
+	}
+
+	// the least recently used plugin makes room for another configuration
+	login(open(t, map[string]string{"domain": "portal.example.org", "tenant": "a"}))
+	first := running()
+	login(open(t, map[string]string{"domain": "portal.example.org", "tenant": "b"}))
+	if len(first) != 1 || !first[0].exited() {
+		t.Errorf("least recently used plugin was not stopped")
+	}
+	if n := len(running()); n != 1 {
+		t.Errorf("%d plugins running, expected 1", n)
+	}
+
+	// idle plugins are stopped
+	second := running()
+	time.Sleep(500 * time.Millisecond)
+	if len(second) != 1 || !second[0].exited() || len(running()) != 0 {
+		t.Errorf("idle plugin was not stopped")
+	}
+
+	// as is every plugin on shutdown
+	login(open(t, map[string]string{"domain": "portal.example.org", "tenant": "c"}))
+	third := running()
+	Shutdown()
+	if len(third) != 1 || !third[0].exited() || len(running()) != 0 {
+		t.Errorf("plugin was not stopped on shutdown")
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	noz, err := nozzle.Open("exec", map[string]string{
+		"plugin": filepath.Base(os.Args[0]),
+	})
+	if err != nil {
+		t.Fatalf("unable to open nozzle: %s", err)
+	}
+	_, err = noz.Login("alice", "Password1!")
+	if err == nil {
+		t.Errorf("expected error for missing required option")
+	}
+
+	noz = open(t, map[string]string{"domain": "other.example.org"})
+	_, err = noz.Login("alice", "Password1!")
+	if err == nil {
+		t.Errorf("expected error for options rejected by the plugin")
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, name := range []string{"", ".", "..", "../bin/sh", "/bin/sh", `..\plugin`} {
+		_, err := nozzle.Open("exec", map[string]string{"plugin": name})
+		if err == nil {
+			t.Errorf("expected error for plugin %q", name)
+		}
+	}
+
+	dir := PluginDir
+	PluginDir = ""
+	defer func() { PluginDir = dir }()
+	_, err := nozzle.Open("exec", map[string]string{"plugin": "acme"})
+	if err == nil {
+		t.Errorf("expected error when no plugin directory is configured")
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exec
+
+import (
+	"github.com/praetorian-inc/trident/pkg/event"
+)
+
+// ProtocolVersion is the version of the plugin protocol implemented by this
+// package. Plugins must reply to the describe request with the same version.
+const ProtocolVersion = 1
+
+// Message types
+const (
+	TypeDescribe  = "describe"
+	TypeOptions   = "options"
+	TypeLogin     = "login"
+	TypeCheckUser = "check_user"
+	TypeResult    = "result"
+	TypeError     = "error"
+)
+
+// CapabilityCheckUser is advertised by plugins which support user enumeration
+const CapabilityCheckUser = "check_user"
+
+// Request is a message sent to a plugin on its stdin.
+type Request struct {
+	// Type is one of describe, options, login or check_user
+	Type string `json:"type"`
+
+	// Version is the protocol version, sent with the describe request
+	Version int `json:"version,omitempty"`
+
+	// ID is echoed in the response to a login or check_user request
+	ID uint64 `json:"id,omitempty"`
+
+	// Options is the nozzle configuration, sent with the options request
+	Options map[string]string `json:"options,omitempty"`
+
+	// Username and Password are the credential to check
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// Response is a message returned by a plugin on its stdout.
+type Response struct {
+	// Type is describe or options to acknowledge those requests, result for
+	// a login or check_user request, or error if any request failed
+	Type string `json:"type"`
+
+	// Version is the protocol version the plugin implements
+	Version int `json:"version,omitempty"`
+
+	// ID is the ID of the request being answered
+	ID uint64 `json:"id,omitempty"`
+
+	// Name is the plugin's name, used in error messages
+	Name string `json:"name,omitempty"`
+
+	// Options describes the configuration options the plugin accepts
+	Options []Option `json:"options,omitempty"`
+
+	// Capabilities lists optional requests the plugin supports
+	Capabilities []string `json:"capabilities,omitempty"`
+
+	// Result is the outcome of a login or check_user request. Only the
+	// valid, locked, mfa, rate_limited, user_status and metadata fields are
+	// used.
+	Result *event.AuthResponse `json:"result,omitempty"`
+
+	// Error describes why a request failed
+	Error string `json:"error,omitempty"`
+}
+
+// Option describes a plugin configuration option.
+type Option struct {
+	// Name is the option key
+	Name string `json:"name"`
+
+	// Required options must be set in the nozzle configuration
+	Required bool `json:"required,omitempty"`
+
+	// Description is shown to operators
+	Description string `json:"description,omitempty"`
+}
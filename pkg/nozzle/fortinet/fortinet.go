@@ -0,0 +1,217 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fortinet
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	netUrl "net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/fingerprint"
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+)
+
+var (
+	// RateLimiter limits requests from the same worker to a maximum of 3/s
+	RateLimiter = rate.NewLimiter(rate.Every(300*time.Millisecond), 1)
+)
+
+// maxBodySize limits the response body read for classification
+const maxBodySize = 1 << 20
+
+// Driver implements the nozzle.Driver interface.
+type Driver struct{}
+
+func init() {
+	nozzle.Register("fortinet", Driver{})
+}
+
+// New is used to create a FortiGate SSL VPN nozzle and accepts the following
+// configuration options:
+//
+// domain
+//
+// The host of the SSL VPN portal, including the port when it is not 443 (e.g.
+// vpn.example.org:10443).
+//
+// realm
+//
+// The SSL VPN realm, which is the path after the host in the portal's URL
+// (e.g. "contractors" for https://vpn.example.org/contractors). Defaults to
+// the root realm.
+//
+// insecure
+//
+// Set to true to skip verification of the SSL VPN's TLS certificate.
+// Certificates are verified by default.
+//
+// profiles, profile-mode
+//
+// The browser fingerprint profiles to send and how to choose between them. See
+// the fingerprint package for details.
+func (Driver) New(opts map[string]string) (nozzle.Nozzle, error) {
+	domain, ok := opts["domain"]
+	if !ok {
+		return nil, fmt.Errorf("fortinet nozzle requires 'domain' config parameter")
+	}
+
+	profiles, err := fingerprint.NewSelector(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	insecure, err := nozzle.Insecure(opts)
+	if err != nil {
+		return nil, fmt.Errorf("fortinet nozzle: %v", err)
+	}
+
+	return &Nozzle{
+		Domain:   domain,
+		Realm:    opts["realm"],
+		Profiles: profiles,
+		Client:   nozzle.NewClient(insecure),
+	}, nil
+}
+
+// Nozzle implements the nozzle.Nozzle interface for FortiGate SSL VPN.
+type Nozzle struct {
+	// Domain is the SSL VPN host
+	Domain string
+
+	// Realm is the SSL VPN realm
+	Realm string
+
+	// Profiles selects the browser headers sent with each request
+	Profiles *fingerprint.Selector
+
+	// Client is the HTTP client used to send requests. Redirects are never
+	// followed.
+	Client *http.Client
+}
+
+// parseReply parses the comma separated key=value pairs returned to the
+// portal's login script, e.g. "ret=1,redir=/remote/fortisslvpn".
+func parseReply(body []byte) map[string]string {
+	values := map[string]string{}
+	for _, pair := range strings.Split(strings.TrimSpace(string(body)), ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) == 2 {
+			values[kv[0]] = kv[1]
+		}
+	}
+	return values
+}
+
+// Login fulfils the nozzle.Nozzle interface and posts the portal's login
+// form. The "ret" value of the reply is 1 for a valid login, 2 when a
+// FortiToken or other second factor is required, and 0 for a failure.
+// FortiGate blocks the source address rather than the account after repeated
+// failures, which is reported as rate limiting.
+func (n *Nozzle) Login(username, password string) (*event.AuthResponse, error) {
+	return n.LoginContext(context.Background(), username, password)
+}
+
+// LoginContext fulfils the nozzle.ContextNozzle interface. The request is
+// cancelled with ctx.
+func (n *Nozzle) LoginContext(ctx context.Context, username, password string) (*event.AuthResponse, error) {
+	err := RateLimiter.Wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	client := *n.Client
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	form := netUrl.Values{
+		"ajax":       {"1"},
+		"username":   {username},
+		"realm":      {n.Realm},
+		"credential": {password},
+	}
+	url := fmt.Sprintf("https://%s/remote/logincheck", n.Domain)
+	req, _ := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	n.Profiles.Apply(req, username)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint:errcheck
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := map[string]interface{}{
+		"status": resp.StatusCode,
+	}
+
+	if bytes.Contains(bytes.ToLower(body), []byte("too many bad login attempts")) {
+		metadata["sourceBlocked"] = true
+		return &event.AuthResponse{
+			RateLimited: true,
+			Metadata:    metadata,
+		}, nil
+	}
+
+	// the reply is only meaningful from the login check itself, not from an
+	// error page or a proxy in front of it
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("unrecognized fortinet response: %d", resp.StatusCode)
+	}
+
+	reply := parseReply(body)
+	if redir, ok := reply["redir"]; ok {
+		metadata["redirect"] = redir
+	}
+
+	switch reply["ret"] {
+	case "1":
+		return &event.AuthResponse{
+			Valid:      true,
+			UserStatus: event.UserStatusExists,
+			Metadata:   metadata,
+		}, nil
+	case "2":
+		if msg, ok := reply["chal_msg"]; ok {
+			metadata["message"] = msg
+		}
+		return &event.AuthResponse{
+			Valid:      true,
+			MFA:        true,
+			UserStatus: event.UserStatusExists,
+			Metadata:   metadata,
+		}, nil
+	case "0":
+		return &event.AuthResponse{
+			Valid:    false,
+			Metadata: metadata,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unrecognized fortinet response: %d", resp.StatusCode)
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fortinet
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+	"github.com/praetorian-inc/trident/pkg/nozzle/nozzletest"
+)
+
+const (
+	replySuccess = "ret=1,redir=/remote/hostcheck_install?auth_type=1&user=alice&grpname=vpn-users&portal=full-access&rip=203.0.113.10&realm=\n"
+	replyToken   = "ret=2,reqid=1073768515,polid=1-1-1,grp=vpn-users,portal=full-access,peer=eve,magic=1-1073768515,tokeninfo=,chal_msg=Please enter your FortiToken code\n"
+	replyDenied  = "ret=0,redir=/remote/login?&err=sslvpn_login_permission_denied&lang=en\n"
+)
+
+const blockedPage = `<html><head><title>Login</title></head><body>
+<div class="message">Too many bad login attempts. Please try again in a few minutes.</div>
+</body></html>`
+
+func fortinetHandler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/remote/logincheck" {
+			w.WriteHeader(404)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		if r.PostForm.Get("ajax") != "1" || r.PostForm.Get("realm") != "contractors" {
+			t.Errorf("unexpected form %v", r.PostForm)
+		}
+
+		switch r.PostForm.Get("username") + ":" + r.PostForm.Get("credential") {
+		case "alice:Password1!":
+			http.SetCookie(w, &http.Cookie{Name: "SVPNCOOKIE", Value: "Q2tQZ1NZVlJ4"})
+			fmt.Fprint(w, replySuccess) // nolint:errcheck
+		case "eve:Password1!":
+			fmt.Fprint(w, replyToken) // nolint:errcheck
+		case "mal:Password1!":
+			fmt.Fprint(w, blockedPage) // nolint:errcheck
+		case "unknown:Password1!":
+			w.WriteHeader(405)
+		default:
+			http.SetCookie(w, &http.Cookie{Name: "SVPNCOOKIE", Value: ""})
+			fmt.Fprint(w, replyDenied) // nolint:errcheck
+		}
+	}
+}
+
+type testcase struct {
+	desc        string
+	username    string
+	password    string
+	valid       bool
+	mfa         bool
+	ratelimited bool
+}
+
+func TestNozzle(t *testing.T) {
+	srv := httptest.NewTLSServer(fortinetHandler(t))
+	defer srv.Close()
+
+	noz, err := nozzle.Open("fortinet", map[string]string{
+		"domain": srv.Listener.Addr().String(),
+		"realm":  "contractors",
+	})
+	if err != nil {
+		t.Fatalf("unable to open nozzle: %s", err)
+	}
+	noz.(*Nozzle).Client = srv.Client()
+
+	var testcases = []testcase{
+		{"invalid login", "alice", "Invalid1!", false, false, false},
+		{"valid login", "alice", "Password1!", true, false, false},
+		{"valid login with fortitoken", "eve", "Password1!", true, true, false},
+		{"source address blocked", "mal", "Password1!", false, false, true},
+	}
+
+	for _, test := range testcases {
+		res, err := noz.Login(test.username, test.password)
+		if err != nil {
+			t.Errorf("[%s] error in login: %s", test.desc, err)
+			continue
+		}
+		if res.Valid != test.valid {
+			t.Errorf("[%s] noz.valid was %t, expected %t", test.desc, res.Valid, test.valid)
+		}
+		if res.MFA != test.mfa {
+			t.Errorf("[%s] noz.mfa %t, expected %t", test.desc, res.MFA, test.mfa)
+		}
+		if res.RateLimited != test.ratelimited {
+			t.Errorf("[%s] noz.ratelimited %t, expected %t", test.desc, res.RateLimited, test.ratelimited)
+		}
+	}
+
+	_, err = noz.Login("unknown", "Password1!")
+	if err == nil {
+		t.Errorf("expected error for unrecognized response")
+	}
+}
+
+func TestConformance(t *testing.T) {
+	nozzletest.Run(t, Driver{}, nozzletest.Fortinet, func(noz nozzle.Nozzle, client *http.Client) {
+		noz.(*Nozzle).Client = client
+	})
+}
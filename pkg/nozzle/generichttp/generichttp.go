@@ -0,0 +1,263 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package generichttp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"strings"
+	"text/template"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/fingerprint"
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+)
+
+var (
+	// RateLimiter limits requests from the same worker to a maximum of 3/s
+	RateLimiter = rate.NewLimiter(rate.Every(300*time.Millisecond), 1)
+)
+
+// maxBodySize limits the response body read for matching and extraction
+const maxBodySize = 1 << 20
+
+// Driver implements the nozzle.Driver interface.
+type Driver struct{}
+
+func init() {
+	nozzle.Register("generic-http", Driver{})
+}
+
+// New is used to create a generic HTTP form nozzle and accepts the following
+// configuration options:
+//
+// spec
+//
+// The YAML login spec (see Spec). This allows a campaign to target a new
+// portal entirely through its provider metadata.
+//
+// spec-file
+//
+// The path of a YAML login spec on the worker, used when spec is not set.
+//
+// insecure
+//
+// Set to true to skip verification of the login host's TLS certificate.
+// Certificates are verified by default.
+//
+// profiles, profile-mode
+//
+// The browser fingerprint profiles to send and how to choose between them. See
+// the fingerprint package for details. Headers set by the spec take
+// precedence.
+func (Driver) New(opts map[string]string) (nozzle.Nozzle, error) {
+	data := []byte(opts["spec"])
+	if len(data) == 0 {
+		path, ok := opts["spec-file"]
+		if !ok {
+			return nil, fmt.Errorf("generic-http nozzle requires 'spec' or 'spec-file' config parameter")
+		}
+		var err error
+		data, err = ioutil.ReadFile(path) // nolint:gosec
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	spec, err := ParseSpec(data)
+	if err != nil {
+		return nil, err
+	}
+
+	profiles, err := fingerprint.NewSelector(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	insecure, err := nozzle.Insecure(opts)
+	if err != nil {
+		return nil, fmt.Errorf("generic-http nozzle: %v", err)
+	}
+
+	return &Nozzle{
+		Spec:     spec,
+		Profiles: profiles,
+		Client:   nozzle.NewClient(insecure),
+	}, nil
+}
+
+// Nozzle implements the nozzle.Nozzle interface for any HTTP form login
+// described by a Spec.
+type Nozzle struct {
+	// Spec describes the login requests and how to classify the response
+	Spec *Spec
+
+	// Profiles selects the browser headers sent with each request
+	Profiles *fingerprint.Selector
+
+	// Client is the HTTP client used to send requests. Each login uses a copy
+	// with a fresh cookie jar.
+	Client *http.Client
+}
+
+// templateData is passed to the request templates.
+type templateData struct {
+	Username string
+	Password string
+	Vars     map[string]string
+}
+
+func execute(t *template.Template, data *templateData) (string, error) {
+	var b bytes.Buffer
+	err := t.Execute(&b, data)
+	return b.String(), err
+}
+
+// do sends the templated request and returns the response with its body.
+func (n *Nozzle) do(ctx context.Context, client http.Client, r *Request, data *templateData) (*http.Response, []byte, error) {
+	url, err := execute(r.url, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := execute(r.body, data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, r.Method, url, strings.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, t := range r.headers {
+		v, err := execute(t, data)
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set(k, v)
+	}
+	n.Profiles.Apply(req, data.Username)
+
+	if !r.FollowRedirects {
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close() // nolint:errcheck
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i := range r.Extract {
+		e := &r.Extract[i]
+		v, ok := e.extract(resp, b)
+		if !ok {
+			return nil, nil, fmt.Errorf("generic-http unable to extract %q from %s", e.Name, url)
+		}
+		data.Vars[e.Name] = v
+	}
+	return resp, b, nil
+}
+
+// Login fulfils the nozzle.Nozzle interface. It sends the optional prelogin
+// request followed by the login request and classifies the response using
+// the spec's rules. When the spec has failure rules, responses which match no
+// rule are reported as errors so that a stale spec does not silently record
+// every guess as invalid. Otherwise every unmatched response is a failure.
+func (n *Nozzle) Login(username, password string) (*event.AuthResponse, error) {
+	return n.LoginContext(context.Background(), username, password)
+}
+
+// LoginContext fulfils the nozzle.ContextNozzle interface. The requests are
+// cancelled with ctx.
+func (n *Nozzle) LoginContext(ctx context.Context, username, password string) (*event.AuthResponse, error) {
+	err := RateLimiter.Wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	client := *n.Client
+	client.Jar, _ = cookiejar.New(nil)
+
+	data := &templateData{
+		Username: username,
+		Password: password,
+		Vars:     map[string]string{},
+	}
+
+	if n.Spec.Prelogin != nil {
+		_, _, err = n.do(ctx, client, n.Spec.Prelogin, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	resp, body, err := n.do(ctx, client, &n.Spec.Login, data)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := map[string]interface{}{
+		"status": resp.StatusCode,
+	}
+
+	switch {
+	case matchAny(n.Spec.RateLimit, resp, body):
+		return &event.AuthResponse{
+			RateLimited: true,
+			Metadata:    metadata,
+		}, nil
+	case matchAny(n.Spec.Lockout, resp, body):
+		return &event.AuthResponse{
+			Locked:     true,
+			UserStatus: event.UserStatusExists,
+			Metadata:   metadata,
+		}, nil
+	case matchAny(n.Spec.MFA, resp, body):
+		return &event.AuthResponse{
+			Valid:      true,
+			MFA:        true,
+			UserStatus: event.UserStatusExists,
+			Metadata:   metadata,
+		}, nil
+	case matchAny(n.Spec.Success, resp, body):
+		return &event.AuthResponse{
+			Valid:      true,
+			UserStatus: event.UserStatusExists,
+			Metadata:   metadata,
+		}, nil
+	case len(n.Spec.Failure) == 0, matchAny(n.Spec.Failure, resp, body):
+		return &event.AuthResponse{
+			Valid:    false,
+			Metadata: metadata,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("generic-http response matched no rules (status %d)", resp.StatusCode)
+}
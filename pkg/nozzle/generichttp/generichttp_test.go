@@ -0,0 +1,174 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package generichttp
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+	"github.com/praetorian-inc/trident/pkg/nozzle/nozzletest"
+)
+
+const testSpec = `
+prelogin:
+  url: '%[1]s/login'
+  extract:
+    - name: csrf
+      body: 'name="csrf" value="([^"]+)"'
+login:
+  url: '%[1]s/login'
+  headers:
+    Content-Type: application/x-www-form-urlencoded
+    X-Requested-For: '{{.Username}}'
+  body: 'user={{urlquery .Username}}&pass={{urlquery .Password}}&csrf={{urlquery .Vars.csrf}}'
+success:
+  - status: 302
+    header: {name: Location, regex: ^/dashboard$}
+    cookie: {name: auth}
+mfa:
+  - status: 302
+    header: {name: Location, regex: ^/mfa$}
+failure:
+  - status: 200
+    body: Invalid username or password
+lockout:
+  - body: account has been locked
+ratelimit:
+  - status: 429
+`
+
+func portalHandler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "s3ss10n"})
+			fmt.Fprint(w, `<form><input type="hidden" name="csrf" value="t0k3n"></form>`) // nolint:errcheck
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		if c, err := r.Cookie("session"); err != nil || c.Value != "s3ss10n" {
+			t.Errorf("prelogin cookie was not sent with login request")
+		}
+		if r.PostForm.Get("csrf") != "t0k3n" {
+			t.Errorf("csrf token was %q, expected t0k3n", r.PostForm.Get("csrf"))
+		}
+		if r.Header.Get("X-Requested-For") != r.PostForm.Get("user") {
+			t.Errorf("templated header was %q", r.Header.Get("X-Requested-For"))
+		}
+
+		switch r.PostForm.Get("user") + ":" + r.PostForm.Get("pass") {
+		case "alice@example.org:Password1!":
+			http.SetCookie(w, &http.Cookie{Name: "auth", Value: "token"})
+			http.Redirect(w, r, "/dashboard", http.StatusFound)
+		case "eve@example.org:Password1!":
+			http.Redirect(w, r, "/mfa", http.StatusFound)
+		case "bob@example.org:Password1!":
+			fmt.Fprint(w, "Your account has been locked") // nolint:errcheck
+		case "mal@example.org:Password1!":
+			w.WriteHeader(429)
+		case "unknown@example.org:Password1!":
+			w.WriteHeader(500)
+		default:
+			fmt.Fprint(w, "Invalid username or password") // nolint:errcheck
+		}
+	}
+}
+
+type testcase struct {
+	desc        string
+	username    string
+	password    string
+	valid       bool
+	mfa         bool
+	locked      bool
+	ratelimited bool
+}
+
+func TestNozzle(t *testing.T) {
+	srv := httptest.NewTLSServer(portalHandler(t))
+	defer srv.Close()
+
+	noz, err := nozzle.Open("generic-http", map[string]string{
+		"spec": fmt.Sprintf(testSpec, srv.URL),
+	})
+	if err != nil {
+		t.Fatalf("unable to open nozzle: %s", err)
+	}
+	noz.(*Nozzle).Client = srv.Client()
+
+	var testcases = []testcase{
+		{"invalid login", "alice@example.org", "Invalid1!", false, false, false, false},
+		{"valid login", "alice@example.org", "Password1!", true, false, false, false},
+		{"valid login with mfa", "eve@example.org", "Password1!", true, true, false, false},
+		{"locked account", "bob@example.org", "Password1!", false, false, true, false},
+		{"rate limited", "mal@example.org", "Password1!", false, false, false, true},
+	}
+
+	for _, test := range testcases {
+		res, err := noz.Login(test.username, test.password)
+		if err != nil {
+			t.Errorf("[%s] error in login: %s", test.desc, err)
+			continue
+		}
+		if res.Valid != test.valid {
+			t.Errorf("[%s] noz.valid was %t, expected %t", test.desc, res.Valid, test.valid)
+		}
+		if res.MFA != test.mfa {
+			t.Errorf("[%s] noz.mfa %t, expected %t", test.desc, res.MFA, test.mfa)
+		}
+		if res.Locked != test.locked {
+			t.Errorf("[%s] noz.locked %t, expected %t", test.desc, res.Locked, test.locked)
+		}
+		if res.RateLimited != test.ratelimited {
+			t.Errorf("[%s] noz.ratelimited %t, expected %t", test.desc, res.RateLimited, test.ratelimited)
+		}
+	}
+
+	_, err = noz.Login("unknown@example.org", "Password1!")
+	if err == nil || !strings.Contains(err.Error(), "matched no rules") {
+		t.Errorf("expected error for unmatched response, got %v", err)
+	}
+}
+
+func TestParseSpec(t *testing.T) {
+	var testcases = []struct {
+		desc string
+		spec string
+	}{
+		{"missing login url", "success: [{status: 200}]"},
+		{"missing success rules", "login: {url: https://example.org}"},
+		{"unknown field", "login: {url: https://example.org, form: x}\nsuccess: [{status: 200}]"},
+		{"invalid regex", "login: {url: https://example.org}\nsuccess: [{body: '('}]"},
+		{"invalid template", "login: {url: 'https://example.org/{{.Username'}\nsuccess: [{status: 200}]"},
+	}
+	for _, test := range testcases {
+		_, err := ParseSpec([]byte(test.spec))
+		if err == nil {
+			t.Errorf("[%s] expected error", test.desc)
+		}
+	}
+}
+
+func TestConformance(t *testing.T) {
+	nozzletest.Run(t, Driver{}, nozzletest.GenericHTTP, func(noz nozzle.Nozzle, client *http.Client) {
+		noz.(*Nozzle).Client = client
+	})
+}
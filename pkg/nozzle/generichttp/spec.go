@@ -0,0 +1,297 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package generichttp
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Spec describes how to log in to a portal. It is written in YAML, for
+// example:
+//
+//  prelogin:
+//    url: https://portal.example.org/login
+//    extract:
+//      - name: csrf
+//        body: 'name="csrf" value="([^"]+)"'
+//  login:
+//    method: POST
+//    url: https://portal.example.org/login
+//    headers:
+//      Content-Type: application/x-www-form-urlencoded
+//    body: 'user={{urlquery .Username}}&pass={{urlquery .Password}}&csrf={{urlquery .Vars.csrf}}'
+//  success:
+//    - status: 302
+//      header: {name: Location, regex: /dashboard}
+//  failure:
+//    - body: Invalid username or password
+//  lockout:
+//    - body: account has been locked
+//
+// The url, headers and body of each request are Go templates which receive
+// the Username, Password and the Vars extracted by the prelogin request.
+type Spec struct {
+	// Prelogin is an optional request sent before the login to collect
+	// cookies and CSRF tokens
+	Prelogin *Request `yaml:"prelogin"`
+
+	// Login is the login request
+	Login Request `yaml:"login"`
+
+	// Success, Failure, Lockout, MFA, and RateLimit classify the login
+	// response. They are checked in the order RateLimit, Lockout, MFA,
+	// Success, Failure and the first list with a matching rule wins. Only
+	// Success is required.
+	Success   []Matcher `yaml:"success"`
+	Failure   []Matcher `yaml:"failure"`
+	Lockout   []Matcher `yaml:"lockout"`
+	MFA       []Matcher `yaml:"mfa"`
+	RateLimit []Matcher `yaml:"ratelimit"`
+}
+
+// Request is a templated HTTP request.
+type Request struct {
+	// Method defaults to GET for the prelogin request and POST for the login
+	Method  string            `yaml:"method"`
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	Body    string            `yaml:"body"`
+
+	// FollowRedirects follows redirects instead of matching on the redirect
+	FollowRedirects bool `yaml:"follow-redirects"`
+
+	// Extract lists the values to collect from the response
+	Extract []Extract `yaml:"extract"`
+
+	url     *template.Template
+	headers map[string]*template.Template
+	body    *template.Template
+}
+
+// Extract collects a value from a response into Vars. Exactly one of Body,
+// Header, or Cookie is set. Body and Header are regular expressions whose
+// first submatch (or entire match) becomes the value. Cookie is a cookie
+// name.
+type Extract struct {
+	Name   string   `yaml:"name"`
+	Body   string   `yaml:"body"`
+	Header *Pattern `yaml:"header"`
+	Cookie string   `yaml:"cookie"`
+
+	body *regexp.Regexp
+}
+
+// Pattern matches the named header or cookie against a regular expression.
+// An empty Regex only requires the header or cookie to be present.
+type Pattern struct {
+	Name  string `yaml:"name"`
+	Regex string `yaml:"regex"`
+
+	regex *regexp.Regexp
+}
+
+// Matcher matches a response when every field it sets matches.
+type Matcher struct {
+	Status int      `yaml:"status"`
+	Header *Pattern `yaml:"header"`
+	Cookie *Pattern `yaml:"cookie"`
+	Body   string   `yaml:"body"`
+
+	body *regexp.Regexp
+}
+
+var funcs = template.FuncMap{
+	// json escapes a string for use inside a JSON string literal
+	"json": func(s string) string {
+		b, _ := json.Marshal(s)
+		return string(b[1 : len(b)-1])
+	},
+	"base64": func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	},
+}
+
+// ParseSpec parses and compiles a YAML spec.
+func ParseSpec(data []byte) (*Spec, error) {
+	var s Spec
+	err := yaml.UnmarshalStrict(data, &s)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing generic-http spec: %w", err)
+	}
+	if s.Login.URL == "" {
+		return nil, fmt.Errorf("generic-http spec requires a login url")
+	}
+	if len(s.Success) == 0 {
+		return nil, fmt.Errorf("generic-http spec requires at least one success rule")
+	}
+
+	if s.Prelogin != nil {
+		if s.Prelogin.Method == "" {
+			s.Prelogin.Method = "GET"
+		}
+		if err = s.Prelogin.compile("prelogin"); err != nil {
+			return nil, err
+		}
+	}
+	if s.Login.Method == "" {
+		s.Login.Method = "POST"
+	}
+	if err = s.Login.compile("login"); err != nil {
+		return nil, err
+	}
+
+	for _, rules := range [][]Matcher{s.Success, s.Failure, s.Lockout, s.MFA, s.RateLimit} {
+		for i := range rules {
+			if err = rules[i].compile(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &s, nil
+}
+
+func (r *Request) compile(name string) error {
+	var err error
+	r.url, err = template.New(name + ".url").Funcs(funcs).Parse(r.URL)
+	if err != nil {
+		return err
+	}
+	r.body, err = template.New(name + ".body").Funcs(funcs).Parse(r.Body)
+	if err != nil {
+		return err
+	}
+	r.headers = map[string]*template.Template{}
+	for k, v := range r.Headers {
+		r.headers[k], err = template.New(name + ".header").Funcs(funcs).Parse(v)
+		if err != nil {
+			return err
+		}
+	}
+	for i := range r.Extract {
+		e := &r.Extract[i]
+		if e.Name == "" {
+			return fmt.Errorf("generic-http %s extract requires a name", name)
+		}
+		if e.Body != "" {
+			if e.body, err = regexp.Compile(e.Body); err != nil {
+				return err
+			}
+		}
+		if e.Header != nil {
+			if err = e.Header.compile(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *Pattern) compile() error {
+	var err error
+	p.regex, err = regexp.Compile(p.Regex)
+	return err
+}
+
+func (m *Matcher) compile() error {
+	var err error
+	if m.Header != nil {
+		if err = m.Header.compile(); err != nil {
+			return err
+		}
+	}
+	if m.Cookie != nil {
+		if err = m.Cookie.compile(); err != nil {
+			return err
+		}
+	}
+	if m.Body != "" {
+		m.body, err = regexp.Compile(m.Body)
+	}
+	return err
+}
+
+// match reports whether the response matches every rule set in m.
+func (m *Matcher) match(resp *http.Response, body []byte) bool {
+	if m.Status != 0 && resp.StatusCode != m.Status {
+		return false
+	}
+	if m.Header != nil {
+		values, ok := resp.Header[http.CanonicalHeaderKey(m.Header.Name)]
+		if !ok || !m.Header.regex.MatchString(strings.Join(values, "\n")) {
+			return false
+		}
+	}
+	if m.Cookie != nil && !cookieMatch(resp, m.Cookie) {
+		return false
+	}
+	if m.body != nil && !m.body.Match(body) {
+		return false
+	}
+	return true
+}
+
+func cookieMatch(resp *http.Response, p *Pattern) bool {
+	for _, c := range resp.Cookies() {
+		if c.Name == p.Name && p.regex.MatchString(c.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(rules []Matcher, resp *http.Response, body []byte) bool {
+	for i := range rules {
+		if rules[i].match(resp, body) {
+			return true
+		}
+	}
+	return false
+}
+
+// extract collects the values of e from the response.
+func (e *Extract) extract(resp *http.Response, body []byte) (string, bool) {
+	switch {
+	case e.body != nil:
+		return submatch(e.body, string(body))
+	case e.Header != nil:
+		return submatch(e.Header.regex, resp.Header.Get(e.Header.Name))
+	case e.Cookie != "":
+		for _, c := range resp.Cookies() {
+			if c.Name == e.Cookie {
+				return c.Value, true
+			}
+		}
+	}
+	return "", false
+}
+
+func submatch(re *regexp.Regexp, s string) (string, bool) {
+	m := re.FindStringSubmatch(s)
+	switch len(m) {
+	case 0:
+		return "", false
+	case 1:
+		return m[0], true
+	}
+	return m[1], true
+}
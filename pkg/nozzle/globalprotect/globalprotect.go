@@ -0,0 +1,271 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package globalprotect
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	netUrl "net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+)
+
+var (
+	// RateLimiter limits requests from the same worker to a maximum of 3/s
+	RateLimiter = rate.NewLimiter(rate.Every(300*time.Millisecond), 1)
+)
+
+// maxBodySize limits the response body read for classification
+const maxBodySize = 1 << 20
+
+// UserAgent is sent by the GlobalProtect agent.
+const UserAgent = "PAN GlobalProtect"
+
+// Driver implements the nozzle.Driver interface.
+type Driver struct{}
+
+func init() {
+	nozzle.Register("globalprotect", Driver{})
+}
+
+// Endpoint is a GlobalProtect login flow.
+type Endpoint struct {
+	// Prelogin is the path of the prelogin request
+	Prelogin string
+
+	// Login is the path of the login request
+	Login string
+}
+
+// Endpoints maps the names accepted by the endpoint option to login flows.
+var Endpoints = map[string]Endpoint{
+	"portal":  {"/global-protect/prelogin.esp", "/global-protect/getconfig.esp"},
+	"gateway": {"/ssl-vpn/prelogin.esp", "/ssl-vpn/login.esp"},
+}
+
+// New is used to create a Palo Alto GlobalProtect nozzle and accepts the
+// following configuration options:
+//
+// domain
+//
+// The host of the GlobalProtect portal or gateway, optionally with a port.
+//
+// endpoint
+//
+// Either portal (default) or gateway. Gateways are often reachable directly
+// and do not always share the portal's authentication profile.
+//
+// insecure
+//
+// Set to true to skip verification of the GlobalProtect host's TLS
+// certificate. Certificates are verified by default.
+func (Driver) New(opts map[string]string) (nozzle.Nozzle, error) {
+	domain, ok := opts["domain"]
+	if !ok {
+		return nil, fmt.Errorf("globalprotect nozzle requires 'domain' config parameter")
+	}
+
+	endpoint, ok := opts["endpoint"]
+	if !ok {
+		endpoint = "portal"
+	}
+	if _, ok := Endpoints[endpoint]; !ok {
+		return nil, fmt.Errorf("globalprotect nozzle: unknown endpoint %q", endpoint)
+	}
+
+	insecure, err := nozzle.Insecure(opts)
+	if err != nil {
+		return nil, fmt.Errorf("globalprotect nozzle: %v", err)
+	}
+
+	return &Nozzle{
+		Domain:   domain,
+		Endpoint: endpoint,
+		Client:   nozzle.NewClient(insecure),
+	}, nil
+}
+
+// Nozzle implements the nozzle.Nozzle interface for GlobalProtect.
+type Nozzle struct {
+	// Domain is the GlobalProtect host
+	Domain string
+
+	// Endpoint is the name of the targeted login flow in Endpoints
+	Endpoint string
+
+	// Client is the HTTP client used to send requests. Redirects are never
+	// followed.
+	Client *http.Client
+}
+
+type preloginResponse struct {
+	Status         string `xml:"status"`
+	Msg            string `xml:"msg"`
+	SAMLAuthMethod string `xml:"saml-auth-method"`
+}
+
+var (
+	respStatusRegexp = regexp.MustCompile(`var respStatus = "([^"]*)"`)
+	respMsgRegexp    = regexp.MustCompile(`var respMsg = "([^"]*)"`)
+	lockedRegexp     = regexp.MustCompile(`(?i)locked`)
+	expiredRegexp    = regexp.MustCompile(`(?i)password.*(expired|change)|(expired|change).*password`)
+)
+
+func (n *Nozzle) post(ctx context.Context, client *http.Client, path string, form netUrl.Values) (*http.Response, []byte, error) {
+	url := fmt.Sprintf("https://%s%s", n.Domain, path)
+	req, _ := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", UserAgent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close() // nolint:errcheck
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	return resp, b, err
+}
+
+// Login fulfils the nozzle.Nozzle interface. It sends the agent's prelogin
+// request, which describes the authentication method, followed by the login
+// request. Portals using SAML are reported as errors as the password must be
+// sprayed at the identity provider instead.
+func (n *Nozzle) Login(username, password string) (*event.AuthResponse, error) {
+	return n.LoginContext(context.Background(), username, password)
+}
+
+// LoginContext fulfils the nozzle.ContextNozzle interface. The requests are
+// cancelled with ctx.
+func (n *Nozzle) LoginContext(ctx context.Context, username, password string) (*event.AuthResponse, error) {
+	err := RateLimiter.Wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	client := *n.Client
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	e := Endpoints[n.Endpoint]
+
+	_, body, err := n.post(ctx, &client, e.Prelogin, netUrl.Values{
+		"tmp":       {"tmp"},
+		"clientVer": {"4100"},
+		"clientos":  {"Windows"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var prelogin preloginResponse
+	if err = xml.Unmarshal(body, &prelogin); err != nil {
+		return nil, fmt.Errorf("invalid globalprotect prelogin response: %w", err)
+	}
+	if prelogin.Status != "Success" {
+		return nil, fmt.Errorf("globalprotect prelogin failed: %s", prelogin.Msg)
+	}
+	if prelogin.SAMLAuthMethod != "" {
+		return nil, fmt.Errorf("globalprotect %s uses SAML authentication", n.Endpoint)
+	}
+
+	resp, body, err := n.post(ctx, &client, e.Login, netUrl.Values{
+		"prot":                          {"https:"},
+		"server":                        {n.Domain},
+		"inputStr":                      {""},
+		"jnlpReady":                     {"jnlpReady"},
+		"user":                          {username},
+		"passwd":                        {password},
+		"computer":                      {"DESKTOP"},
+		"ok":                            {"Login"},
+		"direct":                        {"yes"},
+		"clientVer":                     {"4100"},
+		"os-version":                    {"Microsoft Windows 10 Pro , 64-bit"},
+		"clientos":                      {"Windows"},
+		"portal-userauthcookie":         {"empty"},
+		"portal-prelogonuserauthcookie": {"empty"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := map[string]interface{}{
+		"status":   resp.StatusCode,
+		"endpoint": n.Endpoint,
+	}
+
+	// failures and challenges are described by javascript variables, or by
+	// the body of a 512 response
+	status, msg := "", ""
+	if m := respStatusRegexp.FindSubmatch(body); m != nil {
+		status = string(m[1])
+	}
+	if m := respMsgRegexp.FindSubmatch(body); m != nil {
+		msg = strings.TrimSpace(string(m[1]))
+	} else if resp.StatusCode == 512 {
+		msg = strings.TrimSpace(string(body))
+	}
+	if msg != "" {
+		metadata["message"] = msg
+	}
+
+	switch {
+	case status == "Challenge" && expiredRegexp.MatchString(msg):
+		metadata["passwordExpired"] = true
+		return &event.AuthResponse{
+			Valid:      true,
+			UserStatus: event.UserStatusExists,
+			Metadata:   metadata,
+		}, nil
+	case status == "Challenge":
+		return &event.AuthResponse{
+			Valid:      true,
+			MFA:        true,
+			UserStatus: event.UserStatusExists,
+			Metadata:   metadata,
+		}, nil
+	case status == "Error", resp.StatusCode == 512,
+		resp.Header.Get("X-Private-Pan-Sslvpn") == "auth-failed":
+		if lockedRegexp.MatchString(msg) {
+			return &event.AuthResponse{
+				Locked:     true,
+				UserStatus: event.UserStatusExists,
+				Metadata:   metadata,
+			}, nil
+		}
+		return &event.AuthResponse{
+			Valid:    false,
+			Metadata: metadata,
+		}, nil
+	case resp.StatusCode == 200 && (bytes.Contains(body, []byte("<policy")) || bytes.Contains(body, []byte("<jnlp"))):
+		return &event.AuthResponse{
+			Valid:      true,
+			UserStatus: event.UserStatusExists,
+			Metadata:   metadata,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unrecognized globalprotect %s response: %d", n.Endpoint, resp.StatusCode)
+}
@@ -0,0 +1,200 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package globalprotect
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+	"github.com/praetorian-inc/trident/pkg/nozzle/nozzletest"
+)
+
+const preloginSuccess = `<?xml version="1.0" encoding="UTF-8" ?>
+<prelogin-response>
+<status>Success</status>
+<ccusername></ccusername>
+<autosubmit>false</autosubmit>
+<msg></msg>
+<newmsg></newmsg>
+<authentication-message>Enter login credentials</authentication-message>
+<username-label>Username</username-label>
+<password-label>Password</password-label>
+<panos-version>1</panos-version>
+<region>US</region>
+</prelogin-response>`
+
+const preloginSAML = `<?xml version="1.0" encoding="UTF-8" ?>
+<prelogin-response>
+<status>Success</status>
+<msg></msg>
+<saml-auth-method>REDIRECT</saml-auth-method>
+<saml-request>aHR0cHM6Ly9sb2dpbi5taWNyb3NvZnRvbmxpbmUuY29t</saml-request>
+<region>US</region>
+</prelogin-response>`
+
+const getconfigSuccess = `<?xml version="1.0" encoding="UTF-8" ?>
+<policy>
+<portal-name>GP-Portal</portal-name>
+<portal-config-version>4100</portal-config-version>
+<version>9.1.3</version>
+<client-role>global-protect-full</client-role>
+<portal-userauthcookie>nF3mjtcWdSIu3ClKYGNWnA==</portal-userauthcookie>
+</policy>`
+
+const loginSuccess = `<?xml version="1.0" encoding="utf-8"?>
+<jnlp>
+<application-desc>
+<argument>(auth)</argument>
+<argument>a1b2c3d4e5f6</argument>
+<argument>PAN GlobalProtect</argument>
+<argument>alice</argument>
+</application-desc>
+</jnlp>`
+
+const challengeOTP = `var respStatus = "Challenge";
+var respMsg = "Enter the code from your authenticator app";
+thisForm.inputStr.value = "5ef64e83000119ed";
+`
+
+const challengeExpired = `var respStatus = "Challenge";
+var respMsg = "Your password has expired. Please enter a new password";
+thisForm.inputStr.value = "5ef64e83000119ee";
+`
+
+const errorLocked = `var respStatus = "Error";
+var respMsg = "Authentication failed: Account is locked";
+thisForm.inputStr.value = "";
+`
+
+func gpHandler(t *testing.T, saml bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("User-Agent") != UserAgent {
+			t.Errorf("user agent was %q", r.Header.Get("User-Agent"))
+		}
+		switch r.URL.Path {
+		case "/global-protect/prelogin.esp", "/ssl-vpn/prelogin.esp":
+			if saml {
+				fmt.Fprint(w, preloginSAML) // nolint:errcheck
+				return
+			}
+			fmt.Fprint(w, preloginSuccess) // nolint:errcheck
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		switch r.PostForm.Get("user") + ":" + r.PostForm.Get("passwd") {
+		case "alice:Password1!":
+			if r.URL.Path == "/ssl-vpn/login.esp" {
+				fmt.Fprint(w, loginSuccess) // nolint:errcheck
+				return
+			}
+			fmt.Fprint(w, getconfigSuccess) // nolint:errcheck
+		case "eve:Password1!":
+			fmt.Fprint(w, challengeOTP) // nolint:errcheck
+		case "old:Password1!":
+			fmt.Fprint(w, challengeExpired) // nolint:errcheck
+		case "bob:Password1!":
+			w.Header().Set("X-Private-Pan-Sslvpn", "auth-failed")
+			fmt.Fprint(w, errorLocked) // nolint:errcheck
+		default:
+			w.Header().Set("X-Private-Pan-Sslvpn", "auth-failed")
+			w.WriteHeader(512)
+			fmt.Fprint(w, "Invalid username or password") // nolint:errcheck
+		}
+	}
+}
+
+type testcase struct {
+	desc     string
+	username string
+	password string
+	valid    bool
+	mfa      bool
+	locked   bool
+	flag     string
+}
+
+func TestNozzle(t *testing.T) {
+	srv := httptest.NewTLSServer(gpHandler(t, false))
+	defer srv.Close()
+
+	var testcases = []testcase{
+		{"invalid login", "alice", "Invalid1!", false, false, false, ""},
+		{"valid login", "alice", "Password1!", true, false, false, ""},
+		{"valid login with mfa", "eve", "Password1!", true, true, false, ""},
+		{"password expired", "old", "Password1!", true, false, false, "passwordExpired"},
+		{"locked account", "bob", "Password1!", false, false, true, ""},
+	}
+
+	for _, endpoint := range []string{"portal", "gateway"} {
+		noz, err := nozzle.Open("globalprotect", map[string]string{
+			"domain":   srv.Listener.Addr().String(),
+			"endpoint": endpoint,
+		})
+		if err != nil {
+			t.Fatalf("unable to open nozzle: %s", err)
+		}
+		noz.(*Nozzle).Client = srv.Client()
+
+		for _, test := range testcases {
+			res, err := noz.Login(test.username, test.password)
+			if err != nil {
+				t.Errorf("[%s %s] error in login: %s", endpoint, test.desc, err)
+				continue
+			}
+			if res.Valid != test.valid {
+				t.Errorf("[%s %s] noz.valid was %t, expected %t", endpoint, test.desc, res.Valid, test.valid)
+			}
+			if res.MFA != test.mfa {
+				t.Errorf("[%s %s] noz.mfa %t, expected %t", endpoint, test.desc, res.MFA, test.mfa)
+			}
+			if res.Locked != test.locked {
+				t.Errorf("[%s %s] noz.locked %t, expected %t", endpoint, test.desc, res.Locked, test.locked)
+			}
+			if test.flag != "" && res.Metadata[test.flag] != true {
+				t.Errorf("[%s %s] expected %s metadata", endpoint, test.desc, test.flag)
+			}
+		}
+	}
+}
+
+func TestSAML(t *testing.T) {
+	srv := httptest.NewTLSServer(gpHandler(t, true))
+	defer srv.Close()
+
+	noz, err := nozzle.Open("globalprotect", map[string]string{
+		"domain": srv.Listener.Addr().String(),
+	})
+	if err != nil {
+		t.Fatalf("unable to open nozzle: %s", err)
+	}
+	noz.(*Nozzle).Client = srv.Client()
+
+	_, err = noz.Login("alice", "Password1!")
+	if err == nil {
+		t.Errorf("expected error for SAML portal")
+	}
+}
+
+func TestConformance(t *testing.T) {
+	nozzletest.Run(t, Driver{}, nozzletest.GlobalProtect, func(noz nozzle.Nozzle, client *http.Client) {
+		noz.(*Nozzle).Client = client
+	})
+}
@@ -0,0 +1,373 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kerberos
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5" // nolint:gosec
+	"crypto/rand"
+	"crypto/rc4"  // nolint:gosec
+	"crypto/sha1" // nolint:gosec
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4" // nolint:staticcheck
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Encryption types (RFC 3962 and RFC 4757)
+const (
+	ETypeAES128 int32 = 17
+	ETypeAES256 int32 = 18
+	ETypeRC4    int32 = 23
+)
+
+// ETypes maps the names accepted by the etypes option to encryption types.
+var ETypes = map[string]int32{
+	"aes128": ETypeAES128,
+	"aes256": ETypeAES256,
+	"rc4":    ETypeRC4,
+}
+
+// Key usages (RFC 4120 7.5.1)
+const (
+	usagePAEncTimestamp = 1
+	usageASRepEncPart   = 3
+)
+
+// errIntegrity is returned when a ciphertext fails its integrity check, which
+// is how a wrong password manifests when decrypting.
+var errIntegrity = errors.New("kerberos integrity check failed")
+
+// stringToKey derives the long term key for the password (RFC 3961 section
+// 3). params are the optional s2kparams from PA-ETYPE-INFO2.
+func stringToKey(etype int32, password, salt string, params []byte) ([]byte, error) {
+	switch etype {
+	case ETypeRC4:
+		h := md4.New()
+		h.Write(utf16le(password)) // nolint:errcheck,gosec
+		return h.Sum(nil), nil
+	case ETypeAES128, ETypeAES256:
+		iterations := 4096
+		if len(params) == 4 {
+			iterations = int(binary.BigEndian.Uint32(params))
+		}
+		tkey := pbkdf2.Key([]byte(password), []byte(salt), iterations, aesKeyLen(etype), sha1.New)
+		return dk(tkey, []byte("kerberos"))
+	}
+	return nil, fmt.Errorf("unsupported kerberos etype %d", etype)
+}
+
+func encrypt(etype int32, key []byte, usage uint32, plain []byte) ([]byte, error) {
+	switch etype {
+	case ETypeRC4:
+		return rc4Encrypt(key, usage, plain)
+	case ETypeAES128, ETypeAES256:
+		return aesEncrypt(key, usage, plain)
+	}
+	return nil, fmt.Errorf("unsupported kerberos etype %d", etype)
+}
+
+func decrypt(etype int32, key []byte, usage uint32, ciphertext []byte) ([]byte, error) {
+	switch etype {
+	case ETypeRC4:
+		return rc4Decrypt(key, usage, ciphertext)
+	case ETypeAES128, ETypeAES256:
+		return aesDecrypt(key, usage, ciphertext)
+	}
+	return nil, fmt.Errorf("unsupported kerberos etype %d", etype)
+}
+
+func aesKeyLen(etype int32) int {
+	if etype == ETypeAES128 {
+		return 16
+	}
+	return 32
+}
+
+// aesEncrypt implements aes-cts-hmac-sha1-96 (RFC 3962).
+func aesEncrypt(key []byte, usage uint32, plain []byte) ([]byte, error) {
+	data := make([]byte, aes.BlockSize+len(plain))
+	if _, err := rand.Read(data[:aes.BlockSize]); err != nil {
+		return nil, err
+	}
+	copy(data[aes.BlockSize:], plain)
+	return aesSeal(key, usage, data)
+}
+
+// aesSeal encrypts data, which starts with the random confounder.
+func aesSeal(key []byte, usage uint32, data []byte) ([]byte, error) {
+	ke, ki, err := usageKeys(key, usage)
+	if err != nil {
+		return nil, err
+	}
+
+	ct, err := ctsEncrypt(ke, data)
+	if err != nil {
+		return nil, err
+	}
+	return append(ct, hmacSHA1(ki, data)[:12]...), nil
+}
+
+func aesDecrypt(key []byte, usage uint32, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < aes.BlockSize+12 {
+		return nil, fmt.Errorf("kerberos ciphertext too short")
+	}
+	ke, ki, err := usageKeys(key, usage)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := ciphertext[len(ciphertext)-12:]
+	data, err := ctsDecrypt(ke, ciphertext[:len(ciphertext)-12])
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(mac, hmacSHA1(ki, data)[:12]) {
+		return nil, errIntegrity
+	}
+	return data[aes.BlockSize:], nil
+}
+
+// usageKeys derives the encryption and integrity keys for a key usage.
+func usageKeys(key []byte, usage uint32) ([]byte, []byte, error) {
+	constant := make([]byte, 5)
+	binary.BigEndian.PutUint32(constant, usage)
+
+	constant[4] = 0xaa
+	ke, err := dk(key, constant)
+	if err != nil {
+		return nil, nil, err
+	}
+	constant[4] = 0x55
+	ki, err := dk(key, constant)
+	return ke, ki, err
+}
+
+// dk is the key derivation function DK(key, constant) from RFC 3961 section
+// 5.1. For AES, random-to-key is the identity function.
+func dk(key, constant []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	k := nfold(constant, aes.BlockSize)
+	out := make([]byte, 0, len(key)+aes.BlockSize)
+	for len(out) < len(key) {
+		next := make([]byte, aes.BlockSize)
+		block.Encrypt(next, k)
+		out = append(out, next...)
+		k = next
+	}
+	return out[:len(key)], nil
+}
+
+// nfold implements the n-fold operation from RFC 3961 section 5.1, producing
+// n bytes from the input.
+func nfold(in []byte, n int) []byte {
+	inBits, outBits := len(in)*8, n*8
+	lcm := inBits * outBits / gcd(inBits, outBits)
+
+	// concatenate copies of the input, each rotated right by 13 more bits
+	buf := make([]byte, 0, lcm/8)
+	for i := 0; i < lcm/inBits; i++ {
+		buf = append(buf, rotateRight(in, 13*i)...)
+	}
+
+	// ones' complement addition of each n byte chunk
+	sum := make([]byte, n)
+	for i := 0; i < len(buf); i += n {
+		carry := 0
+		for j := n - 1; j >= 0; j-- {
+			t := int(sum[j]) + int(buf[i+j]) + carry
+			sum[j] = byte(t)
+			carry = t >> 8
+		}
+		for j := n - 1; carry != 0; j = (j - 1 + n) % n {
+			t := int(sum[j]) + carry
+			sum[j] = byte(t)
+			carry = t >> 8
+		}
+	}
+	return sum
+}
+
+func rotateRight(in []byte, bits int) []byte {
+	n := len(in) * 8
+	out := make([]byte, len(in))
+	for i := 0; i < n; i++ {
+		if in[i/8]&(0x80>>uint(i%8)) != 0 {
+			j := (i + bits) % n
+			out[j/8] |= 0x80 >> uint(j%8)
+		}
+	}
+	return out
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// ctsEncrypt is AES in CBC mode with ciphertext stealing and a zero IV, where
+// the last two blocks are always swapped (RFC 3962 section 5).
+func ctsEncrypt(key, plain []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(plain) < aes.BlockSize {
+		return nil, fmt.Errorf("kerberos plaintext too short")
+	}
+
+	padded := make([]byte, (len(plain)+aes.BlockSize-1)/aes.BlockSize*aes.BlockSize)
+	copy(padded, plain)
+	ct := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(ct, padded)
+	if len(ct) == aes.BlockSize {
+		return ct, nil
+	}
+
+	n := len(ct)
+	out := append(append(ct[:n-2*aes.BlockSize:n-2*aes.BlockSize], ct[n-aes.BlockSize:]...), ct[n-2*aes.BlockSize:n-aes.BlockSize]...)
+	return out[:len(plain)], nil
+}
+
+func ctsDecrypt(key, ct []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ct) < aes.BlockSize {
+		return nil, fmt.Errorf("kerberos ciphertext too short")
+	}
+	iv := make([]byte, aes.BlockSize)
+	if len(ct) == aes.BlockSize {
+		out := make([]byte, aes.BlockSize)
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, ct)
+		return out, nil
+	}
+
+	r := len(ct) % aes.BlockSize
+	if r == 0 {
+		r = aes.BlockSize
+	}
+	prefix := ct[:len(ct)-aes.BlockSize-r]
+	cn := ct[len(ct)-aes.BlockSize-r : len(ct)-r]
+	partial := ct[len(ct)-r:]
+
+	out := make([]byte, len(prefix), len(ct))
+	prev := iv
+	if len(prefix) > 0 {
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, prefix)
+		prev = prefix[len(prefix)-aes.BlockSize:]
+	}
+
+	// decrypting the swapped final block yields the second to last
+	// ciphertext block XORed with the zero padded final plaintext
+	dn := make([]byte, aes.BlockSize)
+	block.Decrypt(dn, cn)
+	cn1 := append(append([]byte{}, partial...), dn[r:]...)
+	last := make([]byte, r)
+	for i := range last {
+		last[i] = dn[i] ^ cn1[i]
+	}
+
+	pn1 := make([]byte, aes.BlockSize)
+	block.Decrypt(pn1, cn1)
+	for i := range pn1 {
+		pn1[i] ^= prev[i]
+	}
+	return append(append(out, pn1...), last...), nil
+}
+
+// rc4Usage maps key usages to the values used by RC4-HMAC (RFC 4757 section
+// 4).
+func rc4Usage(usage uint32) []byte {
+	if usage == usageASRepEncPart {
+		usage = 8
+	}
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, usage)
+	return b
+}
+
+func rc4Encrypt(key []byte, usage uint32, plain []byte) ([]byte, error) {
+	data := make([]byte, 8+len(plain))
+	if _, err := rand.Read(data[:8]); err != nil {
+		return nil, err
+	}
+	copy(data[8:], plain)
+	return rc4Seal(key, usage, data)
+}
+
+// rc4Seal encrypts data, which starts with the random confounder.
+func rc4Seal(key []byte, usage uint32, data []byte) ([]byte, error) {
+	k1 := hmacMD5(key, rc4Usage(usage))
+	checksum := hmacMD5(k1, data)
+	c, err := rc4.NewCipher(hmacMD5(k1, checksum)) // nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+	c.XORKeyStream(data, data)
+	return append(checksum, data...), nil
+}
+
+func rc4Decrypt(key []byte, usage uint32, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < 16+8 {
+		return nil, fmt.Errorf("kerberos ciphertext too short")
+	}
+	k1 := hmacMD5(key, rc4Usage(usage))
+
+	checksum := ciphertext[:16]
+	c, err := rc4.NewCipher(hmacMD5(k1, checksum)) // nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, len(ciphertext)-16)
+	c.XORKeyStream(data, ciphertext[16:])
+	if !hmac.Equal(checksum, hmacMD5(k1, data)) {
+		return nil, errIntegrity
+	}
+	return data[8:], nil
+}
+
+func hmacMD5(key, data []byte) []byte {
+	mac := hmac.New(md5.New, key)
+	mac.Write(data) // nolint:errcheck,gosec
+	return mac.Sum(nil)
+}
+
+func hmacSHA1(key, data []byte) []byte {
+	mac := hmac.New(sha1.New, key)
+	mac.Write(data) // nolint:errcheck,gosec
+	return mac.Sum(nil)
+}
+
+func utf16le(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, r := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], r)
+	}
+	return b
+}
@@ -0,0 +1,167 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kerberos
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// RFC 3961 appendix A.1
+func TestNFold(t *testing.T) {
+	var testcases = []struct {
+		in   string
+		bits int
+		out  string
+	}{
+		{"012345", 64, "be072631276b1955"},
+		{"password", 56, "78a07b6caf85fa"},
+		{"Rough Consensus, and Running Code", 64, "bb6ed30870b7f0e0"},
+		{"password", 168, "59e4a8ca7c0385c3c37b3f6d2000247cb6e6bd5b3e"},
+		{"kerberos", 64, "6b65726265726f73"},
+	}
+	for _, test := range testcases {
+		out := hex.EncodeToString(nfold([]byte(test.in), test.bits/8))
+		if out != test.out {
+			t.Errorf("[%d-fold(%q)] was %s, expected %s", test.bits, test.in, out, test.out)
+		}
+	}
+}
+
+// RFC 3962 appendix B and the NT hash of "password"
+func TestStringToKey(t *testing.T) {
+	var testcases = []struct {
+		etype  int32
+		params []byte
+		key    string
+	}{
+		{ETypeAES128, []byte{0, 0, 0, 1}, "42263c6e89f4fc28b8df68ee09799f15"},
+		{ETypeAES256, []byte{0, 0, 0, 1}, "fe697b52bc0d3ce14432ba036a92e65bbb52280990a2fa27883998d72af30161"},
+		{ETypeRC4, nil, "8846f7eaee8fb117ad06bdd830b7586c"},
+	}
+	for _, test := range testcases {
+		key, err := stringToKey(test.etype, "password", "ATHENA.MIT.EDUraeburn", test.params)
+		if err != nil {
+			t.Errorf("[%d] error deriving key: %s", test.etype, err)
+			continue
+		}
+		if hex.EncodeToString(key) != test.key {
+			t.Errorf("[%d] key was %x, expected %s", test.etype, key, test.key)
+		}
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	for _, etype := range []int32{ETypeAES128, ETypeAES256, ETypeRC4} {
+		key, _ := stringToKey(etype, "Password1!", "CORP.EXAMPLE.ORGalice", nil)
+		wrong, _ := stringToKey(etype, "Invalid1!", "CORP.EXAMPLE.ORGalice", nil)
+
+		// lengths around the block size exercise ciphertext stealing
+		for _, k := range []int{0, 1, 15, 16, 17, 31, 32, 33, 100} {
+			plain := bytes.Repeat([]byte{'a'}, k)
+			ct, err := encrypt(etype, key, usagePAEncTimestamp, plain)
+			if err != nil {
+				t.Fatalf("[%d %d] error encrypting: %s", etype, k, err)
+			}
+			out, err := decrypt(etype, key, usagePAEncTimestamp, ct)
+			if err != nil || !bytes.Equal(out, plain) {
+				t.Errorf("[%d %d] round trip returned %x, %v", etype, k, out, err)
+			}
+			_, err = decrypt(etype, wrong, usagePAEncTimestamp, ct)
+			if !errors.Is(err, errIntegrity) {
+				t.Errorf("[%d %d] expected integrity error with wrong key, got %v", etype, k, err)
+			}
+			_, err = decrypt(etype, key, usageASRepEncPart, ct)
+			if !errors.Is(err, errIntegrity) {
+				t.Errorf("[%d %d] expected integrity error with wrong usage, got %v", etype, k, err)
+			}
+		}
+	}
+}
+
+// RFC 3962 appendix B
+func TestCTS(t *testing.T) {
+	key, _ := hex.DecodeString("636869636b656e207465726979616b69")
+	var testcases = []struct {
+		plain string
+		ct    string
+	}{
+		{"4920776f756c64206c696b652074686520", "c6353568f2bf8cb4d8a580362da7ff7f97"},
+		{"4920776f756c64206c696b65207468652047656e6572616c20476175277320", "fc00783e0efdb2c1d445d4c8eff7ed2297687268d6ecccc0c07b25e25ecfe5"},
+		{"4920776f756c64206c696b65207468652047656e6572616c2047617527732043", "39312523a78662d5be7fcbcc98ebf5a897687268d6ecccc0c07b25e25ecfe584"},
+		{"4920776f756c64206c696b65207468652047656e6572616c20476175277320436869636b656e2c20706c656173652c", "97687268d6ecccc0c07b25e25ecfe584b3fffd940c16a18c1b5549d2f838029e39312523a78662d5be7fcbcc98ebf5"},
+		{"4920776f756c64206c696b65207468652047656e6572616c20476175277320436869636b656e2c20706c656173652c20", "97687268d6ecccc0c07b25e25ecfe5849dad8bbb96c4cdc03bc103e1a194bbd839312523a78662d5be7fcbcc98ebf5a8"},
+		{"4920776f756c64206c696b65207468652047656e6572616c20476175277320436869636b656e2c20706c656173652c20616e6420776f6e746f6e20736f75702e", "97687268d6ecccc0c07b25e25ecfe58439312523a78662d5be7fcbcc98ebf5a84807efe836ee89a526730dbc2f7bc8409dad8bbb96c4cdc03bc103e1a194bbd8"},
+	}
+	for _, test := range testcases {
+		plain, _ := hex.DecodeString(test.plain)
+		ct, err := ctsEncrypt(key, plain)
+		if err != nil || hex.EncodeToString(ct) != test.ct {
+			t.Errorf("[%d] ciphertext was %x, %v, expected %s", len(plain), ct, err, test.ct)
+		}
+		ctb, _ := hex.DecodeString(test.ct)
+		out, err := ctsDecrypt(key, ctb)
+		if err != nil || hex.EncodeToString(out) != test.plain {
+			t.Errorf("[%d] plaintext was %x, %v, expected %s", len(plain), out, err, test.plain)
+		}
+	}
+}
+
+// The ciphertexts were produced by gokrb5's crypto package with the RFC 3962
+// appendix B key for "password" and the confounders below.
+func TestKnownAnswer(t *testing.T) {
+	var testcases = []struct {
+		etype      int32
+		usage      uint32
+		confounder string
+		plain      string
+		ct         string
+	}{
+		{ETypeAES128, usagePAEncTimestamp, "666855b73bd9c32b84dc8f48e0bb4c39", "kerberos", "68be2eedcac4ab91b57ed8c159cfa3a81eeaaa798ccc9f384d771e54792fa622782ed297"},
+		{ETypeAES128, usageASRepEncPart, "35879636501166074b4d8bfa02f86737", "known answer tst", "f19f83495a572317176013a1f7292f0c69616046e8bd227c8e699e657452d56aaedd8fb9ada0fe99062ccc33"},
+		{ETypeAES256, usagePAEncTimestamp, "6e02ec060e30ab7880085b19590cde6e", "kerberos", "39591d1a651ef354b05b00e191f6b6a630f59985006a294262a8a9dfc57a28525653d113"},
+		{ETypeAES256, usageASRepEncPart, "c327b1b21ae4a0ef103e14f6545282d6", "known answer tst", "987b2f1c2a4fa7563d764e6d373977be26ba7d866532d6f26bdd163242886ac460f29e61e616b0efb5539f8d"},
+		{ETypeRC4, usagePAEncTimestamp, "99dfe15c7ebd69cc", "kerberos", "28b4dbbdecb1b16c8e60145ae8c3dd5d7a1ccc72fa2b0871f7c1d86ae94ca7f4"},
+		{ETypeRC4, usageASRepEncPart, "4214a67dccab17a7", "known answer tst", "12ea432a412121ab2aaa2e4c2f5e12043bc3abe6fcddda04178eea71126ee5410a3efc341f83af7c"},
+	}
+	for _, test := range testcases {
+		var params []byte
+		if test.etype != ETypeRC4 {
+			params = []byte{0, 0, 0, 1}
+		}
+		key, _ := stringToKey(test.etype, "password", "ATHENA.MIT.EDUraeburn", params)
+
+		data, _ := hex.DecodeString(test.confounder)
+		data = append(data, test.plain...)
+		var ct []byte
+		var err error
+		if test.etype == ETypeRC4 {
+			ct, err = rc4Seal(key, test.usage, data)
+		} else {
+			ct, err = aesSeal(key, test.usage, data)
+		}
+		if err != nil || hex.EncodeToString(ct) != test.ct {
+			t.Errorf("[%d %d] ciphertext was %x, %v, expected %s", test.etype, test.usage, ct, err, test.ct)
+		}
+
+		ctb, _ := hex.DecodeString(test.ct)
+		out, err := decrypt(test.etype, key, test.usage, ctb)
+		if err != nil || string(out) != test.plain {
+			t.Errorf("[%d %d] plaintext was %q, %v, expected %q", test.etype, test.usage, out, err, test.plain)
+		}
+	}
+}
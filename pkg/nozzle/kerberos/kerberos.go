@@ -0,0 +1,484 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kerberos
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+)
+
+var (
+	// RateLimiter limits requests from the same worker to a maximum of 3/s
+	RateLimiter = rate.NewLimiter(rate.Every(300*time.Millisecond), 1)
+)
+
+// Driver implements the nozzle.Driver interface.
+type Driver struct{}
+
+func init() {
+	nozzle.Register("kerberos", Driver{})
+}
+
+// Transports accepted by the transport option.
+const (
+	TransportTCP = "tcp"
+	TransportUDP = "udp"
+)
+
+// KRB-ERROR codes (RFC 4120 7.5.9)
+const (
+	errCPrincipalUnknown = 6
+	errETypeNoSupport    = 14
+	errClientRevoked     = 18
+	errKeyExpired        = 23
+	errPreauthFailed     = 24
+	errPreauthRequired   = 25
+	errSkew              = 37
+	errResponseTooBig    = 52
+	errWrongRealm        = 68
+)
+
+// maxMessageSize limits the length of a KDC reply read over TCP
+const maxMessageSize = 1 << 20
+
+// till is the ticket end time requested by Windows clients.
+var till = time.Date(2037, 9, 13, 2, 48, 5, 0, time.UTC)
+
+// New is used to create a Kerberos pre-authentication nozzle and accepts the
+// following configuration options:
+//
+// realm
+//
+// The Kerberos realm of the users (e.g. CORP.EXAMPLE.ORG). For Active
+// Directory this is the DNS name of the domain.
+//
+// kdc
+//
+// The KDC to send requests to, optionally with a port. Defaults to the realm,
+// which resolves to the domain controllers in Active Directory, and port 88.
+//
+// transport
+//
+// Either tcp (default) or udp. Replies too large for UDP are retried over TCP.
+//
+// etypes
+//
+// A comma separated list of the encryption types offered to the KDC, in order
+// of preference. Defaults to aes256,aes128,rc4. Offering rc4 lets the nozzle
+// guess users without AES keys, but RC4 requests are commonly alerted on.
+func (Driver) New(opts map[string]string) (nozzle.Nozzle, error) {
+	realm, ok := opts["realm"]
+	if !ok {
+		return nil, fmt.Errorf("kerberos nozzle requires 'realm' config parameter")
+	}
+	realm = strings.ToUpper(realm)
+
+	kdc, ok := opts["kdc"]
+	if !ok {
+		kdc = strings.ToLower(realm)
+	}
+	if _, _, err := net.SplitHostPort(kdc); err != nil {
+		kdc = net.JoinHostPort(kdc, "88")
+	}
+
+	transport, ok := opts["transport"]
+	if !ok {
+		transport = TransportTCP
+	}
+	if transport != TransportTCP && transport != TransportUDP {
+		return nil, fmt.Errorf("kerberos nozzle: unknown transport %q", transport)
+	}
+
+	names, ok := opts["etypes"]
+	if !ok {
+		names = "aes256,aes128,rc4"
+	}
+	var etypes []int32
+	for _, name := range strings.Split(names, ",") {
+		etype, ok := ETypes[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("kerberos nozzle: unknown etype %q", name)
+		}
+		etypes = append(etypes, etype)
+	}
+
+	return &Nozzle{
+		KDC:       kdc,
+		Realm:     realm,
+		Transport: transport,
+		ETypes:    etypes,
+		Timeout:   10 * time.Second,
+	}, nil
+}
+
+// Nozzle implements the nozzle.Nozzle interface for Kerberos AS exchanges.
+type Nozzle struct {
+	// KDC is the host:port of the key distribution center
+	KDC string
+
+	// Realm is the upper case Kerberos realm
+	Realm string
+
+	// Transport is one of TransportTCP or TransportUDP
+	Transport string
+
+	// ETypes are the encryption types offered to the KDC in preference order
+	ETypes []int32
+
+	// Timeout limits each exchange with the KDC
+	Timeout time.Duration
+}
+
+// errorCodes maps the KRB-ERROR codes which describe the user to a normalized
+// result. Active Directory returns CLIENT_REVOKED for locked, disabled, and
+// expired accounts, and only returns KEY_EXPIRED once the password has been
+// verified.
+var errorCodes = map[int32]nozzle.Outcome{
+	errCPrincipalUnknown: {Desc: "client not found", UserStatus: event.UserStatusNotExists},
+	errClientRevoked:     {Desc: "client revoked", Locked: true, UserStatus: event.UserStatusExists},
+	errKeyExpired:        {Desc: "password expired", Valid: true, UserStatus: event.UserStatusExists, Flag: "passwordExpired"},
+	errPreauthFailed:     {Desc: "pre-authentication failed", UserStatus: event.UserStatusExists},
+}
+
+// errorNames is used to describe the KRB-ERROR codes which are returned as
+// errors.
+var errorNames = map[int32]string{
+	errETypeNoSupport:  "KDC_ERR_ETYPE_NOSUPP",
+	errPreauthRequired: "KDC_ERR_PREAUTH_REQUIRED",
+	errSkew:            "KRB_AP_ERR_SKEW",
+	errWrongRealm:      "KRB_AP_ERR_WRONG_REALM",
+}
+
+// principal strips any NetBIOS domain or UPN suffix from the username, leaving
+// the name within the realm.
+func principal(username string) string {
+	if i := strings.LastIndex(username, `\`); i >= 0 {
+		username = username[i+1:]
+	}
+	if i := strings.Index(username, "@"); i >= 0 {
+		username = username[:i]
+	}
+	return username
+}
+
+func (n *Nozzle) asReq(user string, padata []paData) (*kdcReq, error) {
+	nonce := make([]byte, 4)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return &kdcReq{
+		PVNO:    5,
+		MsgType: msgTypeASReq,
+		PAData:  padata,
+		ReqBody: kdcReqBody{
+			// forwardable, renewable, canonicalize, renewable-ok
+			KDCOptions: asn1.BitString{Bytes: []byte{0x40, 0x81, 0x00, 0x10}, BitLength: 32},
+			CName:      newPrincipal(nameTypePrincipal, user),
+			Realm:      tagged(2, generalString(n.Realm)),
+			SName:      newPrincipal(nameTypeSrvInst, "krbtgt", n.Realm),
+			Till:       till,
+			Nonce:      int32(binary.BigEndian.Uint32(nonce) & 0x7fffffff),
+			EType:      n.ETypes,
+		},
+	}, nil
+}
+
+// send writes the message to the KDC and returns its reply. Messages sent over
+// TCP are prefixed with their length (RFC 4120 7.2.2).
+func (n *Nozzle) send(transport string, msg []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(transport, n.KDC, n.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close() // nolint:errcheck
+	if err = conn.SetDeadline(time.Now().Add(n.Timeout)); err != nil {
+		return nil, err
+	}
+
+	if transport == TransportUDP {
+		if _, err = conn.Write(msg); err != nil {
+			return nil, err
+		}
+		b := make([]byte, 65535)
+		k, err := conn.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:k], nil
+	}
+
+	b := make([]byte, 4+len(msg))
+	binary.BigEndian.PutUint32(b, uint32(len(msg)))
+	copy(b[4:], msg)
+	if _, err = conn.Write(b); err != nil {
+		return nil, err
+	}
+
+	if _, err = io.ReadFull(conn, b[:4]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(b[:4])
+	if length > maxMessageSize {
+		return nil, fmt.Errorf("kerberos reply of %d bytes is too large", length)
+	}
+	b = make([]byte, length)
+	_, err = io.ReadFull(conn, b)
+	return b, err
+}
+
+// exchange sends an AS-REQ and returns either the AS-REP or the KRB-ERROR.
+func (n *Nozzle) exchange(req *kdcReq) (*kdcRep, *krbError, error) {
+	msg, err := marshalApplication(msgTypeASReq, *req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	transport := n.Transport
+	for {
+		b, err := n.send(transport, msg)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var rep kdcRep
+		var kerr krbError
+		tag, err := unmarshalApplication(b, func(tag int) interface{} {
+			switch tag {
+			case msgTypeASRep:
+				return &rep
+			case msgTypeKRBError:
+				return &kerr
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid kerberos reply: %w", err)
+		}
+		if tag == msgTypeASRep {
+			return &rep, nil, nil
+		}
+		if kerr.ErrorCode == errResponseTooBig && transport == TransportUDP {
+			transport = TransportTCP
+			continue
+		}
+		return nil, &kerr, nil
+	}
+}
+
+// choose returns the first PA-ETYPE-INFO2 entry with an etype the nozzle
+// offered. Without PA-ETYPE-INFO2 the preferred etype is used.
+func (n *Nozzle) choose(entries []etypeInfo2Entry) (etypeInfo2Entry, error) {
+	if len(entries) == 0 {
+		return etypeInfo2Entry{EType: n.ETypes[0]}, nil
+	}
+	for _, e := range entries {
+		for _, etype := range n.ETypes {
+			if e.EType == etype {
+				return e, nil
+			}
+		}
+	}
+	return etypeInfo2Entry{}, fmt.Errorf("kerberos KDC offered no supported etypes")
+}
+
+// key derives the user's key for the entry. Without a salt the default salt,
+// the realm followed by the username, is used.
+func (n *Nozzle) key(user, password string, entry etypeInfo2Entry) ([]byte, error) {
+	salt := n.Realm + user
+	if len(entry.Salt.FullBytes) > 0 {
+		salt = kerberosString(entry.Salt)
+	}
+	return stringToKey(entry.EType, password, salt, entry.S2KParams)
+}
+
+// response converts a KRB-ERROR to an AuthResponse.
+func response(kerr *krbError, metadata map[string]interface{}) (*event.AuthResponse, error) {
+	metadata["code"] = kerr.ErrorCode
+	if text := kerberosString(kerr.EText); text != "" {
+		metadata["errorText"] = text
+	}
+
+	o, ok := errorCodes[kerr.ErrorCode]
+	if !ok {
+		name, ok := errorNames[kerr.ErrorCode]
+		if !ok {
+			name = "unrecognized error"
+		}
+		return nil, fmt.Errorf("kerberos error %d (%s)", kerr.ErrorCode, name)
+	}
+	return o.Response(metadata), nil
+}
+
+// Login fulfils the nozzle.Nozzle interface. It first sends an AS-REQ without
+// pre-authentication to learn the user's etype and salt, then an AS-REQ with
+// an encrypted timestamp. Users who do not require pre-authentication are
+// tested by decrypting the AS-REP.
+func (n *Nozzle) Login(username, password string) (*event.AuthResponse, error) {
+	ctx := context.Background()
+	err := RateLimiter.Wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	user := principal(username)
+	metadata := map[string]interface{}{
+		"principal": user + "@" + n.Realm,
+	}
+
+	req, err := n.asReq(user, nil)
+	if err != nil {
+		return nil, err
+	}
+	rep, kerr, err := n.exchange(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if rep != nil {
+		metadata["preauthNotRequired"] = true
+		entries, err := etypeInfo2(rep.PAData)
+		if err != nil {
+			return nil, err
+		}
+		entry := etypeInfo2Entry{EType: rep.EncPart.EType}
+		for _, e := range entries {
+			if e.EType == entry.EType {
+				entry = e
+			}
+		}
+		key, err := n.key(user, password, entry)
+		if err != nil {
+			return nil, err
+		}
+		_, err = decrypt(rep.EncPart.EType, key, usageASRepEncPart, rep.EncPart.Cipher)
+		if err != nil && !errors.Is(err, errIntegrity) {
+			return nil, err
+		}
+		return &event.AuthResponse{
+			Valid:      err == nil,
+			UserStatus: event.UserStatusExists,
+			Metadata:   metadata,
+		}, nil
+	}
+	if kerr.ErrorCode != errPreauthRequired {
+		return response(kerr, metadata)
+	}
+
+	var methods []paData
+	if _, err = asn1.Unmarshal(kerr.EData, &methods); err != nil {
+		return nil, fmt.Errorf("invalid kerberos METHOD-DATA: %w", err)
+	}
+	entries, err := etypeInfo2(methods)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := n.choose(entries)
+	if err != nil {
+		return nil, err
+	}
+	key, err := n.key(user, password, entry)
+	if err != nil {
+		return nil, err
+	}
+	etype := entry.EType
+	metadata["etype"] = etype
+
+	now := time.Now().UTC()
+	ts, err := asn1.Marshal(paEncTSEnc{
+		Timestamp: now.Truncate(time.Second),
+		USec:      now.Nanosecond() / 1000,
+	})
+	if err != nil {
+		return nil, err
+	}
+	cipher, err := encrypt(etype, key, usagePAEncTimestamp, ts)
+	if err != nil {
+		return nil, err
+	}
+	encData, err := asn1.Marshal(encryptedData{EType: etype, Cipher: cipher})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err = n.asReq(user, []paData{{Type: paEncTimestamp, Value: encData}})
+	if err != nil {
+		return nil, err
+	}
+	rep, kerr, err = n.exchange(req)
+	if err != nil {
+		return nil, err
+	}
+	if rep != nil {
+		return &event.AuthResponse{
+			Valid:      true,
+			UserStatus: event.UserStatusExists,
+			Metadata:   metadata,
+		}, nil
+	}
+	return response(kerr, metadata)
+}
+
+// CheckUser fulfils the nozzle.Enumerator interface by sending an AS-REQ
+// without pre-authentication. The KDC asks existing users for
+// pre-authentication and reports unknown users as C_PRINCIPAL_UNKNOWN, without
+// incrementing the bad password count.
+func (n *Nozzle) CheckUser(username string) (*event.AuthResponse, error) {
+	ctx := context.Background()
+	err := RateLimiter.Wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	user := principal(username)
+	metadata := map[string]interface{}{
+		"principal": user + "@" + n.Realm,
+	}
+
+	req, err := n.asReq(user, nil)
+	if err != nil {
+		return nil, err
+	}
+	rep, kerr, err := n.exchange(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case rep != nil:
+		metadata["preauthNotRequired"] = true
+	case kerr.ErrorCode == errPreauthRequired:
+		metadata["code"] = kerr.ErrorCode
+	default:
+		return response(kerr, metadata)
+	}
+	return &event.AuthResponse{
+		UserStatus: event.UserStatusExists,
+		Metadata:   metadata,
+	}, nil
+}
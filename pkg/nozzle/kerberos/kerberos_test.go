@@ -0,0 +1,376 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kerberos
+
+import (
+	"encoding/asn1"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+)
+
+const testRealm = "CORP.EXAMPLE.ORG"
+
+type account struct {
+	password string
+	etypes   []int32
+
+	revoked   bool
+	expired   bool
+	noPreauth bool
+	udpTooBig bool
+}
+
+var accounts = map[string]account{
+	"alice":  {password: "Password1!", etypes: []int32{ETypeAES256, ETypeAES128, ETypeRC4}},
+	"bob":    {password: "Password1!", etypes: []int32{ETypeAES256}, revoked: true},
+	"eve":    {password: "Password1!", etypes: []int32{ETypeAES256}, expired: true},
+	"roast":  {password: "Password1!", etypes: []int32{ETypeAES256}, noPreauth: true},
+	"legacy": {password: "Password1!", etypes: []int32{ETypeRC4}},
+	"carol":  {password: "Password1!", etypes: []int32{ETypeAES128}, udpTooBig: true},
+}
+
+// testKDC is a minimal KDC which answers AS-REQs over TCP and UDP on the same
+// port and verifies encrypted timestamps.
+type testKDC struct {
+	t        *testing.T
+	listener net.Listener
+	packet   net.PacketConn
+}
+
+func newTestKDC(t *testing.T) *testKDC {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := net.ListenPacket("udp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := &testKDC{t: t, listener: l, packet: p}
+	go k.serveTCP()
+	go k.serveUDP()
+	return k
+}
+
+func (k *testKDC) Addr() string {
+	return k.listener.Addr().String()
+}
+
+func (k *testKDC) Close() {
+	k.listener.Close() // nolint:errcheck,gosec
+	k.packet.Close()   // nolint:errcheck,gosec
+}
+
+func (k *testKDC) serveTCP() {
+	for {
+		conn, err := k.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close() // nolint:errcheck
+			b := make([]byte, 4)
+			if _, err := io.ReadFull(conn, b); err != nil {
+				return
+			}
+			msg := make([]byte, binary.BigEndian.Uint32(b))
+			if _, err := io.ReadFull(conn, msg); err != nil {
+				return
+			}
+			reply := k.handle(msg, TransportTCP)
+			binary.BigEndian.PutUint32(b, uint32(len(reply)))
+			conn.Write(append(b, reply...)) // nolint:errcheck,gosec
+		}()
+	}
+}
+
+func (k *testKDC) serveUDP() {
+	b := make([]byte, 65535)
+	for {
+		n, addr, err := k.packet.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		k.packet.WriteTo(k.handle(b[:n], TransportUDP), addr) // nolint:errcheck,gosec
+	}
+}
+
+func (k *testKDC) handle(msg []byte, transport string) []byte {
+	var req kdcReq
+	_, err := unmarshalApplication(msg, func(tag int) interface{} {
+		if tag == msgTypeASReq {
+			return &req
+		}
+		return nil
+	})
+	if err != nil {
+		k.t.Errorf("invalid AS-REQ: %s", err)
+		return nil
+	}
+	var realm asn1.RawValue
+	asn1.Unmarshal(req.ReqBody.Realm.Bytes, &realm) // nolint:errcheck,gosec
+	if realm.Tag != asn1.TagGeneralString || string(realm.Bytes) != testRealm {
+		k.t.Errorf("realm was not the GeneralString %s", testRealm)
+	}
+
+	user := string(req.ReqBody.CName.NameString[0].Bytes)
+	a, ok := accounts[user]
+	switch {
+	case !ok:
+		return k.krbError(errCPrincipalUnknown, nil)
+	case a.udpTooBig && transport == TransportUDP:
+		return k.krbError(errResponseTooBig, nil)
+	case a.revoked:
+		return k.krbError(errClientRevoked, nil)
+	}
+
+	// offer the account's keys in the client's order of preference
+	var entries []etypeInfo2Entry
+	for _, etype := range req.ReqBody.EType {
+		for _, e := range a.etypes {
+			if e == etype {
+				entries = append(entries, etypeInfo2Entry{EType: e, Salt: tagged(1, generalString(testRealm+user))})
+			}
+		}
+	}
+	if len(entries) == 0 {
+		return k.krbError(errETypeNoSupport, nil)
+	}
+
+	if a.noPreauth {
+		return k.asRep(user, a, entries[0])
+	}
+
+	var ts *paData
+	for i := range req.PAData {
+		if req.PAData[i].Type == paEncTimestamp {
+			ts = &req.PAData[i]
+		}
+	}
+	if ts == nil {
+		info, _ := asn1.Marshal(entries)
+		methods, _ := asn1.Marshal([]paData{{Type: paETypeInfo2, Value: info}})
+		return k.krbError(errPreauthRequired, methods)
+	}
+
+	var ed encryptedData
+	if _, err = asn1.Unmarshal(ts.Value, &ed); err != nil {
+		k.t.Errorf("invalid PA-ENC-TIMESTAMP: %s", err)
+		return nil
+	}
+	key, _ := stringToKey(ed.EType, a.password, testRealm+user, nil)
+	plain, err := decrypt(ed.EType, key, usagePAEncTimestamp, ed.Cipher)
+	if err != nil {
+		return k.krbError(errPreauthFailed, nil)
+	}
+	var enc paEncTSEnc
+	if _, err = asn1.Unmarshal(plain, &enc); err != nil {
+		k.t.Errorf("invalid PA-ENC-TS-ENC: %s", err)
+		return nil
+	}
+	if d := time.Since(enc.Timestamp); d > 5*time.Minute || d < -5*time.Minute {
+		return k.krbError(errSkew, nil)
+	}
+	if a.expired {
+		return k.krbError(errKeyExpired, nil)
+	}
+	return k.asRep(user, a, etypeInfo2Entry{EType: ed.EType})
+}
+
+func (k *testKDC) krbError(code int32, edata []byte) []byte {
+	b, err := marshalApplication(msgTypeKRBError, krbError{
+		PVNO:      5,
+		MsgType:   msgTypeKRBError,
+		STime:     time.Now().UTC().Truncate(time.Second),
+		ErrorCode: code,
+		Realm:     tagged(9, generalString(testRealm)),
+		SName:     newPrincipal(nameTypeSrvInst, "krbtgt", testRealm),
+		EData:     edata,
+	})
+	if err != nil {
+		k.t.Fatal(err)
+	}
+	return b
+}
+
+// asRep returns an AS-REP whose encrypted part is protected by the user's key.
+// The ticket and the encrypted part's contents are placeholders.
+func (k *testKDC) asRep(user string, a account, entry etypeInfo2Entry) []byte {
+	key, _ := stringToKey(entry.EType, a.password, testRealm+user, nil)
+	cipher, err := encrypt(entry.EType, key, usageASRepEncPart, []byte("EncASRepPart"))
+	if err != nil {
+		k.t.Fatal(err)
+	}
+	ticket, err := marshalApplication(1, struct {
+		TktVNO int `asn1:"explicit,tag:0"`
+	}{5})
+	if err != nil {
+		k.t.Fatal(err)
+	}
+	b, err := marshalApplication(msgTypeASRep, kdcRep{
+		PVNO:    5,
+		MsgType: msgTypeASRep,
+		CRealm:  tagged(3, generalString(testRealm)),
+		CName:   newPrincipal(nameTypePrincipal, user),
+		Ticket:  asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 5, IsCompound: true, Bytes: ticket},
+		EncPart: encryptedData{EType: entry.EType, Cipher: cipher},
+	})
+	if err != nil {
+		k.t.Fatal(err)
+	}
+	return b
+}
+
+type testcase struct {
+	desc     string
+	username string
+	password string
+	valid    bool
+	locked   bool
+	status   event.UserStatus
+	flag     string
+}
+
+func TestNozzle(t *testing.T) {
+	kdc := newTestKDC(t)
+	defer kdc.Close()
+
+	var testcases = []testcase{
+		{"invalid login", "alice", "Invalid1!", false, false, event.UserStatusExists, ""},
+		{"valid login", "alice", "Password1!", true, false, event.UserStatusExists, ""},
+		{"valid login with upn", "alice@corp.example.org", "Password1!", true, false, event.UserStatusExists, ""},
+		{"valid login with netbios name", `CORP\alice`, "Password1!", true, false, event.UserStatusExists, ""},
+		{"unknown user", "mallory", "Password1!", false, false, event.UserStatusNotExists, ""},
+		{"revoked account", "bob", "Password1!", false, true, event.UserStatusExists, ""},
+		{"password expired", "eve", "Password1!", true, false, event.UserStatusExists, "passwordExpired"},
+		{"no pre-authentication", "roast", "Password1!", true, false, event.UserStatusExists, "preauthNotRequired"},
+		{"no pre-authentication invalid", "roast", "Invalid1!", false, false, event.UserStatusExists, "preauthNotRequired"},
+		{"rc4 only", "legacy", "Password1!", true, false, event.UserStatusExists, ""},
+		{"retried over tcp", "carol", "Password1!", true, false, event.UserStatusExists, ""},
+	}
+
+	for _, transport := range []string{TransportTCP, TransportUDP} {
+		noz, err := nozzle.Open("kerberos", map[string]string{
+			"realm":     "corp.example.org",
+			"kdc":       kdc.Addr(),
+			"transport": transport,
+		})
+		if err != nil {
+			t.Fatalf("unable to open nozzle: %s", err)
+		}
+
+		for _, test := range testcases {
+			res, err := noz.Login(test.username, test.password)
+			if err != nil {
+				t.Errorf("[%s %s] error in login: %s", transport, test.desc, err)
+				continue
+			}
+			if res.Valid != test.valid {
+				t.Errorf("[%s %s] noz.valid was %t, expected %t", transport, test.desc, res.Valid, test.valid)
+			}
+			if res.Locked != test.locked {
+				t.Errorf("[%s %s] noz.locked %t, expected %t", transport, test.desc, res.Locked, test.locked)
+			}
+			if res.UserStatus != test.status {
+				t.Errorf("[%s %s] noz.status %q, expected %q", transport, test.desc, res.UserStatus, test.status)
+			}
+			if test.flag != "" && res.Metadata[test.flag] != true {
+				t.Errorf("[%s %s] expected %s metadata", transport, test.desc, test.flag)
+			}
+		}
+	}
+
+	// without rc4 the KDC has no key for the legacy user
+	noz, err := nozzle.Open("kerberos", map[string]string{
+		"realm":  testRealm,
+		"kdc":    kdc.Addr(),
+		"etypes": "aes256,aes128",
+	})
+	if err != nil {
+		t.Fatalf("unable to open nozzle: %s", err)
+	}
+	_, err = noz.Login("legacy", "Password1!")
+	if err == nil {
+		t.Errorf("expected error for unsupported etype")
+	}
+}
+
+func TestCheckUser(t *testing.T) {
+	kdc := newTestKDC(t)
+	defer kdc.Close()
+
+	noz, err := nozzle.Open("kerberos", map[string]string{
+		"realm": testRealm,
+		"kdc":   kdc.Addr(),
+	})
+	if err != nil {
+		t.Fatalf("unable to open nozzle: %s", err)
+	}
+
+	var testcases = []struct {
+		username string
+		status   event.UserStatus
+		locked   bool
+	}{
+		{"alice", event.UserStatusExists, false},
+		{"roast", event.UserStatusExists, false},
+		{"bob", event.UserStatusExists, true},
+		{"mallory", event.UserStatusNotExists, false},
+	}
+	for _, test := range testcases {
+		res, err := nozzle.CheckUser(noz, test.username)
+		if err != nil {
+			t.Errorf("[%s] error in check: %s", test.username, err)
+			continue
+		}
+		if res.UserStatus != test.status {
+			t.Errorf("[%s] noz.status %q, expected %q", test.username, res.UserStatus, test.status)
+		}
+		if res.Locked != test.locked {
+			t.Errorf("[%s] noz.locked %t, expected %t", test.username, res.Locked, test.locked)
+		}
+		if res.Valid {
+			t.Errorf("[%s] enumeration reported a valid login", test.username)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	noz, err := nozzle.Open("kerberos", map[string]string{"realm": "corp.example.org"})
+	if err != nil {
+		t.Fatalf("unable to open nozzle: %s", err)
+	}
+	n := noz.(*Nozzle)
+	if n.KDC != net.JoinHostPort("corp.example.org", strconv.Itoa(88)) || n.Realm != testRealm {
+		t.Errorf("default kdc was %s for realm %s", n.KDC, n.Realm)
+	}
+
+	for _, opts := range []map[string]string{
+		{},
+		{"realm": testRealm, "transport": "sctp"},
+		{"realm": testRealm, "etypes": "des"},
+	} {
+		if _, err := nozzle.Open("kerberos", opts); err == nil {
+			t.Errorf("expected error for %v", opts)
+		}
+	}
+}
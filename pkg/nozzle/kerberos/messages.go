@@ -0,0 +1,197 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kerberos
+
+import (
+	"encoding/asn1"
+	"fmt"
+	"time"
+)
+
+// The subset of the RFC 4120 messages needed for AS exchanges. KerberosString
+// is a GeneralString, which encoding/asn1 cannot marshal, so those fields are
+// carried as raw values. encoding/asn1 does not add or remove the explicit tag
+// of a RawValue field, so those fields hold the tagged value: they are built
+// with tagged and read with kerberosString.
+
+// Message types
+const (
+	msgTypeASReq    = 10
+	msgTypeASRep    = 11
+	msgTypeKRBError = 30
+)
+
+// Pre-authentication data types
+const (
+	paEncTimestamp = 2
+	paETypeInfo2   = 19
+)
+
+// Principal name types
+const (
+	nameTypePrincipal = 1
+	nameTypeSrvInst   = 2
+)
+
+type principalName struct {
+	NameType   int32           `asn1:"explicit,tag:0"`
+	NameString []asn1.RawValue `asn1:"explicit,tag:1"`
+}
+
+type paData struct {
+	Type  int32  `asn1:"explicit,tag:1"`
+	Value []byte `asn1:"explicit,tag:2"`
+}
+
+type encryptedData struct {
+	EType  int32  `asn1:"explicit,tag:0"`
+	KVNO   int    `asn1:"optional,explicit,tag:1"`
+	Cipher []byte `asn1:"explicit,tag:2"`
+}
+
+type paEncTSEnc struct {
+	Timestamp time.Time `asn1:"generalized,explicit,tag:0"`
+	USec      int       `asn1:"optional,explicit,tag:1"`
+}
+
+type etypeInfo2Entry struct {
+	EType     int32         `asn1:"explicit,tag:0"`
+	Salt      asn1.RawValue `asn1:"optional,explicit,tag:1"`
+	S2KParams []byte        `asn1:"optional,explicit,tag:2"`
+}
+
+type kdcReqBody struct {
+	KDCOptions asn1.BitString `asn1:"explicit,tag:0"`
+	CName      principalName  `asn1:"optional,explicit,tag:1"`
+	Realm      asn1.RawValue  `asn1:"explicit,tag:2"`
+	SName      principalName  `asn1:"optional,explicit,tag:3"`
+	Till       time.Time      `asn1:"generalized,explicit,tag:5"`
+	Nonce      int32          `asn1:"explicit,tag:7"`
+	EType      []int32        `asn1:"explicit,tag:8"`
+}
+
+type kdcReq struct {
+	PVNO    int        `asn1:"explicit,tag:1"`
+	MsgType int        `asn1:"explicit,tag:2"`
+	PAData  []paData   `asn1:"optional,explicit,tag:3"`
+	ReqBody kdcReqBody `asn1:"explicit,tag:4"`
+}
+
+type kdcRep struct {
+	PVNO    int           `asn1:"explicit,tag:0"`
+	MsgType int           `asn1:"explicit,tag:1"`
+	PAData  []paData      `asn1:"optional,explicit,tag:2"`
+	CRealm  asn1.RawValue `asn1:"explicit,tag:3"`
+	CName   principalName `asn1:"explicit,tag:4"`
+	Ticket  asn1.RawValue `asn1:"explicit,tag:5"`
+	EncPart encryptedData `asn1:"explicit,tag:6"`
+}
+
+type krbError struct {
+	PVNO      int           `asn1:"explicit,tag:0"`
+	MsgType   int           `asn1:"explicit,tag:1"`
+	CTime     time.Time     `asn1:"generalized,optional,explicit,tag:2"`
+	CUSec     int           `asn1:"optional,explicit,tag:3"`
+	STime     time.Time     `asn1:"generalized,explicit,tag:4"`
+	SUSec     int           `asn1:"explicit,tag:5"`
+	ErrorCode int32         `asn1:"explicit,tag:6"`
+	CRealm    asn1.RawValue `asn1:"optional,explicit,tag:7"`
+	CName     principalName `asn1:"optional,explicit,tag:8"`
+	Realm     asn1.RawValue `asn1:"explicit,tag:9"`
+	SName     principalName `asn1:"explicit,tag:10"`
+	EText     asn1.RawValue `asn1:"optional,explicit,tag:11"`
+	EData     []byte        `asn1:"optional,explicit,tag:12"`
+}
+
+// generalString encodes s as a KerberosString.
+func generalString(s string) asn1.RawValue {
+	return asn1.RawValue{Tag: asn1.TagGeneralString, Bytes: []byte(s)}
+}
+
+// tagged wraps v in an explicit context-specific tag.
+func tagged(tag int, v asn1.RawValue) asn1.RawValue {
+	b, _ := asn1.Marshal(v) // a RawValue without FullBytes always marshals
+	return asn1.RawValue{
+		Class:      asn1.ClassContextSpecific,
+		Tag:        tag,
+		IsCompound: true,
+		Bytes:      b,
+	}
+}
+
+// kerberosString returns the string in an explicitly tagged KerberosString, or
+// "" if the optional field was absent.
+func kerberosString(v asn1.RawValue) string {
+	var s asn1.RawValue
+	if _, err := asn1.Unmarshal(v.Bytes, &s); err != nil {
+		return ""
+	}
+	return string(s.Bytes)
+}
+
+func newPrincipal(nameType int32, names ...string) principalName {
+	p := principalName{NameType: nameType}
+	for _, n := range names {
+		p.NameString = append(p.NameString, generalString(n))
+	}
+	return p
+}
+
+// marshalApplication marshals v wrapped in an APPLICATION tag.
+func marshalApplication(tag int, v interface{}) ([]byte, error) {
+	b, err := asn1.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(asn1.RawValue{
+		Class:      asn1.ClassApplication,
+		Tag:        tag,
+		IsCompound: true,
+		Bytes:      b,
+	})
+}
+
+// unmarshalApplication returns the APPLICATION tag of b and unmarshals its
+// contents into the value returned by pick, which may return nil to skip
+// unknown tags.
+func unmarshalApplication(b []byte, pick func(tag int) interface{}) (int, error) {
+	var raw asn1.RawValue
+	if _, err := asn1.Unmarshal(b, &raw); err != nil {
+		return 0, err
+	}
+	if raw.Class != asn1.ClassApplication {
+		return 0, fmt.Errorf("unexpected kerberos message class %d", raw.Class)
+	}
+	v := pick(raw.Tag)
+	if v == nil {
+		return raw.Tag, fmt.Errorf("unexpected kerberos message type %d", raw.Tag)
+	}
+	_, err := asn1.Unmarshal(raw.Bytes, v)
+	return raw.Tag, err
+}
+
+// etypeInfo2 returns the PA-ETYPE-INFO2 entries in a METHOD-DATA or padata
+// sequence.
+func etypeInfo2(padata []paData) ([]etypeInfo2Entry, error) {
+	for _, pa := range padata {
+		if pa.Type != paETypeInfo2 {
+			continue
+		}
+		var entries []etypeInfo2Entry
+		_, err := asn1.Unmarshal(pa.Value, &entries)
+		return entries, err
+	}
+	return nil, nil
+}
@@ -0,0 +1,321 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldap
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	goldap "github.com/go-ldap/ldap/v3"
+	"golang.org/x/time/rate"
+
+	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+)
+
+var (
+	// RateLimiter limits requests from the same worker to a maximum of 3/s
+	RateLimiter = rate.NewLimiter(rate.Every(300*time.Millisecond), 1)
+)
+
+// Driver implements the nozzle.Driver interface.
+type Driver struct{}
+
+func init() {
+	nozzle.Register("ldap", Driver{})
+}
+
+// Username formats accepted by the format option.
+const (
+	FormatUPN     = "upn"
+	FormatNetBIOS = "netbios"
+	FormatDN      = "dn"
+)
+
+// TLS modes accepted by the tls option.
+const (
+	TLSNone     = "none"
+	TLSLDAPS    = "ldaps"
+	TLSStartTLS = "starttls"
+)
+
+// New is used to create an LDAP simple bind nozzle and accepts the following
+// configuration options:
+//
+// host
+//
+// The domain controller to bind to, optionally with a port. The port defaults
+// to 389, or 636 when tls is ldaps.
+//
+// tls
+//
+// One of none (default), ldaps, or starttls.
+//
+// insecure
+//
+// Set to true to skip verification of the domain controller's TLS
+// certificate when tls is ldaps or starttls. Certificates are verified by
+// default.
+//
+// format
+//
+// How usernames are converted to a bind name. This can be one of the
+// following: upn (default, user@domain), netbios (DOMAIN\user), or dn.
+// Usernames which already contain an @ or \ are sent as is.
+//
+// domain
+//
+// The domain used by the upn and netbios formats (e.g. corp.example.org or
+// CORP). Required for the netbios format.
+//
+// dn-template
+//
+// The bind DN for the dn format, with %s replaced by the escaped username (e.g.
+// CN=%s,OU=Users,DC=corp,DC=example,DC=org).
+func (Driver) New(opts map[string]string) (nozzle.Nozzle, error) {
+	host, ok := opts["host"]
+	if !ok {
+		return nil, fmt.Errorf("ldap nozzle requires 'host' config parameter")
+	}
+
+	mode, ok := opts["tls"]
+	if !ok {
+		mode = TLSNone
+	}
+	port := "389"
+	switch mode {
+	case TLSNone, TLSStartTLS:
+	case TLSLDAPS:
+		port = "636"
+	default:
+		return nil, fmt.Errorf("ldap nozzle: unknown tls mode %q", mode)
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, port)
+	}
+
+	format, ok := opts["format"]
+	if !ok {
+		format = FormatUPN
+	}
+	switch format {
+	case FormatUPN:
+	case FormatNetBIOS:
+		if opts["domain"] == "" {
+			return nil, fmt.Errorf("ldap nozzle requires 'domain' config parameter for the netbios format")
+		}
+	case FormatDN:
+		if !strings.Contains(opts["dn-template"], "%s") {
+			return nil, fmt.Errorf("ldap nozzle requires a 'dn-template' containing %%s for the dn format")
+		}
+	default:
+		return nil, fmt.Errorf("ldap nozzle: unknown format %q", format)
+	}
+
+	insecure, err := nozzle.Insecure(opts)
+	if err != nil {
+		return nil, fmt.Errorf("ldap nozzle: %v", err)
+	}
+
+	hostname, _, _ := net.SplitHostPort(host)
+	return &Nozzle{
+		Host:       host,
+		TLS:        mode,
+		Format:     format,
+		Domain:     opts["domain"],
+		DNTemplate: opts["dn-template"],
+		TLSConfig: &tls.Config{
+			ServerName:         hostname,
+			InsecureSkipVerify: insecure, // nolint:gosec
+		},
+		Timeout: 10 * time.Second,
+	}, nil
+}
+
+// Nozzle implements the nozzle.Nozzle interface for LDAP simple binds.
+type Nozzle struct {
+	// Host is the host:port of the domain controller
+	Host string
+
+	// TLS is one of TLSNone, TLSLDAPS, or TLSStartTLS
+	TLS string
+
+	// Format is one of FormatUPN, FormatNetBIOS, or FormatDN
+	Format string
+
+	// Domain is the domain used by the upn and netbios formats
+	Domain string
+
+	// DNTemplate is the bind DN used by the dn format
+	DNTemplate string
+
+	// TLSConfig is used for ldaps and starttls connections
+	TLSConfig *tls.Config
+
+	// Timeout limits the connection and each request
+	Timeout time.Duration
+}
+
+// subCodes maps the "data" sub-code in Active Directory's invalid credentials
+// diagnostic message to a normalized result. AD only reports the account
+// restrictions (530-533, 568, 701, 773) once the password has been verified,
+// so they are valid credentials flagged with the restriction.
+// https://ldapwiki.com/wiki/Common%20Active%20Directory%20Bind%20Errors
+var subCodes = map[string]nozzle.Outcome{
+	"525": {Desc: "user not found", UserStatus: event.UserStatusNotExists},
+	"52e": {Desc: "invalid credentials"},
+	"530": {Desc: "logon time restriction", Valid: true, UserStatus: event.UserStatusExists},
+	"531": {Desc: "workstation restriction", Valid: true, UserStatus: event.UserStatusExists},
+	"532": {Desc: "password expired", Valid: true, UserStatus: event.UserStatusExists, Flag: "passwordExpired"},
+	"533": {Desc: "account disabled", Valid: true, UserStatus: event.UserStatusExists, Flag: "accountDisabled"},
+	"568": {Desc: "too many security ids", Valid: true, UserStatus: event.UserStatusExists},
+	"701": {Desc: "account expired", Valid: true, UserStatus: event.UserStatusExists, Flag: "accountExpired"},
+	"773": {Desc: "user must reset password", Valid: true, UserStatus: event.UserStatusExists, Flag: "passwordExpired"},
+	"775": {Desc: "account locked", Locked: true, UserStatus: event.UserStatusExists},
+}
+
+var subCodeRegexp = regexp.MustCompile(`data ([0-9a-fA-F]+)`)
+
+func (n *Nozzle) bindName(username string) string {
+	if strings.ContainsAny(username, `@\`) || (n.Format == FormatDN && strings.Contains(username, "=")) {
+		return username
+	}
+	switch n.Format {
+	case FormatNetBIOS:
+		return n.Domain + `\` + username
+	case FormatDN:
+		return fmt.Sprintf(n.DNTemplate, escapeDN(username))
+	}
+	if n.Domain == "" {
+		return username
+	}
+	return username + "@" + n.Domain
+}
+
+// escapeDN escapes the special characters of an RDN value (RFC 4514).
+func escapeDN(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		switch {
+		case strings.ContainsRune(`,+"\<>;=`, r),
+			i == 0 && (r == ' ' || r == '#'),
+			i == len(s)-1 && r == ' ':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (n *Nozzle) dial() (*goldap.Conn, error) {
+	dialer := &net.Dialer{Timeout: n.Timeout}
+	if n.TLS == TLSLDAPS {
+		c, err := tls.DialWithDialer(dialer, "tcp", n.Host, n.TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		conn := goldap.NewConn(c, true)
+		conn.Start()
+		return conn, nil
+	}
+
+	c, err := dialer.Dial("tcp", n.Host)
+	if err != nil {
+		return nil, err
+	}
+	conn := goldap.NewConn(c, false)
+	conn.Start()
+	return conn, nil
+}
+
+// Login fulfils the nozzle.Nozzle interface and performs a simple bind against
+// the domain controller. Active Directory's sub-codes are used to distinguish
+// invalid, locked, expired, and disabled accounts.
+func (n *Nozzle) Login(username, password string) (*event.AuthResponse, error) {
+	ctx := context.Background()
+	err := RateLimiter.Wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// an empty password is an unauthenticated bind, which always succeeds
+	if password == "" {
+		return nil, fmt.Errorf("ldap nozzle does not support empty passwords")
+	}
+
+	conn, err := n.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetTimeout(n.Timeout)
+
+	if n.TLS == TLSStartTLS {
+		err = conn.StartTLS(n.TLSConfig)
+		if err != nil {
+			return nil, fmt.Errorf("ldap starttls failed: %w", err)
+		}
+	}
+
+	name := n.bindName(username)
+	metadata := map[string]interface{}{
+		"bindName": name,
+	}
+
+	_, err = conn.SimpleBind(&goldap.SimpleBindRequest{
+		Username: name,
+		Password: password,
+	})
+	if err == nil {
+		return &event.AuthResponse{
+			Valid:      true,
+			UserStatus: event.UserStatusExists,
+			Metadata:   metadata,
+		}, nil
+	}
+
+	var lerr *goldap.Error
+	if !errors.As(err, &lerr) || lerr.ResultCode != goldap.LDAPResultInvalidCredentials {
+		return nil, err
+	}
+	metadata["diagnosticMessage"] = lerr.Err.Error()
+
+	m := subCodeRegexp.FindStringSubmatch(lerr.Err.Error())
+	if m == nil {
+		// not Active Directory, or a directory which does not explain failures
+		return &event.AuthResponse{
+			Valid:    false,
+			Metadata: metadata,
+		}, nil
+	}
+
+	code := strings.ToLower(m[1])
+	metadata["code"] = code
+	o, ok := subCodes[code]
+	if !ok {
+		metadata["unrecognizedCode"] = true
+		return &event.AuthResponse{
+			Valid:    false,
+			Metadata: metadata,
+		}, nil
+	}
+	return o.Response(metadata), nil
+}
@@ -0,0 +1,300 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldap
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+
+	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+)
+
+const (
+	appBindRequest      = 0
+	appBindResponse     = 1
+	appUnbindRequest    = 2
+	appExtendedRequest  = 23
+	appExtendedResponse = 24
+
+	startTLSOID = "1.3.6.1.4.1.1466.20037"
+)
+
+// accounts maps each bind name to its password and the AD sub-code returned
+// once the password is verified ("" for a successful bind).
+var accounts = map[string]struct {
+	password string
+	code     string
+}{
+	"alice@corp.example.org": {"Password1!", ""},
+	`CORP\alice`:             {"Password1!", ""},
+	"CN=alice,OU=Users,DC=corp,DC=example,DC=org":     {"Password1!", ""},
+	"CN=o\\,brien,OU=Users,DC=corp,DC=example,DC=org": {"Password1!", ""},
+	"bob@corp.example.org":                            {"Password1!", "775"},
+	"eve@corp.example.org":                            {"Password1!", "532"},
+	"mal@corp.example.org":                            {"Password1!", "533"},
+	"old@corp.example.org":                            {"Password1!", "701"},
+}
+
+// testServer is a minimal LDAP server which understands simple binds and
+// StartTLS, and returns Active Directory style diagnostic messages.
+type testServer struct {
+	t        *testing.T
+	listener net.Listener
+	tls      *tls.Config
+}
+
+func newTestServer(t *testing.T, ldaps bool) *testServer {
+	cfg := &tls.Config{Certificates: []tls.Certificate{selfSigned(t)}}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ldaps {
+		l = tls.NewListener(l, cfg)
+	}
+	s := &testServer{t: t, listener: l, tls: cfg}
+	go s.serve()
+	return s
+}
+
+func (s *testServer) Close() {
+	s.listener.Close() // nolint:errcheck,gosec
+}
+
+func (s *testServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *testServer) handle(conn net.Conn) {
+	defer func() { conn.Close() }() // nolint:errcheck
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case appBindRequest:
+			name := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			code, diag := 0, ""
+			a, ok := accounts[name]
+			switch {
+			case !ok:
+				code, diag = 49, adError("52e")
+			case a.password != password:
+				code, diag = 49, adError("52e")
+			case a.code != "":
+				code, diag = 49, adError(a.code)
+			}
+			s.respond(conn, id, appBindResponse, code, diag)
+		case appExtendedRequest:
+			if string(op.Children[0].Data.Bytes()) != startTLSOID {
+				s.respond(conn, id, appExtendedResponse, 2, "unsupported extended operation")
+				continue
+			}
+			s.respond(conn, id, appExtendedResponse, 0, "")
+			conn = tls.Server(conn, s.tls)
+		case appUnbindRequest:
+			return
+		}
+	}
+}
+
+func adError(code string) string {
+	return fmt.Sprintf("80090308: LdapErr: DSID-0C09044E, comment: AcceptSecurityContext error, data %s, v4563\x00", code)
+}
+
+func (s *testServer) respond(conn net.Conn, id int64, app ber.Tag, code int, diag string) {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+	res := ber.Encode(ber.ClassApplication, ber.TypeConstructed, app, nil, "Response")
+	res.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "resultCode"))
+	res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, diag, "diagnosticMessage"))
+	packet.AppendChild(res)
+	if _, err := conn.Write(packet.Bytes()); err != nil {
+		s.t.Errorf("error writing ldap response: %s", err)
+	}
+}
+
+func selfSigned(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dc01.corp.example.org"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+type testcase struct {
+	desc     string
+	username string
+	password string
+	valid    bool
+	locked   bool
+	status   event.UserStatus
+	flag     string
+}
+
+func TestNozzle(t *testing.T) {
+	var testcases = []testcase{
+		{"invalid login", "alice", "Invalid1!", false, false, "", ""},
+		{"valid login", "alice", "Password1!", true, false, event.UserStatusExists, ""},
+		{"valid login with upn", "alice@corp.example.org", "Password1!", true, false, event.UserStatusExists, ""},
+		{"locked account", "bob", "Password1!", false, true, event.UserStatusExists, ""},
+		{"password expired", "eve", "Password1!", true, false, event.UserStatusExists, "passwordExpired"},
+		{"account disabled", "mal", "Password1!", true, false, event.UserStatusExists, "accountDisabled"},
+		{"account disabled with invalid password", "mal", "Invalid1!", false, false, "", ""},
+		{"account expired", "old", "Password1!", true, false, event.UserStatusExists, "accountExpired"},
+		{"account expired with invalid password", "old", "Invalid1!", false, false, "", ""},
+	}
+
+	for _, mode := range []string{TLSNone, TLSLDAPS, TLSStartTLS} {
+		srv := newTestServer(t, mode == TLSLDAPS)
+
+		// the test server's certificate is self-signed
+		noz, err := nozzle.Open("ldap", map[string]string{
+			"host":     srv.listener.Addr().String(),
+			"tls":      mode,
+			"domain":   "corp.example.org",
+			"insecure": "true",
+		})
+		if err != nil {
+			t.Fatalf("unable to open nozzle: %s", err)
+		}
+
+		for _, test := range testcases {
+			res, err := noz.Login(test.username, test.password)
+			if err != nil {
+				t.Errorf("[%s %s] error in login: %s", mode, test.desc, err)
+				continue
+			}
+			if res.Valid != test.valid {
+				t.Errorf("[%s %s] noz.valid was %t, expected %t", mode, test.desc, res.Valid, test.valid)
+			}
+			if res.Locked != test.locked {
+				t.Errorf("[%s %s] noz.locked %t, expected %t", mode, test.desc, res.Locked, test.locked)
+			}
+			if res.UserStatus != test.status {
+				t.Errorf("[%s %s] noz.status %q, expected %q", mode, test.desc, res.UserStatus, test.status)
+			}
+			if test.flag != "" && res.Metadata[test.flag] != true {
+				t.Errorf("[%s %s] expected %s metadata", mode, test.desc, test.flag)
+			}
+		}
+
+		_, err = noz.Login("alice", "")
+		if err == nil {
+			t.Errorf("[%s] expected error for empty password", mode)
+		}
+		srv.Close()
+	}
+}
+
+func TestFormats(t *testing.T) {
+	srv := newTestServer(t, false)
+	defer srv.Close()
+
+	var testcases = []struct {
+		opts     map[string]string
+		username string
+	}{
+		{map[string]string{"format": "netbios", "domain": "CORP"}, "alice"},
+		{map[string]string{"format": "dn", "dn-template": "CN=%s,OU=Users,DC=corp,DC=example,DC=org"}, "alice"},
+		{map[string]string{"format": "dn", "dn-template": "CN=%s,OU=Users,DC=corp,DC=example,DC=org"}, "o,brien"},
+	}
+
+	for _, test := range testcases {
+		test.opts["host"] = srv.listener.Addr().String()
+		noz, err := nozzle.Open("ldap", test.opts)
+		if err != nil {
+			t.Fatalf("unable to open nozzle: %s", err)
+		}
+		res, err := noz.Login(test.username, "Password1!")
+		if err != nil {
+			t.Errorf("[%s] error in login: %s", test.opts["format"], err)
+			continue
+		}
+		if !res.Valid {
+			t.Errorf("[%s] expected valid login for %s as %v", test.opts["format"], test.username, res.Metadata["bindName"])
+		}
+	}
+
+	_, err := nozzle.Open("ldap", map[string]string{"host": "dc01", "format": "dn"})
+	if err == nil {
+		t.Errorf("expected error for dn format without dn-template")
+	}
+}
+
+func TestInsecure(t *testing.T) {
+	for _, mode := range []string{TLSLDAPS, TLSStartTLS} {
+		srv := newTestServer(t, mode == TLSLDAPS)
+
+		for _, insecure := range []string{"", "false", "true"} {
+			opts := map[string]string{
+				"host":   srv.listener.Addr().String(),
+				"tls":    mode,
+				"domain": "corp.example.org",
+			}
+			if insecure != "" {
+				opts["insecure"] = insecure
+			}
+			noz, err := nozzle.Open("ldap", opts)
+			if err != nil {
+				t.Fatalf("[%s insecure %q] unable to open nozzle: %s", mode, insecure, err)
+			}
+			_, err = noz.Login("alice", "Password1!")
+			if verified := err != nil; verified != (insecure != "true") {
+				t.Errorf("[%s insecure %q] login error was %v", mode, insecure, err)
+			}
+		}
+		srv.Close()
+	}
+
+	_, err := nozzle.Open("ldap", map[string]string{"host": "dc01", "insecure": "sometimes"})
+	if err == nil {
+		t.Errorf("expected error for an invalid insecure option")
+	}
+}
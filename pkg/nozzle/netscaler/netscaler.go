@@ -0,0 +1,198 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netscaler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	netUrl "net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/fingerprint"
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+)
+
+var (
+	// RateLimiter limits requests from the same worker to a maximum of 3/s
+	RateLimiter = rate.NewLimiter(rate.Every(300*time.Millisecond), 1)
+)
+
+// maxBodySize limits the response body read for classification
+const maxBodySize = 1 << 20
+
+// Driver implements the nozzle.Driver interface.
+type Driver struct{}
+
+func init() {
+	nozzle.Register("netscaler", Driver{})
+}
+
+// New is used to create a Citrix NetScaler (ADC) Gateway nozzle and accepts
+// the following configuration options:
+//
+// domain
+//
+// The host of the NetScaler Gateway, optionally with a port.
+//
+// insecure
+//
+// Set to true to skip verification of the NetScaler Gateway's TLS certificate.
+// Certificates are verified by default.
+//
+// profiles, profile-mode
+//
+// The browser fingerprint profiles to send and how to choose between them. See
+// the fingerprint package for details.
+func (Driver) New(opts map[string]string) (nozzle.Nozzle, error) {
+	domain, ok := opts["domain"]
+	if !ok {
+		return nil, fmt.Errorf("netscaler nozzle requires 'domain' config parameter")
+	}
+
+	profiles, err := fingerprint.NewSelector(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	insecure, err := nozzle.Insecure(opts)
+	if err != nil {
+		return nil, fmt.Errorf("netscaler nozzle: %v", err)
+	}
+
+	return &Nozzle{
+		Domain:   domain,
+		Profiles: profiles,
+		Client:   nozzle.NewClient(insecure),
+	}, nil
+}
+
+// Nozzle implements the nozzle.Nozzle interface for NetScaler Gateway.
+type Nozzle struct {
+	// Domain is the NetScaler Gateway host
+	Domain string
+
+	// Profiles selects the browser headers sent with each request
+	Profiles *fingerprint.Selector
+
+	// Client is the HTTP client used to send requests. Redirects are never
+	// followed.
+	Client *http.Client
+}
+
+// errorCodes maps the NSC_VPNERR cookie, which the Gateway's logon page uses
+// to choose its error message, to a normalized result.
+var errorCodes = map[string]nozzle.Outcome{
+	"4001": {Desc: "incorrect credentials"},
+	"4011": {Desc: "account disabled", Locked: true, UserStatus: event.UserStatusExists, Flag: "accountDisabled"},
+	"4012": {Desc: "password expired", Valid: true, UserStatus: event.UserStatusExists, Flag: "passwordExpired"},
+	"4015": {Desc: "account locked", Locked: true, UserStatus: event.UserStatusExists},
+}
+
+// Login fulfils the nozzle.Nozzle interface and posts the Gateway's logon
+// form. An NSC_AAAC session cookie is a valid login and a redirect to the
+// dialogue page (/cgi/dlge) is a challenge for a second factor. Failures are
+// described by the NSC_VPNERR cookie.
+func (n *Nozzle) Login(username, password string) (*event.AuthResponse, error) {
+	return n.LoginContext(context.Background(), username, password)
+}
+
+// LoginContext fulfils the nozzle.ContextNozzle interface. The request is
+// cancelled with ctx.
+func (n *Nozzle) LoginContext(ctx context.Context, username, password string) (*event.AuthResponse, error) {
+	err := RateLimiter.Wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	client := *n.Client
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	form := netUrl.Values{
+		"login":  {username},
+		"passwd": {password},
+	}
+	url := fmt.Sprintf("https://%s/cgi/login", n.Domain)
+	req, _ := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	// set by the logon page's script to show that cookies are enabled
+	req.AddCookie(&http.Cookie{Name: "NSC_TEMP", Value: "xyz"})
+	n.Profiles.Apply(req, username)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint:errcheck
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := map[string]interface{}{
+		"status": resp.StatusCode,
+	}
+
+	var session bool
+	var code string
+	for _, c := range resp.Cookies() {
+		switch {
+		// xyz is the placeholder NetScaler uses to clear its cookies
+		case c.Name == "NSC_AAAC" && c.Value != "" && c.Value != "xyz":
+			session = true
+		case c.Name == "NSC_VPNERR":
+			code = c.Value
+		}
+	}
+
+	switch {
+	case session:
+		return &event.AuthResponse{
+			Valid:      true,
+			UserStatus: event.UserStatusExists,
+			Metadata:   metadata,
+		}, nil
+	case strings.Contains(resp.Header.Get("Location"), "/cgi/dlge"),
+		bytes.Contains(body, []byte("/cgi/dlge")):
+		return &event.AuthResponse{
+			Valid:      true,
+			MFA:        true,
+			UserStatus: event.UserStatusExists,
+			Metadata:   metadata,
+		}, nil
+	case code == "":
+		return nil, fmt.Errorf("unrecognized netscaler response: %d", resp.StatusCode)
+	}
+
+	metadata["code"] = code
+	o, ok := errorCodes[code]
+	if !ok {
+		metadata["unrecognizedCode"] = true
+		return &event.AuthResponse{
+			Valid:    false,
+			Metadata: metadata,
+		}, nil
+	}
+	return o.Response(metadata), nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netscaler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+	"github.com/praetorian-inc/trident/pkg/nozzle/nozzletest"
+)
+
+// vpnError redirects back to the logon page with the NSC_VPNERR cookie set,
+// as the Gateway does after a failed login.
+func vpnError(w http.ResponseWriter, r *http.Request, code string) {
+	http.SetCookie(w, &http.Cookie{Name: "NSC_VPNERR", Value: code, Path: "/"})
+	http.Redirect(w, r, "/vpn/index.html", http.StatusFound)
+}
+
+func netscalerHandler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/cgi/login" {
+			w.WriteHeader(404)
+			return
+		}
+		if c, err := r.Cookie("NSC_TEMP"); err != nil || c.Value != "xyz" {
+			t.Errorf("NSC_TEMP cookie was not sent with login request")
+		}
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+
+		switch r.PostForm.Get("login") + ":" + r.PostForm.Get("passwd") {
+		case "alice:Password1!":
+			http.SetCookie(w, &http.Cookie{Name: "NSC_AAAC", Value: "9f6a1e6b2c8d4e0f5a3b7c9d1e2f4a6b", Path: "/", Secure: true})
+			http.Redirect(w, r, "/cgi/setclient?wica", http.StatusFound)
+		case "eve:Password1!":
+			http.Redirect(w, r, "/cgi/dlge?CtxsAuthId=6B2A7D3F", http.StatusFound)
+		case "old:Password1!":
+			vpnError(w, r, "4012")
+		case "bob:Password1!":
+			vpnError(w, r, "4015")
+		case "mal:Password1!":
+			vpnError(w, r, "4011")
+		case "unknown:Password1!":
+			w.WriteHeader(500)
+		default:
+			vpnError(w, r, "4001")
+		}
+	}
+}
+
+type testcase struct {
+	desc     string
+	username string
+	password string
+	valid    bool
+	mfa      bool
+	locked   bool
+	flag     string
+}
+
+func TestNozzle(t *testing.T) {
+	srv := httptest.NewTLSServer(netscalerHandler(t))
+	defer srv.Close()
+
+	noz, err := nozzle.Open("netscaler", map[string]string{
+		"domain": srv.Listener.Addr().String(),
+	})
+	if err != nil {
+		t.Fatalf("unable to open nozzle: %s", err)
+	}
+	noz.(*Nozzle).Client = srv.Client()
+
+	var testcases = []testcase{
+		{"invalid login", "alice", "Invalid1!", false, false, false, ""},
+		{"valid login", "alice", "Password1!", true, false, false, ""},
+		{"valid login with challenge", "eve", "Password1!", true, true, false, ""},
+		{"password expired", "old", "Password1!", true, false, false, "passwordExpired"},
+		{"locked account", "bob", "Password1!", false, false, true, ""},
+		{"disabled account", "mal", "Password1!", false, false, true, "accountDisabled"},
+	}
+
+	for _, test := range testcases {
+		res, err := noz.Login(test.username, test.password)
+		if err != nil {
+			t.Errorf("[%s] error in login: %s", test.desc, err)
+			continue
+		}
+		if res.Valid != test.valid {
+			t.Errorf("[%s] noz.valid was %t, expected %t", test.desc, res.Valid, test.valid)
+		}
+		if res.MFA != test.mfa {
+			t.Errorf("[%s] noz.mfa %t, expected %t", test.desc, res.MFA, test.mfa)
+		}
+		if res.Locked != test.locked {
+			t.Errorf("[%s] noz.locked %t, expected %t", test.desc, res.Locked, test.locked)
+		}
+		if test.flag != "" && res.Metadata[test.flag] != true {
+			t.Errorf("[%s] expected %s metadata", test.desc, test.flag)
+		}
+	}
+
+	_, err = noz.Login("unknown", "Password1!")
+	if err == nil {
+		t.Errorf("expected error for unrecognized response")
+	}
+}
+
+func TestConformance(t *testing.T) {
+	nozzletest.Run(t, Driver{}, nozzletest.NetScaler, func(noz nozzle.Nozzle, client *http.Client) {
+		noz.(*Nozzle).Client = client
+	})
+}
@@ -34,10 +34,23 @@
 //
 // See https://golang.org/doc/effective_go.html#blank_import for more
 // information on "blank imports".
+//
+// Workers open a new nozzle for every task, so a nozzle only lives for a
+// single login. State which should be reused across logins, such as
+// discovered endpoints, sign-in contexts, or plugin processes, is kept in a
+// mutex-guarded package-level map in the nozzle's package, keyed by the
+// configuration it depends on:
+//
+//  var discovered = struct {
+//      sync.Mutex
+//      endpoints map[string]string
+//  }{endpoints: map[string]string{}}
 package nozzle
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"sync"
 
 	"github.com/praetorian-inc/trident/pkg/event"
@@ -59,6 +72,57 @@ type Nozzle interface {
 	Login(username, password string) (*event.AuthResponse, error)
 }
 
+// ContextNozzle is an optional interface implemented by nozzles which abandon
+// a login, including any request in flight, when its context is cancelled.
+type ContextNozzle interface {
+	LoginContext(ctx context.Context, username, password string) (*event.AuthResponse, error)
+}
+
+// LoginContext performs a login with noz, returning ctx.Err() once ctx is
+// cancelled. Nozzles which do not implement the ContextNozzle interface are
+// left to finish the login in the background.
+func LoginContext(ctx context.Context, noz Nozzle, username, password string) (*event.AuthResponse, error) {
+	if c, ok := noz.(ContextNozzle); ok {
+		return c.LoginContext(ctx, username, password)
+	}
+
+	type result struct {
+		res *event.AuthResponse
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		res, err := noz.Login(username, password)
+		done <- result{res, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.res, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Enumerator is an optional interface implemented by nozzles which are able to
+// determine whether a user exists without guessing a password. CheckUser
+// should set the UserStatus of the returned AuthResponse and, where the
+// provider exposes it, describe the user's federation in the metadata under
+// the "federation" key.
+type Enumerator interface {
+	CheckUser(username string) (*event.AuthResponse, error)
+}
+
+// CheckUser performs a user enumeration request with noz, returning an error if
+// the nozzle does not implement the Enumerator interface.
+func CheckUser(noz Nozzle, username string) (*event.AuthResponse, error) {
+	e, ok := noz.(Enumerator)
+	if !ok {
+		return nil, fmt.Errorf("nozzle: %T does not support user enumeration", noz)
+	}
+	return e.CheckUser(username)
+}
+
 // Open opens a nozzle specified by the nozzle driver name (e.g. okta) and
 // configures that nozzle via the provided opts argument. Each Nozzle should
 // document its configuration options in its New() method.
@@ -73,6 +137,18 @@ func Open(name string, opts map[string]string) (Nozzle, error) {
 	return n.New(opts)
 }
 
+// Drivers returns a sorted list of the names of the registered nozzle drivers.
+func Drivers() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	list := make([]string, 0, len(drivers))
+	for name := range drivers {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
 // Register makes a nozzle driver available at the provided name. If register is
 // called twice or if the driver is nil, if panics. Register() is typically
 // called in the nozzle implementation's init() function to allow for easy
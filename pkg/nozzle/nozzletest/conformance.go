@@ -0,0 +1,326 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nozzletest
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+)
+
+// Server is a running fake provider.
+type Server struct {
+	*httptest.Server
+
+	// Directory answers the fake's logins
+	Directory *Directory
+
+	mu        sync.Mutex
+	stall     bool
+	malformed http.HandlerFunc
+	cancelled chan struct{}
+}
+
+// NewServer starts a TLS server for the fake, backed by dir. The caller must
+// Close the server.
+func NewServer(f Fake, dir *Directory) *Server {
+	s := &Server{
+		Directory: dir,
+		cancelled: make(chan struct{}, 1),
+	}
+	handler := f.Handler(dir)
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		stall, malformed := s.stall, s.malformed
+		s.mu.Unlock()
+
+		switch {
+		case stall:
+			// the server only notices the client hanging up once the
+			// request body has been read
+			io.Copy(ioutil.Discard, r.Body) // nolint:errcheck,gosec
+			select {
+			case <-r.Context().Done():
+				select {
+				case s.cancelled <- struct{}{}:
+				default:
+				}
+			case <-time.After(10 * time.Second):
+			}
+		case malformed != nil:
+			malformed(w, r)
+		default:
+			handler.ServeHTTP(w, r)
+		}
+	}))
+	return s
+}
+
+// Host returns the address of the server.
+func (s *Server) Host() string {
+	return s.Listener.Addr().String()
+}
+
+// Stall makes the server hold every request until the client gives up on it.
+func (s *Server) Stall(stall bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stall = stall
+}
+
+// Cancelled returns a channel which receives once a stalled request has been
+// abandoned by the client.
+func (s *Server) Cancelled() <-chan struct{} {
+	return s.cancelled
+}
+
+// Malform replaces every response with the output of h. A nil h restores the
+// fake's responses.
+func (s *Server) Malform(h http.HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.malformed = h
+}
+
+// Malformations are responses which no provider sends for a login. A nozzle
+// must return an error or an invalid login for each of them.
+var Malformations = map[string]http.HandlerFunc{
+	"empty": func(w http.ResponseWriter, r *http.Request) {},
+	"empty json": func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}")) // nolint:errcheck,gosec
+	},
+	"truncated json": func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"SUCC`)) // nolint:errcheck,gosec
+	},
+	"binary": func(w http.ResponseWriter, r *http.Request) {
+		data := make([]byte, 4096)
+		rand.New(rand.NewSource(1)).Read(data) // nolint:gosec
+		w.Write(data)                          // nolint:errcheck,gosec
+	},
+	"html": func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><head><title>Maintenance</title></head><body>Back soon</body></html>")) // nolint:errcheck,gosec
+	},
+	"server error": func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+	},
+	"teapot": func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(418)
+		w.Write([]byte("ret=1")) // nolint:errcheck,gosec
+	},
+}
+
+// Configure points a nozzle created by the suite at the fake. It is passed a
+// client which trusts the fake's certificate.
+type Configure func(noz nozzle.Nozzle, client *http.Client)
+
+// Run runs the conformance suite for a nozzle driver against the fake. It
+// checks that each outcome is mapped to the right AuthResponse, that the
+// nozzle implements nozzle.ContextNozzle and abandons its request when the
+// context is cancelled, and that malformed responses are never reported as
+// valid logins.
+func Run(t *testing.T, d nozzle.Driver, f Fake, configure Configure) {
+	open := func(t *testing.T, dir *Directory) (nozzle.Nozzle, *Server) {
+		srv := NewServer(f, dir)
+		noz, err := d.New(f.Options(srv.Host()))
+		if err != nil {
+			srv.Close()
+			t.Fatalf("[%s] unable to open nozzle: %s", f.Name, err)
+		}
+		configure(noz, srv.Client())
+		return noz, srv
+	}
+
+	t.Run("outcomes", func(t *testing.T) {
+		noz, srv := open(t, NewDirectory())
+		defer srv.Close()
+
+		testcases := []struct {
+			username string
+			password string
+			outcome  Outcome
+		}{
+			{"alice@example.org", "Password1!", Valid},
+			{"alice@example.org", "wrong", Invalid},
+			{"eve@example.org", "Password2!", ValidMFA},
+			{"old@example.org", "Password3!", PasswordExpired},
+			{"bob@example.org", "Password4!", Locked},
+			{"nobody@example.org", "Password1!", UnknownUser},
+		}
+		for _, tc := range testcases {
+			if tc.outcome == PasswordExpired && !f.Reports.PasswordExpired {
+				continue
+			}
+			res, err := noz.Login(tc.username, tc.password)
+			if err != nil {
+				t.Errorf("[%s] %s: error in login: %s", f.Name, tc.outcome, err)
+				continue
+			}
+			check(t, f, tc.outcome, res)
+		}
+	})
+
+	t.Run("lockout", func(t *testing.T) {
+		if !f.Reports.Locked {
+			t.Skipf("%s does not report locked accounts", f.Name)
+		}
+
+		dir := NewDirectory()
+		dir.LockoutThreshold = 3
+		noz, srv := open(t, dir)
+		defer srv.Close()
+
+		for i := 0; i < dir.LockoutThreshold; i++ {
+			res, err := noz.Login("carol@example.org", "wrong")
+			if err != nil {
+				t.Fatalf("[%s] error in login: %s", f.Name, err)
+			}
+			check(t, f, Invalid, res)
+		}
+		res, err := noz.Login("carol@example.org", "Password5!")
+		if err != nil {
+			t.Fatalf("[%s] error in login: %s", f.Name, err)
+		}
+		check(t, f, Locked, res)
+	})
+
+	t.Run("rate limiting", func(t *testing.T) {
+		if !f.Reports.RateLimited {
+			t.Skipf("%s does not rate limit", f.Name)
+		}
+
+		dir := NewDirectory()
+		dir.RateLimitAfter = 1
+		noz, srv := open(t, dir)
+		defer srv.Close()
+
+		for _, outcome := range []Outcome{Valid, RateLimited} {
+			res, err := noz.Login("alice@example.org", "Password1!")
+			if err != nil {
+				t.Fatalf("[%s] error in login: %s", f.Name, err)
+			}
+			check(t, f, outcome, res)
+		}
+	})
+
+	t.Run("cancellation", func(t *testing.T) {
+		noz, srv := open(t, NewDirectory())
+		defer srv.Close()
+		c, ok := noz.(nozzle.ContextNozzle)
+		if !ok {
+			t.Fatalf("[%s] nozzle does not implement nozzle.ContextNozzle", f.Name)
+		}
+		srv.Stall(true)
+		defer srv.Stall(false)
+
+		// long enough for the nozzle's rate limiter to let the request through
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := c.LoginContext(ctx, "alice@example.org", "Password1!")
+			done <- err
+		}()
+
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Errorf("[%s] login with a cancelled context did not return an error", f.Name)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("[%s] login did not return after its context was cancelled", f.Name)
+		}
+
+		select {
+		case <-srv.Cancelled():
+		case <-time.After(5 * time.Second):
+			t.Errorf("[%s] request was not cancelled with its context", f.Name)
+		}
+	})
+
+	t.Run("malformed responses", func(t *testing.T) {
+		noz, srv := open(t, NewDirectory())
+		defer srv.Close()
+
+		for name, h := range Malformations {
+			srv.Malform(h)
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Errorf("[%s] %s response: login panicked: %v", f.Name, name, r)
+					}
+				}()
+				res, err := noz.Login("alice@example.org", "Password1!")
+				switch {
+				case err != nil:
+				case res == nil:
+					t.Errorf("[%s] %s response: login returned neither a result nor an error", f.Name, name)
+				case res.Valid:
+					t.Errorf("[%s] %s response: reported as a valid login", f.Name, name)
+				}
+			}()
+		}
+	})
+}
+
+// check compares a login result with the outcome the fake returned.
+func check(t *testing.T, f Fake, outcome Outcome, res *event.AuthResponse) {
+	t.Helper()
+
+	var valid, mfa, locked, ratelimited bool
+	switch outcome {
+	case Valid:
+		valid = true
+	case ValidMFA:
+		valid, mfa = true, f.Reports.MFA
+	case PasswordExpired:
+		valid = true
+	case Locked:
+		locked = f.Reports.Locked
+	case RateLimited:
+		ratelimited = true
+	}
+
+	if res.Valid != valid {
+		t.Errorf("[%s] %s: res.Valid was %t, expected %t", f.Name, outcome, res.Valid, valid)
+	}
+	if res.MFA != mfa {
+		t.Errorf("[%s] %s: res.MFA was %t, expected %t", f.Name, outcome, res.MFA, mfa)
+	}
+	if res.Locked != locked {
+		t.Errorf("[%s] %s: res.Locked was %t, expected %t", f.Name, outcome, res.Locked, locked)
+	}
+	if res.RateLimited != ratelimited {
+		t.Errorf("[%s] %s: res.RateLimited was %t, expected %t", f.Name, outcome, res.RateLimited, ratelimited)
+	}
+	if outcome == PasswordExpired && res.Metadata["passwordExpired"] != true {
+		t.Errorf("[%s] %s: expected passwordExpired metadata", f.Name, outcome)
+	}
+	if outcome == UnknownUser && f.Reports.UnknownUser && res.UserStatus != event.UserStatusNotExists {
+		t.Errorf("[%s] %s: res.UserStatus was %q, expected %q", f.Name, outcome, res.UserStatus, event.UserStatusNotExists)
+	}
+}
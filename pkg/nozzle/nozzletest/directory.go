@@ -0,0 +1,173 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package nozzletest provides fake identity providers and a conformance suite
+// for testing nozzles without sending requests to a real provider.
+//
+// Each fake is an http.Handler which answers logins the way the provider
+// does, backed by a Directory of users. The Directory decides the outcome of
+// every login, including lockouts after repeated failures and rate limiting,
+// so the fakes only translate an Outcome into the provider's response format.
+//
+// A nozzle's tests run the conformance suite against the matching fake:
+//
+//	func TestConformance(t *testing.T) {
+//	    nozzletest.Run(t, Driver{}, nozzletest.Okta, func(noz nozzle.Nozzle, client *http.Client) {
+//	        noz.(*Nozzle).Client = client
+//	    })
+//	}
+//
+// Every HTTP nozzle has a fake and runs the suite. The ldap, kerberos, and ssh
+// nozzles speak their own protocols and the exec nozzle delegates to a plugin,
+// so their tests run protocol-level test servers (or a test plugin) instead.
+package nozzletest
+
+import (
+	"sync"
+)
+
+// Outcome is the result of a login decided by a Directory.
+type Outcome int
+
+// Login outcomes
+const (
+	Invalid Outcome = iota
+	Valid
+	ValidMFA
+	PasswordExpired
+	Locked
+	UnknownUser
+	RateLimited
+)
+
+var outcomeNames = map[Outcome]string{
+	Invalid:         "invalid",
+	Valid:           "valid",
+	ValidMFA:        "valid with mfa",
+	PasswordExpired: "password expired",
+	Locked:          "locked",
+	UnknownUser:     "unknown user",
+	RateLimited:     "rate limited",
+}
+
+func (o Outcome) String() string {
+	return outcomeNames[o]
+}
+
+// User is an account in a Directory.
+type User struct {
+	// Username and Password are the user's credential
+	Username string
+	Password string
+
+	// MFA requires a second factor after a correct password
+	MFA bool
+
+	// Locked rejects every login, including ones with the correct password
+	Locked bool
+
+	// PasswordExpired requires the password to be changed after a correct
+	// password
+	PasswordExpired bool
+}
+
+// DefaultUsers are added to every new Directory. Each covers one outcome of a
+// login with the correct password.
+var DefaultUsers = []User{
+	{Username: "alice@example.org", Password: "Password1!"},
+	{Username: "eve@example.org", Password: "Password2!", MFA: true},
+	{Username: "old@example.org", Password: "Password3!", PasswordExpired: true},
+	{Username: "bob@example.org", Password: "Password4!", Locked: true},
+	{Username: "carol@example.org", Password: "Password5!"},
+}
+
+// Directory is the user store behind a fake provider. It is safe for
+// concurrent use.
+type Directory struct {
+	mu sync.Mutex
+
+	users    map[string]*User
+	failures map[string]int
+	attempts int
+
+	// LockoutThreshold locks a user after this many consecutive failed logins.
+	// Zero disables lockout.
+	LockoutThreshold int
+
+	// RateLimitAfter rate limits every login after this many logins. Zero
+	// disables rate limiting.
+	RateLimitAfter int
+}
+
+// NewDirectory returns a Directory containing the DefaultUsers.
+func NewDirectory() *Directory {
+	d := &Directory{
+		users:    map[string]*User{},
+		failures: map[string]int{},
+	}
+	for _, u := range DefaultUsers {
+		d.Add(u)
+	}
+	return d
+}
+
+// Add adds a user to the directory, replacing any user with the same name.
+func (d *Directory) Add(u User) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.users[u.Username] = &u
+	delete(d.failures, u.Username)
+}
+
+// Authenticate decides the outcome of a login. A locked user is reported as
+// locked whether or not the password is correct.
+func (d *Directory) Authenticate(username, password string) Outcome {
+	return d.AuthenticateFunc(username, func(p string) bool { return p == password })
+}
+
+// AuthenticateFunc decides the outcome of a login for challenge-response
+// protocols such as NTLM, where the password is never sent. verify reports
+// whether the client proved knowledge of the user's password.
+func (d *Directory) AuthenticateFunc(username string, verify func(password string) bool) Outcome {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.attempts++
+	if d.RateLimitAfter > 0 && d.attempts > d.RateLimitAfter {
+		return RateLimited
+	}
+
+	u, ok := d.users[username]
+	switch {
+	case !ok:
+		return UnknownUser
+	case u.Locked:
+		return Locked
+	case !verify(u.Password):
+		d.failures[username]++
+		if d.LockoutThreshold > 0 && d.failures[username] >= d.LockoutThreshold {
+			u.Locked = true
+		}
+		return Invalid
+	}
+
+	d.failures[username] = 0
+	switch {
+	case u.PasswordExpired:
+		return PasswordExpired
+	case u.MFA:
+		return ValidMFA
+	}
+	return Valid
+}
@@ -0,0 +1,70 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nozzletest
+
+import (
+	"testing"
+)
+
+type testcase struct {
+	desc     string
+	username string
+	password string
+	outcome  Outcome
+}
+
+func run(t *testing.T, dir *Directory, testcases []testcase) {
+	for _, tc := range testcases {
+		o := dir.Authenticate(tc.username, tc.password)
+		if o != tc.outcome {
+			t.Errorf("[%s] outcome was %s, expected %s", tc.desc, o, tc.outcome)
+		}
+	}
+}
+
+func TestDirectory(t *testing.T) {
+	run(t, NewDirectory(), []testcase{
+		{"valid", "alice@example.org", "Password1!", Valid},
+		{"invalid", "alice@example.org", "wrong", Invalid},
+		{"mfa", "eve@example.org", "Password2!", ValidMFA},
+		{"expired", "old@example.org", "Password3!", PasswordExpired},
+		{"locked", "bob@example.org", "Password4!", Locked},
+		{"locked invalid", "bob@example.org", "wrong", Locked},
+		{"unknown", "nobody@example.org", "Password1!", UnknownUser},
+	})
+}
+
+func TestLockout(t *testing.T) {
+	dir := NewDirectory()
+	dir.LockoutThreshold = 2
+	run(t, dir, []testcase{
+		{"first failure", "carol@example.org", "wrong", Invalid},
+		{"success resets failures", "carol@example.org", "Password5!", Valid},
+		{"second failure", "carol@example.org", "wrong", Invalid},
+		{"third failure", "carol@example.org", "wrong", Invalid},
+		{"locked out", "carol@example.org", "Password5!", Locked},
+		{"other users", "alice@example.org", "Password1!", Valid},
+	})
+}
+
+func TestRateLimit(t *testing.T) {
+	dir := NewDirectory()
+	dir.RateLimitAfter = 2
+	run(t, dir, []testcase{
+		{"first", "alice@example.org", "Password1!", Valid},
+		{"second", "nobody@example.org", "Password1!", UnknownUser},
+		{"third", "alice@example.org", "Password1!", RateLimited},
+	})
+}
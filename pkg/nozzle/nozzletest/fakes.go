@@ -0,0 +1,636 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nozzletest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/praetorian-inc/trident/pkg/ntlm"
+)
+
+// Fake describes a fake identity provider.
+type Fake struct {
+	// Name identifies the fake in test output
+	Name string
+
+	// Options returns the nozzle configuration which targets the fake at
+	// host (an address such as 127.0.0.1:4242)
+	Options func(host string) map[string]string
+
+	// Handler returns the fake's handler, answering logins from dir
+	Handler func(dir *Directory) http.Handler
+
+	// Reports lists the outcomes the provider distinguishes, and so which
+	// outcomes the nozzle is expected to report
+	Reports Reports
+}
+
+// Reports lists the outcomes a provider distinguishes from an invalid login.
+type Reports struct {
+	// MFA is reported with the MFA field
+	MFA bool
+
+	// PasswordExpired is reported as valid with the passwordExpired metadata
+	PasswordExpired bool
+
+	// Locked is reported with the Locked field
+	Locked bool
+
+	// UnknownUser is reported with the not_exists user status
+	UnknownUser bool
+
+	// RateLimited is reported with the RateLimited field
+	RateLimited bool
+}
+
+// Okta answers the primary authentication API.
+var Okta = Fake{
+	Name: "okta",
+	Options: func(host string) map[string]string {
+		return map[string]string{"custom-domain": host}
+	},
+	Handler: func(dir *Directory) http.Handler {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/api/v1/authn", func(w http.ResponseWriter, r *http.Request) {
+			var req struct {
+				Username string `json:"username"`
+				Password string `json:"password"`
+			}
+			if r.Method != "POST" || json.NewDecoder(r.Body).Decode(&req) != nil {
+				writeJSON(w, 400, map[string]string{"errorCode": "E0000003"})
+				return
+			}
+
+			status := map[Outcome]string{
+				Valid:           "SUCCESS",
+				ValidMFA:        "MFA_REQUIRED",
+				PasswordExpired: "PASSWORD_EXPIRED",
+				Locked:          "LOCKED_OUT",
+			}
+			switch o := dir.Authenticate(req.Username, req.Password); o {
+			case RateLimited:
+				writeJSON(w, 429, map[string]string{"errorCode": "E0000047"})
+			case Invalid, UnknownUser:
+				writeJSON(w, 401, map[string]string{"errorCode": "E0000004"})
+			default:
+				writeJSON(w, 200, map[string]string{"status": status[o]})
+			}
+		})
+		return mux
+	},
+	Reports: Reports{
+		MFA:             true,
+		PasswordExpired: true,
+		Locked:          true,
+		RateLimited:     true,
+	},
+}
+
+// aadsts maps the outcomes of failed logins to the AADSTS error codes Azure AD
+// returns for them.
+var aadsts = map[Outcome]string{
+	Invalid:         "AADSTS50126",
+	ValidMFA:        "AADSTS50076",
+	PasswordExpired: "AADSTS50055",
+	Locked:          "AADSTS50053",
+	UnknownUser:     "AADSTS50034",
+}
+
+// O365 answers the Azure AD v1 and v2 token endpoints with AADSTS errors.
+var O365 = Fake{
+	Name: "o365",
+	Options: func(host string) map[string]string {
+		return map[string]string{"domain": host}
+	},
+	Handler: func(dir *Directory) http.Handler {
+		token := func(w http.ResponseWriter, r *http.Request) {
+			switch o := dir.Authenticate(r.PostFormValue("username"), r.PostFormValue("password")); o {
+			case Valid:
+				writeJSON(w, 200, map[string]string{"token_type": "Bearer", "access_token": "eyJ0eXAiOiJKV1QifQ"})
+			case RateLimited:
+				w.WriteHeader(429)
+			default:
+				writeJSON(w, 400, map[string]interface{}{
+					"error":             "invalid_grant",
+					"error_description": aadsts[o] + ": Error validating credentials.",
+				})
+			}
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/common/oauth2/token", token)
+		mux.HandleFunc("/common/oauth2/v2.0/token", token)
+		return mux
+	},
+	Reports: Reports{
+		MFA:             true,
+		PasswordExpired: true,
+		Locked:          true,
+		UnknownUser:     true,
+		RateLimited:     true,
+	},
+}
+
+const (
+	adfsToken = `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope"><s:Body>` +
+		`<trust:RequestSecurityTokenResponse xmlns:trust="http://schemas.xmlsoap.org/ws/2005/02/trust"/>` +
+		`</s:Body></s:Envelope>`
+	adfsFault = `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope"><s:Body><s:Fault>` +
+		`<s:Code><s:Value>s:Sender</s:Value><s:Subcode><s:Value xmlns:a="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd">a:%s</s:Value></s:Subcode></s:Code>` +
+		`<s:Reason><s:Text xml:lang="en-US">%s</s:Text></s:Reason>` +
+		`</s:Fault></s:Body></s:Envelope>`
+)
+
+// ADFS answers the WS-Trust usernamemixed endpoint with SOAP faults. An
+// issuance authorization rule denying the token is how a relying party
+// requiring MFA appears to WS-Trust, so MFA is not distinguished from a valid
+// login.
+var ADFS = Fake{
+	Name: "adfs",
+	Options: func(host string) map[string]string {
+		return map[string]string{"domain": host, "strategy": "usernamemixed"}
+	},
+	Handler: func(dir *Directory) http.Handler {
+		const failed = "ID3242: The security token could not be authenticated or authorized."
+		mux := http.NewServeMux()
+		mux.HandleFunc("/adfs/services/trust/2005/usernamemixed", func(w http.ResponseWriter, r *http.Request) {
+			var env struct {
+				Username string `xml:"Header>Security>UsernameToken>Username"`
+				Password string `xml:"Header>Security>UsernameToken>Password"`
+			}
+			if xml.NewDecoder(r.Body).Decode(&env) != nil {
+				w.WriteHeader(400)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/soap+xml; charset=utf-8")
+			o := dir.Authenticate(env.Username, env.Password)
+			if o == Valid {
+				fmt.Fprint(w, adfsToken) // nolint:errcheck
+				return
+			}
+
+			subcode, reason := "FailedAuthentication", failed
+			switch o {
+			case ValidMFA:
+				subcode, reason = "RequestFailed", "MSIS7068: Access denied."
+			case PasswordExpired:
+				reason = failed + " The password for this account has expired."
+			case Locked:
+				reason = failed + " The referenced account is currently locked out and may not be logged on to."
+			case RateLimited:
+				subcode, reason = "RequestFailed", "MSIS7042: The same client browser session has made '6' requests in the last '11' seconds."
+			}
+			w.WriteHeader(500)
+			fmt.Fprintf(w, adfsFault, subcode, reason) // nolint:errcheck
+		})
+		return mux
+	},
+	Reports: Reports{
+		PasswordExpired: true,
+		Locked:          true,
+		RateLimited:     true,
+	},
+}
+
+// OIDCROPC answers an OAuth2 token endpoint with the errors used by Keycloak
+// and Auth0.
+var OIDCROPC = Fake{
+	Name: "oidc-ropc",
+	Options: func(host string) map[string]string {
+		return map[string]string{
+			"token-endpoint": "https://" + host + "/token",
+			"client-id":      "nozzletest",
+		}
+	},
+	Handler: func(dir *Directory) http.Handler {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+			if r.PostFormValue("grant_type") != "password" {
+				writeJSON(w, 400, map[string]string{"error": "unsupported_grant_type"})
+				return
+			}
+
+			grant := func(description string) {
+				writeJSON(w, 400, map[string]string{"error": "invalid_grant", "error_description": description})
+			}
+			switch dir.Authenticate(r.PostFormValue("username"), r.PostFormValue("password")) {
+			case Valid:
+				writeJSON(w, 200, map[string]interface{}{"access_token": "eyJ0eXAiOiJKV1QifQ", "token_type": "Bearer", "expires_in": 300})
+			case ValidMFA:
+				writeJSON(w, 403, map[string]string{"error": "mfa_required", "error_description": "Multifactor authentication required"})
+			case PasswordExpired:
+				grant("Password has expired")
+			case Locked:
+				grant("Account is temporarily locked")
+			case RateLimited:
+				writeJSON(w, 429, map[string]string{"error": "too_many_requests", "error_description": "Too many requests"})
+			default:
+				grant("Invalid user credentials")
+			}
+		})
+		return mux
+	},
+	Reports: Reports{
+		MFA:             true,
+		PasswordExpired: true,
+		Locked:          true,
+		RateLimited:     true,
+	},
+}
+
+// NetScaler answers the Gateway's logon form with session and NSC_VPNERR
+// cookies. The Gateway has no rate limiting of its own.
+var NetScaler = Fake{
+	Name: "netscaler",
+	Options: func(host string) map[string]string {
+		return map[string]string{"domain": host}
+	},
+	Handler: func(dir *Directory) http.Handler {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/cgi/login", func(w http.ResponseWriter, r *http.Request) {
+			code := map[Outcome]string{
+				PasswordExpired: "4012",
+				Locked:          "4015",
+			}
+			switch o := dir.Authenticate(r.PostFormValue("login"), r.PostFormValue("passwd")); o {
+			case Valid:
+				http.SetCookie(w, &http.Cookie{Name: "NSC_AAAC", Value: "5e1f0a2b", Path: "/"})
+				http.Redirect(w, r, "/vpns/index.html", http.StatusFound)
+			case ValidMFA:
+				http.Redirect(w, r, "/cgi/dlge", http.StatusFound)
+			default:
+				if code[o] == "" {
+					code[o] = "4001"
+				}
+				http.SetCookie(w, &http.Cookie{Name: "NSC_VPNERR", Value: code[o], Path: "/"})
+				http.Redirect(w, r, "/vpn/index.html", http.StatusFound)
+			}
+		})
+		return mux
+	},
+	Reports: Reports{
+		MFA:             true,
+		PasswordExpired: true,
+		Locked:          true,
+	},
+}
+
+// Fortinet answers the SSL VPN's login check. FortiGate blocks the source
+// address rather than the account, so a locked user is indistinguishable from
+// an invalid login.
+var Fortinet = Fake{
+	Name: "fortinet",
+	Options: func(host string) map[string]string {
+		return map[string]string{"domain": host}
+	},
+	Handler: func(dir *Directory) http.Handler {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/remote/logincheck", func(w http.ResponseWriter, r *http.Request) {
+			switch dir.Authenticate(r.PostFormValue("username"), r.PostFormValue("credential")) {
+			case Valid, PasswordExpired:
+				fmt.Fprint(w, "ret=1,redir=/remote/fortisslvpn") // nolint:errcheck
+			case ValidMFA:
+				fmt.Fprint(w, "ret=2,tokeninfo=,chal_msg=Please enter your FortiToken code") // nolint:errcheck
+			case RateLimited:
+				fmt.Fprint(w, "Too many bad login attempts. Please try again in a few minutes.") // nolint:errcheck
+			default:
+				fmt.Fprint(w, "ret=0,redir=/remote/login?&err=sslvpn_login_permission_denied") // nolint:errcheck
+			}
+		})
+		return mux
+	},
+	Reports: Reports{
+		MFA:         true,
+		RateLimited: true,
+	},
+}
+
+// exchangeChallenge is the server challenge of the Exchange fake.
+var exchangeChallenge = []byte("01234567")
+
+// Exchange answers EWS with NTLM authentication. Like Exchange, it challenges
+// anonymous requests and sends a new challenge after a failed login. Legacy
+// endpoints do not prompt for MFA, and Active Directory rejects locked users
+// like any invalid login.
+var Exchange = Fake{
+	Name: "exchange",
+	Options: func(host string) map[string]string {
+		return map[string]string{"domain": host, "endpoint": "ews", "auth": "ntlm"}
+	},
+	Handler: func(dir *Directory) http.Handler {
+		challenge := ntlm.NewChallenge(&ntlm.ChallengeInfo{NetBIOSDomain: "CORP"}, exchangeChallenge)
+		unauthorized := func(w http.ResponseWriter, header string) {
+			w.Header().Set("WWW-Authenticate", header)
+			w.WriteHeader(401)
+		}
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/EWS/Exchange.asmx", func(w http.ResponseWriter, r *http.Request) {
+			auth := r.Header.Get("Authorization")
+			if !strings.HasPrefix(auth, "NTLM ") {
+				unauthorized(w, "NTLM")
+				return
+			}
+			data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "NTLM "))
+			if err != nil {
+				w.WriteHeader(400)
+				return
+			}
+			msg, err := ntlm.ParseAuthenticate(data)
+			if err != nil {
+				// a negotiate message
+				unauthorized(w, "NTLM "+base64.StdEncoding.EncodeToString(challenge))
+				return
+			}
+
+			o := dir.AuthenticateFunc(msg.User, func(password string) bool {
+				return msg.Verify(exchangeChallenge, "CORP", password)
+			})
+			switch o {
+			case Valid, ValidMFA, PasswordExpired:
+				w.WriteHeader(200)
+			case RateLimited:
+				w.WriteHeader(429)
+			default:
+				unauthorized(w, "NTLM")
+			}
+		})
+		return mux
+	},
+	Reports: Reports{
+		RateLimited: true,
+	},
+}
+
+const (
+	autologonToken = `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope"><s:Body>` +
+		`<wst:RequestSecurityTokenResponse xmlns:wst="http://schemas.xmlsoap.org/ws/2005/02/trust">` +
+		`<wst:RequestedSecurityToken><DesktopSsoToken>eyJ0eXAiOiJKV1QifQ</DesktopSsoToken></wst:RequestedSecurityToken>` +
+		`</wst:RequestSecurityTokenResponse></s:Body></s:Envelope>`
+	autologonFault = `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope"><s:Body><s:Fault>` +
+		`<s:Code><s:Value>s:Sender</s:Value></s:Code>` +
+		`<s:Reason><s:Text xml:lang="en-US">Authentication Failure</s:Text></s:Reason>` +
+		`<s:Detail><psf:error xmlns:psf="http://schemas.microsoft.com/Passport/SoapServices/SOAPFault">` +
+		`<psf:value>0x80048821</psf:value><psf:internalerror><psf:code>0x80048821</psf:code>` +
+		`<psf:text>%s: Error validating credentials.</psf:text></psf:internalerror>` +
+		`</psf:error></s:Detail></s:Fault></s:Body></s:Envelope>`
+)
+
+// Autologon answers the Azure AD Seamless SSO usernamemixed endpoint with
+// SOAP faults carrying the same AADSTS codes as the token endpoint.
+var Autologon = Fake{
+	Name: "autologon",
+	Options: func(host string) map[string]string {
+		return map[string]string{"host": host}
+	},
+	Handler: func(dir *Directory) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.HasSuffix(r.URL.Path, "/winauth/trust/2005/usernamemixed") {
+				http.NotFound(w, r)
+				return
+			}
+			var env struct {
+				Username string `xml:"Header>Security>UsernameToken>Username"`
+				Password string `xml:"Header>Security>UsernameToken>Password"`
+			}
+			if xml.NewDecoder(r.Body).Decode(&env) != nil {
+				w.WriteHeader(400)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/soap+xml; charset=utf-8")
+			switch o := dir.Authenticate(env.Username, env.Password); o {
+			case Valid:
+				fmt.Fprint(w, autologonToken) // nolint:errcheck
+			case RateLimited:
+				w.WriteHeader(429)
+			default:
+				w.WriteHeader(400)
+				fmt.Fprintf(w, autologonFault, aadsts[o]) // nolint:errcheck
+			}
+		})
+	},
+	Reports: Reports{
+		MFA:             true,
+		PasswordExpired: true,
+		Locked:          true,
+		UnknownUser:     true,
+		RateLimited:     true,
+	},
+}
+
+// OWA answers the forms based logon of Outlook on the web with cadata cookies.
+// OWA does not prompt for MFA, and Active Directory rejects locked users like
+// any invalid login.
+var OWA = Fake{
+	Name: "owa",
+	Options: func(host string) map[string]string {
+		return map[string]string{"domain": host, "netbios-domain": "CORP"}
+	},
+	Handler: func(dir *Directory) http.Handler {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/owa/auth.owa", func(w http.ResponseWriter, r *http.Request) {
+			switch dir.Authenticate(r.PostFormValue("username"), r.PostFormValue("password")) {
+			case Valid, ValidMFA:
+				http.SetCookie(w, &http.Cookie{Name: "cadata", Value: "5e1f0a2b", Path: "/"})
+				http.SetCookie(w, &http.Cookie{Name: "cadataTTL", Value: "5e1f0a2b", Path: "/"})
+				http.Redirect(w, r, "/owa/", http.StatusFound)
+			case PasswordExpired:
+				http.Redirect(w, r, "/owa/auth/expiredpassword.aspx?url=/owa/auth.owa&reason=0", http.StatusFound)
+			default:
+				http.Redirect(w, r, "/owa/auth/logon.aspx?replaceCurrent=1&reason=2&url=", http.StatusFound)
+			}
+		})
+		return mux
+	},
+	Reports: Reports{
+		PasswordExpired: true,
+	},
+}
+
+const (
+	globalProtectPrelogin = `<?xml version="1.0" encoding="UTF-8" ?>` +
+		`<prelogin-response><status>Success</status><msg></msg>` +
+		`<authentication-message>Enter login credentials</authentication-message></prelogin-response>`
+	globalProtectLogin = `<?xml version="1.0" encoding="utf-8"?>` +
+		`<jnlp><application-desc><argument>(auth)</argument><argument>a1b2c3d4e5f6</argument></application-desc></jnlp>`
+	globalProtectStatus = "var respStatus = %q;\nvar respMsg = %q;\nthisForm.inputStr.value = \"5ef64e83000119ed\";\n"
+)
+
+// GlobalProtect answers a gateway's prelogin and login requests. Challenges
+// and errors are described by the javascript variables of the login page. The
+// gateway has no rate limiting of its own.
+var GlobalProtect = Fake{
+	Name: "globalprotect",
+	Options: func(host string) map[string]string {
+		return map[string]string{"domain": host, "endpoint": "gateway"}
+	},
+	Handler: func(dir *Directory) http.Handler {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/ssl-vpn/prelogin.esp", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, globalProtectPrelogin) // nolint:errcheck
+		})
+		mux.HandleFunc("/ssl-vpn/login.esp", func(w http.ResponseWriter, r *http.Request) {
+			switch dir.Authenticate(r.PostFormValue("user"), r.PostFormValue("passwd")) {
+			case Valid:
+				fmt.Fprint(w, globalProtectLogin) // nolint:errcheck
+			case ValidMFA:
+				fmt.Fprintf(w, globalProtectStatus, "Challenge", "Enter the code from your authenticator app") // nolint:errcheck
+			case PasswordExpired:
+				fmt.Fprintf(w, globalProtectStatus, "Challenge", "Your password has expired. Please enter a new password") // nolint:errcheck
+			case Locked:
+				w.Header().Set("X-Private-Pan-Sslvpn", "auth-failed")
+				fmt.Fprintf(w, globalProtectStatus, "Error", "Authentication failed: Account is locked") // nolint:errcheck
+			default:
+				w.Header().Set("X-Private-Pan-Sslvpn", "auth-failed")
+				w.WriteHeader(512)
+				fmt.Fprint(w, "Invalid username or password") // nolint:errcheck
+			}
+		})
+		return mux
+	},
+	Reports: Reports{
+		MFA:             true,
+		PasswordExpired: true,
+		Locked:          true,
+	},
+}
+
+// AnyConnect answers the ASA WebVPN logon page and form. A webvpn session
+// cookie is a valid login, and challenges and failures are described by the
+// returned page. The ASA has no rate limiting of its own.
+var AnyConnect = Fake{
+	Name: "anyconnect",
+	Options: func(host string) map[string]string {
+		return map[string]string{"domain": host, "group": "Employees"}
+	},
+	Handler: func(dir *Directory) http.Handler {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/+CSCOE+/logon.html", func(w http.ResponseWriter, r *http.Request) {
+			http.SetCookie(w, &http.Cookie{Name: "webvpnlogin", Value: "1", Path: "/"})
+			fmt.Fprint(w, `<form name="frmLogin" method="post" action="/+webvpn+/index.html">`) // nolint:errcheck
+		})
+		mux.HandleFunc("/+webvpn+/index.html", func(w http.ResponseWriter, r *http.Request) {
+			switch dir.Authenticate(r.PostFormValue("username"), r.PostFormValue("password")) {
+			case Valid:
+				http.SetCookie(w, &http.Cookie{Name: "webvpn", Value: "C8A5E4@28672@AB12@5C1E0A", Path: "/"})
+				fmt.Fprint(w, `<script>document.location.replace("/+CSCOE+/portal.html");</script>`) // nolint:errcheck
+			case ValidMFA:
+				fmt.Fprint(w, `<form name="frmLogin" method="post" action="/+webvpn+/login/challenge.html">`+ // nolint:errcheck
+					`Enter the passcode sent to your phone <input type="hidden" name="auth_handle" value="2617"></form>`)
+			case PasswordExpired:
+				fmt.Fprint(w, `<form name="frmLogin" method="post" action="/+webvpn+/login/password_change.html">`+ // nolint:errcheck
+					`Your password has expired. <input type="password" name="new_password"></form>`)
+			case Locked:
+				fmt.Fprint(w, `<form name="frmLogin">Login failed. Your account has been locked.</form>`) // nolint:errcheck
+			default:
+				http.SetCookie(w, &http.Cookie{Name: "webvpn", Value: "", Path: "/"})
+				w.Header().Set("Location", "/+CSCOE+/logon.html?a0=15&a1=&a2=&a3=1&reason=1")
+				w.WriteHeader(http.StatusFound)
+			}
+		})
+		return mux
+	},
+	Reports: Reports{
+		MFA:             true,
+		PasswordExpired: true,
+		Locked:          true,
+	},
+}
+
+// genericHTTPSpec is the generic-http spec for the GenericHTTP fake, with
+// HOST replaced by the fake's address.
+const genericHTTPSpec = `
+prelogin:
+  url: https://HOST/login
+  extract:
+    - name: csrf
+      body: 'name="csrf" value="([^"]+)"'
+login:
+  url: https://HOST/login
+  headers:
+    Content-Type: application/x-www-form-urlencoded
+  body: 'user={{urlquery .Username}}&pass={{urlquery .Password}}&csrf={{urlquery .Vars.csrf}}'
+success:
+  - status: 302
+    header: {name: Location, regex: /dashboard}
+failure:
+  - body: Invalid username or password
+lockout:
+  - body: account has been locked
+mfa:
+  - body: verification code
+ratelimit:
+  - status: 429
+`
+
+// GenericHTTP answers a form login with a CSRF token, described to the
+// generic-http nozzle by a spec. Specs have no rule for expired passwords.
+var GenericHTTP = Fake{
+	Name: "generic-http",
+	Options: func(host string) map[string]string {
+		return map[string]string{"spec": strings.ReplaceAll(genericHTTPSpec, "HOST", host)}
+	},
+	Handler: func(dir *Directory) http.Handler {
+		const csrf = "7f3a9c2e"
+		mux := http.NewServeMux()
+		mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" {
+				fmt.Fprintf(w, `<form method="post"><input type="hidden" name="csrf" value="%s"></form>`, csrf) // nolint:errcheck
+				return
+			}
+			if r.PostFormValue("csrf") != csrf {
+				w.WriteHeader(403)
+				return
+			}
+
+			switch dir.Authenticate(r.PostFormValue("user"), r.PostFormValue("pass")) {
+			case Valid, PasswordExpired:
+				http.Redirect(w, r, "/dashboard", http.StatusFound)
+			case ValidMFA:
+				fmt.Fprint(w, "Enter the verification code sent to your phone") // nolint:errcheck
+			case Locked:
+				fmt.Fprint(w, "Your account has been locked") // nolint:errcheck
+			case RateLimited:
+				w.WriteHeader(429)
+			default:
+				fmt.Fprint(w, "Invalid username or password") // nolint:errcheck
+			}
+		})
+		return mux
+	},
+	Reports: Reports{
+		MFA:         true,
+		Locked:      true,
+		RateLimited: true,
+	},
+}
+
+// Fakes lists every fake provider.
+var Fakes = []Fake{
+	Okta, O365, ADFS, OIDCROPC, NetScaler, Fortinet, Exchange,
+	Autologon, OWA, GlobalProtect, AnyConnect, GenericHTTP,
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v) // nolint:errcheck,gosec
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package o365
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// ClientConfig is a client_id and resource pair used to request a token. Many
+// conditional access policies only apply to specific applications, so a
+// credential blocked for one client may succeed with another.
+type ClientConfig struct {
+	// ClientID is the application ID of a first-party (public) client
+	ClientID string
+
+	// Resource is the resource the token is requested for. On the v2.0
+	// endpoint the resource is converted to the "<resource>/.default" scope.
+	Resource string
+}
+
+var (
+	// DefaultClients is used when the clients option is not set.
+	DefaultClients = []ClientConfig{
+		// Azure Active Directory PowerShell
+		{"1b730954-1685-4b74-9bfd-dac224a7b894", "https://graph.windows.net"},
+	}
+
+	// FirstPartyClients is used when the clients option is "first-party". Each
+	// of these applications is a public client which allows the ROPC flow.
+	FirstPartyClients = []ClientConfig{
+		// Azure Active Directory PowerShell
+		{"1b730954-1685-4b74-9bfd-dac224a7b894", "https://graph.windows.net"},
+		// Microsoft Office
+		{"d3590ed6-52b3-4102-aeff-aad2292ab01c", "https://graph.microsoft.com"},
+		// Azure PowerShell
+		{"1950a258-227b-4e31-a9cf-717495945fc2", "https://management.azure.com"},
+		// Microsoft Azure CLI
+		{"04b07795-8ddb-461a-bbee-02f9e1bf7b46", "https://management.core.windows.net"},
+		// Outlook Mobile
+		{"27922004-5251-4030-b22d-91ecd9a37ea4", "https://outlook.office365.com"},
+		// Microsoft Teams
+		{"1fec8e78-bce4-4aaf-ab1b-5451cc387264", "https://api.spaces.skype.com"},
+	}
+)
+
+const (
+	// ClientModeFallback tries each client in order until one is not blocked
+	ClientModeFallback = "fallback"
+
+	// ClientModeRotate uses the next client for each request
+	ClientModeRotate = "rotate"
+)
+
+// rotation is shared by every nozzle so that rotation continues across the
+// short-lived nozzles opened for each task.
+var rotation uint32
+
+// parseClients parses the clients option, which is either "first-party" or a
+// comma separated list of client_id=resource pairs.
+func parseClients(s string) ([]ClientConfig, error) {
+	switch s {
+	case "":
+		return DefaultClients, nil
+	case "first-party":
+		return FirstPartyClients, nil
+	}
+
+	var clients []ClientConfig
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("o365 nozzle: invalid client %q, expected client_id=resource", pair)
+		}
+		clients = append(clients, ClientConfig{
+			ClientID: parts[0],
+			Resource: parts[1],
+		})
+	}
+	return clients, nil
+}
+
+// attemptOrder returns the clients to try for a single login attempt.
+func (n *Nozzle) attemptOrder() []ClientConfig {
+	if n.ClientMode != ClientModeRotate || len(n.Clients) < 2 {
+		return n.Clients
+	}
+	i := atomic.AddUint32(&rotation, 1) % uint32(len(n.Clients))
+	return n.Clients[i : i+1]
+}
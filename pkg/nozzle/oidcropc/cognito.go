@@ -0,0 +1,101 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oidcropc
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	netUrl "net/url"
+	"strings"
+
+	"github.com/praetorian-inc/trident/pkg/event"
+)
+
+// Cognito user pools do not support the password grant on their OAuth2 token
+// endpoint. The same check is made with the InitiateAuth API, which is what
+// the Amplify libraries use.
+const (
+	cognitoTarget      = "AWSCognitoIdentityProviderService.InitiateAuth"
+	cognitoContentType = "application/x-amz-json-1.1"
+)
+
+// isCognito reports whether the endpoint is a Cognito service endpoint such as
+// https://cognito-idp.us-east-1.amazonaws.com/.
+func isCognito(endpoint string) bool {
+	u, err := netUrl.Parse(endpoint)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(u.Hostname(), "cognito-idp.") &&
+		strings.HasSuffix(u.Hostname(), ".amazonaws.com")
+}
+
+// cognitoRequest builds an InitiateAuth request for the USER_PASSWORD_AUTH
+// flow. Clients with a secret must also send the SECRET_HASH parameter.
+func (n *Nozzle) cognitoRequest(endpoint, username, password string) *http.Request {
+	params := map[string]string{
+		"USERNAME": username,
+		"PASSWORD": password,
+	}
+	if n.ClientSecret != "" {
+		mac := hmac.New(sha256.New, []byte(n.ClientSecret))
+		mac.Write([]byte(username + n.ClientID)) // nolint:errcheck,gosec
+		params["SECRET_HASH"] = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+
+	data, _ := json.Marshal(map[string]interface{}{
+		"AuthFlow":       "USER_PASSWORD_AUTH",
+		"ClientId":       n.ClientID,
+		"AuthParameters": params,
+	})
+
+	req, _ := http.NewRequest("POST", endpoint, bytes.NewReader(data))
+	req.Header.Set("Content-Type", cognitoContentType)
+	req.Header.Set("X-Amz-Target", cognitoTarget)
+	return req
+}
+
+// cognitoChallenge converts the challenge returned for a correct password into
+// an AuthResponse.
+func cognitoChallenge(name string, metadata map[string]interface{}) *event.AuthResponse {
+	metadata["challenge"] = name
+
+	res := &event.AuthResponse{
+		Valid:      true,
+		UserStatus: event.UserStatusExists,
+		Metadata:   metadata,
+	}
+	switch name {
+	case "SMS_MFA", "SOFTWARE_TOKEN_MFA":
+		res.MFA = true
+		res.Artifacts = &event.Artifacts{
+			Factors: []event.Factor{{Type: name}},
+			MFA:     event.MFAPostureEnforced,
+		}
+	case "SELECT_MFA_TYPE", "CUSTOM_CHALLENGE":
+		res.MFA = true
+		res.Artifacts = &event.Artifacts{MFA: event.MFAPostureEnforced}
+	case "MFA_SETUP":
+		metadata["mfaSetup"] = true
+		res.Artifacts = &event.Artifacts{MFA: event.MFAPostureEnforced}
+	case "NEW_PASSWORD_REQUIRED":
+		metadata["passwordExpired"] = true
+	}
+	return res
+}
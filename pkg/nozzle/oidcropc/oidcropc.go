@@ -0,0 +1,446 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oidcropc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	netUrl "net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/fingerprint"
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+)
+
+var (
+	// RateLimiter limits requests from the same worker to a maximum of 3/s
+	RateLimiter = rate.NewLimiter(rate.Every(300*time.Millisecond), 1)
+)
+
+// maxBodySize limits the response body read for classification
+const maxBodySize = 1 << 20
+
+// wellKnownPath is appended to discovery URLs which are an issuer rather than
+// the discovery document itself
+const wellKnownPath = "/.well-known/openid-configuration"
+
+// Driver implements the nozzle.Driver interface.
+type Driver struct{}
+
+func init() {
+	nozzle.Register("oidc-ropc", Driver{})
+}
+
+// New is used to create a generic OAuth2 resource owner password credentials
+// (ROPC) nozzle, for identity providers such as Keycloak, Auth0, PingFederate
+// and Amazon Cognito. It accepts the following configuration options:
+//
+// token-endpoint
+//
+// The URL of the provider's token endpoint. For Cognito this is the regional
+// service endpoint (e.g. https://cognito-idp.us-east-1.amazonaws.com/), and
+// the password is sent with the InitiateAuth API instead of the password
+// grant.
+//
+// discovery-url
+//
+// The issuer or OpenID Connect discovery document from which the token
+// endpoint is read. Either token-endpoint or discovery-url is required.
+//
+// client-id
+//
+// The OAuth2 client (application) id. Required.
+//
+// client-secret
+//
+// The client secret, for confidential clients.
+//
+// client-auth
+//
+// How the client secret is sent: basic (the default, HTTP basic
+// authentication) or post (in the form body).
+//
+// scope
+//
+// The space separated scopes requested. Defaults to openid.
+//
+// insecure
+//
+// Set to true to skip verification of the provider's TLS certificate, e.g.
+// for a lab Keycloak instance with a self-signed certificate. Certificates are
+// verified by default.
+//
+// profiles, profile-mode
+//
+// The browser fingerprint profiles to send and how to choose between them. See
+// the fingerprint package for details.
+func (Driver) New(opts map[string]string) (nozzle.Nozzle, error) {
+	endpoint, discovery := opts["token-endpoint"], opts["discovery-url"]
+	if endpoint == "" && discovery == "" {
+		return nil, fmt.Errorf("oidc-ropc nozzle requires 'token-endpoint' or 'discovery-url' config parameter")
+	}
+	if discovery != "" && !strings.Contains(discovery, "/.well-known/") {
+		discovery = strings.TrimRight(discovery, "/") + wellKnownPath
+	}
+
+	clientID, ok := opts["client-id"]
+	if !ok {
+		return nil, fmt.Errorf("oidc-ropc nozzle requires 'client-id' config parameter")
+	}
+
+	clientAuth := "basic"
+	if v, ok := opts["client-auth"]; ok {
+		clientAuth = v
+	}
+	if clientAuth != "basic" && clientAuth != "post" {
+		return nil, fmt.Errorf("oidc-ropc nozzle: unknown client-auth %q", clientAuth)
+	}
+
+	scope := "openid"
+	if v, ok := opts["scope"]; ok {
+		scope = v
+	}
+
+	profiles, err := fingerprint.NewSelector(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	insecure, err := nozzle.Insecure(opts)
+	if err != nil {
+		return nil, fmt.Errorf("oidc-ropc nozzle: %v", err)
+	}
+
+	return &Nozzle{
+		TokenEndpoint: endpoint,
+		DiscoveryURL:  discovery,
+		ClientID:      clientID,
+		ClientSecret:  opts["client-secret"],
+		ClientAuth:    clientAuth,
+		Scope:         scope,
+		Profiles:      profiles,
+		Client:        nozzle.NewClient(insecure),
+	}, nil
+}
+
+// Nozzle implements the nozzle.Nozzle interface for OAuth2 ROPC token
+// endpoints.
+type Nozzle struct {
+	// TokenEndpoint is the URL the credentials are sent to. It is read from
+	// the discovery document on the first login when empty.
+	TokenEndpoint string
+
+	// DiscoveryURL is the OpenID Connect discovery document URL
+	DiscoveryURL string
+
+	// ClientID is the OAuth2 client id
+	ClientID string
+
+	// ClientSecret is the optional OAuth2 client secret
+	ClientSecret string
+
+	// ClientAuth is how the client secret is sent: basic or post
+	ClientAuth string
+
+	// Scope is the space separated list of scopes requested
+	Scope string
+
+	// Profiles selects the browser headers sent with each request
+	Profiles *fingerprint.Selector
+
+	// Client is the HTTP client used to send requests. Redirects are never
+	// followed.
+	Client *http.Client
+}
+
+// discovered caches the token endpoint of each discovery document.
+var discovered = struct {
+	sync.Mutex
+	endpoints map[string]string
+}{endpoints: map[string]string{}}
+
+// Discover returns the token endpoint, fetching it from the discovery
+// document if one was not configured.
+func (n *Nozzle) Discover() (string, error) {
+	if n.TokenEndpoint != "" {
+		return n.TokenEndpoint, nil
+	}
+
+	discovered.Lock()
+	defer discovered.Unlock()
+
+	if endpoint, ok := discovered.endpoints[n.DiscoveryURL]; ok {
+		return endpoint, nil
+	}
+
+	req, _ := http.NewRequest("GET", n.DiscoveryURL, nil)
+	req.Header.Set("Accept", "application/json")
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close() // nolint:errcheck
+
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("unhandled status code from oidc discovery: %d", resp.StatusCode)
+	}
+
+	var doc struct {
+		TokenEndpoint string `json:"token_endpoint"`
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxBodySize)).Decode(&doc)
+	if err != nil {
+		return "", err
+	}
+	if doc.TokenEndpoint == "" {
+		return "", fmt.Errorf("oidc discovery document has no token_endpoint")
+	}
+
+	discovered.endpoints[n.DiscoveryURL] = doc.TokenEndpoint
+	return doc.TokenEndpoint, nil
+}
+
+// tokenResponse is the union of an OAuth2 token or error response and the
+// Cognito InitiateAuth response and error.
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	RefreshToken     string `json:"refresh_token"`
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+
+	Type                 string `json:"__type"`
+	Message              string `json:"message"`
+	AuthenticationResult *struct {
+		AccessToken  string `json:"AccessToken"`
+		RefreshToken string `json:"RefreshToken"`
+		IDToken      string `json:"IdToken"`
+	} `json:"AuthenticationResult"`
+	ChallengeName string `json:"ChallengeName"`
+}
+
+// artifacts returns the tokens issued by a successful login.
+func (res *tokenResponse) artifacts() *event.Artifacts {
+	access, refresh, id := res.AccessToken, res.RefreshToken, res.IDToken
+	if r := res.AuthenticationResult; r != nil {
+		access, refresh, id = r.AccessToken, r.RefreshToken, r.IDToken
+	}
+
+	tokens := map[string]string{}
+	for name, token := range map[string]string{"access_token": access, "refresh_token": refresh, "id_token": id} {
+		if token != "" {
+			tokens[name] = token
+		}
+	}
+	return &event.Artifacts{
+		Tokens: tokens,
+		MFA:    event.MFAPostureNotEnforced,
+	}
+}
+
+// errorCodes maps the error (or Cognito __type) of a failed token request to
+// a normalized result. The standard codes are from RFC 6749 section 5.2.
+var errorCodes = map[string]nozzle.Outcome{
+	"invalid_grant":           {Desc: "invalid credentials", Generic: true},
+	"invalid_request":         {Desc: "invalid request", Fatal: true},
+	"invalid_client":          {Desc: "invalid client", Fatal: true},
+	"invalid_scope":           {Desc: "invalid scope", Fatal: true},
+	"unauthorized_client":     {Desc: "client may not use the password grant", Fatal: true},
+	"unsupported_grant_type":  {Desc: "password grant not enabled", Fatal: true},
+	"temporarily_unavailable": {Desc: "temporarily unavailable", RateLimited: true},
+	"slow_down":               {Desc: "slow down", RateLimited: true},
+
+	// Keycloak brute force detection
+	"user_temporarily_disabled": {Desc: "account temporarily locked", Locked: true, UserStatus: event.UserStatusExists},
+
+	// Auth0
+	"too_many_attempts": {Desc: "account blocked by brute force protection", Locked: true, UserStatus: event.UserStatusExists},
+	"mfa_required":      {Desc: "multi-factor authentication required", Valid: true, MFA: true, UserStatus: event.UserStatusExists},
+	"too_many_requests": {Desc: "rate limited", RateLimited: true},
+	"unauthorized":      {Desc: "unauthorized", Generic: true},
+
+	// Cognito
+	"NotAuthorizedException":         {Desc: "invalid credentials", Generic: true},
+	"UserNotFoundException":          {Desc: "user not found", UserStatus: event.UserStatusNotExists},
+	"UserNotConfirmedException":      {Desc: "user not confirmed", Valid: true, UserStatus: event.UserStatusExists, Flag: "userNotConfirmed"},
+	"PasswordResetRequiredException": {Desc: "password reset required", UserStatus: event.UserStatusExists, Flag: "passwordResetRequired"},
+	"TooManyRequestsException":       {Desc: "rate limited", RateLimited: true},
+	"ResourceNotFoundException":      {Desc: "client not found", Fatal: true},
+	"InvalidParameterException":      {Desc: "invalid parameter", Fatal: true},
+}
+
+// descriptions refine generic error codes using the error description. The
+// first match wins.
+var descriptions = []struct {
+	re *regexp.Regexp
+	o  nozzle.Outcome
+}{
+	// Keycloak's required actions (e.g. UPDATE_PASSWORD, CONFIGURE_TOTP) are
+	// only reported once the password has been checked
+	{regexp.MustCompile(`(?i)account is not fully set up`), nozzle.Outcome{Desc: "required actions pending", Valid: true, UserStatus: event.UserStatusExists, Flag: "requiredActions"}},
+	{regexp.MustCompile(`(?i)password (has )?expired|expired password`), nozzle.Outcome{Desc: "password expired", Valid: true, UserStatus: event.UserStatusExists, Flag: "passwordExpired"}},
+	{regexp.MustCompile(`(?i)password attempts exceeded|temporarily (disabled|locked)|account (is |has been )?locked`), nozzle.Outcome{Desc: "account locked", Locked: true, UserStatus: event.UserStatusExists}},
+	{regexp.MustCompile(`(?i)(account|user) (is )?(disabled|blocked)`), nozzle.Outcome{Desc: "account disabled", Locked: true, UserStatus: event.UserStatusExists, Flag: "accountDisabled"}},
+}
+
+// Login fulfils the nozzle.Nozzle interface and requests a token with the
+// resource owner password credentials grant. Cognito endpoints use the
+// equivalent InitiateAuth USER_PASSWORD_AUTH flow.
+func (n *Nozzle) Login(username, password string) (*event.AuthResponse, error) {
+	return n.LoginContext(context.Background(), username, password)
+}
+
+// LoginContext fulfils the nozzle.ContextNozzle interface. The request is
+// cancelled with ctx.
+func (n *Nozzle) LoginContext(ctx context.Context, username, password string) (*event.AuthResponse, error) {
+	err := RateLimiter.Wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint, err := n.Discover()
+	if err != nil {
+		return nil, err
+	}
+
+	var req *http.Request
+	if isCognito(endpoint) {
+		req = n.cognitoRequest(endpoint, username, password)
+	} else {
+		req = n.tokenRequest(endpoint, username, password)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	n.Profiles.Apply(req, username)
+
+	client := *n.Client
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint:errcheck
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := map[string]interface{}{
+		"status": resp.StatusCode,
+	}
+
+	var res tokenResponse
+	if json.Unmarshal(body, &res) != nil && resp.StatusCode != 429 {
+		return nil, fmt.Errorf("unrecognized oidc-ropc response: %d", resp.StatusCode)
+	}
+
+	switch {
+	case resp.StatusCode == 200 && res.AccessToken != "",
+		resp.StatusCode == 200 && res.AuthenticationResult != nil:
+		return &event.AuthResponse{
+			Valid:      true,
+			UserStatus: event.UserStatusExists,
+			Metadata:   metadata,
+			Artifacts:  res.artifacts(),
+		}, nil
+	case resp.StatusCode == 200 && res.ChallengeName != "":
+		return cognitoChallenge(res.ChallengeName, metadata), nil
+	}
+
+	code, description := res.Error, res.ErrorDescription
+	if res.Type != "" {
+		// Cognito error types may be prefixed with the service namespace
+		code = res.Type[strings.LastIndex(res.Type, "#")+1:]
+		description = res.Message
+	}
+	if code == "" {
+		if resp.StatusCode == 429 {
+			return &event.AuthResponse{
+				RateLimited: true,
+				Metadata:    metadata,
+			}, nil
+		}
+		return nil, fmt.Errorf("unrecognized oidc-ropc response: %d", resp.StatusCode)
+	}
+
+	metadata["code"] = code
+	if description != "" {
+		metadata["errorDescription"] = description
+	}
+	o, ok := errorCodes[code]
+	if !ok {
+		metadata["unrecognizedCode"] = true
+		return &event.AuthResponse{
+			Valid:       false,
+			RateLimited: resp.StatusCode == 429,
+			Metadata:    metadata,
+		}, nil
+	}
+	if o.Fatal {
+		return nil, fmt.Errorf("oidc-ropc request failed with %s: %s", code, description)
+	}
+	if o.Generic {
+		for _, d := range descriptions {
+			if d.re.MatchString(description) {
+				o = d.o
+				break
+			}
+		}
+	}
+
+	return o.Response(metadata), nil
+}
+
+// tokenRequest builds the password grant request. The client secret is sent
+// with HTTP basic authentication, whose credentials are form encoded as
+// required by RFC 6749 section 2.3.1, or in the body.
+func (n *Nozzle) tokenRequest(endpoint, username, password string) *http.Request {
+	form := netUrl.Values{
+		"grant_type": {"password"},
+		"username":   {username},
+		"password":   {password},
+	}
+	if n.Scope != "" {
+		form.Set("scope", n.Scope)
+	}
+
+	basic := n.ClientSecret != "" && n.ClientAuth == "basic"
+	if !basic {
+		form.Set("client_id", n.ClientID)
+		if n.ClientSecret != "" {
+			form.Set("client_secret", n.ClientSecret)
+		}
+	}
+
+	req, _ := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if basic {
+		req.SetBasicAuth(netUrl.QueryEscape(n.ClientID), netUrl.QueryEscape(n.ClientSecret))
+	}
+	return req
+}
@@ -0,0 +1,305 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oidcropc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+	"github.com/praetorian-inc/trident/pkg/nozzle/nozzletest"
+)
+
+func oauthError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{ // nolint:errcheck,gosec
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+func tokenHandler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/realms/corp/.well-known/openid-configuration":
+			fmt.Fprintf(w, `{"issuer":"https://%s/realms/corp","token_endpoint":"https://%s/realms/corp/protocol/openid-connect/token"}`, r.Host, r.Host) // nolint:errcheck
+			return
+		case "/realms/corp/protocol/openid-connect/token":
+		default:
+			w.WriteHeader(404)
+			return
+		}
+
+		if id, secret, ok := r.BasicAuth(); !ok || id != "trident" || secret != "s3cr3t" {
+			oauthError(w, 401, "invalid_client", "Invalid client credentials")
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		if r.PostForm.Get("grant_type") != "password" || r.PostForm.Get("scope") != "openid" {
+			t.Errorf("unexpected form %v", r.PostForm)
+		}
+
+		switch r.PostForm.Get("username") + ":" + r.PostForm.Get("password") {
+		case "alice:Password1!":
+			fmt.Fprint(w, `{"access_token":"eyJhbGciOiJSUzI1NiJ9.e30.c2ln","expires_in":300,"token_type":"Bearer","scope":"openid"}`) // nolint:errcheck
+		case "eve:Password1!":
+			oauthError(w, 403, "mfa_required", "Multifactor authentication required")
+		case "new:Password1!":
+			oauthError(w, 400, "invalid_grant", "Account is not fully set up")
+		case "bob:Password1!":
+			oauthError(w, 400, "user_temporarily_disabled", "Account temporarily disabled")
+		case "mal:Password1!":
+			oauthError(w, 400, "invalid_grant", "Account disabled")
+		case "joe:Password1!":
+			oauthError(w, 429, "too_many_attempts", "Your account has been blocked after multiple consecutive login attempts.")
+		case "slow:Password1!":
+			w.WriteHeader(429)
+		case "unknown:Password1!":
+			w.WriteHeader(500)
+		default:
+			oauthError(w, 401, "invalid_grant", "Invalid user credentials")
+		}
+	}
+}
+
+type testcase struct {
+	desc        string
+	username    string
+	password    string
+	valid       bool
+	mfa         bool
+	locked      bool
+	ratelimited bool
+	flag        string
+}
+
+func runTestcases(t *testing.T, noz nozzle.Nozzle, testcases []testcase) {
+	for _, test := range testcases {
+		res, err := noz.Login(test.username, test.password)
+		if err != nil {
+			t.Errorf("[%s] error in login: %s", test.desc, err)
+			continue
+		}
+		if res.Valid != test.valid {
+			t.Errorf("[%s] noz.valid was %t, expected %t", test.desc, res.Valid, test.valid)
+		}
+		if res.MFA != test.mfa {
+			t.Errorf("[%s] noz.mfa %t, expected %t", test.desc, res.MFA, test.mfa)
+		}
+		if res.Locked != test.locked {
+			t.Errorf("[%s] noz.locked %t, expected %t", test.desc, res.Locked, test.locked)
+		}
+		if res.RateLimited != test.ratelimited {
+			t.Errorf("[%s] noz.ratelimited %t, expected %t", test.desc, res.RateLimited, test.ratelimited)
+		}
+		if test.flag != "" && res.Metadata[test.flag] != true {
+			t.Errorf("[%s] expected %s metadata", test.desc, test.flag)
+		}
+	}
+}
+
+func TestNozzle(t *testing.T) {
+	srv := httptest.NewTLSServer(tokenHandler(t))
+	defer srv.Close()
+
+	noz, err := nozzle.Open("oidc-ropc", map[string]string{
+		"discovery-url": srv.URL + "/realms/corp",
+		"client-id":     "trident",
+		"client-secret": "s3cr3t",
+	})
+	if err != nil {
+		t.Fatalf("unable to open nozzle: %s", err)
+	}
+	noz.(*Nozzle).Client = srv.Client()
+
+	runTestcases(t, noz, []testcase{
+		{"invalid login", "alice", "Invalid1!", false, false, false, false, ""},
+		{"valid login", "alice", "Password1!", true, false, false, false, ""},
+		{"valid login with mfa", "eve", "Password1!", true, true, false, false, ""},
+		{"required actions", "new", "Password1!", true, false, false, false, "requiredActions"},
+		{"locked account", "bob", "Password1!", false, false, true, false, ""},
+		{"disabled account", "mal", "Password1!", false, false, true, false, "accountDisabled"},
+		{"blocked account", "joe", "Password1!", false, false, true, false, ""},
+		{"rate limited", "slow", "Password1!", false, false, false, true, ""},
+	})
+
+	_, err = noz.Login("unknown", "Password1!")
+	if err == nil {
+		t.Errorf("expected error for unrecognized response")
+	}
+
+	// a bad client secret affects every credential
+	noz.(*Nozzle).ClientSecret = "wrong"
+	_, err = noz.Login("alice", "Password1!")
+	if err == nil {
+		t.Errorf("expected error for invalid client")
+	}
+}
+
+func TestInsecure(t *testing.T) {
+	// the test server's certificate is self-signed
+	srv := httptest.NewTLSServer(tokenHandler(t))
+	defer srv.Close()
+
+	for _, insecure := range []string{"", "false", "true"} {
+		opts := map[string]string{
+			"token-endpoint": srv.URL + "/realms/corp/protocol/openid-connect/token",
+			"client-id":      "trident",
+			"client-secret":  "s3cr3t",
+		}
+		if insecure != "" {
+			opts["insecure"] = insecure
+		}
+		noz, err := nozzle.Open("oidc-ropc", opts)
+		if err != nil {
+			t.Fatalf("[insecure %q] unable to open nozzle: %s", insecure, err)
+		}
+		_, err = noz.Login("alice", "Password1!")
+		if verified := err != nil; verified != (insecure != "true") {
+			t.Errorf("[insecure %q] login error was %v", insecure, err)
+		}
+	}
+
+	_, err := nozzle.Open("oidc-ropc", map[string]string{
+		"token-endpoint": srv.URL,
+		"client-id":      "trident",
+		"insecure":       "sometimes",
+	})
+	if err == nil {
+		t.Errorf("expected error for an invalid insecure option")
+	}
+}
+
+func cognitoError(w http.ResponseWriter, kind, message string) {
+	w.Header().Set("Content-Type", cognitoContentType)
+	w.WriteHeader(400)
+	json.NewEncoder(w).Encode(map[string]string{ // nolint:errcheck,gosec
+		"__type":  kind,
+		"message": message,
+	})
+}
+
+func cognitoHandler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Amz-Target") != cognitoTarget {
+			cognitoError(w, "UnknownOperationException", "")
+			return
+		}
+
+		var req struct {
+			AuthFlow       string
+			ClientId       string // nolint:golint,stylecheck
+			AuthParameters map[string]string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatal(err)
+		}
+		if req.AuthFlow != "USER_PASSWORD_AUTH" || req.ClientId != "5ebkc3lb8lvq4o1n2mk7ndr6vp" {
+			t.Errorf("unexpected request %v", req)
+		}
+
+		w.Header().Set("Content-Type", cognitoContentType)
+		switch req.AuthParameters["USERNAME"] + ":" + req.AuthParameters["PASSWORD"] {
+		case "alice:Password1!":
+			fmt.Fprint(w, `{"AuthenticationResult":{"AccessToken":"eyJraWQiOiJ9.e30.c2ln","ExpiresIn":3600,"TokenType":"Bearer"},"ChallengeParameters":{}}`) // nolint:errcheck
+		case "eve:Password1!":
+			fmt.Fprint(w, `{"ChallengeName":"SOFTWARE_TOKEN_MFA","ChallengeParameters":{},"Session":"AYABeH"}`) // nolint:errcheck
+		case "old:Password1!":
+			fmt.Fprint(w, `{"ChallengeName":"NEW_PASSWORD_REQUIRED","ChallengeParameters":{},"Session":"AYABeH"}`) // nolint:errcheck
+		case "bob:Password1!":
+			cognitoError(w, "NotAuthorizedException", "Password attempts exceeded")
+		case "mal:Password1!":
+			cognitoError(w, "NotAuthorizedException", "User is disabled.")
+		case "nobody:Password1!":
+			cognitoError(w, "UserNotFoundException", "User does not exist.")
+		case "slow:Password1!":
+			cognitoError(w, "TooManyRequestsException", "Rate exceeded")
+		default:
+			cognitoError(w, "NotAuthorizedException", "Incorrect username or password.")
+		}
+	}
+}
+
+func TestCognito(t *testing.T) {
+	srv := httptest.NewTLSServer(cognitoHandler(t))
+	defer srv.Close()
+
+	noz, err := nozzle.Open("oidc-ropc", map[string]string{
+		"token-endpoint": "https://cognito-idp.us-east-1.amazonaws.com/",
+		"client-id":      "5ebkc3lb8lvq4o1n2mk7ndr6vp",
+	})
+	if err != nil {
+		t.Fatalf("unable to open nozzle: %s", err)
+	}
+
+	// send requests for the Cognito endpoint to the test server
+	client := srv.Client()
+	transport := client.Transport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+	}
+	transport.TLSClientConfig.ServerName = "example.com"
+	client.Transport = transport
+	noz.(*Nozzle).Client = client
+
+	runTestcases(t, noz, []testcase{
+		{"invalid login", "alice", "Invalid1!", false, false, false, false, ""},
+		{"valid login", "alice", "Password1!", true, false, false, false, ""},
+		{"valid login with mfa", "eve", "Password1!", true, true, false, false, ""},
+		{"new password required", "old", "Password1!", true, false, false, false, "passwordExpired"},
+		{"locked account", "bob", "Password1!", false, false, true, false, ""},
+		{"disabled account", "mal", "Password1!", false, false, true, false, "accountDisabled"},
+		{"rate limited", "slow", "Password1!", false, false, false, true, ""},
+	})
+
+	res, err := noz.Login("alice", "Password1!")
+	if err != nil {
+		t.Fatalf("error in login: %s", err)
+	}
+	if a := res.Artifacts; a == nil || a.Tokens["access_token"] != "eyJraWQiOiJ9.e30.c2ln" || a.MFA != event.MFAPostureNotEnforced {
+		t.Errorf("artifacts were %+v", a)
+	}
+
+	res, err = noz.Login("eve", "Password1!")
+	if err != nil {
+		t.Fatalf("error in login: %s", err)
+	}
+	if a := res.Artifacts; a == nil || a.MFA != event.MFAPostureEnforced || len(a.Factors) != 1 || a.Factors[0].Type != "SOFTWARE_TOKEN_MFA" {
+		t.Errorf("artifacts were %+v", a)
+	}
+
+	res, err = noz.Login("nobody", "Password1!")
+	if err != nil {
+		t.Fatalf("error in login: %s", err)
+	}
+	if res.UserStatus != event.UserStatusNotExists {
+		t.Errorf("user status was %s, expected %s", res.UserStatus, event.UserStatusNotExists)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	nozzletest.Run(t, Driver{}, nozzletest.OIDCROPC, func(noz nozzle.Nozzle, client *http.Client) {
+		noz.(*Nozzle).Client = client
+	})
+}
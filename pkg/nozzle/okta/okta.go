@@ -20,21 +20,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	netUrl "net/url"
+	"regexp"
 	"time"
 
 	"golang.org/x/time/rate"
 
 	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/fingerprint"
 	"github.com/praetorian-inc/trident/pkg/nozzle"
-	"github.com/praetorian-inc/trident/pkg/util"
-)
-
-const (
-	// FrozenUserAgent is a static user agent that we use for all requests. This
-	// value is based on the UA client hint work within browsers.
-	// Additional details: https://bugs.chromium.org/p/chromium/issues/detail?id=955620
-	FrozenUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64)" +
-		"AppleWebKit/537.36 (KHTML, like Gecko) Chrome/75.0.3764.0 Safari/537.36"
 )
 
 var (
@@ -49,52 +43,193 @@ func init() {
 	nozzle.Register("okta", Driver{})
 }
 
+// BaseDomains are the Okta cells an organization's subdomain may belong to.
+// Credentials are only ever sent to a subdomain of one of these or to an
+// explicitly configured custom domain.
+var BaseDomains = []string{
+	"okta.com",
+	"oktapreview.com",
+	"okta-emea.com",
+	"okta-gov.com",
+}
+
+var (
+	labelRegexp = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?$`)
+	hostRegexp  = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?)*(:[0-9]+)?$`)
+)
+
 // New is used to create an Okta nozzle and accepts the following configuration
 // options:
 //
-// domain
+// subdomain
 //
 // The subdomain of the Okta organization. If a user logs in at
 // example.okta.com, the value of subdomain is "example".
+//
+// base-domain
+//
+// The Okta cell of the organization, one of BaseDomains. Defaults to
+// okta.com.
+//
+// custom-domain
+//
+// The custom (vanity) domain of the organization, e.g. login.example.org.
+// When set, subdomain and base-domain are not required.
+//
+// simulator
+//
+// The host:port of a trident-idp-sim server to send logins to instead of
+// Okta, for rehearsing a campaign. Its certificate is not verified.
+//
+// insecure
+//
+// Set to true to skip verification of Okta's TLS certificate, e.g. when
+// sending logins through an intercepting proxy. Certificates are verified by
+// default.
+//
+// profiles, profile-mode
+//
+// The browser fingerprint profiles to send and how to choose between them. See
+// the fingerprint package for details.
 func (Driver) New(opts map[string]string) (nozzle.Nozzle, error) {
-	subdomain, ok := opts["subdomain"]
-	if !ok {
-		return nil, fmt.Errorf("okta nozzle requires 'subdomain' config parameter")
+	insecure, err := nozzle.Insecure(opts)
+	if err != nil {
+		return nil, fmt.Errorf("okta nozzle: %v", err)
+	}
+
+	var host string
+	client := nozzle.NewClient(insecure)
+	sim, simulated := nozzle.Simulator(opts)
+	switch custom, ok := opts["custom-domain"]; {
+	case simulated:
+		if !hostRegexp.MatchString(sim) {
+			return nil, fmt.Errorf("okta nozzle: invalid simulator %q", sim)
+		}
+		host = sim
+		client = nozzle.SimulatorClient
+	case ok:
+		if !hostRegexp.MatchString(custom) {
+			return nil, fmt.Errorf("okta nozzle: invalid custom-domain %q", custom)
+		}
+		host = custom
+	default:
+		subdomain, ok := opts["subdomain"]
+		if !ok {
+			return nil, fmt.Errorf("okta nozzle requires 'subdomain' config parameter")
+		}
+		if !labelRegexp.MatchString(subdomain) {
+			return nil, fmt.Errorf("okta nozzle: invalid subdomain %q", subdomain)
+		}
+
+		base := "okta.com"
+		if v, ok := opts["base-domain"]; ok {
+			base = v
+		}
+		allowed := false
+		for _, d := range BaseDomains {
+			allowed = allowed || base == d
+		}
+		if !allowed {
+			return nil, fmt.Errorf("okta nozzle: unknown base-domain %q", base)
+		}
+		host = subdomain + "." + base
+	}
+
+	profiles, err := fingerprint.NewSelector(opts)
+	if err != nil {
+		return nil, err
 	}
 
 	return &Nozzle{
-		Subdomain: subdomain,
-		UserAgent: FrozenUserAgent,
+		Host:     host,
+		Profiles: profiles,
+		Client:   client,
 	}, nil
 }
 
 // Nozzle implements the nozzle.Nozzle interface for Okta.
 type Nozzle struct {
-	// Subdomain is the Okta subdomain
-	Subdomain string
+	// Host is the Okta organization's host, e.g. example.okta.com
+	Host string
+
+	// Profiles selects the browser headers sent with each request
+	Profiles *fingerprint.Selector
 
-	// UserAgent will override the Go-http-client user-agent in requests
-	UserAgent string
+	// Client is the HTTP client used to send requests
+	Client *http.Client
+}
+
+// url returns the URL of path on the organization's host, checking that the
+// host was not changed since the nozzle was created.
+func (n *Nozzle) url(path string) (string, error) {
+	u := fmt.Sprintf("https://%s%s", n.Host, path)
+	parsed, err := netUrl.Parse(u)
+	if err != nil {
+		return "", err
+	}
+	if parsed.Scheme != "https" || parsed.Host != n.Host {
+		return "", fmt.Errorf("okta nozzle: invalid host %q", n.Host)
+	}
+	return u, nil
 }
 
 type oktaAuthResponse struct {
-	Status   string                 `json:"status"`
-	Factor   string                 `json:"factorResult"`
-	Embedded map[string]interface{} `json:"_embedded"`
+	Status       string `json:"status"`
+	SessionToken string `json:"sessionToken"`
+	StateToken   string `json:"stateToken"`
+	ErrorCode    string `json:"errorCode"`
+	ErrorSummary string `json:"errorSummary"`
+	Embedded     struct {
+		User struct {
+			ID              string `json:"id"`
+			PasswordChanged string `json:"passwordChanged"`
+			Profile         struct {
+				Login string `json:"login"`
+			} `json:"profile"`
+		} `json:"user"`
+		Factors []struct {
+			FactorType string `json:"factorType"`
+			Provider   string `json:"provider"`
+			Status     string `json:"status"`
+		} `json:"factors"`
+		Policy struct {
+			Expiration struct {
+				PasswordExpireDays *int `json:"passwordExpireDays"`
+			} `json:"expiration"`
+		} `json:"policy"`
+	} `json:"_embedded"`
+}
+
+// statuses maps the authentication transaction states returned by a primary
+// authentication to a normalized result.
+// https://developer.okta.com/docs/reference/api/authn/#transaction-state
+var statuses = map[string]nozzle.Outcome{
+	"SUCCESS":          {Valid: true, Posture: event.MFAPostureNotEnforced, UserStatus: event.UserStatusExists},
+	"MFA_REQUIRED":     {Valid: true, MFA: true, Posture: event.MFAPostureEnforced, UserStatus: event.UserStatusExists},
+	"MFA_CHALLENGE":    {Valid: true, MFA: true, Posture: event.MFAPostureEnforced, UserStatus: event.UserStatusExists},
+	"MFA_ENROLL":       {Valid: true, Flag: "mfaEnroll", Posture: event.MFAPostureEnforced, UserStatus: event.UserStatusExists},
+	"PASSWORD_EXPIRED": {Valid: true, Flag: "passwordExpired", UserStatus: event.UserStatusExists},
+	"PASSWORD_WARN":    {Valid: true, Flag: "passwordWarn", UserStatus: event.UserStatusExists},
+	"LOCKED_OUT":       {Locked: true, UserStatus: event.UserStatusExists},
 }
 
 // Login fulfils the nozzle.Nozzle interface and performs an authentication
-// requests against Okta. This function supports rate limiting and parses valid,
-// invalid, and locked out responses.
+// requests against Okta. This function supports rate limiting and parses the
+// transaction state of successful requests. Valid credentials capture the
+// session or state token and the factors a user has enrolled as artifacts.
 func (n *Nozzle) Login(username, password string) (*event.AuthResponse, error) {
-	ctx := context.Background()
+	return n.LoginContext(context.Background(), username, password)
+}
+
+// LoginContext fulfils the nozzle.ContextNozzle interface. The request is
+// cancelled with ctx.
+func (n *Nozzle) LoginContext(ctx context.Context, username, password string) (*event.AuthResponse, error) {
 	err := RateLimiter.Wait(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	url := fmt.Sprintf("https://%s.okta.com/api/v1/authn", n.Subdomain)
-	err = util.ValidateURLSuffix(url, ".okta.com")
+	url, err := n.url("/api/v1/authn")
 	if err != nil {
 		return nil, err
 	}
@@ -103,43 +238,178 @@ func (n *Nozzle) Login(username, password string) (*event.AuthResponse, error) {
 		"username": username,
 		"password": password,
 	})
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(data))
 	if err != nil {
 		return nil, err
 	}
 
+	req.Header.Set("Accept", "application/json")
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", n.UserAgent)
+	n.Profiles.Apply(req, username)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := n.Client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close() // nolint:errcheck
 
+	metadata := map[string]interface{}{}
+
 	switch resp.StatusCode {
 	case 200:
+	case 401, 403:
 		var res oktaAuthResponse
-		err = json.NewDecoder(resp.Body).Decode(&res)
-		if err != nil {
-			return nil, err
+		if json.NewDecoder(resp.Body).Decode(&res) == nil && res.ErrorCode != "" {
+			metadata["code"] = res.ErrorCode
 		}
-
 		return &event.AuthResponse{
-			Valid:    res.Status != "LOCKED_OUT",
-			MFA:      res.Status == "MFA_REQUIRED",
-			Locked:   res.Status == "LOCKED_OUT",
-			Metadata: res.Embedded,
+			Valid:    false,
+			Metadata: metadata,
 		}, nil
-	case 401:
+	case 429:
 		return &event.AuthResponse{
-			Valid: false,
+			RateLimited: true,
+			Metadata:    metadata,
 		}, nil
+	default:
+		return nil, fmt.Errorf("unhandled status code from okta provider: %d", resp.StatusCode)
+	}
+
+	var res oktaAuthResponse
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata["authStatus"] = res.Status
+	user := res.Embedded.User
+	if user.ID != "" {
+		metadata["userId"] = user.ID
+	}
+	if user.Profile.Login != "" {
+		metadata["login"] = user.Profile.Login
+	}
+	if user.PasswordChanged != "" {
+		metadata["passwordChanged"] = user.PasswordChanged
+	}
+	if days := res.Embedded.Policy.Expiration.PasswordExpireDays; days != nil {
+		metadata["passwordExpireDays"] = *days
+	}
+
+	o, ok := statuses[res.Status]
+	if !ok {
+		metadata["unrecognizedStatus"] = true
+		return &event.AuthResponse{
+			Valid:    false,
+			Metadata: metadata,
+		}, nil
+	}
+	ar := o.Response(metadata)
+	if o.Valid {
+		ar.Artifacts = res.artifacts(o.Posture)
+	}
+	return ar, nil
+}
+
+// artifacts returns the tokens and enrolled factors of a transaction.
+func (res *oktaAuthResponse) artifacts(posture event.MFAPosture) *event.Artifacts {
+	a := &event.Artifacts{
+		Tokens: map[string]string{},
+		MFA:    posture,
+	}
+	if res.SessionToken != "" {
+		a.Tokens["sessionToken"] = res.SessionToken
+	}
+	if res.StateToken != "" {
+		a.Tokens["stateToken"] = res.StateToken
+	}
+
+	// MFA_ENROLL lists the factors available for enrollment as NOT_SETUP
+	for _, f := range res.Embedded.Factors {
+		if f.Status != "" && f.Status != "ACTIVE" {
+			continue
+		}
+		a.Factors = append(a.Factors, event.Factor{Type: f.FactorType, Provider: f.Provider})
+	}
+	return a
+}
+
+type webfingerResponse struct {
+	Subject string `json:"subject"`
+	Links   []struct {
+		Rel        string            `json:"rel"`
+		Href       string            `json:"href"`
+		Properties map[string]string `json:"properties"`
+	} `json:"links"`
+}
+
+// CheckUser fulfils the nozzle.Enumerator interface using Okta's WebFinger
+// endpoint. WebFinger exposes the identity provider routing rule that applies
+// to a username, which reveals federation to an external IdP. Okta applies
+// the default routing rule to users which do not exist, so CheckUser only
+// reports the federation metadata and the UserStatus is always unknown.
+func (n *Nozzle) CheckUser(username string) (*event.AuthResponse, error) {
+	ctx := context.Background()
+	err := RateLimiter.Wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := n.url("/.well-known/webfinger?resource=" + netUrl.QueryEscape("okta:acct:"+username))
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/jrd+json")
+	n.Profiles.Apply(req, username)
+
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint:errcheck
+
+	switch resp.StatusCode {
+	case 200:
 	case 429:
 		return &event.AuthResponse{
+			UserStatus:  event.UserStatusUnknown,
 			RateLimited: true,
 		}, nil
+	default:
+		return nil, fmt.Errorf("unhandled status code from okta webfinger: %d", resp.StatusCode)
+	}
+
+	var res webfingerResponse
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, fmt.Errorf("unhandled status code from okta provider: %d", resp.StatusCode)
+	metadata := map[string]interface{}{
+		"federation": "unknown",
+	}
+	for _, link := range res.Links {
+		idpType, ok := link.Properties["okta:idp:type"]
+		if !ok {
+			continue
+		}
+		if idpType == "OKTA" {
+			metadata["federation"] = "managed"
+		} else {
+			metadata["federation"] = "federated"
+		}
+		metadata["idpType"] = idpType
+		metadata["idpUrl"] = link.Href
+		break
+	}
+
+	return &event.AuthResponse{
+		UserStatus: event.UserStatusUnknown,
+		Metadata:   metadata,
+	}, nil
 }
@@ -15,13 +15,18 @@
 package okta
 
 import (
+	"encoding/json"
 	"fmt"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/praetorian-inc/trident/pkg/event"
 	"github.com/praetorian-inc/trident/pkg/nozzle"
+	"github.com/praetorian-inc/trident/pkg/nozzle/nozzletest"
 )
 
 func TestMain(m *testing.M) {
@@ -37,6 +42,7 @@ type testcase struct {
 	valid    bool
 	mfa      bool
 	locked   bool
+	flag     string
 }
 
 func TestNozzle(t *testing.T) {
@@ -107,3 +113,246 @@ func TestNozzle(t *testing.T) {
 		}
 	}
 }
+
+const mfaRequired = `{"stateToken":"00ZlGmOC5Y","expiresAt":"2020-10-20T18:47:06.000Z","status":"MFA_REQUIRED",
+"_embedded":{"user":{"id":"00ub0oNGTSWTBKOLGLNR","passwordChanged":"2020-08-14T18:29:00.000Z",
+"profile":{"login":"eve@example.org","firstName":"Eve","lastName":"Example","locale":"en","timeZone":"America/Los_Angeles"}},
+"factors":[{"id":"opf3hkfocI4JTLAju0g4","factorType":"push","provider":"OKTA","vendorName":"OKTA"},
+{"id":"ostf2gsyictRQDSGTDZE","factorType":"token:software:totp","provider":"GOOGLE","vendorName":"GOOGLE"}]}}`
+
+const mfaEnroll = `{"stateToken":"007ucIX7PATyn94hsHfOLVaXAmOBkKHWnOOLG43bsb","status":"MFA_ENROLL",
+"_embedded":{"user":{"id":"00ub0oNGTSWTBKOLGLNR","profile":{"login":"new@example.org"}},
+"factors":[{"factorType":"sms","provider":"OKTA","enrollment":"REQUIRED","status":"NOT_SETUP"}]}}`
+
+const passwordWarn = `{"stateToken":"00ZlGmOC5Y","status":"PASSWORD_WARN",
+"_embedded":{"user":{"id":"00ub0oNGTSWTBKOLGLNR","profile":{"login":"warn@example.org"}},
+"policy":{"expiration":{"passwordExpireDays":3},"complexity":{"minLength":8}}}}`
+
+func authnHandler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/authn" {
+			w.WriteHeader(404)
+			return
+		}
+		var req map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatal(err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		switch req["username"] + ":" + req["password"] {
+		case "alice:Password1!":
+			fmt.Fprint(w, `{"expiresAt":"2020-10-20T18:47:06.000Z","status":"SUCCESS","sessionToken":"20111ZbeMB6vpH0ge6D"}`) // nolint:errcheck
+		case "eve:Password1!":
+			fmt.Fprint(w, mfaRequired) // nolint:errcheck
+		case "new:Password1!":
+			fmt.Fprint(w, mfaEnroll) // nolint:errcheck
+		case "old:Password1!":
+			fmt.Fprint(w, `{"stateToken":"00s1pd3bZuOv","status":"PASSWORD_EXPIRED"}`) // nolint:errcheck
+		case "warn:Password1!":
+			fmt.Fprint(w, passwordWarn) // nolint:errcheck
+		case "unknown:Password1!":
+			fmt.Fprint(w, `{"status":"RECOVERY"}`) // nolint:errcheck
+		case "slow:Password1!":
+			w.WriteHeader(429)
+			fmt.Fprint(w, `{"errorCode":"E0000047","errorSummary":"API call exceeded rate limit due to too many requests."}`) // nolint:errcheck
+		default:
+			if req["username"] == "bob" {
+				fmt.Fprint(w, `{"status":"LOCKED_OUT"}`) // nolint:errcheck
+				return
+			}
+			w.WriteHeader(401)
+			fmt.Fprint(w, `{"errorCode":"E0000004","errorSummary":"Authentication failed","errorLink":"E0000004","errorCauses":[]}`) // nolint:errcheck
+		}
+	}
+}
+
+func TestStatuses(t *testing.T) {
+	srv := httptest.NewTLSServer(authnHandler(t))
+	defer srv.Close()
+
+	noz, err := nozzle.Open("okta", map[string]string{
+		"custom-domain": srv.Listener.Addr().String(),
+	})
+	if err != nil {
+		t.Fatalf("unable to open nozzle: %s", err)
+	}
+	noz.(*Nozzle).Client = srv.Client()
+
+	var testcases = []testcase{
+		{"invalid login", "alice", "Invalid1!", false, false, false, ""},
+		{"valid login", "alice", "Password1!", true, false, false, ""},
+		{"valid login with mfa", "eve", "Password1!", true, true, false, ""},
+		{"mfa enrollment", "new", "Password1!", true, false, false, "mfaEnroll"},
+		{"password expired", "old", "Password1!", true, false, false, "passwordExpired"},
+		{"password warning", "warn", "Password1!", true, false, false, "passwordWarn"},
+		{"locked account", "bob", "Invalid1!", false, false, true, ""},
+		{"unrecognized status", "unknown", "Password1!", false, false, false, "unrecognizedStatus"},
+	}
+
+	for _, test := range testcases {
+		res, err := noz.Login(test.username, test.password)
+		if err != nil {
+			t.Errorf("[%s] error in login: %s", test.desc, err)
+			continue
+		}
+		if res.Valid != test.valid {
+			t.Errorf("[%s] noz.valid was %t, expected %t", test.desc, res.Valid, test.valid)
+		}
+		if res.MFA != test.mfa {
+			t.Errorf("[%s] noz.mfa %t, expected %t", test.desc, res.MFA, test.mfa)
+		}
+		if res.Locked != test.locked {
+			t.Errorf("[%s] noz.locked %t, expected %t", test.desc, res.Locked, test.locked)
+		}
+		if test.flag != "" && res.Metadata[test.flag] != true {
+			t.Errorf("[%s] expected %s metadata", test.desc, test.flag)
+		}
+	}
+
+	res, err := noz.Login("alice", "Password1!")
+	if err != nil {
+		t.Fatalf("error in login: %s", err)
+	}
+	if a := res.Artifacts; a == nil || a.Tokens["sessionToken"] != "20111ZbeMB6vpH0ge6D" || a.MFA != event.MFAPostureNotEnforced {
+		t.Errorf("artifacts were %+v", a)
+	}
+
+	res, err = noz.Login("eve", "Password1!")
+	if err != nil {
+		t.Fatalf("error in login: %s", err)
+	}
+	a := res.Artifacts
+	if a == nil || a.MFA != event.MFAPostureEnforced || a.Tokens["stateToken"] != "00ZlGmOC5Y" {
+		t.Fatalf("artifacts were %+v", a)
+	}
+	if len(a.Factors) != 2 || a.Factors[0] != (event.Factor{Type: "push", Provider: "OKTA"}) || a.Factors[1] != (event.Factor{Type: "token:software:totp", Provider: "GOOGLE"}) {
+		t.Errorf("factors were %v", a.Factors)
+	}
+	if _, ok := res.Metadata["factors"]; ok {
+		t.Errorf("factors were reported in metadata")
+	}
+
+	res, err = noz.Login("new", "Password1!")
+	if err != nil {
+		t.Fatalf("error in login: %s", err)
+	}
+	if res.Artifacts == nil || len(res.Artifacts.Factors) != 0 {
+		t.Errorf("factors available for enrollment were reported as enrolled")
+	}
+
+	res, err = noz.Login("warn", "Password1!")
+	if err != nil {
+		t.Fatalf("error in login: %s", err)
+	}
+	if res.Metadata["passwordExpireDays"] != 3 {
+		t.Errorf("passwordExpireDays was %v, expected 3", res.Metadata["passwordExpireDays"])
+	}
+
+	res, err = noz.Login("slow", "Password1!")
+	if err != nil {
+		t.Fatalf("error in login: %s", err)
+	}
+	if !res.RateLimited {
+		t.Errorf("expected rate limited response")
+	}
+}
+
+func TestDomains(t *testing.T) {
+	var testcases = []struct {
+		opts      map[string]string
+		host      string
+		expecterr bool
+	}{
+		{map[string]string{"subdomain": "example"}, "example.okta.com", false},
+		{map[string]string{"subdomain": "example", "base-domain": "oktapreview.com"}, "example.oktapreview.com", false},
+		{map[string]string{"subdomain": "example", "base-domain": "okta-emea.com"}, "example.okta-emea.com", false},
+		{map[string]string{"custom-domain": "login.example.org"}, "login.example.org", false},
+		{map[string]string{"subdomain": "example", "base-domain": "example.org"}, "", true},
+		{map[string]string{"subdomain": "example.org/"}, "", true},
+		{map[string]string{"subdomain": "evil.example.org#"}, "", true},
+		{map[string]string{"subdomain": "example:8443"}, "", true},
+		{map[string]string{"custom-domain": "login.example.org/api?"}, "", true},
+		{map[string]string{"custom-domain": "user@login.example.org"}, "", true},
+		{map[string]string{}, "", true},
+	}
+
+	for _, test := range testcases {
+		noz, err := nozzle.Open("okta", test.opts)
+		if test.expecterr {
+			if err == nil {
+				t.Errorf("expected error for %v", test.opts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %v: %s", test.opts, err)
+			continue
+		}
+		if host := noz.(*Nozzle).Host; host != test.host {
+			t.Errorf("host for %v was %s, expected %s", test.opts, host, test.host)
+		}
+	}
+}
+
+func TestCheckUser(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/webfinger" {
+			http.NotFound(w, r)
+			return
+		}
+		idp := map[string]interface{}{
+			"rel":        "okta:idp",
+			"href":       "https://example.okta.com/sso/idps/OKTA",
+			"properties": map[string]string{"okta:idp:type": "OKTA"},
+		}
+		if r.URL.Query().Get("resource") == "okta:acct:bob@federated.example.org" {
+			idp["href"] = "https://example.okta.com/sso/idps/0oa1k5d68qR2954hb0g4"
+			idp["properties"] = map[string]string{"okta:idp:type": "SAML2"}
+		}
+		w.Header().Set("Content-Type", "application/jrd+json")
+		json.NewEncoder(w).Encode(map[string]interface{}{ // nolint:errcheck,gosec
+			"subject": r.URL.Query().Get("resource"),
+			"links":   []interface{}{idp},
+		})
+	}))
+	defer srv.Close()
+
+	noz, err := nozzle.Open("okta", map[string]string{
+		"custom-domain": srv.Listener.Addr().String(),
+	})
+	if err != nil {
+		t.Fatalf("unable to open nozzle: %s", err)
+	}
+	noz.(*Nozzle).Client = srv.Client()
+
+	var testcases = []struct {
+		username   string
+		federation string
+	}{
+		{"alice@example.org", "managed"},
+		{"nobody@example.org", "managed"},
+		{"bob@federated.example.org", "federated"},
+	}
+
+	for _, test := range testcases {
+		res, err := nozzle.CheckUser(noz, test.username)
+		if err != nil {
+			t.Errorf("[%s] error in check: %s", test.username, err)
+			continue
+		}
+		// okta routes users which do not exist with the default rule
+		if res.UserStatus != event.UserStatusUnknown {
+			t.Errorf("[%s] status was %q, expected %q", test.username, res.UserStatus, event.UserStatusUnknown)
+		}
+		if res.Metadata["federation"] != test.federation {
+			t.Errorf("[%s] federation was %v, expected %s", test.username, res.Metadata["federation"], test.federation)
+		}
+	}
+}
+
+func TestConformance(t *testing.T) {
+	nozzletest.Run(t, Driver{}, nozzletest.Okta, func(noz nozzle.Nozzle, client *http.Client) {
+		noz.(*Nozzle).Client = client
+	})
+}
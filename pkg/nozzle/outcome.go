@@ -0,0 +1,93 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nozzle
+
+import (
+	"github.com/praetorian-inc/trident/pkg/event"
+)
+
+// Outcome is the normalized result of a provider's status or error code.
+// Nozzles map their provider's codes to an Outcome in a table, so that new
+// codes can be added without changing any login logic, and convert it to an
+// AuthResponse with Response.
+type Outcome struct {
+	// Desc describes the code in the result metadata
+	Desc string
+
+	// Valid indicates the password was correct, even if no session was
+	// issued
+	Valid bool
+
+	// Locked indicates the account is locked or disabled
+	Locked bool
+
+	// MFA indicates the account requires an additional factor
+	MFA bool
+
+	// RateLimited indicates the provider is throttling requests
+	RateLimited bool
+
+	// UserStatus is set when the code reveals whether the user exists
+	UserStatus event.UserStatus
+
+	// Flag is an additional metadata key set to true (e.g. passwordExpired)
+	Flag string
+
+	// Posture is whether the code shows MFA is enforced. MFA outcomes are
+	// always enforced.
+	Posture event.MFAPosture
+
+	// Fatal indicates a problem with the request or client configuration
+	// which affects every credential, so the nozzle reports an error instead
+	Fatal bool
+
+	// Generic indicates the code is used for many failures, so the nozzle
+	// refines the outcome using the provider's error message
+	Generic bool
+}
+
+// Response converts the outcome into an AuthResponse, recording its
+// description and flag in metadata, which may be nil. The MFA posture is
+// reported in the artifacts when it is known.
+func (o Outcome) Response(metadata map[string]interface{}) *event.AuthResponse {
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+	}
+	if o.Desc != "" {
+		metadata["description"] = o.Desc
+	}
+	if o.Flag != "" {
+		metadata[o.Flag] = true
+	}
+
+	posture := o.Posture
+	if o.MFA {
+		posture = event.MFAPostureEnforced
+	}
+	var artifacts *event.Artifacts
+	if posture != event.MFAPostureUnknown {
+		artifacts = &event.Artifacts{MFA: posture}
+	}
+
+	return &event.AuthResponse{
+		Valid:       o.Valid,
+		Locked:      o.Locked,
+		MFA:         o.MFA,
+		RateLimited: o.RateLimited,
+		UserStatus:  o.UserStatus,
+		Metadata:    metadata,
+		Artifacts:   artifacts,
+	}
+}
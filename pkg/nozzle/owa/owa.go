@@ -0,0 +1,274 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package owa
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	netUrl "net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/fingerprint"
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+	"github.com/praetorian-inc/trident/pkg/ntlm"
+)
+
+var (
+	// RateLimiter limits requests from the same worker to a maximum of 3/s
+	RateLimiter = rate.NewLimiter(rate.Every(300*time.Millisecond), 1)
+)
+
+// Driver implements the nozzle.Driver interface.
+type Driver struct{}
+
+func init() {
+	nozzle.Register("owa", Driver{})
+}
+
+// New is used to create an Outlook Web App nozzle and accepts the following
+// configuration options:
+//
+// domain
+//
+// The host serving OWA. If a user logs in at https://mail.example.org/owa, the
+// value of domain is "mail.example.org".
+//
+// netbios-domain
+//
+// The internal domain prepended to usernames which are not already in
+// DOMAIN\user or UPN format. By default this is discovered from the NTLM
+// challenge on /EWS or /autodiscover.
+//
+// timing-threshold
+//
+// A duration (e.g. 250ms). Invalid logins which complete faster than this are
+// flagged as likely belonging to an existing user in the "timingUserExists"
+// metadata. The raw response time is always reported in "responseTime".
+//
+// insecure
+//
+// Set to true to skip verification of the OWA host's TLS certificate.
+// Certificates are verified by default.
+//
+// profiles, profile-mode
+//
+// The browser fingerprint profiles to send and how to choose between them. See
+// the fingerprint package for details.
+func (Driver) New(opts map[string]string) (nozzle.Nozzle, error) {
+	domain, ok := opts["domain"]
+	if !ok {
+		return nil, fmt.Errorf("owa nozzle requires 'domain' config parameter")
+	}
+
+	var threshold time.Duration
+	if v, ok := opts["timing-threshold"]; ok {
+		var err error
+		threshold, err = time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("owa nozzle: invalid timing-threshold: %w", err)
+		}
+	}
+
+	profiles, err := fingerprint.NewSelector(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	insecure, err := nozzle.Insecure(opts)
+	if err != nil {
+		return nil, fmt.Errorf("owa nozzle: %v", err)
+	}
+
+	return &Nozzle{
+		Domain:          domain,
+		NetBIOSDomain:   opts["netbios-domain"],
+		TimingThreshold: threshold,
+		Profiles:        profiles,
+		Client:          nozzle.NewClient(insecure),
+	}, nil
+}
+
+// Nozzle implements the nozzle.Nozzle interface for OWA.
+type Nozzle struct {
+	// Domain is the OWA host
+	Domain string
+
+	// NetBIOSDomain is the internal domain prepended to bare usernames. It is
+	// discovered on the first login when empty.
+	NetBIOSDomain string
+
+	// TimingThreshold is the response time below which an invalid login is
+	// considered to belong to an existing user. Zero disables the check.
+	TimingThreshold time.Duration
+
+	// Profiles selects the browser headers sent with each request
+	Profiles *fingerprint.Selector
+
+	// Client is the HTTP client used to send requests. Redirects are never
+	// followed regardless of the client's CheckRedirect.
+	Client *http.Client
+}
+
+var (
+	owaAuthURL     = "https://%s/owa/auth.owa"
+	owaDestination = "https://%s/owa/"
+
+	// discoveryPaths are tried in order when discovering the NetBIOS domain
+	discoveryPaths = []string{
+		"https://%s/EWS/Exchange.asmx",
+		"https://%s/autodiscover/autodiscover.xml",
+	}
+)
+
+// discovered caches the NTLM challenge of each OWA host.
+var discovered = struct {
+	sync.Mutex
+	hosts map[string]*ntlm.ChallengeInfo
+}{hosts: map[string]*ntlm.ChallengeInfo{}}
+
+// Discover returns the domain information from the NTLM challenge of the
+// Exchange server's /EWS or /autodiscover endpoints.
+func (n *Nozzle) Discover() (*ntlm.ChallengeInfo, error) {
+	discovered.Lock()
+	defer discovered.Unlock()
+
+	if info, ok := discovered.hosts[n.Domain]; ok {
+		return info, nil
+	}
+
+	var err error
+	for _, path := range discoveryPaths {
+		var info *ntlm.ChallengeInfo
+		info, err = ntlm.Challenge(n.Client, fmt.Sprintf(path, n.Domain))
+		if err == nil {
+			discovered.hosts[n.Domain] = info
+			return info, nil
+		}
+	}
+	return nil, fmt.Errorf("unable to discover owa netbios domain: %w", err)
+}
+
+func (n *Nozzle) username(username string) (string, map[string]interface{}, error) {
+	metadata := map[string]interface{}{}
+	if strings.ContainsAny(username, `\@`) {
+		return username, metadata, nil
+	}
+
+	domain := n.NetBIOSDomain
+	if domain == "" {
+		info, err := n.Discover()
+		if err != nil {
+			return "", nil, err
+		}
+		domain = info.NetBIOSDomain
+		metadata["netbiosDomain"] = info.NetBIOSDomain
+		if info.DNSDomain != "" {
+			metadata["dnsDomain"] = info.DNSDomain
+		}
+	}
+	return domain + `\` + username, metadata, nil
+}
+
+// Login fulfils the nozzle.Nozzle interface and performs a forms based
+// authentication request against OWA. Success is detected by the cadata
+// cookies which OWA sets along with the redirect to the mailbox.
+func (n *Nozzle) Login(username, password string) (*event.AuthResponse, error) {
+	return n.LoginContext(context.Background(), username, password)
+}
+
+// LoginContext fulfils the nozzle.ContextNozzle interface. The login request
+// is cancelled with ctx.
+func (n *Nozzle) LoginContext(ctx context.Context, username, password string) (*event.AuthResponse, error) {
+	err := RateLimiter.Wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	user, metadata, err := n.username(username)
+	if err != nil {
+		return nil, err
+	}
+
+	form := netUrl.Values{}
+	form.Set("destination", fmt.Sprintf(owaDestination, n.Domain))
+	form.Set("flags", "4")
+	form.Set("forcedownlevel", "0")
+	form.Set("username", user)
+	form.Set("password", password)
+	form.Set("passwordText", "")
+	form.Set("isUtf8", "1")
+
+	req, _ := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf(owaAuthURL, n.Domain), strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: "PBack", Value: "0"})
+	n.Profiles.Apply(req, username)
+
+	// copy the client so the caller's redirect policy is left untouched
+	client := *n.Client
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint:errcheck
+	elapsed := time.Since(start)
+
+	metadata["status"] = resp.StatusCode
+	metadata["responseTime"] = elapsed.Milliseconds()
+
+	var cadata bool
+	for _, cookie := range resp.Cookies() {
+		if strings.HasPrefix(cookie.Name, "cadata") && cookie.Value != "" {
+			cadata = true
+		}
+	}
+
+	location := resp.Header.Get("Location")
+	switch {
+	case resp.StatusCode != 302 && resp.StatusCode != 200:
+		return nil, fmt.Errorf("unhandled status code from owa: %d", resp.StatusCode)
+	case strings.Contains(strings.ToLower(location), "expiredpassword"):
+		metadata["passwordExpired"] = true
+		return &event.AuthResponse{
+			Valid:      true,
+			UserStatus: event.UserStatusExists,
+			Metadata:   metadata,
+		}, nil
+	case cadata && !strings.Contains(location, "reason="):
+		return &event.AuthResponse{
+			Valid:      true,
+			UserStatus: event.UserStatusExists,
+			Metadata:   metadata,
+		}, nil
+	}
+
+	if n.TimingThreshold > 0 {
+		metadata["timingUserExists"] = elapsed < n.TimingThreshold
+	}
+	return &event.AuthResponse{
+		Valid:    false,
+		Metadata: metadata,
+	}, nil
+}
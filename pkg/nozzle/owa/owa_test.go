@@ -0,0 +1,121 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package owa
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+	"github.com/praetorian-inc/trident/pkg/nozzle/nozzletest"
+	"github.com/praetorian-inc/trident/pkg/ntlm"
+)
+
+var challenge = ntlm.NewChallenge(&ntlm.ChallengeInfo{
+	NetBIOSDomain: "CORP",
+	DNSDomain:     "corp.example.org",
+}, []byte("01234567"))
+
+func owaHandler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/EWS/Exchange.asmx":
+			if !strings.HasPrefix(r.Header.Get("Authorization"), "NTLM ") {
+				t.Errorf("discovery request did not include an ntlm negotiate message")
+			}
+			w.Header().Set("WWW-Authenticate", "NTLM "+base64.StdEncoding.EncodeToString(challenge))
+			w.WriteHeader(401)
+		case "/owa/auth.owa":
+			if err := r.ParseForm(); err != nil {
+				t.Fatal(err)
+			}
+			switch r.PostForm.Get("username") + ":" + r.PostForm.Get("password") {
+			case `CORP\alice:Password1!`, "alice@corp.example.org:Password1!":
+				http.SetCookie(w, &http.Cookie{Name: "cadata", Value: "token"})
+				http.SetCookie(w, &http.Cookie{Name: "cadataTTL", Value: "token"})
+				http.Redirect(w, r, "/owa/", http.StatusFound)
+			case `CORP\bob:Password1!`:
+				http.Redirect(w, r, "/owa/auth/expiredpassword.aspx?url=/owa/auth.owa&reason=0", http.StatusFound)
+			default:
+				http.Redirect(w, r, "/owa/auth/logon.aspx?replaceCurrent=1&reason=2&url=", http.StatusFound)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
+
+type testcase struct {
+	desc     string
+	username string
+	password string
+	valid    bool
+}
+
+func TestNozzle(t *testing.T) {
+	srv := httptest.NewTLSServer(owaHandler(t))
+	defer srv.Close()
+
+	noz, err := nozzle.Open("owa", map[string]string{
+		"domain":           srv.Listener.Addr().String(),
+		"timing-threshold": "1h",
+	})
+	if err != nil {
+		t.Fatalf("unable to open nozzle: %s", err)
+	}
+	noz.(*Nozzle).Client = srv.Client()
+
+	var testcases = []testcase{
+		{"invalid login", "alice", "Invalid1!", false},
+		{"valid login", "alice", "Password1!", true},
+		{"valid upn login", "alice@corp.example.org", "Password1!", true},
+		{"expired password", "bob", "Password1!", true},
+		{"unknown user", "nobody", "Password1!", false},
+	}
+
+	for _, test := range testcases {
+		res, err := noz.Login(test.username, test.password)
+		if err != nil {
+			t.Errorf("[%s] error in login: %s", test.desc, err)
+			continue
+		}
+		if res.Valid != test.valid {
+			t.Errorf("[%s] noz.valid was %t, expected %t", test.desc, res.Valid, test.valid)
+		}
+		if _, ok := res.Metadata["responseTime"]; !ok {
+			t.Errorf("[%s] expected responseTime metadata", test.desc)
+		}
+		if !test.valid && res.Metadata["timingUserExists"] != true {
+			t.Errorf("[%s] expected timingUserExists metadata", test.desc)
+		}
+	}
+
+	info, err := noz.(*Nozzle).Discover()
+	if err != nil {
+		t.Fatalf("error in discovery: %s", err)
+	}
+	if info.NetBIOSDomain != "CORP" || info.DNSDomain != "corp.example.org" {
+		t.Errorf("discovered %+v, expected CORP and corp.example.org", info)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	nozzletest.Run(t, Driver{}, nozzletest.OWA, func(noz nozzle.Nozzle, client *http.Client) {
+		noz.(*Nozzle).Client = client
+	})
+}
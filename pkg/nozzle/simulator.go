@@ -0,0 +1,43 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nozzle
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+// SimulatorOption is the configuration option which points a nozzle at a
+// trident-idp-sim server (host:port) instead of the real provider, for
+// rehearsing campaigns. Nozzles which support it document it in their New()
+// method.
+const SimulatorOption = "simulator"
+
+// SimulatorClient is the HTTP client used to reach a trident-idp-sim server.
+// The simulator usually serves a self-signed certificate, so it is not
+// verified.
+var SimulatorClient = &http.Client{
+	Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true, // nolint:gosec
+		},
+	},
+}
+
+// Simulator returns the trident-idp-sim server configured in opts, if any.
+func Simulator(opts map[string]string) (string, bool) {
+	host, ok := opts[SimulatorOption]
+	return host, ok && host != ""
+}
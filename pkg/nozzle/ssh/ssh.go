@@ -0,0 +1,337 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/time/rate"
+
+	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+)
+
+var (
+	// RateLimiter limits requests from the same worker to a maximum of 3/s
+	RateLimiter = rate.NewLimiter(rate.Every(300*time.Millisecond), 1)
+)
+
+// Driver implements the nozzle.Driver interface.
+type Driver struct{}
+
+func init() {
+	nozzle.Register("ssh", Driver{})
+}
+
+// Host key policies accepted by the host-key-policy option.
+const (
+	HostKeyAny         = "any"
+	HostKeyFingerprint = "fingerprint"
+	HostKeyKnownHosts  = "known-hosts"
+)
+
+// DefaultClientVersion is the identification string sent to the server, in
+// place of the "SSH-2.0-Go" default which stands out in server logs.
+const DefaultClientVersion = "SSH-2.0-OpenSSH_8.2p1 Ubuntu-4ubuntu0.1"
+
+// New is used to create an SSH password authentication nozzle and accepts the
+// following configuration options:
+//
+// host
+//
+// The SSH server, optionally with a port.
+//
+// port
+//
+// The port of the SSH server when host does not include one. Defaults to 22.
+//
+// host-key-policy
+//
+// How the server's host key is verified. One of any (default, accept any
+// key), fingerprint, or known-hosts.
+//
+// host-key-fingerprint
+//
+// The expected SHA256 fingerprint of the host key (e.g. SHA256:nThbg6kX...)
+// for the fingerprint policy, as printed by ssh-keygen -l.
+//
+// known-hosts
+//
+// The path of an OpenSSH known_hosts file on the worker for the known-hosts
+// policy.
+//
+// client-version
+//
+// The SSH identification string sent to the server. Defaults to
+// DefaultClientVersion.
+func (Driver) New(opts map[string]string) (nozzle.Nozzle, error) {
+	host, ok := opts["host"]
+	if !ok {
+		return nil, fmt.Errorf("ssh nozzle requires 'host' config parameter")
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		port, ok := opts["port"]
+		if !ok {
+			port = "22"
+		}
+		host = net.JoinHostPort(host, port)
+	}
+
+	var callback gossh.HostKeyCallback
+	switch opts["host-key-policy"] {
+	case "", HostKeyAny:
+		callback = gossh.InsecureIgnoreHostKey() // nolint:gosec
+	case HostKeyFingerprint:
+		fingerprint, ok := opts["host-key-fingerprint"]
+		if !ok {
+			return nil, fmt.Errorf("ssh nozzle requires 'host-key-fingerprint' config parameter for the fingerprint policy")
+		}
+		callback = func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+			if gossh.FingerprintSHA256(key) != fingerprint {
+				return fmt.Errorf("ssh host key %s does not match %s", gossh.FingerprintSHA256(key), fingerprint)
+			}
+			return nil
+		}
+	case HostKeyKnownHosts:
+		path, ok := opts["known-hosts"]
+		if !ok {
+			return nil, fmt.Errorf("ssh nozzle requires 'known-hosts' config parameter for the known-hosts policy")
+		}
+		var err error
+		callback, err = knownhosts.New(path)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("ssh nozzle: unknown host key policy %q", opts["host-key-policy"])
+	}
+
+	version, ok := opts["client-version"]
+	if !ok {
+		version = DefaultClientVersion
+	}
+
+	return &Nozzle{
+		Host:            host,
+		HostKeyCallback: callback,
+		ClientVersion:   version,
+		Timeout:         10 * time.Second,
+	}, nil
+}
+
+// Nozzle implements the nozzle.Nozzle interface for SSH password
+// authentication.
+type Nozzle struct {
+	// Host is the host:port of the SSH server
+	Host string
+
+	// HostKeyCallback verifies the server's host key
+	HostKeyCallback gossh.HostKeyCallback
+
+	// ClientVersion is the identification string sent to the server
+	ClientVersion string
+
+	// Timeout limits the connection and authentication
+	Timeout time.Duration
+}
+
+// attempt tracks the authentication methods used during a single login.
+type attempt struct {
+	password string
+
+	// passwordSent is set once the password has been sent by either method
+	passwordSent bool
+
+	// passwordMethod is set when the server offered the password method
+	passwordMethod bool
+
+	// required is set when the server prompts for something other than the
+	// password during keyboard-interactive authentication
+	required bool
+
+	prompts []string
+}
+
+func isPasswordPrompt(prompt string, echo bool) bool {
+	return !echo && strings.Contains(strings.ToLower(prompt), "password")
+}
+
+// errAbort stops authentication once the result is known. The ssh package
+// does not wrap errors, so the attempt's fields carry the result instead.
+var errAbort = errors.New("aborted keyboard-interactive authentication")
+
+// challenge answers keyboard-interactive prompts. Only password prompts are
+// answered, and only once. A prompt for anything else, before or after the
+// password, means the result cannot be known without answering it: a PAM
+// conversation prompts for a one time code whether or not the password was
+// correct.
+func (a *attempt) challenge(user, instruction string, questions []string, echos []bool) ([]string, error) {
+	answers := make([]string, len(questions))
+	for i, q := range questions {
+		if isPasswordPrompt(q, echos[i]) {
+			if a.passwordSent {
+				return nil, errAbort
+			}
+			continue
+		}
+		a.prompts = append(a.prompts, strings.TrimSpace(q))
+		a.required = true
+	}
+	if a.required {
+		return nil, errAbort
+	}
+
+	for i, q := range questions {
+		if isPasswordPrompt(q, echos[i]) {
+			answers[i] = a.password
+			a.passwordSent = true
+		}
+	}
+	return answers, nil
+}
+
+// Login fulfils the nozzle.Nozzle interface. The password is sent using the
+// password method, or in answer to a keyboard-interactive password prompt
+// when the server does not offer that method. Only a partial success of the
+// password method, which OpenSSH sends once the password is accepted and
+// another method is required, is reported as MFA. SSH servers do not reveal
+// whether a user exists or is locked out.
+func (n *Nozzle) Login(username, password string) (*event.AuthResponse, error) {
+	ctx := context.Background()
+	err := RateLimiter.Wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &attempt{password: password}
+	metadata := map[string]interface{}{}
+
+	// the password method is tried on its own, so that a partial success is
+	// not followed by the next method
+	err = n.handshake(username, metadata, gossh.PasswordCallback(func() (string, error) {
+		a.passwordMethod = true
+		a.passwordSent = true
+		return password, nil
+	}))
+	if err != nil && !a.passwordSent && rejected(err) {
+		err = n.handshake(username, metadata, gossh.KeyboardInteractive(a.challenge))
+		if a.passwordSent {
+			metadata["keyboardInteractive"] = true
+		}
+	}
+	if err == nil {
+		return &event.AuthResponse{
+			Valid:      true,
+			UserStatus: event.UserStatusExists,
+			Metadata:   metadata,
+		}, nil
+	}
+
+	if len(a.prompts) > 0 {
+		metadata["prompts"] = a.prompts
+	}
+	switch {
+	case a.passwordMethod && partialSuccess(err):
+		return &event.AuthResponse{
+			Valid:      true,
+			MFA:        true,
+			UserStatus: event.UserStatusExists,
+			Metadata:   metadata,
+		}, nil
+	case a.required:
+		metadata["keyboardInteractiveRequired"] = true
+		return &event.AuthResponse{
+			Valid:    false,
+			Metadata: metadata,
+		}, nil
+	case a.passwordSent && rejected(err):
+		return &event.AuthResponse{
+			Valid:    false,
+			Metadata: metadata,
+		}, nil
+	}
+
+	// the host key was rejected, the server does not accept passwords, or the
+	// connection failed
+	return nil, err
+}
+
+// handshake connects to the server and authenticates with method.
+func (n *Nozzle) handshake(username string, metadata map[string]interface{}, method gossh.AuthMethod) error {
+	config := &gossh.ClientConfig{
+		User: username,
+		Auth: []gossh.AuthMethod{method},
+		HostKeyCallback: func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+			metadata["hostKey"] = gossh.FingerprintSHA256(key)
+			return n.HostKeyCallback(hostname, remote, key)
+		},
+		BannerCallback: func(message string) error {
+			metadata["banner"] = message
+			return nil
+		},
+		ClientVersion: n.ClientVersion,
+		Timeout:       n.Timeout,
+	}
+
+	conn, err := net.DialTimeout("tcp", n.Host, n.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close() // nolint:errcheck
+	if err = conn.SetDeadline(time.Now().Add(n.Timeout)); err != nil {
+		return err
+	}
+
+	c, chans, reqs, err := gossh.NewClientConn(conn, n.Host, config)
+	if err != nil {
+		return err
+	}
+	metadata["serverVersion"] = string(c.ServerVersion())
+	gossh.NewClient(c, chans, reqs).Close() // nolint:errcheck,gosec
+	return nil
+}
+
+// rejected reports whether the handshake failed because the server rejected
+// the password, rather than because of a network or protocol error.
+func rejected(err error) bool {
+	return strings.Contains(err.Error(), "unable to authenticate") ||
+		strings.Contains(err.Error(), errAbort.Error())
+}
+
+var attemptedRegexp = regexp.MustCompile(`attempted methods \[([^\]]*)\]`)
+
+// partialSuccess reports whether the handshake failed after a partial success
+// of the password method. The ssh package does not expose partial success,
+// but only lists a method as attempted once the server has rejected it.
+func partialSuccess(err error) bool {
+	m := attemptedRegexp.FindStringSubmatch(err.Error())
+	if m == nil {
+		return false
+	}
+	for _, method := range strings.Fields(m[1]) {
+		if method == "password" {
+			return false
+		}
+	}
+	return true
+}
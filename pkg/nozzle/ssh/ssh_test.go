@@ -0,0 +1,328 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+)
+
+const testPassword = "Password1!"
+
+// testServer is an in-process SSH server which accepts connections with the
+// given config and immediately rejects any channels.
+type testServer struct {
+	listener net.Listener
+	signer   gossh.Signer
+
+	// guesses counts the passwords received by either method
+	guesses int32
+}
+
+func newTestServer(t *testing.T, config *gossh.ServerConfig) *testServer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{listener: l, signer: signer}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close() // nolint:errcheck
+				_, chans, reqs, err := gossh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				go gossh.DiscardRequests(reqs)
+				for ch := range chans {
+					ch.Reject(gossh.Prohibited, "no channels") // nolint:errcheck,gosec
+				}
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *testServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *testServer) Close() {
+	s.listener.Close() // nolint:errcheck,gosec
+}
+
+// check verifies a password sent by either method.
+func (s *testServer) check(t *testing.T, conn gossh.ConnMetadata, password string) error {
+	atomic.AddInt32(&s.guesses, 1)
+	if string(conn.ClientVersion()) != DefaultClientVersion {
+		t.Errorf("client version was %q", conn.ClientVersion())
+	}
+	if password != testPassword {
+		return fmt.Errorf("invalid password for %s", conn.User())
+	}
+	return nil
+}
+
+// passwordServer offers the password method and a keyboard-interactive
+// method which prompts for the password, like OpenSSH with PAM.
+func passwordServer(t *testing.T) *testServer {
+	var s *testServer
+	s = newTestServer(t, &gossh.ServerConfig{
+		PasswordCallback: func(conn gossh.ConnMetadata, password []byte) (*gossh.Permissions, error) {
+			return nil, s.check(t, conn, string(password))
+		},
+		KeyboardInteractiveCallback: func(conn gossh.ConnMetadata, client gossh.KeyboardInteractiveChallenge) (*gossh.Permissions, error) {
+			answers, err := client(conn.User(), "", []string{"Password: "}, []bool{false})
+			if err != nil {
+				return nil, err
+			}
+			return nil, s.check(t, conn, answers[0])
+		},
+	})
+	return s
+}
+
+// interactiveServer only offers keyboard-interactive. It prompts for the
+// password and then, for eve, a verification code, as a PAM conversation
+// would.
+func interactiveServer(t *testing.T) *testServer {
+	var s *testServer
+	s = newTestServer(t, &gossh.ServerConfig{
+		KeyboardInteractiveCallback: func(conn gossh.ConnMetadata, client gossh.KeyboardInteractiveChallenge) (*gossh.Permissions, error) {
+			answers, err := client(conn.User(), "", []string{"Password: "}, []bool{false})
+			if err != nil {
+				return nil, err
+			}
+			if err = s.check(t, conn, answers[0]); err != nil {
+				return nil, err
+			}
+			if conn.User() == "eve" {
+				_, err = client(conn.User(), "", []string{"Verification code: "}, []bool{true})
+				if err != nil {
+					return nil, err
+				}
+				return nil, fmt.Errorf("invalid verification code")
+			}
+			return nil, nil
+		},
+	})
+	return s
+}
+
+type testcase struct {
+	desc     string
+	username string
+	password string
+	valid    bool
+	mfa      bool
+	flag     string
+}
+
+func testLogins(t *testing.T, name string, s *testServer, testcases []testcase) {
+	noz, err := nozzle.Open("ssh", map[string]string{"host": s.Addr()})
+	if err != nil {
+		t.Fatalf("unable to open nozzle: %s", err)
+	}
+
+	for _, test := range testcases {
+		atomic.StoreInt32(&s.guesses, 0)
+		res, err := noz.Login(test.username, test.password)
+		if err != nil {
+			t.Errorf("[%s %s] error in login: %s", name, test.desc, err)
+			continue
+		}
+		if res.Valid != test.valid {
+			t.Errorf("[%s %s] noz.valid was %t, expected %t", name, test.desc, res.Valid, test.valid)
+		}
+		if res.MFA != test.mfa {
+			t.Errorf("[%s %s] noz.mfa %t, expected %t", name, test.desc, res.MFA, test.mfa)
+		}
+		if test.valid && res.UserStatus != event.UserStatusExists {
+			t.Errorf("[%s %s] noz.status %q, expected %q", name, test.desc, res.UserStatus, event.UserStatusExists)
+		}
+		if test.flag != "" && res.Metadata[test.flag] != true {
+			t.Errorf("[%s %s] expected %s metadata", name, test.desc, test.flag)
+		}
+		if g := atomic.LoadInt32(&s.guesses); g > 1 {
+			t.Errorf("[%s %s] server received %d guesses, expected at most 1", name, test.desc, g)
+		}
+	}
+}
+
+func TestNozzle(t *testing.T) {
+	s := passwordServer(t)
+	defer s.Close()
+	testLogins(t, "password", s, []testcase{
+		{"invalid login", "alice", "Invalid1!", false, false, ""},
+		{"valid login", "alice", testPassword, true, false, ""},
+	})
+
+	s = interactiveServer(t)
+	defer s.Close()
+	testLogins(t, "keyboard-interactive", s, []testcase{
+		{"invalid login", "alice", "Invalid1!", false, false, "keyboardInteractive"},
+		{"valid login", "alice", testPassword, true, false, "keyboardInteractive"},
+		{"verification code after password", "eve", testPassword, false, false, "keyboardInteractiveRequired"},
+	})
+
+	// a server which asks for a one time code before the password
+	s = newTestServer(t, &gossh.ServerConfig{
+		KeyboardInteractiveCallback: func(conn gossh.ConnMetadata, client gossh.KeyboardInteractiveChallenge) (*gossh.Permissions, error) {
+			_, err := client(conn.User(), "", []string{"Verification code: "}, []bool{true})
+			if err == nil {
+				t.Errorf("nozzle answered a verification code prompt")
+			}
+			return nil, fmt.Errorf("invalid verification code")
+		},
+	})
+	defer s.Close()
+	testLogins(t, "otp", s, []testcase{
+		{"keyboard-interactive required", "alice", testPassword, false, false, "keyboardInteractiveRequired"},
+	})
+
+	// a server which checks the password method and then prompts for a one
+	// time code, whether or not the password was correct
+	s = newTestServer(t, &gossh.ServerConfig{
+		PasswordCallback: func(conn gossh.ConnMetadata, password []byte) (*gossh.Permissions, error) {
+			return nil, s.check(t, conn, string(password))
+		},
+		KeyboardInteractiveCallback: func(conn gossh.ConnMetadata, client gossh.KeyboardInteractiveChallenge) (*gossh.Permissions, error) {
+			_, err := client(conn.User(), "", []string{"Verification code: "}, []bool{true})
+			if err == nil {
+				t.Errorf("nozzle answered a verification code prompt")
+			}
+			return nil, fmt.Errorf("invalid verification code")
+		},
+	})
+	defer s.Close()
+	testLogins(t, "password and otp", s, []testcase{
+		{"invalid login", "alice", "Invalid1!", false, false, ""},
+		{"valid login", "alice", testPassword, true, false, ""},
+	})
+
+	// a server which only accepts public keys
+	s = newTestServer(t, &gossh.ServerConfig{
+		PublicKeyCallback: func(conn gossh.ConnMetadata, key gossh.PublicKey) (*gossh.Permissions, error) {
+			return nil, fmt.Errorf("unknown key")
+		},
+	})
+	defer s.Close()
+	noz, err := nozzle.Open("ssh", map[string]string{"host": s.Addr()})
+	if err != nil {
+		t.Fatalf("unable to open nozzle: %s", err)
+	}
+	_, err = noz.Login("alice", testPassword)
+	if err == nil {
+		t.Errorf("expected error for server without password authentication")
+	}
+}
+
+func TestHostKeyPolicy(t *testing.T) {
+	s := passwordServer(t)
+	defer s.Close()
+
+	f, err := ioutil.TempFile("", "known_hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name()) // nolint:errcheck
+	line := knownhosts.Line([]string{knownhosts.Normalize(s.Addr())}, s.signer.PublicKey())
+	if _, err = fmt.Fprintln(f, line); err != nil {
+		t.Fatal(err)
+	}
+	f.Close() // nolint:errcheck,gosec
+
+	var testcases = []struct {
+		desc string
+		opts map[string]string
+		ok   bool
+	}{
+		{"matching fingerprint", map[string]string{"host-key-policy": "fingerprint", "host-key-fingerprint": gossh.FingerprintSHA256(s.signer.PublicKey())}, true},
+		{"mismatched fingerprint", map[string]string{"host-key-policy": "fingerprint", "host-key-fingerprint": "SHA256:AAAA"}, false},
+		{"known host", map[string]string{"host-key-policy": "known-hosts", "known-hosts": f.Name()}, true},
+	}
+	for _, test := range testcases {
+		test.opts["host"] = s.Addr()
+		noz, err := nozzle.Open("ssh", test.opts)
+		if err != nil {
+			t.Fatalf("[%s] unable to open nozzle: %s", test.desc, err)
+		}
+		res, err := noz.Login("alice", testPassword)
+		if test.ok && (err != nil || !res.Valid) {
+			t.Errorf("[%s] expected valid login, got %v", test.desc, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("[%s] expected host key error", test.desc)
+		}
+	}
+
+	for _, opts := range []map[string]string{
+		{},
+		{"host": "jump.example.org", "host-key-policy": "fingerprint"},
+		{"host": "jump.example.org", "host-key-policy": "known-hosts"},
+		{"host": "jump.example.org", "host-key-policy": "trust-me"},
+	} {
+		if _, err := nozzle.Open("ssh", opts); err == nil {
+			t.Errorf("expected error for %v", opts)
+		}
+	}
+}
+
+func TestPartialSuccess(t *testing.T) {
+	s := passwordServer(t)
+	defer s.Close()
+	noz, err := nozzle.Open("ssh", map[string]string{"host": s.Addr()})
+	if err != nil {
+		t.Fatalf("unable to open nozzle: %s", err)
+	}
+
+	// a rejected password is listed as attempted by the ssh package
+	err = noz.(*Nozzle).handshake("alice", map[string]interface{}{}, gossh.Password("Invalid1!"))
+	if err == nil || partialSuccess(err) {
+		t.Errorf("rejected password was a partial success: %v", err)
+	}
+
+	// an accepted password is not, when keyboard-interactive is then required
+	err = fmt.Errorf("ssh: handshake failed: ssh: unable to authenticate, attempted methods [none], no supported methods remain")
+	if !partialSuccess(err) {
+		t.Errorf("accepted password was not a partial success")
+	}
+}
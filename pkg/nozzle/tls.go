@@ -0,0 +1,57 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nozzle
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/praetorian-inc/trident/pkg/fingerprint"
+)
+
+// InsecureOption is the configuration option which disables verification of
+// the provider's TLS certificate, e.g. for an appliance or lab instance with a
+// self-signed certificate. Every nozzle which connects over TLS verifies
+// certificates unless it is set to true, and documents it in its New() method.
+const InsecureOption = "insecure"
+
+// Insecure returns whether opts disable TLS certificate verification.
+func Insecure(opts map[string]string) (bool, error) {
+	v, ok := opts[InsecureOption]
+	if !ok || v == "" {
+		return false, nil
+	}
+	insecure, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid insecure %q", v)
+	}
+	return insecure, nil
+}
+
+// NewClient returns an HTTP client for a nozzle, which verifies the provider's
+// TLS certificate unless insecure is set. Requests carrying a fingerprint
+// profile's User-Agent are written in the profile's header order.
+func NewClient(insecure bool) *http.Client {
+	return &http.Client{
+		Transport: fingerprint.OrderHeaders(&http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: insecure, // nolint:gosec
+			},
+		}),
+	}
+}
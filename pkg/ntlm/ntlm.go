@@ -0,0 +1,167 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ntlm contains the NTLM helpers shared by the nozzles. Negotiation is
+// handled by go-ntlmssp, while this package adds the parsing needed to
+// discover a server's internal domain and to stand in for an NTLM server in
+// tests.
+package ntlm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/Azure/go-ntlmssp"
+)
+
+// ChallengeInfo is the domain information disclosed by an NTLM challenge.
+type ChallengeInfo struct {
+	// NetBIOSDomain is the internal domain name (e.g. CORP)
+	NetBIOSDomain string
+
+	// NetBIOSComputer is the name of the server which issued the challenge
+	NetBIOSComputer string
+
+	// DNSDomain is the internal DNS domain (e.g. corp.example.org)
+	DNSDomain string
+
+	// DNSComputer is the FQDN of the server which issued the challenge
+	DNSComputer string
+}
+
+// AV_PAIR identifiers from MS-NLMP 2.2.2.1
+const (
+	avEOL             = 0
+	avNbComputerName  = 1
+	avNbDomainName    = 2
+	avDNSComputerName = 3
+	avDNSDomainName   = 4
+)
+
+const negotiateUnicode = 0x00000001
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// Client returns a copy of c which converts basic authentication to NTLM when
+// the server requests it, as used by the adfs ntlm strategy.
+func Client(c *http.Client) *http.Client {
+	client := *c
+	client.Transport = ntlmssp.Negotiator{RoundTripper: c.Transport}
+	return &client
+}
+
+// Challenge sends an anonymous NTLM negotiate message to url and parses the
+// domain information from the challenge the server responds with. Exchange
+// exposes NTLM on /EWS and /autodiscover even when OWA uses forms login.
+func Challenge(client *http.Client, url string) (*ChallengeInfo, error) {
+	negotiate, err := ntlmssp.NewNegotiateMessage("", "")
+	if err != nil {
+		return nil, err
+	}
+
+	req, _ := http.NewRequest("POST", url, nil)
+	req.Header.Set("Authorization", "NTLM "+base64.StdEncoding.EncodeToString(negotiate))
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint:errcheck
+
+	for _, h := range resp.Header.Values("WWW-Authenticate") {
+		for _, scheme := range []string{"NTLM ", "Negotiate "} {
+			if !strings.HasPrefix(h, scheme) {
+				continue
+			}
+			data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(h, scheme))
+			if err != nil {
+				return nil, fmt.Errorf("error decoding ntlm challenge: %w", err)
+			}
+			return parseChallenge(data)
+		}
+	}
+	return nil, fmt.Errorf("no ntlm challenge from %s (status %d)", url, resp.StatusCode)
+}
+
+// parseChallenge parses the target name and target info fields of an NTLM
+// CHALLENGE_MESSAGE (MS-NLMP 2.2.1.2).
+func parseChallenge(data []byte) (*ChallengeInfo, error) {
+	if len(data) < 48 || !bytes.Equal(data[:8], ntlmSignature) || binary.LittleEndian.Uint32(data[8:]) != 2 {
+		return nil, fmt.Errorf("invalid ntlm challenge message")
+	}
+	flags := binary.LittleEndian.Uint32(data[20:])
+	unicode := flags&negotiateUnicode != 0
+
+	info := &ChallengeInfo{}
+	target, err := field(data, 12)
+	if err != nil {
+		return nil, err
+	}
+	info.NetBIOSDomain = decode(target, unicode)
+
+	avPairs, err := field(data, 40)
+	if err != nil {
+		return nil, err
+	}
+	for len(avPairs) >= 4 {
+		id := binary.LittleEndian.Uint16(avPairs)
+		n := int(binary.LittleEndian.Uint16(avPairs[2:]))
+		if id == avEOL || len(avPairs) < 4+n {
+			break
+		}
+		// AV_PAIR values are always UTF-16LE
+		value := decode(avPairs[4:4+n], true)
+		switch id {
+		case avNbComputerName:
+			info.NetBIOSComputer = value
+		case avNbDomainName:
+			info.NetBIOSDomain = value
+		case avDNSComputerName:
+			info.DNSComputer = value
+		case avDNSDomainName:
+			info.DNSDomain = value
+		}
+		avPairs = avPairs[4+n:]
+	}
+
+	if info.NetBIOSDomain == "" {
+		return nil, fmt.Errorf("ntlm challenge did not include a domain")
+	}
+	return info, nil
+}
+
+// field reads the security buffer (length, max length, offset) at offset i.
+func field(data []byte, i int) ([]byte, error) {
+	n := int(binary.LittleEndian.Uint16(data[i:]))
+	offset := int(binary.LittleEndian.Uint32(data[i+4:]))
+	if offset+n > len(data) {
+		return nil, fmt.Errorf("invalid ntlm challenge field")
+	}
+	return data[offset : offset+n], nil
+}
+
+func decode(b []byte, unicode bool) string {
+	if !unicode {
+		return string(b)
+	}
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(u))
+}
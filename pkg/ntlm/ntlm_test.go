@@ -0,0 +1,75 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ntlm
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/Azure/go-ntlmssp"
+)
+
+var testInfo = &ChallengeInfo{
+	NetBIOSDomain:   "CORP",
+	NetBIOSComputer: "EXCH01",
+	DNSDomain:       "corp.example.org",
+	DNSComputer:     "exch01.corp.example.org",
+}
+
+var testServerChallenge = []byte("01234567")
+
+func TestParseChallenge(t *testing.T) {
+	info, err := parseChallenge(NewChallenge(testInfo, testServerChallenge))
+	if err != nil {
+		t.Fatalf("error parsing challenge: %s", err)
+	}
+	if *info != *testInfo {
+		t.Errorf("parsed %+v, expected %+v", info, testInfo)
+	}
+
+	_, err = parseChallenge([]byte("NTLMSSP\x00"))
+	if err == nil {
+		t.Errorf("expected error for truncated challenge")
+	}
+
+	msg := NewChallenge(testInfo, testServerChallenge)
+	binary.LittleEndian.PutUint32(msg[44:], 4096)
+	_, err = parseChallenge(msg)
+	if err == nil {
+		t.Errorf("expected error for out of range target info")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	challenge := NewChallenge(testInfo, testServerChallenge)
+	data, err := ntlmssp.ProcessChallenge(challenge, "alice", "Password1!")
+	if err != nil {
+		t.Fatalf("error processing challenge: %s", err)
+	}
+
+	auth, err := ParseAuthenticate(data)
+	if err != nil {
+		t.Fatalf("error parsing authenticate message: %s", err)
+	}
+	if auth.User != "alice" {
+		t.Errorf("user was %q, expected alice", auth.User)
+	}
+	if !auth.Verify(testServerChallenge, "CORP", "Password1!") {
+		t.Errorf("expected valid ntlm response")
+	}
+	if auth.Verify(testServerChallenge, "CORP", "Invalid1!") {
+		t.Errorf("expected invalid ntlm response")
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ntlm
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5" // nolint:gosec
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4" // nolint:staticcheck
+)
+
+// NewChallenge builds a CHALLENGE_MESSAGE for the provided domain information
+// and 8 byte server challenge. It is used by servers which stand in for
+// Exchange or ADFS.
+func NewChallenge(info *ChallengeInfo, serverChallenge []byte) []byte {
+	target := encode(info.NetBIOSDomain)
+
+	var avPairs bytes.Buffer
+	for _, av := range []struct {
+		id    uint16
+		value string
+	}{
+		{avNbDomainName, info.NetBIOSDomain},
+		{avNbComputerName, info.NetBIOSComputer},
+		{avDNSDomainName, info.DNSDomain},
+		{avDNSComputerName, info.DNSComputer},
+	} {
+		if av.value == "" {
+			continue
+		}
+		v := encode(av.value)
+		binary.Write(&avPairs, binary.LittleEndian, av.id)          // nolint:errcheck,gosec
+		binary.Write(&avPairs, binary.LittleEndian, uint16(len(v))) // nolint:errcheck,gosec
+		avPairs.Write(v)
+	}
+	avPairs.Write([]byte{0, 0, 0, 0})
+
+	// NTLMSSP_NEGOTIATE_UNICODE | NTLMSSP_NEGOTIATE_NTLM |
+	// NTLMSSP_NEGOTIATE_TARGET_INFO
+	flags := uint32(negotiateUnicode | 0x00000200 | 0x00800000)
+
+	msg := make([]byte, 48)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 2)
+	putField(msg[12:], len(target), 48)
+	binary.LittleEndian.PutUint32(msg[20:], flags)
+	copy(msg[24:32], serverChallenge)
+	putField(msg[40:], avPairs.Len(), 48+len(target))
+	return append(append(msg, target...), avPairs.Bytes()...)
+}
+
+// Authenticate is the subset of an AUTHENTICATE_MESSAGE needed to verify an
+// NTLMv2 response.
+type Authenticate struct {
+	Domain     string
+	User       string
+	NTResponse []byte
+}
+
+// ParseAuthenticate parses an AUTHENTICATE_MESSAGE (MS-NLMP 2.2.1.3).
+func ParseAuthenticate(data []byte) (*Authenticate, error) {
+	if len(data) < 64 || !bytes.Equal(data[:8], ntlmSignature) || binary.LittleEndian.Uint32(data[8:]) != 3 {
+		return nil, fmt.Errorf("invalid ntlm authenticate message")
+	}
+	unicode := binary.LittleEndian.Uint32(data[60:])&negotiateUnicode != 0
+
+	nt, err := field(data, 20)
+	if err != nil {
+		return nil, err
+	}
+	domain, err := field(data, 28)
+	if err != nil {
+		return nil, err
+	}
+	user, err := field(data, 36)
+	if err != nil {
+		return nil, err
+	}
+	return &Authenticate{
+		Domain:     decode(domain, unicode),
+		User:       decode(user, unicode),
+		NTResponse: nt,
+	}, nil
+}
+
+// Verify checks the NTLMv2 response against the password. target is the
+// target name the server sent in its challenge.
+func (a *Authenticate) Verify(serverChallenge []byte, target, password string) bool {
+	if len(a.NTResponse) <= 16 {
+		return false
+	}
+
+	h := md4.New()
+	h.Write(encode(password)) // nolint:errcheck,gosec
+	key := hmacMD5(h.Sum(nil), encode(strings.ToUpper(a.User)+target))
+
+	blob := a.NTResponse[16:]
+	proof := hmacMD5(key, serverChallenge, blob)
+	return hmac.Equal(proof, a.NTResponse[:16])
+}
+
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(md5.New, key)
+	for _, d := range data {
+		mac.Write(d) // nolint:errcheck,gosec
+	}
+	return mac.Sum(nil)
+}
+
+func putField(b []byte, n, offset int) {
+	binary.LittleEndian.PutUint16(b, uint16(n))
+	binary.LittleEndian.PutUint16(b[2:], uint16(n))
+	binary.LittleEndian.PutUint32(b[4:], uint32(offset))
+}
+
+func encode(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, r := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], r)
+	}
+	return b
+}
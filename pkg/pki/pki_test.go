@@ -0,0 +1,125 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pki
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// mint writes a CA and a certificate of each usage to dir.
+func mint(t *testing.T, dir, prefix string) {
+	ca, err := NewCA(prefix+" engagement", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ca.Issue("worker-a", []string{"127.0.0.1", "localhost"}, UsageServer, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := ca.Issue("dispatcher", nil, UsageClient, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, kp := range map[string]*KeyPair{"ca": ca, "server": server, "client": client} {
+		err = kp.Write(filepath.Join(dir, prefix+name+".pem"), filepath.Join(dir, prefix+name+"-key.pem"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint:errcheck
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	mint(t, dir, "")
+	mint(t, dir, "other-")
+
+	if info, err := os.Stat(path("ca-key.pem")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("CA key is readable by others: %v", info.Mode())
+	}
+	if _, err := Load(path("ca.pem"), path("ca-key.pem")); err != nil {
+		t.Errorf("error loading CA: %s", err)
+	}
+
+	serverConfig, err := ServerConfig(path("server.pem"), path("server-key.pem"), path("ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = serverConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	var testcases = []struct {
+		desc              string
+		cert, key, ca     string
+		expectedToConnect bool
+	}{
+		{"engagement client", "client.pem", "client-key.pem", "ca.pem", true},
+		{"no client certificate", "", "", "ca.pem", false},
+		{"client from another CA", "other-client.pem", "other-client-key.pem", "ca.pem", false},
+		{"server from another CA", "client.pem", "client-key.pem", "other-ca.pem", false},
+		{"server certificate as client", "server.pem", "server-key.pem", "ca.pem", false},
+	}
+	for _, test := range testcases {
+		var cert, key string
+		if test.cert != "" {
+			cert, key = path(test.cert), path(test.key)
+		}
+		config, err := ClientConfig(cert, key, path(test.ca))
+		if err != nil {
+			t.Fatalf("[%s] %s", test.desc, err)
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		resp, err := client.Get(ts.URL)
+		if err == nil {
+			resp.Body.Close() // nolint:errcheck,gosec
+		}
+		if connected := err == nil; connected != test.expectedToConnect {
+			t.Errorf("[%s] connected: %v (%v), expected %v", test.desc, connected, err, test.expectedToConnect)
+		}
+	}
+}
+
+func TestIssue(t *testing.T) {
+	ca, err := NewCA("engagement", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ca.Issue("worker-a", nil, Usage("admin"), time.Hour); err == nil {
+		t.Errorf("expected error for an unknown usage")
+	}
+	kp, err := ca.Issue("worker-a", []string{"worker-a.example.org", "203.0.113.10"}, UsageServer, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kp.Cert.VerifyHostname("203.0.113.10"); err != nil {
+		t.Errorf("certificate is not valid for its IP: %s", err)
+	}
+	if err := kp.Cert.CheckSignatureFrom(ca.Cert); err != nil {
+		t.Errorf("certificate was not signed by the CA: %s", err)
+	}
+}
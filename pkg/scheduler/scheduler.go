@@ -25,6 +25,8 @@ import (
 	"github.com/go-redis/redis/v7"
 
 	"github.com/praetorian-inc/trident/pkg/db"
+	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/seal"
 )
 
 const (
@@ -45,10 +47,11 @@ type Scheduler interface {
 // PubSubScheduler implements the scheduler interface and produces/consumes to
 // Google Cloud Pub/Sub.
 type PubSubScheduler struct {
-	db    *db.TridentDB
-	cache *redis.Client
-	pub   *pubsub.Topic
-	sub   *pubsub.Subscription
+	db     *db.TridentDB
+	cache  *redis.Client
+	pub    *pubsub.Topic
+	sub    *pubsub.Subscription
+	sealer *seal.Sealer
 }
 
 // Options is used to configure a PubSubScheduler.
@@ -71,6 +74,10 @@ type Options struct {
 
 	// RedisPassword is the Redis password
 	RedisPassword string
+
+	// Sealer encrypts the session artifacts captured for valid results. If
+	// it is nil, artifacts are discarded rather than stored in the clear.
+	Sealer *seal.Sealer
 }
 
 // NewPubSubScheduler creates a PubSubScheduler given the provided Options.
@@ -99,10 +106,11 @@ func NewPubSubScheduler(opts Options) (*PubSubScheduler, error) {
 	}
 
 	return &PubSubScheduler{
-		db:    opts.Database,
-		cache: cache,
-		sub:   sub,
-		pub:   client.Topic(opts.TopicID),
+		db:     opts.Database,
+		cache:  cache,
+		sub:    sub,
+		pub:    client.Topic(opts.TopicID),
+		sealer: opts.Sealer,
 	}, nil
 }
 
@@ -130,7 +138,14 @@ func (s *PubSubScheduler) popTask(task *db.Task, campaignKey string) error {
 // Additionally, this scheduler prefers to schedule credential guesses for a
 // single password at a time, allowing the maximum time to pass before guessing
 // a given username again.
+//
+// Enumeration campaigns do not guess passwords. Instead, a single task is
+// scheduled for each user and the ScheduleInterval separates each user.
 func (s *PubSubScheduler) Schedule(campaign db.Campaign) error {
+	if campaign.Type == db.CampaignTypeEnumeration {
+		return s.scheduleEnumeration(campaign)
+	}
+
 	t := campaign.NotBefore
 	for _, p := range campaign.Passwords {
 		for _, u := range campaign.Users {
@@ -142,6 +157,7 @@ func (s *PubSubScheduler) Schedule(campaign db.Campaign) error {
 				Password:         p,
 				Provider:         campaign.Provider,
 				ProviderMetadata: campaign.ProviderMetadata,
+				Workers:          campaign.Workers,
 			}, campaign.ID)
 			if err != nil {
 				log.Printf("error in redis push task: %s", err)
@@ -155,6 +171,30 @@ func (s *PubSubScheduler) Schedule(campaign db.Campaign) error {
 	return nil
 }
 
+func (s *PubSubScheduler) scheduleEnumeration(campaign db.Campaign) error {
+	t := campaign.NotBefore
+	for _, u := range campaign.Users {
+		err := s.pushCampaignTask(&db.Task{
+			CampaignID:       campaign.ID,
+			Type:             db.CampaignTypeEnumeration,
+			NotBefore:        t,
+			NotAfter:         campaign.NotAfter,
+			Username:         u,
+			Provider:         campaign.Provider,
+			ProviderMetadata: campaign.ProviderMetadata,
+			Workers:          campaign.Workers,
+		}, campaign.ID)
+		if err != nil {
+			log.Printf("error in redis push task: %s", err)
+		}
+		t = t.Add(campaign.ScheduleInterval)
+		if t.After(campaign.NotAfter) {
+			return nil
+		}
+	}
+	return nil
+}
+
 func (s *PubSubScheduler) publishTask(ctx context.Context, task *db.Task) error {
 
 	taskStatus, err := s.db.GetCampaignStatus(task.CampaignID)
@@ -220,12 +260,20 @@ func (s *PubSubScheduler) ProduceTasks() {
 }
 
 // ConsumeResults will stream results from pub/sub and store them in the
-// database. Valid results are written directly to the database and invalid
-// results are batched by the db.StreamingInsertResults function.
+// database. Valid results are written directly to the database, along with
+// their sealed session artifacts, and invalid results are batched by the
+// db.StreamingInsertResults function. Worker statistics reported by
+// dispatchers on the same topic are stored as well.
 func (s *PubSubScheduler) ConsumeResults() error {
 	ctx := context.Background()
 	results := s.db.StreamingInsertResults()
 	return s.sub.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		if msg.Attributes[event.MessageTypeAttribute] == event.MessageTypeWorkerStats {
+			s.storeWorkerStats(msg.Data)
+			msg.Ack()
+			return
+		}
+
 		var res db.Result
 		err := json.Unmarshal(msg.Data, &res)
 		if err != nil {
@@ -234,11 +282,22 @@ func (s *PubSubScheduler) ConsumeResults() error {
 			return
 		}
 
+		// artifacts are not a column of the results table
+		var captured struct {
+			Artifacts *event.Artifacts `json:"artifacts"`
+		}
+		err = json.Unmarshal(msg.Data, &captured)
+		if err != nil {
+			log.Printf("error unmarshaling artifacts: %s", err)
+		}
+
 		if res.Valid {
 			err = s.db.InsertResult(&res)
 			if err != nil {
 				log.Printf("error inserting result into db: %s", err)
 				results <- &res
+			} else if captured.Artifacts != nil {
+				s.storeArtifacts(&res, captured.Artifacts)
 			}
 		} else {
 			results <- &res
@@ -248,3 +307,56 @@ func (s *PubSubScheduler) ConsumeResults() error {
 		msg.Ack()
 	})
 }
+
+// storeArtifacts seals and stores the session artifacts of an inserted result.
+func (s *PubSubScheduler) storeArtifacts(res *db.Result, artifacts *event.Artifacts) {
+	if s.sealer == nil {
+		log.Printf("discarding artifacts for result %d: no artifact key is configured", res.ID)
+		return
+	}
+
+	a := db.Artifact{
+		ResultID:   res.ID,
+		CampaignID: res.CampaignID,
+		Username:   res.Username,
+	}
+	err := a.Seal(s.sealer, artifacts)
+	if err != nil {
+		log.Printf("error sealing artifacts for result %d: %s", res.ID, err)
+		return
+	}
+	err = s.db.InsertArtifact(&a)
+	if err != nil {
+		log.Printf("error inserting artifacts into db: %s", err)
+	}
+}
+
+// storeWorkerStats stores the worker statistics reported by a dispatcher.
+// Malformed reports are logged and dropped.
+func (s *PubSubScheduler) storeWorkerStats(data []byte) {
+	var report event.WorkerStatsReport
+	err := json.Unmarshal(data, &report)
+	if err != nil {
+		log.Printf("error unmarshaling worker stats: %s", err)
+		return
+	}
+
+	for _, w := range report.Workers {
+		err = s.db.SaveWorkerStat(&db.WorkerStat{
+			Dispatcher:  report.Dispatcher,
+			Worker:      w.Worker,
+			ReportedAt:  report.Timestamp,
+			Healthy:     w.Healthy,
+			Ejected:     w.Ejected,
+			Submitted:   w.Submitted,
+			Succeeded:   w.Succeeded,
+			Errors:      w.Errors,
+			RateLimited: w.RateLimited,
+			Ejections:   w.Ejections,
+			LastError:   w.LastError,
+		})
+		if err != nil {
+			log.Printf("error saving worker stats into db: %s", err)
+		}
+	}
+}
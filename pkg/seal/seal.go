@@ -0,0 +1,97 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package seal encrypts sensitive values, such as captured session
+// artifacts, before they are written to the database. Values are sealed with
+// AES-256-GCM and bound to additional data (e.g. the ID of the row they
+// belong to) so a sealed value cannot be moved to another row.
+package seal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// KeySize is the size of a key in bytes.
+const KeySize = 32
+
+// version prefixes every sealed value so the format can change later.
+const version byte = 1
+
+// ErrInvalid is returned when a sealed value cannot be opened, because it was
+// modified, sealed with another key, or sealed with other additional data.
+var ErrInvalid = errors.New("seal: invalid sealed value")
+
+// Sealer seals and opens values with a single key. It is safe for
+// concurrent use.
+type Sealer struct {
+	aead cipher.AEAD
+}
+
+// New returns a Sealer for a KeySize byte key.
+func New(key []byte) (*Sealer, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("seal: key must be %d bytes, got %d", KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Sealer{aead: aead}, nil
+}
+
+// ParseKey returns a Sealer for a base64 encoded key, as generated by
+//
+//	openssl rand -base64 32
+func ParseKey(key string) (*Sealer, error) {
+	data, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("seal: key is not valid base64: %w", err)
+	}
+	return New(data)
+}
+
+// Seal encrypts plaintext and authenticates it with aad.
+func (s *Sealer) Seal(plaintext, aad []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	out := append([]byte{version}, nonce...)
+	return s.aead.Seal(out, nonce, plaintext, aad), nil
+}
+
+// Open decrypts a value sealed with the same aad.
+func (s *Sealer) Open(sealed, aad []byte) ([]byte, error) {
+	n := s.aead.NonceSize()
+	if len(sealed) < 1+n || sealed[0] != version {
+		return nil, ErrInvalid
+	}
+	plaintext, err := s.aead.Open(nil, sealed[1:1+n], sealed[1+n:], aad)
+	if err != nil {
+		return nil, ErrInvalid
+	}
+	return plaintext, nil
+}
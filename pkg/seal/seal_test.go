@@ -0,0 +1,79 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package seal
+
+import (
+	"bytes"
+	"testing"
+)
+
+const testKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+
+func TestSeal(t *testing.T) {
+	s, err := ParseKey(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := []byte(`{"tokens":{"access_token":"eyJ0eXAiOiJKV1QifQ"}}`)
+	sealed, err := s.Seal(secret, []byte("result:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("access_token")) {
+		t.Errorf("sealed value contains the plaintext")
+	}
+
+	opened, err := s.Open(sealed, []byte("result:1"))
+	if err != nil || !bytes.Equal(opened, secret) {
+		t.Errorf("opened %q (%v), expected %q", opened, err, secret)
+	}
+
+	// the same value is sealed differently each time
+	again, _ := s.Seal(secret, []byte("result:1"))
+	if bytes.Equal(again, sealed) {
+		t.Errorf("sealing reused a nonce")
+	}
+
+	other, _ := New(bytes.Repeat([]byte{1}, KeySize))
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-1] ^= 1
+
+	var testcases = []struct {
+		desc   string
+		s      *Sealer
+		sealed []byte
+		aad    string
+	}{
+		{"other aad", s, sealed, "result:2"},
+		{"other key", other, sealed, "result:1"},
+		{"tampered", s, tampered, "result:1"},
+		{"truncated", s, sealed[:10], "result:1"},
+		{"empty", s, nil, "result:1"},
+	}
+	for _, test := range testcases {
+		if _, err := test.s.Open(test.sealed, []byte(test.aad)); err != ErrInvalid {
+			t.Errorf("[%s] open returned %v, expected ErrInvalid", test.desc, err)
+		}
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	for _, key := range []string{"", "not base64!", "c2hvcnQ="} {
+		if _, err := ParseKey(key); err == nil {
+			t.Errorf("expected an error parsing %q", key)
+		}
+	}
+}
@@ -18,19 +18,27 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/jinzhu/gorm"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/praetorian-inc/trident/pkg/auth"
 	"github.com/praetorian-inc/trident/pkg/db"
+	"github.com/praetorian-inc/trident/pkg/event"
 	"github.com/praetorian-inc/trident/pkg/parse"
 	"github.com/praetorian-inc/trident/pkg/scheduler"
+	"github.com/praetorian-inc/trident/pkg/seal"
 )
 
 // Server carries context for the http handlers to work from. it keeps track of
-// the current server's database connection pool and scheduler.
+// the current server's database connection pool and scheduler, and the sealer
+// used to decrypt captured session artifacts.
 type Server struct {
-	DB  db.Datastore
-	Sch scheduler.Scheduler
+	DB     db.Datastore
+	Sch    scheduler.Scheduler
+	Sealer *seal.Sealer
 }
 
 // HealthzHandler is for k8s health checking, this always returns 200
@@ -55,6 +63,17 @@ func (s *Server) CampaignHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	unknown, err := s.unknownWorkers(c.Workers)
+	if err != nil {
+		log.Printf("error querying database: %s", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	if len(unknown) > 0 {
+		http.Error(w, "unknown workers: "+strings.Join(unknown, ", "), http.StatusBadRequest)
+		return
+	}
+
 	err = s.DB.InsertCampaign(&c)
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -75,6 +94,29 @@ func (s *Server) CampaignHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// unknownWorkers returns the names of the workers a campaign is pinned to
+// which are not registered.
+func (s *Server) unknownWorkers(names []string) ([]string, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	workers, err := s.DB.ListWorkers()
+	if err != nil {
+		return nil, err
+	}
+	registered := make(map[string]bool, len(workers))
+	for _, w := range workers {
+		registered[w.Name] = true
+	}
+	var unknown []string
+	for _, name := range names {
+		if !registered[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	return unknown, nil
+}
+
 // ResultsHandler takes a user defined database query (returned fields + filter)
 // and applies it, returning the results in JSON
 func (s *Server) ResultsHandler(w http.ResponseWriter, r *http.Request) {
@@ -127,6 +169,25 @@ func (s *Server) CampaignListHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// WorkerStatsHandler accepts no parameters and returns the latest statistics
+// dispatchers reported for their workers via JSON
+func (s *Server) WorkerStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := s.DB.ListWorkerStats()
+	if err != nil {
+		log.Printf("error querying database: %s", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(&stats)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"results": stats,
+		}).Errorf("error encoding results: %s", err)
+		return
+	}
+}
+
 // CampaignDescribeHandler takes a user-defined DB query with the campaignID, then
 // returns the parameters of that campaign via JSON
 func (s *Server) CampaignDescribeHandler(w http.ResponseWriter, r *http.Request) {
@@ -190,3 +251,228 @@ func (s *Server) StatusUpdateHandler(w http.ResponseWriter, r *http.Request) {
 
 	log.Infof("campaign id=%d status has been set to %s", postBody.ID, postBody.Status)
 }
+
+// ArtifactsRequest selects the session artifacts to return. A reason is
+// required and is recorded in the audit log.
+type ArtifactsRequest struct {
+	CampaignID uint   `json:"campaign_id"`
+	ResultIDs  []uint `json:"result_ids"`
+	Reason     string `json:"reason"`
+}
+
+// ArtifactsResult is the decrypted session artifacts of a single result.
+type ArtifactsResult struct {
+	ResultID   uint             `json:"result_id"`
+	CampaignID uint             `json:"campaign_id"`
+	Username   string           `json:"username"`
+	Artifacts  *event.Artifacts `json:"artifacts"`
+}
+
+// ArtifactsHandler returns the decrypted session artifacts captured for a
+// campaign's valid results. Every request is recorded in the artifact access
+// log, with the requester's identity and reason, before any artifacts are
+// returned; if the access cannot be recorded nothing is returned. Only
+// operators may access artifacts.
+func (s *Server) ArtifactsHandler(w http.ResponseWriter, r *http.Request) {
+	if auth.Role(r.Context()) != auth.RoleOperator {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	var req ArtifactsRequest
+
+	err := parse.DecodeJSONBody(w, r, &req)
+	if err != nil {
+		var mr *parse.MalformedRequest
+		if errors.As(err, &mr) {
+			http.Error(w, mr.Msg, mr.Status)
+		} else {
+			log.Errorf("unknown error decoding json: %s", err)
+			http.Error(w, http.StatusText(500), 500)
+		}
+		return
+	}
+
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.CampaignID == 0 || req.Reason == "" {
+		http.Error(w, "campaign_id and reason are required", http.StatusBadRequest)
+		return
+	}
+	if s.Sealer == nil {
+		http.Error(w, "artifact capture is not configured", http.StatusNotFound)
+		return
+	}
+
+	artifacts, err := s.DB.SelectArtifacts(req.CampaignID, req.ResultIDs)
+	if err != nil {
+		log.Printf("error querying database: %s", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	access := db.ArtifactAccess{
+		Identity:   auth.Identity(r.Context()),
+		RemoteAddr: r.RemoteAddr,
+		Reason:     req.Reason,
+		CampaignID: req.CampaignID,
+		Count:      len(artifacts),
+	}
+	for _, id := range req.ResultIDs {
+		access.ResultIDs = append(access.ResultIDs, int64(id))
+	}
+	err = s.DB.InsertArtifactAccess(&access)
+	if err != nil {
+		log.Errorf("error recording artifact access: %s", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	log.WithFields(log.Fields{
+		"identity":   access.Identity,
+		"remoteAddr": access.RemoteAddr,
+		"reason":     access.Reason,
+		"campaign":   access.CampaignID,
+		"results":    req.ResultIDs,
+		"count":      access.Count,
+	}).Info("session artifacts accessed")
+
+	results := make([]ArtifactsResult, 0, len(artifacts))
+	for _, a := range artifacts {
+		res := ArtifactsResult{
+			ResultID:   a.ResultID,
+			CampaignID: a.CampaignID,
+			Username:   a.Username,
+		}
+		err = a.Open(s.Sealer, &res.Artifacts)
+		if err != nil {
+			log.Errorf("error opening artifacts for result %d: %s", a.ResultID, err)
+			http.Error(w, http.StatusText(500), 500)
+			return
+		}
+		results = append(results, res)
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Add("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(&results)
+	if err != nil {
+		log.Errorf("error encoding artifacts: %s", err)
+		return
+	}
+}
+
+// WorkerHeartbeatHandler registers a worker, or refreshes its registration,
+// from the heartbeat it sends and responds with the state an operator has set
+// for it.
+func (s *Server) WorkerHeartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	var hb event.WorkerHeartbeat
+
+	err := parse.DecodeJSONBody(w, r, &hb)
+	if err != nil {
+		var mr *parse.MalformedRequest
+		if errors.As(err, &mr) {
+			http.Error(w, mr.Msg, mr.Status)
+		} else {
+			log.Errorf("unknown error decoding json: %s", err)
+			http.Error(w, http.StatusText(500), 500)
+		}
+		return
+	}
+
+	if hb.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+
+	worker := db.Worker{
+		Name:     hb.Name,
+		Kind:     hb.Kind,
+		URL:      hb.URL,
+		Version:  hb.Version,
+		Nozzles:  hb.Nozzles,
+		IP:       hb.IP,
+		Load:     hb.Load,
+		LastSeen: time.Now(),
+	}
+	err = s.DB.SaveWorker(&worker)
+	if err != nil {
+		log.Printf("error updating database: %s", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(&event.WorkerHeartbeatResponse{State: worker.State})
+	if err != nil {
+		log.Errorf("error encoding heartbeat response: %s", err)
+		return
+	}
+}
+
+// WorkerListHandler accepts no parameters and returns the registered workers
+// via JSON
+func (s *Server) WorkerListHandler(w http.ResponseWriter, r *http.Request) {
+	workers, err := s.DB.ListWorkers()
+	if err != nil {
+		log.Printf("error querying database: %s", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	for i := range workers {
+		workers[i].Online = time.Since(workers[i].LastSeen) < db.WorkerTimeout
+	}
+
+	err = json.NewEncoder(w).Encode(&workers)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"results": workers,
+		}).Errorf("error encoding results: %s", err)
+		return
+	}
+}
+
+// WorkerStateRequest sets the state of a registered worker.
+type WorkerStateRequest struct {
+	Name  string            `json:"name"`
+	State event.WorkerState `json:"state"`
+}
+
+// WorkerStateHandler sets the state of a registered worker. The worker learns
+// its new state from the response to its next heartbeat.
+func (s *Server) WorkerStateHandler(w http.ResponseWriter, r *http.Request) {
+	var req WorkerStateRequest
+
+	err := parse.DecodeJSONBody(w, r, &req)
+	if err != nil {
+		var mr *parse.MalformedRequest
+		if errors.As(err, &mr) {
+			http.Error(w, mr.Msg, mr.Status)
+		} else {
+			log.Errorf("unknown error decoding json: %s", err)
+			http.Error(w, http.StatusText(500), 500)
+		}
+		return
+	}
+
+	switch req.State {
+	case event.WorkerStateActive, event.WorkerStateDraining, event.WorkerStateDisabled:
+	default:
+		http.Error(w, "state must be active, draining, or disabled", http.StatusBadRequest)
+		return
+	}
+
+	err = s.DB.UpdateWorkerState(req.Name, req.State)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "unknown worker", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("error updating database: %s", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"identity": auth.Identity(r.Context()),
+	}).Infof("worker %s state has been set to %s", req.Name, req.State)
+}
@@ -17,15 +17,27 @@ package server
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
 
+	"github.com/jinzhu/gorm"
+
+	"github.com/praetorian-inc/trident/pkg/auth"
 	"github.com/praetorian-inc/trident/pkg/db"
+	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/seal"
 )
 
-type mockDB struct{}
+type mockDB struct {
+	artifacts []db.Artifact
+	accesses  []db.ArtifactAccess
+	auditErr  error
+	stats     []db.WorkerStat
+	workers   []db.Worker
+}
 
 func (m *mockDB) IsCampaignCancelled(campaignID uint) (bool, error) {
 	//For now, always return false, but maybe we can make this return true for odd campaignIDs
@@ -100,6 +112,65 @@ func (m *mockDB) DescribeCampaign(query db.Query) (db.Campaign, error) {
 
 }
 
+func (m *mockDB) InsertArtifact(a *db.Artifact) error {
+	m.artifacts = append(m.artifacts, *a)
+	return nil
+}
+
+func (m *mockDB) SelectArtifacts(campaignID uint, resultIDs []uint) ([]db.Artifact, error) {
+	var artifacts []db.Artifact
+	for _, a := range m.artifacts {
+		if a.CampaignID == campaignID {
+			artifacts = append(artifacts, a)
+		}
+	}
+	return artifacts, nil
+}
+
+func (m *mockDB) InsertArtifactAccess(a *db.ArtifactAccess) error {
+	if m.auditErr != nil {
+		return m.auditErr
+	}
+	m.accesses = append(m.accesses, *a)
+	return nil
+}
+
+func (m *mockDB) SaveWorkerStat(stat *db.WorkerStat) error {
+	m.stats = append(m.stats, *stat)
+	return nil
+}
+
+func (m *mockDB) ListWorkerStats() ([]db.WorkerStat, error) {
+	return m.stats, nil
+}
+
+func (m *mockDB) SaveWorker(w *db.Worker) error {
+	for i := range m.workers {
+		if m.workers[i].Name == w.Name {
+			w.State = m.workers[i].State
+			m.workers[i] = *w
+			return nil
+		}
+	}
+	w.State = event.WorkerStateActive
+	m.workers = append(m.workers, *w)
+	return nil
+}
+
+func (m *mockDB) ListWorkers() ([]db.Worker, error) {
+	return append([]db.Worker(nil), m.workers...), nil
+}
+
+func (m *mockDB) UpdateWorkerState(name string, state event.WorkerState) error {
+	for i := range m.workers {
+		if m.workers[i].Name == name {
+			m.workers[i].State = state
+			return nil
+		}
+	}
+	return gorm.ErrRecordNotFound
+}
+
 func (m *mockDB) Close() error {
 	return nil
 }
@@ -239,3 +310,189 @@ func TestResultsHandler(t *testing.T) {
 			status, http.StatusOK)
 	}
 }
+
+func TestArtifactsHandler(t *testing.T) {
+	sealer, err := seal.ParseKey("MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mdb := &mockDB{}
+	a := db.Artifact{ResultID: 18, CampaignID: 1, Username: "alice@example.org"}
+	err = a.Seal(sealer, &event.Artifacts{
+		Tokens: map[string]string{"access_token": "eyJ0eXAiOiJKV1QifQ"},
+		MFA:    event.MFAPostureNotEnforced,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mdb.InsertArtifact(&a); err != nil {
+		t.Fatal(err)
+	}
+	s := Server{DB: mdb, Sch: &mockScheduler{}, Sealer: sealer}
+
+	requestAs := func(role, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "/artifacts", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		ctx := auth.WithIdentity(req.Context(), "operator@example.org")
+		req = req.WithContext(auth.WithRole(ctx, role))
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(s.ArtifactsHandler).ServeHTTP(rr, req)
+		return rr
+	}
+	request := func(body string) *httptest.ResponseRecorder {
+		return requestAs(auth.RoleOperator, body)
+	}
+
+	// workers and unauthenticated requests never see artifacts
+	for _, role := range []string{auth.RoleWorker, ""} {
+		rr := requestAs(role, `{"campaign_id":1,"reason":"demonstrate impact"}`)
+		if rr.Code != http.StatusForbidden || len(mdb.accesses) != 0 {
+			t.Errorf("request with role %q returned %d", role, rr.Code)
+		}
+	}
+
+	rr := request(`{"campaign_id":1}`)
+	if rr.Code != http.StatusBadRequest || len(mdb.accesses) != 0 {
+		t.Errorf("request without a reason returned %d", rr.Code)
+	}
+
+	rr = request(`{"campaign_id":1,"reason":"demonstrate impact"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("artifacts response may be cached")
+	}
+	var results []ArtifactsResult
+	if err = json.NewDecoder(rr.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].ResultID != 18 || results[0].Artifacts.Tokens["access_token"] != "eyJ0eXAiOiJKV1QifQ" {
+		t.Errorf("unexpected artifacts %+v", results)
+	}
+	if len(mdb.accesses) != 1 {
+		t.Fatalf("expected one recorded access, got %d", len(mdb.accesses))
+	}
+	if access := mdb.accesses[0]; access.Identity != "operator@example.org" || access.Reason != "demonstrate impact" || access.Count != 1 {
+		t.Errorf("unexpected access record %+v", access)
+	}
+
+	// nothing is returned if the access cannot be audited
+	mdb.auditErr = errors.New("database unavailable")
+	rr = request(`{"campaign_id":1,"reason":"demonstrate impact"}`)
+	if rr.Code != http.StatusInternalServerError || strings.Contains(rr.Body.String(), "eyJ0eXAiOiJKV1QifQ") {
+		t.Errorf("unaudited request returned %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestWorkerStatsHandler(t *testing.T) {
+	mdb := &mockDB{}
+	err := mdb.SaveWorkerStat(&db.WorkerStat{
+		Dispatcher:  "dispatcher-1",
+		Worker:      "worker-a",
+		Healthy:     true,
+		Submitted:   10,
+		Succeeded:   7,
+		RateLimited: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := Server{DB: mdb, Sch: &mockScheduler{}}
+
+	req, err := http.NewRequest("GET", "/workers/stats", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(s.WorkerStatsHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	var stats []db.WorkerStat
+	if err = json.NewDecoder(rr.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0].Worker != "worker-a" || stats[0].RateLimited != 3 {
+		t.Errorf("unexpected worker stats %+v", stats)
+	}
+}
+
+func TestWorkerHandlers(t *testing.T) {
+	mdb := &mockDB{}
+	s := Server{DB: mdb, Sch: &mockScheduler{}}
+
+	request := func(handler http.HandlerFunc, method, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "/workers", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	heartbeat := func() event.WorkerState {
+		rr := request(s.WorkerHeartbeatHandler, "POST",
+			`{"name":"worker-a","kind":"webhook","version":"1.2.0","nozzles":["okta"],"ip":"203.0.113.10","load":2}`)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("heartbeat returned %d", rr.Code)
+		}
+		var res event.WorkerHeartbeatResponse
+		if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		return res.State
+	}
+
+	if rr := request(s.WorkerHeartbeatHandler, "POST", `{"kind":"webhook"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("heartbeat without a name returned %d", rr.Code)
+	}
+	if state := heartbeat(); state != event.WorkerStateActive {
+		t.Errorf("new worker is %s, expected active", state)
+	}
+
+	rr := request(s.WorkerListHandler, "GET", "")
+	var workers []db.Worker
+	if err := json.NewDecoder(rr.Body).Decode(&workers); err != nil {
+		t.Fatal(err)
+	}
+	if len(workers) != 1 || !workers[0].Online || workers[0].IP != "203.0.113.10" || workers[0].Load != 2 {
+		t.Errorf("unexpected workers %+v", workers)
+	}
+
+	// the operator's state is kept across heartbeats
+	if rr := request(s.WorkerStateHandler, "POST", `{"name":"worker-a","state":"draining"}`); rr.Code != http.StatusOK {
+		t.Errorf("state update returned %d", rr.Code)
+	}
+	if state := heartbeat(); state != event.WorkerStateDraining {
+		t.Errorf("drained worker is %s after heartbeat", state)
+	}
+
+	var testcases = []struct {
+		body string
+		code int
+	}{
+		{`{"name":"worker-a","state":"paused"}`, http.StatusBadRequest},
+		{`{"name":"worker-b","state":"disabled"}`, http.StatusNotFound},
+	}
+	for _, test := range testcases {
+		if rr := request(s.WorkerStateHandler, "POST", test.body); rr.Code != test.code {
+			t.Errorf("[%s] returned %d, expected %d", test.body, rr.Code, test.code)
+		}
+	}
+
+	// campaigns may only be pinned to registered workers
+	rr = request(s.CampaignHandler, "POST", `{"provider":"okta","workers":["worker-b"]}`)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("campaign pinned to an unknown worker returned %d", rr.Code)
+	}
+	rr = request(s.CampaignHandler, "POST", `{"provider":"okta","workers":["worker-a"]}`)
+	if rr.Code != http.StatusOK {
+		t.Errorf("campaign pinned to a registered worker returned %d", rr.Code)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/praetorian-inc/trident/pkg/auth/signing"
+)
+
+// Verifier returns a middleware which authenticates requests from
+// dispatchers. If verifier is set, signed requests are verified with it and
+// unsigned requests must carry the access token, unless token is empty, in
+// which case they are rejected. Without a verifier every request must carry
+// the access token in the X-Access-Token header.
+func Verifier(verifier *signing.Verifier, token []byte) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if verifier != nil {
+				if signing.Signed(r) {
+					err := verifier.Verify(r)
+					if err != nil {
+						log.Warnf("rejected request from %s: %s", r.RemoteAddr, err)
+						http.Error(w, http.StatusText(403), 403)
+						return
+					}
+					next.ServeHTTP(w, r)
+					return
+				}
+				if len(token) == 0 {
+					http.Error(w, http.StatusText(403), 403)
+					return
+				}
+			}
+
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Access-Token")), token) == 0 {
+				http.Error(w, http.StatusText(403), 403)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/praetorian-inc/trident/pkg/auth/signing"
+	"github.com/praetorian-inc/trident/pkg/dispatch"
+	dispatchwebhook "github.com/praetorian-inc/trident/pkg/dispatch/clients/webhook"
+	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/pki"
+)
+
+const testKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+
+func TestVerifier(t *testing.T) {
+	keys, err := signing.ParseKeys(map[string]string{"k1": testKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Name: "worker-a", ip: "203.0.113.10", state: event.WorkerStateActive}
+
+	// requests sent by the worker, so they can be replayed
+	var captured []*http.Request
+	var bodies [][]byte
+
+	newWorker := func(verifier *signing.Verifier, token string) *httptest.Server {
+		h := Verifier(verifier, []byte(token))(http.HandlerFunc(s.EventHandler))
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			captured = append(captured, r.Clone(r.Context()))
+			bodies = append(bodies, body)
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			h.ServeHTTP(w, r)
+		}))
+	}
+	submit := func(url string, opts map[string]string) error {
+		opts["url"] = url
+		wc, err := dispatch.Open("webhook", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = wc.Submit(event.AuthRequest{Username: "alice", Password: "Password1!", Provider: "webhook-test"})
+		return err
+	}
+
+	signed := newWorker(signing.NewVerifier(keys, 0), "")
+	defer signed.Close()
+	if err := submit(signed.URL, map[string]string{"key-id": "k1", "key": testKey}); err != nil {
+		t.Errorf("signed request failed: %s", err)
+	}
+	if captured[0].Header.Get("X-Access-Token") != "" {
+		t.Errorf("signed request sent the access token")
+	}
+	if err := submit(signed.URL, map[string]string{"token": "s3cret"}); err == nil {
+		t.Errorf("unsigned request was accepted without a fallback token")
+	}
+
+	// a captured request cannot be replayed
+	replay, err := http.NewRequest("POST", signed.URL, bytes.NewReader(bodies[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replay.Header = captured[0].Header
+	resp, err := http.DefaultClient.Do(replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close() // nolint:errcheck,gosec
+	if resp.StatusCode != 403 {
+		t.Errorf("replayed request returned %d", resp.StatusCode)
+	}
+
+	// the access token is still accepted as a fallback when configured
+	fallback := newWorker(signing.NewVerifier(keys, 0), "s3cret")
+	defer fallback.Close()
+	if err := submit(fallback.URL, map[string]string{"token": "s3cret"}); err != nil {
+		t.Errorf("fallback token request failed: %s", err)
+	}
+	if err := submit(fallback.URL, map[string]string{"token": "guess"}); err == nil {
+		t.Errorf("wrong token was accepted")
+	}
+	if err := submit(fallback.URL, map[string]string{"key-id": "k2", "key": testKey}); err == nil {
+		t.Errorf("request signed with an unknown key was accepted")
+	}
+
+	// without signing keys only the access token is accepted
+	legacy := newWorker(nil, "s3cret")
+	defer legacy.Close()
+	if err := submit(legacy.URL, map[string]string{"token": "s3cret"}); err != nil {
+		t.Errorf("token request failed: %s", err)
+	}
+	if err := submit(legacy.URL, map[string]string{"key-id": "k1", "key": testKey}); err == nil {
+		t.Errorf("signed request was accepted by a worker without keys")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint:errcheck
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	ca, err := pki.NewCA("engagement", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued := map[string]pki.Usage{"worker": pki.UsageServer, "dispatcher": pki.UsageClient}
+	for name, usage := range issued {
+		kp, err := ca.Issue(name, []string{"127.0.0.1"}, usage, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := kp.Write(path(name+".pem"), path(name+"-key.pem")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ca.Write(path("ca.pem"), path("ca-key.pem")); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{Name: "worker-a", ip: "203.0.113.10", state: event.WorkerStateActive}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.HealthzHandler)
+	mux.HandleFunc("/", s.EventHandler)
+	ts := httptest.NewUnstartedServer(Verifier(nil, []byte("s3cret"))(mux))
+	ts.TLS, err = pki.ServerConfig(path("worker.pem"), path("worker-key.pem"), path("ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	var testcases = []struct {
+		desc              string
+		opts              map[string]string
+		expectedToConnect bool
+	}{
+		{"client certificate", map[string]string{"tls-cert": path("dispatcher.pem"), "tls-key": path("dispatcher-key.pem"), "tls-ca": path("ca.pem")}, true},
+		{"no client certificate", map[string]string{"tls-ca": path("ca.pem")}, false},
+		{"untrusted worker", map[string]string{"tls-cert": path("dispatcher.pem"), "tls-key": path("dispatcher-key.pem")}, false},
+	}
+	for _, test := range testcases {
+		test.opts["url"] = ts.URL + "/"
+		test.opts["token"] = "s3cret"
+		wc, err := dispatch.Open("webhook", test.opts)
+		if err != nil {
+			t.Fatalf("[%s] %s", test.desc, err)
+		}
+		_, err = wc.Submit(event.AuthRequest{Username: "alice", Password: "Password1!", Provider: "webhook-test"})
+		if connected := err == nil; connected != test.expectedToConnect {
+			t.Errorf("[%s] submitted: %v (%v), expected %v", test.desc, connected, err, test.expectedToConnect)
+		}
+		err = wc.(*dispatchwebhook.Client).Healthz(context.Background())
+		if connected := err == nil; connected != test.expectedToConnect {
+			t.Errorf("[%s] health check: %v (%v), expected %v", test.desc, connected, err, test.expectedToConnect)
+		}
+	}
+
+	if _, err := dispatch.Open("webhook", map[string]string{"url": ts.URL, "token": "s3cret", "tls-cert": path("dispatcher.pem")}); err == nil {
+		t.Errorf("expected error for a client certificate without a key")
+	}
+}
@@ -15,21 +15,44 @@
 package webhook
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/praetorian-inc/trident/pkg/event"
-	"github.com/praetorian-inc/trident/pkg/nozzle"
 	"github.com/praetorian-inc/trident/pkg/util"
+	"github.com/praetorian-inc/trident/pkg/worker"
 )
 
+// MaxBatchSize is the maximum number of tasks accepted in a batch.
+const MaxBatchSize = 100
+
+// DefaultBatchConcurrency is the number of tasks of a batch performed at once
+// unless configured otherwise.
+const DefaultBatchConcurrency = 10
+
 // Server implements an HTTP server handler for handling tasks.
 type Server struct {
+	// Name identifies the worker when it registers with the orchestrator and
+	// when campaigns are pinned to workers
+	Name string
+
+	// BatchConcurrency is the number of tasks of a batch performed at once
+	BatchConcurrency int
+
 	ip string
+
+	// load is the number of tasks being performed
+	load int32
+
+	mu    sync.RWMutex
+	state event.WorkerState
 }
 
 // NewWebhookServer creates a new Server.
@@ -39,49 +62,155 @@ func NewWebhookServer() (*Server, error) {
 		log.Fatal(err)
 	}
 	return &Server{
-		ip: externalIP,
+		BatchConcurrency: DefaultBatchConcurrency,
+		ip:               externalIP,
+		state:            event.WorkerStateActive,
 	}, nil
 }
 
-// HealthzHandler returns an HTTP 200 ok always.
-func (s *Server) HealthzHandler(w http.ResponseWriter, r *http.Request) {}
+// State returns the state the operator has set for the worker.
+func (s *Server) State() event.WorkerState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.state
+}
+
+// SetState sets the state of the worker.
+func (s *Server) SetState(state event.WorkerState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state != s.state {
+		log.Infof("worker state has been set to %s", state)
+	}
+	s.state = state
+}
+
+// HealthzHandler returns an HTTP 200 ok while the worker is active, and a 503
+// once it is draining or disabled so it is no longer chosen for tasks.
+func (s *Server) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	if state := s.State(); state != event.WorkerStateActive {
+		http.Error(w, string(state), http.StatusServiceUnavailable)
+	}
+}
 
-func httperr(w http.ResponseWriter, err error) {
+func httperr(w http.ResponseWriter, code int, err error) {
 	res := event.ErrorResponse{ErrorMsg: err.Error()}
-	w.WriteHeader(500)
+	w.WriteHeader(code)
 	json.NewEncoder(w).Encode(&res) // nolint:errcheck,gosec
 }
 
 // EventHandler accepts an AuthRequest, executes the task using the nozzle
-// interface and returns the AuthResponse via JSON.
+// interface and returns the AuthResponse via JSON. Enumeration tasks are
+// executed with the nozzle's optional Enumerator interface. Tasks are refused
+// when the worker is disabled or the task is pinned to other workers.
 func (s *Server) EventHandler(w http.ResponseWriter, r *http.Request) {
 	var req event.AuthRequest
 
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
-		httperr(w, fmt.Errorf("error decoding body: %w", err))
+		httperr(w, 500, fmt.Errorf("error decoding body: %w", err))
 		return
 	}
 
-	noz, err := nozzle.Open(req.Provider, req.ProviderMetadata)
+	if s.State() == event.WorkerStateDisabled {
+		httperr(w, http.StatusServiceUnavailable, fmt.Errorf("worker %s is disabled", s.Name))
+		return
+	}
+	if !req.Allows(s.Name) {
+		httperr(w, http.StatusConflict, fmt.Errorf("task is not pinned to worker %s", s.Name))
+		return
+	}
+
+	atomic.AddInt32(&s.load, 1)
+	defer atomic.AddInt32(&s.load, -1)
+
+	res, err := worker.Execute(r.Context(), req, s.ip)
 	if err != nil {
-		httperr(w, fmt.Errorf("error opening nozzle: %w", err))
+		httperr(w, 500, err)
 		return
 	}
 
-	ts := time.Now()
-	res, err := noz.Login(req.Username, req.Password)
+	json.NewEncoder(w).Encode(&res) // nolint:errcheck,gosec
+}
+
+// BatchHandler accepts an array of AuthRequests and returns a BatchResult for
+// each in the same order. Up to BatchConcurrency tasks are performed at once,
+// each once its NotBefore time has passed, and tasks are not performed after
+// their NotAfter time. Tasks which are pinned to other workers, or which are
+// not due before the request is cancelled, are skipped so the dispatcher can
+// redeliver them.
+func (s *Server) BatchHandler(w http.ResponseWriter, r *http.Request) {
+	var reqs []event.AuthRequest
+
+	err := json.NewDecoder(r.Body).Decode(&reqs)
 	if err != nil {
-		httperr(w, fmt.Errorf("error authenticating to %s provider: %w", req.Provider, err))
+		httperr(w, 500, fmt.Errorf("error decoding body: %w", err))
+		return
+	}
+	if len(reqs) > MaxBatchSize {
+		httperr(w, http.StatusRequestEntityTooLarge,
+			fmt.Errorf("batch of %d tasks exceeds the maximum of %d", len(reqs), MaxBatchSize))
 		return
 	}
 
-	// fill in generic AuthResult values
-	res.CampaignID = req.CampaignID
-	res.Username = req.Username
-	res.Password = req.Password
-	res.Timestamp = ts
-	res.IP = s.ip
+	if s.State() == event.WorkerStateDisabled {
+		httperr(w, http.StatusServiceUnavailable, fmt.Errorf("worker %s is disabled", s.Name))
+		return
+	}
 
-	json.NewEncoder(w).Encode(&res) // nolint:errcheck,gosec
+	concurrency := s.BatchConcurrency
+	if concurrency < 1 {
+		concurrency = DefaultBatchConcurrency
+	}
+	sem := make(chan struct{}, concurrency)
+
+	atomic.AddInt32(&s.load, int32(len(reqs)))
+	results := make([]event.BatchResult, len(reqs))
+	var wg sync.WaitGroup
+	for i, req := range reqs {
+		wg.Add(1)
+		go func(i int, req event.AuthRequest) {
+			defer wg.Done()
+			defer atomic.AddInt32(&s.load, -1)
+			results[i] = s.executeBatched(r.Context(), req, sem)
+		}(i, req)
+	}
+	wg.Wait()
+
+	json.NewEncoder(w).Encode(&results) // nolint:errcheck,gosec
+}
+
+// executeBatched performs a task of a batch once it is due, while holding a
+// slot of sem.
+func (s *Server) executeBatched(ctx context.Context, req event.AuthRequest, sem chan struct{}) event.BatchResult {
+	if !req.Allows(s.Name) {
+		return event.BatchResult{Error: fmt.Sprintf("task is not pinned to worker %s", s.Name), Skipped: true}
+	}
+
+	if d := time.Until(req.NotBefore); d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return event.BatchResult{Error: ctx.Err().Error(), Skipped: true}
+		}
+	}
+
+	select {
+	case sem <- struct{}{}:
+	case <-ctx.Done():
+		return event.BatchResult{Error: ctx.Err().Error(), Skipped: true}
+	}
+	defer func() { <-sem }()
+
+	if !req.NotAfter.IsZero() && time.Now().After(req.NotAfter) {
+		return event.BatchResult{Error: "task expired before it was performed"}
+	}
+
+	res, err := worker.Execute(ctx, req, s.ip)
+	if err != nil {
+		return event.BatchResult{Error: err.Error()}
+	}
+	return event.BatchResult{Response: res}
 }
@@ -0,0 +1,271 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/praetorian-inc/trident/pkg/dispatch"
+	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+)
+
+type testDriver struct{}
+
+func (testDriver) New(opts map[string]string) (nozzle.Nozzle, error) {
+	return testNozzle{}, nil
+}
+
+type testNozzle struct{}
+
+func (testNozzle) Login(username, password string) (*event.AuthResponse, error) {
+	return &event.AuthResponse{Valid: password == "Password1!"}, nil
+}
+
+// slowNozzle records the most logins it performed at once.
+type slowNozzle struct{}
+
+var running, maxRunning int32
+
+func (slowNozzle) New(opts map[string]string) (nozzle.Nozzle, error) {
+	return slowNozzle{}, nil
+}
+
+func (slowNozzle) Login(username, password string) (*event.AuthResponse, error) {
+	n := atomic.AddInt32(&running, 1)
+	defer atomic.AddInt32(&running, -1)
+	for {
+		max := atomic.LoadInt32(&maxRunning)
+		if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	return &event.AuthResponse{}, nil
+}
+
+func init() {
+	nozzle.Register("webhook-test", testDriver{})
+	nozzle.Register("webhook-slow", slowNozzle{})
+}
+
+func TestEventHandler(t *testing.T) {
+	s := &Server{Name: "worker-a", ip: "203.0.113.10", state: event.WorkerStateActive}
+
+	submit := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		s.EventHandler(rr, req)
+		return rr
+	}
+
+	var testcases = []struct {
+		desc  string
+		state event.WorkerState
+		body  string
+		code  int
+	}{
+		{"active", event.WorkerStateActive, `{"username":"alice","password":"Password1!","provider":"webhook-test"}`, 200},
+		{"pinned", event.WorkerStateActive, `{"username":"alice","provider":"webhook-test","workers":["worker-a"]}`, 200},
+		{"pinned elsewhere", event.WorkerStateActive, `{"username":"alice","provider":"webhook-test","workers":["worker-b"]}`, http.StatusConflict},
+		{"draining", event.WorkerStateDraining, `{"username":"alice","provider":"webhook-test"}`, 200},
+		{"disabled", event.WorkerStateDisabled, `{"username":"alice","provider":"webhook-test"}`, http.StatusServiceUnavailable},
+	}
+	for _, test := range testcases {
+		s.SetState(test.state)
+		if rr := submit(test.body); rr.Code != test.code {
+			t.Errorf("[%s] returned %d, expected %d: %s", test.desc, rr.Code, test.code, rr.Body.String())
+		}
+
+		rr := httptest.NewRecorder()
+		s.HealthzHandler(rr, httptest.NewRequest("GET", "/healthz", nil))
+		if healthy := rr.Code == 200; healthy != (test.state == event.WorkerStateActive) {
+			t.Errorf("[%s] health check returned %d", test.desc, rr.Code)
+		}
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	heartbeats := make(chan event.WorkerHeartbeat, 1)
+	orchestrator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/workers/heartbeat" {
+			http.NotFound(w, r)
+			return
+		}
+		var hb event.WorkerHeartbeat
+		if err := json.NewDecoder(r.Body).Decode(&hb); err != nil {
+			t.Errorf("error decoding heartbeat: %s", err)
+		}
+		heartbeats <- hb
+		json.NewEncoder(w).Encode(&event.WorkerHeartbeatResponse{State: event.WorkerStateDraining}) // nolint:errcheck,gosec
+	}))
+	defer orchestrator.Close()
+
+	s := &Server{Name: "worker-a", ip: "203.0.113.10", state: event.WorkerStateActive}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Heartbeat(ctx, HeartbeatOptions{
+		OrchestratorURL: orchestrator.URL,
+		URL:             "https://worker-a.example.org/",
+		Version:         "1.2.0",
+		Interval:        time.Hour,
+	})
+
+	hb := <-heartbeats
+	if hb.Name != "worker-a" || hb.Kind != "webhook" || hb.IP != "203.0.113.10" || hb.Version != "1.2.0" {
+		t.Errorf("unexpected heartbeat %+v", hb)
+	}
+	found := false
+	for _, n := range hb.Nozzles {
+		found = found || n == "webhook-test"
+	}
+	if !found {
+		t.Errorf("heartbeat nozzles %v do not include webhook-test", hb.Nozzles)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for s.State() != event.WorkerStateDraining && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if s.State() != event.WorkerStateDraining {
+		t.Errorf("worker state was not updated from the heartbeat response")
+	}
+}
+
+func TestBatchHandler(t *testing.T) {
+	s := &Server{Name: "worker-a", BatchConcurrency: 2, ip: "203.0.113.10", state: event.WorkerStateActive}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/batch", s.BatchHandler)
+	ts := httptest.NewServer(Verifier(nil, []byte("s3cret"))(mux))
+	defer ts.Close()
+
+	wc, err := dispatch.Open("webhook", map[string]string{"url": ts.URL + "/", "token": "s3cret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := wc.(dispatch.BatchSubmitter)
+
+	now := time.Now()
+	due := now.Add(100 * time.Millisecond)
+	reqs := []event.AuthRequest{
+		{Username: "alice", Password: "Password1!", Provider: "webhook-test", NotAfter: now.Add(time.Hour)},
+		{Username: "bob", Password: "guess", Provider: "webhook-test", NotAfter: now.Add(time.Hour)},
+		{Username: "carol", Provider: "webhook-test", NotAfter: now.Add(time.Hour), Workers: []string{"worker-b"}},
+		{Username: "dave", Provider: "webhook-test", NotAfter: now.Add(-time.Minute)},
+		{Username: "erin", Provider: "webhook-test", NotBefore: due, NotAfter: now.Add(time.Hour)},
+		{Username: "frank", Provider: "unknown", NotAfter: now.Add(time.Hour)},
+	}
+	results := bs.SubmitBatch(reqs)
+	if len(results) != len(reqs) {
+		t.Fatalf("returned %d results for %d tasks", len(results), len(reqs))
+	}
+
+	var testcases = []struct {
+		desc          string
+		expectedValid bool
+		expectedError bool
+	}{
+		{"valid", true, false},
+		{"invalid", false, false},
+		{"pinned elsewhere", false, true},
+		{"expired", false, true},
+		{"not before", false, false},
+		{"unknown provider", false, true},
+	}
+	if !errors.Is(results[2].Err, dispatch.ErrUnavailable) {
+		t.Errorf("expected ErrUnavailable for a task pinned to another worker, got %v", results[2].Err)
+	}
+	for i, test := range testcases {
+		res := results[i]
+		if (res.Err != nil) != test.expectedError {
+			t.Errorf("[%s] error: %v, expected error: %v", test.desc, res.Err, test.expectedError)
+			continue
+		}
+		if res.Err != nil {
+			continue
+		}
+		if res.Response.Username != reqs[i].Username || res.Response.Valid != test.expectedValid {
+			t.Errorf("[%s] unexpected response %+v", test.desc, res.Response)
+		}
+	}
+	if res := results[4].Response; res != nil && res.Timestamp.Before(due) {
+		t.Errorf("task was performed at %s, before its NotBefore time %s", res.Timestamp, due)
+	}
+
+	// concurrency is bounded
+	var slow []event.AuthRequest
+	for i := 0; i < 6; i++ {
+		slow = append(slow, event.AuthRequest{Username: fmt.Sprintf("user%d", i), Provider: "webhook-slow", NotAfter: now.Add(time.Hour)})
+	}
+	for _, res := range bs.SubmitBatch(slow) {
+		if res.Err != nil {
+			t.Errorf("error in slow task: %s", res.Err)
+		}
+	}
+	if max := atomic.LoadInt32(&maxRunning); max != 2 {
+		t.Errorf("performed %d tasks at once, expected 2", max)
+	}
+
+	// tasks which are not due before the request times out are skipped, and
+	// redelivered by the dispatcher
+	short := httptest.NewServer(Verifier(nil, []byte("s3cret"))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), 50*time.Millisecond)
+		defer cancel()
+		s.BatchHandler(w, r.WithContext(ctx))
+	})))
+	defer short.Close()
+	wc, err = dispatch.Open("webhook", map[string]string{"url": short.URL + "/", "token": "s3cret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := event.AuthRequest{Username: "alice", Provider: "webhook-test", NotBefore: now.Add(time.Hour), NotAfter: now.Add(2 * time.Hour)}
+	if res := wc.(dispatch.BatchSubmitter).SubmitBatch([]event.AuthRequest{later}); !errors.Is(res[0].Err, dispatch.ErrUnavailable) {
+		t.Errorf("expected ErrUnavailable for a skipped task, got %v", res[0].Err)
+	}
+
+	// a disabled worker refuses the whole batch, which is redelivered
+	s.SetState(event.WorkerStateDisabled)
+	for _, res := range bs.SubmitBatch(reqs[:2]) {
+		if !errors.Is(res.Err, dispatch.ErrUnavailable) {
+			t.Errorf("expected ErrUnavailable from a disabled worker, got %v", res.Err)
+		}
+	}
+	s.SetState(event.WorkerStateActive)
+
+	// the worker rejects large batches, which the client splits
+	big := make([]event.AuthRequest, MaxBatchSize+1)
+	for i := range big {
+		big[i] = event.AuthRequest{Username: fmt.Sprintf("user%d", i), Provider: "webhook-test", NotAfter: now.Add(time.Hour)}
+	}
+	body, _ := json.Marshal(big)
+	rr := httptest.NewRecorder()
+	s.BatchHandler(rr, httptest.NewRequest("POST", "/batch", strings.NewReader(string(body))))
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("batch of %d tasks returned %d", len(big), rr.Code)
+	}
+	results = bs.SubmitBatch(big)
+	if len(results) != len(big) || results[MaxBatchSize].Err != nil || results[MaxBatchSize].Response.Username != big[MaxBatchSize].Username {
+		t.Errorf("large batch was not split: %d results", len(results))
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/praetorian-inc/trident/pkg/auth"
+	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+)
+
+// HeartbeatOptions configures how a Server registers with the orchestrator.
+type HeartbeatOptions struct {
+	// OrchestratorURL is the base URL of the orchestrator
+	OrchestratorURL string
+
+	// Authenticator authenticates heartbeats to the orchestrator
+	Authenticator auth.Authenticator
+
+	// URL is where dispatchers reach the worker, if it is known
+	URL string
+
+	// Version is the version of the worker
+	Version string
+
+	// Interval is the time between heartbeats
+	Interval time.Duration
+}
+
+// Heartbeat registers the worker with the orchestrator and then sends a
+// heartbeat each interval until ctx is done. The worker's state is updated
+// from each response; if a heartbeat fails the last known state is kept.
+func (s *Server) Heartbeat(ctx context.Context, opts HeartbeatOptions) {
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+	for {
+		err := s.heartbeat(ctx, opts)
+		if err != nil {
+			log.Warnf("error sending heartbeat: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// heartbeat sends a single heartbeat to the orchestrator.
+func (s *Server) heartbeat(ctx context.Context, opts HeartbeatOptions) error {
+	data, _ := json.Marshal(&event.WorkerHeartbeat{
+		Name:    s.Name,
+		Kind:    "webhook",
+		URL:     opts.URL,
+		Version: opts.Version,
+		Nozzles: nozzle.Drivers(),
+		IP:      s.ip,
+		Load:    int(atomic.LoadInt32(&s.load)),
+	})
+	req, err := http.NewRequestWithContext(ctx, "POST", opts.OrchestratorURL+"/workers/heartbeat", bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if opts.Authenticator != nil {
+		err = opts.Authenticator.Auth(req)
+		if err != nil {
+			return err
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint:errcheck
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("orchestrator returned %d", resp.StatusCode)
+	}
+
+	var res event.WorkerHeartbeatResponse
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return err
+	}
+	if res.State != "" {
+		s.SetState(res.State)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+// Copyright 2020 Praetorian Security, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package worker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/praetorian-inc/trident/pkg/event"
+	"github.com/praetorian-inc/trident/pkg/nozzle"
+)
+
+// Execute opens the nozzle for a task, performs it, and fills in the generic
+// AuthResponse values, reporting ip as the originating IP of the guess.
+// Enumeration tasks are executed with the nozzle's optional Enumerator
+// interface, and credential guesses are cancelled with ctx if the nozzle
+// supports it.
+func Execute(ctx context.Context, req event.AuthRequest, ip string) (*event.AuthResponse, error) {
+	noz, err := nozzle.Open(req.Provider, req.ProviderMetadata)
+	if err != nil {
+		return nil, fmt.Errorf("error opening nozzle: %w", err)
+	}
+
+	ts := time.Now()
+	var res *event.AuthResponse
+	if req.Type == event.TaskTypeEnumeration {
+		res, err = nozzle.CheckUser(noz, req.Username)
+	} else {
+		res, err = nozzle.LoginContext(ctx, noz, req.Username, req.Password)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error authenticating to %s provider: %w", req.Provider, err)
+	}
+
+	// fill in generic AuthResult values
+	res.CampaignID = req.CampaignID
+	res.Username = req.Username
+	res.Password = req.Password
+	res.Timestamp = ts
+	res.IP = ip
+
+	return res, nil
+}
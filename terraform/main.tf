@@ -142,8 +142,9 @@ module "dispatcher" {
   pubsub_topic        = module.pubsub.pubsub_topic_results
   pubsub_subscription = module.pubsub.pubsub_subscription_credentials
 
-  worker_url   = module.worker.endpoint
-  worker_token = module.worker.token
+  worker_url    = module.worker.endpoint
+  worker_key_id = module.worker.key_id
+  worker_key    = module.worker.key
 
   image = var.dispatcher_image
 
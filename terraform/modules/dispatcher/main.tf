@@ -30,8 +30,9 @@ locals {
   }
 
   worker_config = jsonencode({
-    "url"   = var.worker_url,
-    "token" = var.worker_token,
+    "url"    = var.worker_url,
+    "key-id" = var.worker_key_id,
+    "key"    = var.worker_key,
   })
 }
 
@@ -49,8 +49,13 @@ variable "worker_url" {
   type        = string
 }
 
-variable "worker_token" {
-  description = "The access token to use when authenticating to a worker"
+variable "worker_key_id" {
+  description = "The ID of the key used to sign requests to a worker"
+  type        = string
+}
+
+variable "worker_key" {
+  description = "The base64 encoded key used to sign requests to a worker"
   type        = string
 }
 
@@ -127,6 +127,22 @@ resource "kubernetes_secret" "db" {
   }
 }
 
+# key used to encrypt captured session artifacts at rest
+resource "random_id" "artifact_key" {
+  byte_length = 32
+}
+
+resource "kubernetes_secret" "artifacts" {
+  metadata {
+    namespace = var.namespace
+    name = "artifacts"
+  }
+
+  data = {
+    "key" = random_id.artifact_key.b64_std
+  }
+}
+
 resource "kubernetes_secret" "tunnel" {
   metadata {
     namespace = var.namespace
@@ -180,6 +196,16 @@ resource "kubernetes_deployment" "server" {
               }
             }
           }
+
+          env {
+            name = "ARTIFACT_KEY"
+            value_from {
+              secret_key_ref {
+                name = kubernetes_secret.artifacts.metadata[0].name
+                key  = "key"
+              }
+            }
+          }
         }
 
         container {
@@ -15,8 +15,8 @@
  */
 
 
-resource "random_id" "token" {
-  byte_length = 16
+resource "random_id" "signing_key" {
+  byte_length = 32
 }
 
 resource "google_cloud_run_service" "worker" {
@@ -30,8 +30,8 @@ resource "google_cloud_run_service" "worker" {
         image = var.image
 
         env {
-          name = "ACCESS_TOKEN"
-          value = random_id.token.hex
+          name = "SIGNING_KEYS"
+          value = "${var.signing_key_id}:${random_id.signing_key.b64_std}"
         }
       }
     }
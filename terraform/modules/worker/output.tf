@@ -19,6 +19,11 @@ output "endpoint" {
   value = google_cloud_run_service.worker.status[0].url
 }
 
-output "token" {
-  value = random_id.token.hex
+output "key_id" {
+  value = var.signing_key_id
+}
+
+output "key" {
+  value     = random_id.signing_key.b64_std
+  sensitive = true
 }
@@ -38,3 +38,9 @@ variable "image" {
 # OPTIONAL PARAMETERS
 # Generally, these values won't need to be changed.
 # -----------------------------------------------------------------------------
+
+variable "signing_key_id" {
+  description = "The ID of the key dispatchers sign requests with"
+  type        = string
+  default     = "k1"
+}